@@ -1,24 +1,40 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/acentior/camera-pipeline-sender/internal/config"
 	vidoestreamsender "github.com/acentior/camera-pipeline-sender/internal/videoStreamSender"
-	"github.com/joho/godotenv"
 )
 
 func main() {
-	if err := godotenv.Load(); err != nil {
+	cfg, err := config.LoadConfig()
+	if err != nil {
 		log.Fatalf("Failed to load env {%v}", err)
 		return
 	}
-	websocketUrl := os.Getenv("WEBSOCKET_URL")
-	stunUrl := os.Getenv("STURN_URL")
+	// manual signaling, for a stream without any signaling server
+	flag.BoolVar(&cfg.ManualSignaling, "manual", cfg.ManualSignaling, "answer base64 offers pasted on stdin")
+	flag.IntVar(&cfg.ManualHTTPPort, "manual-http", cfg.ManualHTTPPort, "answer base64 offers posted to this HTTP port")
+	flag.BoolVar(&cfg.ManualGzip, "gzip", cfg.ManualGzip, "gzip the answers of the manual signaling")
+	flag.Parse()
+
 	vss := vidoestreamsender.VideoStreamSender{}
-	err := vss.Init(websocketUrl, stunUrl)
+	err = vss.Init(cfg)
 	if err != nil {
 		log.Default().Fatalf("Failed to init: %v", err)
 	}
+	// the recordings are completed before exiting
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		vss.Close()
+		os.Exit(0)
+	}()
 	vss.Run()
 }
@@ -0,0 +1,367 @@
+// Command recordings works on the recordings and clips taken off a device: it decrypts, exports and verifies
+// them, and manages the keys of their encryption.
+//
+//	recordings keygen [-id <id>]
+//	recordings decrypt [-keys <file>] [-out <dir>] <file or dir>...
+//	recordings export [-keys <file>] -dir <dir> -from <time> -to <time> -o <file>
+//	recordings rewrap [-keys <file>] <file or dir>...
+//	recordings pubkey [<signing key file>]
+//	recordings verify [-pub <key>] [<dir>...]
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/recorder"
+	"github.com/acentior/camera-pipeline-sender/pkg/encryption"
+)
+
+const usage = `Usage: recordings <command> [flags] [args]
+
+Commands:
+  keygen   print a new key line to append to the key file, it becomes the current key
+  decrypt  decrypt recordings to plain MP4 files
+  export   export a time range of a recordings directory to a single MP4
+  rewrap   wrap the data keys of recordings with the current key, so older keys can be retired
+  pubkey   print the public key of a device signing key, to check the manifests with
+  verify   check recordings directories against their signed manifest
+
+The key file defaults to RECORDING_KEY_FILE, the signing key file to RECORDING_SIGNING_KEY_FILE and the
+directory to RECORDING_DIR.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	commands := map[string]func(args []string) error{
+		"keygen":  keygen,
+		"decrypt": decrypt,
+		"export":  export,
+		"rewrap":  rewrap,
+		"pubkey":  pubkey,
+		"verify":  verify,
+	}
+	command, found := commands[os.Args[1]]
+	if !found {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := command(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "recordings %v: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// keysFlag adds the -keys flag, the key file, to a command
+func keysFlag(flags *flag.FlagSet) *string {
+	return flags.String("keys", os.Getenv("RECORDING_KEY_FILE"), "key file of the recordings")
+}
+
+// loadKeyring reads the key file, it's optional for the commands reading recordings in the clear too
+func loadKeyring(path string, required bool) (*encryption.Keyring, error) {
+	if path == "" {
+		if required {
+			return nil, errors.New("no key file, set -keys or RECORDING_KEY_FILE")
+		}
+		return nil, nil
+	}
+	return encryption.LoadKeyring(path)
+}
+
+// recordingPaths returns the files of args, with the recordings of the directories
+func recordingPaths(args []string) ([]string, error) {
+	paths := []string{}
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*"+recorder.Ext))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("no recordings")
+	}
+	return paths, nil
+}
+
+func keygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	id := flags.String("id", time.Now().UTC().Format("20060102T150405"), "id of the key, at most 16 characters")
+	flags.Parse(args)
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		return err
+	}
+	// checks the id
+	if err := encryption.NewKeyring().Add(*id, key); err != nil {
+		return err
+	}
+	fmt.Println(encryption.FormatKey(*id, key))
+	return nil
+}
+
+func decrypt(args []string) error {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keys := keysFlag(flags)
+	out := flags.String("out", ".", "directory of the decrypted files, named as the recordings")
+	flags.Parse(args)
+	keyring, err := loadKeyring(*keys, true)
+	if err != nil {
+		return err
+	}
+	paths, err := recordingPaths(flags.Args())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		return err
+	}
+	failed := 0
+	for _, path := range paths {
+		if err := decryptFile(path, filepath.Join(*out, filepath.Base(path)), keyring); err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(paths))
+	}
+	return nil
+}
+
+// decryptFile writes the plaintext of an encrypted recording to out
+func decryptFile(path string, out string, keyring *encryption.Keyring) error {
+	if same, err := sameFile(path, out); err != nil || same {
+		if same {
+			err = errors.New("the output would replace the recording")
+		}
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r, err := encryption.NewReader(f, info.Size(), keyring)
+	if err != nil {
+		return err
+	}
+	w, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(r, 0, r.Size())); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	status := "decrypted"
+	if !r.Complete() {
+		// an interrupted recording, or a file cut short
+		status = "decrypted, incomplete"
+	}
+	fmt.Printf("%v -> %v (%v, key %v)\n", path, out, status, r.KeyID())
+	return nil
+}
+
+// sameFile tells whether two paths are the same existing file
+func sameFile(a string, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	infoB, err := os.Stat(b)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(infoA, infoB), nil
+}
+
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	keys := keysFlag(flags)
+	dir := flags.String("dir", os.Getenv("RECORDING_DIR"), "directory of the recordings or clips")
+	from := flags.String("from", "", "start of the range, RFC 3339")
+	to := flags.String("to", "", "end of the range, RFC 3339")
+	out := flags.String("o", "export.mp4", "exported file")
+	flags.Parse(args)
+	keyring, err := loadKeyring(*keys, false)
+	if err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("no directory, set -dir or RECORDING_DIR")
+	}
+	start, err := time.Parse(time.RFC3339Nano, *from)
+	if err != nil {
+		return fmt.Errorf("invalid -from: %v", err)
+	}
+	end, err := time.Parse(time.RFC3339Nano, *to)
+	if err != nil {
+		return fmt.Errorf("invalid -to: %v", err)
+	}
+	w, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	err = recorder.NewCatalog(*dir, keyring).Export(w, start, end)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+	fmt.Printf("%v to %v -> %v\n", start, end, *out)
+	return nil
+}
+
+func rewrap(args []string) error {
+	flags := flag.NewFlagSet("rewrap", flag.ExitOnError)
+	keys := keysFlag(flags)
+	flags.Parse(args)
+	keyring, err := loadKeyring(*keys, true)
+	if err != nil {
+		return err
+	}
+	paths, err := recordingPaths(flags.Args())
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, path := range paths {
+		id, err := rewrapFile(path, keyring)
+		switch {
+		case errors.Is(err, encryption.ErrNotEncrypted):
+			fmt.Printf("%v: not encrypted\n", path)
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			failed++
+		case id == keyring.Current():
+			fmt.Printf("%v: already under key %v\n", path, id)
+		default:
+			fmt.Printf("%v: key %v -> %v\n", path, id, keyring.Current())
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(paths))
+	}
+	return nil
+}
+
+func rewrapFile(path string, keyring *encryption.Keyring) (string, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	id, err := encryption.Rewrap(f, keyring)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return id, err
+}
+
+func pubkey(args []string) error {
+	path := os.Getenv("RECORDING_SIGNING_KEY_FILE")
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if path == "" {
+		return errors.New("no signing key file, pass it or set RECORDING_SIGNING_KEY_FILE")
+	}
+	if _, err := os.Stat(path); err != nil {
+		// LoadSigningKey would create it
+		return err
+	}
+	key, err := recorder.LoadSigningKey(path)
+	if err != nil {
+		return err
+	}
+	fmt.Println(recorder.PublicKeyString(key))
+	return nil
+}
+
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	pub := flags.String("pub", "", "trusted public key of the device in base64, the key of the manifest otherwise")
+	flags.Parse(args)
+	var key ed25519.PublicKey
+	if *pub != "" {
+		decoded, err := base64.StdEncoding.DecodeString(*pub)
+		if err != nil || len(decoded) != ed25519.PublicKeySize {
+			return errors.New("invalid -pub, not a base64 Ed25519 public key")
+		}
+		key = decoded
+	}
+	dirs := flags.Args()
+	if len(dirs) == 0 {
+		if dir := os.Getenv("RECORDING_DIR"); dir != "" {
+			dirs = []string{dir}
+		}
+	}
+	if len(dirs) == 0 {
+		return errors.New("no directory, pass it or set RECORDING_DIR")
+	}
+	problems := 0
+	for _, dir := range dirs {
+		report, err := recorder.Verify(dir, key)
+		if err != nil {
+			return fmt.Errorf("%v: %v", dir, err)
+		}
+		if report.Links == 0 {
+			fmt.Fprintf(os.Stderr, "%v: no manifest\n", dir)
+			problems++
+			continue
+		}
+		for _, segment := range report.Segments {
+			line := fmt.Sprintf("%v: %-9v %v", dir, segment.Status, segment.Name)
+			if segment.Seq != 0 {
+				line += fmt.Sprintf(" (link %d)", segment.Seq)
+			}
+			if segment.Detail != "" {
+				line += ": " + segment.Detail
+			}
+			fmt.Println(line)
+		}
+		if *pub == "" {
+			fmt.Printf("%v: %d links signed by %v, not checked against a trusted key\n", dir, report.Links, report.Key)
+		} else {
+			fmt.Printf("%v: %d links\n", dir, report.Links)
+		}
+		problems += report.Problems
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	return nil
+}
@@ -1,16 +1,347 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	WEBSOCKET_URL string
+	// External signaling server, and the address of the built-in one, at least one is needed
+	WebsocketURL  string
+	SignalingAddr string
+	StunURL       string
+
+	// Camera capture. More than one device id turns on the compositor.
+	CameraDevices []string
+	CameraWidth   int
+	CameraHeight  int
+	CameraFps     int
+
+	// Orientation fixes applied to every camera, in this order: crop, rotation, flips
+	TransformCrop     string
+	TransformRotation int
+	TransformFlipH    bool
+	TransformFlipV    bool
+
+	// Compositor output, only used with several camera devices
+	CompositorLayout     string
+	CompositorMain       int
+	CompositorInsetScale float64
+	CompositorWidth      int
+	CompositorHeight     int
+	CompositorFps        int
+
+	// Text overlay burned into the frames
+	OverlayEnabled    bool
+	OverlayDeviceName string
+	OverlayText       string
+	OverlayTimeFormat string
+	OverlayPosition   string
+	OverlayFontSize   float64
+	OverlayColor      string
+	OverlayBackground string
+
+	// Privacy masks, stored as a JSON list of masks per camera
+	PrivacyMasksFile string
+
+	// Motion detection
+	MotionEnabled     bool
+	MotionSensitivity float64
+	MotionMinArea     float64
+	MotionZones       string
+	MotionFps         int
+	MotionCooldown    time.Duration
+
+	// Digital pan/tilt/zoom controlled by the viewers
+	PTZMode      string
+	PTZMaxZoom   float64
+	PTZSmoothing time.Duration
+
+	// Token granting the admin role on the control data channel, admin requests are refused when empty
+	ControlAdminToken string
+
+	// HTTP API, disabled when the address is empty
+	HTTPAddr  string
+	HTTPToken string
+	// WHIP endpoint the stream is published to, empty disables the WHIP client
+	WHIPURL   string
+	WHIPToken string
+	WHIPRetry time.Duration
+
+	// Bearer token of the WHEP endpoint, served by the HTTP API server, empty allows every player
+	WHEPToken string
+
+	// Manual signaling with base64 session descriptions: offers pasted on stdin and/or posted to a HTTP port.
+	// ManualGzip compresses the answers, compressed offers are always accepted.
+	ManualSignaling bool
+	ManualHTTPPort  int
+	ManualGzip      bool
+
+	// Longest time between keyframes of the stream shared by the RTP, RTSP, HLS and recording outputs
+	KeyframeInterval time.Duration
+
+	// Plain RTP output, disabled when the address is empty
+	RTPOutputAddr    string
+	RTPOutputTTL     int
+	RTPOutputSDPFile string
+	RTPOutputSRTPKey string
+
+	// RTSP server, disabled when the address is empty, an empty username disables the authentication
+	RTSPAddr     string
+	RTSPUsername string
+	RTSPPassword string
+
+	// MJPEG and snapshot defaults of the HTTP clients, a 0 width keeps the frame size
+	MJPEGQuality int
+	MJPEGWidth   int
+	MJPEGMaxFps  int
+
+	// Low-Latency HLS served by the HTTP API server under /hls/, segments last KeyframeInterval
+	HLSEnabled      bool
+	HLSSegmentCount int
+	HLSPartDuration time.Duration
+
+	// Recording to fragmented MP4 files, disabled when the directory is empty. Files rotate at the first keyframe
+	// after RecordingSegment or RecordingMaxFileSize bytes, 0 disables the size limit.
+	RecordingDir         string
+	RecordingSegment     time.Duration
+	RecordingMaxFileSize int64
+
+	// Event clips, disabled when the directory is empty. ClipOnMotion triggers a clip on the motion events.
+	ClipsDir     string
+	ClipPreRoll  time.Duration
+	ClipPostRoll time.Duration
+	ClipOnMotion bool
+
+	// Retention of the recordings and the clips, checked every RetentionInterval, a 0 limit is disabled
+	RetentionMaxAge       time.Duration
+	RetentionMaxBytes     int64
+	RetentionMinFreeBytes int64
+	RetentionInterval     time.Duration
+
+	// Encryption of the recordings and the clips with the keys of RecordingKeyFile, disabled when it's empty
+	RecordingKeyFile string
+	// Hash chain of the recordings and the clips signed by the device key of RecordingSigningKeyFile, created when
+	// missing, disabled when it's empty
+	RecordingSigningKeyFile string
+
+	// Timelapse of a frame every TimelapseInterval, between the TimelapseStart and TimelapseStop times of day and
+	// only in daylight at the TimelapseLatitude and TimelapseLongitude when TimelapseDaylight, disabled when
+	// TimelapseDir is empty
+	TimelapseDir        string
+	TimelapseInterval   time.Duration
+	TimelapseFps        int
+	TimelapseStart      string
+	TimelapseStop       string
+	TimelapseDaylight   bool
+	TimelapseLatitude   float64
+	TimelapseLongitude  float64
+	TimelapseKeepFrames bool
+	TimelapseMaxAge     time.Duration
+	TimelapseMaxBytes   int64
 }
 
-func LoadConfig() error {
+// LoadConfig loads the .env file and reads the configuration from the environment
+func LoadConfig() (*Config, error) {
 	if err := godotenv.Load(); err != nil {
-		return err
+		return nil, err
+	}
+	// the byte sizes overflow an int on 32-bit devices
+	recordingMaxFileSize, err := getEnvInt64("RECORDING_MAX_FILE_SIZE", 0)
+	if err != nil {
+		return nil, err
+	}
+	retentionMaxBytes, err := getEnvInt64("RETENTION_MAX_BYTES", 0)
+	if err != nil {
+		return nil, err
+	}
+	retentionMinFreeBytes, err := getEnvInt64("RETENTION_MIN_FREE_BYTES", 512<<20)
+	if err != nil {
+		return nil, err
+	}
+	timelapseMaxBytes, err := getEnvInt64("TIMELAPSE_MAX_BYTES", 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		WebsocketURL:  os.Getenv("WEBSOCKET_URL"),
+		SignalingAddr: os.Getenv("SIGNALING_ADDR"),
+		StunURL:       os.Getenv("STURN_URL"),
+
+		CameraDevices: getEnvList("CAMERA_DEVICES"),
+		CameraWidth:   getEnvInt("CAMERA_WIDTH", 1920),
+		CameraHeight:  getEnvInt("CAMERA_HEIGHT", 1440),
+		CameraFps:     getEnvInt("CAMERA_FPS", 60),
+
+		TransformCrop:     os.Getenv("TRANSFORM_CROP"),
+		TransformRotation: getEnvInt("TRANSFORM_ROTATION", 0),
+		TransformFlipH:    getEnvBool("TRANSFORM_FLIP_H", false),
+		TransformFlipV:    getEnvBool("TRANSFORM_FLIP_V", false),
+
+		CompositorLayout:     getEnv("COMPOSITOR_LAYOUT", "grid"),
+		CompositorMain:       getEnvInt("COMPOSITOR_MAIN", 0),
+		CompositorInsetScale: getEnvFloat("COMPOSITOR_INSET_SCALE", 0.25),
+		CompositorWidth:      getEnvInt("COMPOSITOR_WIDTH", 1280),
+		CompositorHeight:     getEnvInt("COMPOSITOR_HEIGHT", 720),
+		CompositorFps:        getEnvInt("COMPOSITOR_FPS", 30),
+
+		OverlayEnabled:    getEnvBool("OVERLAY_ENABLED", false),
+		OverlayDeviceName: getEnv("OVERLAY_DEVICE_NAME", hostname()),
+		OverlayText:       os.Getenv("OVERLAY_TEXT"),
+		OverlayTimeFormat: getEnv("OVERLAY_TIME_FORMAT", "2006-01-02 15:04:05"),
+		OverlayPosition:   getEnv("OVERLAY_POSITION", "top-left"),
+		OverlayFontSize:   getEnvFloat("OVERLAY_FONT_SIZE", 24),
+		OverlayColor:      getEnv("OVERLAY_COLOR", "#ffffff"),
+		OverlayBackground: getEnv("OVERLAY_BACKGROUND", "#00000099"),
+
+		PrivacyMasksFile: os.Getenv("PRIVACY_MASKS_FILE"),
+
+		MotionEnabled:     getEnvBool("MOTION_ENABLED", false),
+		MotionSensitivity: getEnvFloat("MOTION_SENSITIVITY", 0.5),
+		MotionMinArea:     getEnvFloat("MOTION_MIN_AREA", 0.01),
+		MotionZones:       os.Getenv("MOTION_ZONES"),
+		MotionFps:         getEnvInt("MOTION_FPS", 5),
+		MotionCooldown:    getEnvDuration("MOTION_COOLDOWN", 3*time.Second),
+
+		PTZMode:      getEnv("PTZ_MODE", "viewer"),
+		PTZMaxZoom:   getEnvFloat("PTZ_MAX_ZOOM", 8),
+		PTZSmoothing: getEnvDuration("PTZ_SMOOTHING", 300*time.Millisecond),
+
+		ControlAdminToken: os.Getenv("CONTROL_ADMIN_TOKEN"),
+
+		HTTPAddr:  os.Getenv("HTTP_ADDR"),
+		HTTPToken: os.Getenv("HTTP_TOKEN"),
+		WHEPToken: os.Getenv("WHEP_TOKEN"),
+
+		WHIPURL:   os.Getenv("WHIP_URL"),
+		WHIPToken: os.Getenv("WHIP_TOKEN"),
+		WHIPRetry: getEnvDuration("WHIP_RETRY_INTERVAL", 5*time.Second),
+
+		ManualSignaling: getEnvBool("MANUAL_SIGNALING", false),
+		ManualHTTPPort:  getEnvInt("MANUAL_SIGNALING_HTTP_PORT", 0),
+		ManualGzip:      getEnvBool("MANUAL_SIGNALING_GZIP", false),
+
+		KeyframeInterval: getEnvDuration("KEYFRAME_INTERVAL", 2*time.Second),
+
+		RTPOutputAddr:    os.Getenv("RTP_OUTPUT_ADDR"),
+		RTPOutputTTL:     getEnvInt("RTP_OUTPUT_TTL", 1),
+		RTPOutputSDPFile: getEnv("RTP_OUTPUT_SDP_FILE", "stream.sdp"),
+		RTPOutputSRTPKey: os.Getenv("RTP_OUTPUT_SRTP_KEY"),
+
+		RTSPAddr:     os.Getenv("RTSP_ADDR"),
+		RTSPUsername: os.Getenv("RTSP_USERNAME"),
+		RTSPPassword: os.Getenv("RTSP_PASSWORD"),
+
+		MJPEGQuality: getEnvInt("MJPEG_QUALITY", 80),
+		MJPEGWidth:   getEnvInt("MJPEG_WIDTH", 0),
+		MJPEGMaxFps:  getEnvInt("MJPEG_MAX_FPS", 10),
+
+		HLSEnabled:      getEnvBool("HLS_ENABLED", false),
+		HLSSegmentCount: getEnvInt("HLS_SEGMENT_COUNT", 6),
+		HLSPartDuration: getEnvDuration("HLS_PART_DURATION", 200*time.Millisecond),
+
+		RecordingDir:         os.Getenv("RECORDING_DIR"),
+		RecordingSegment:     getEnvDuration("RECORDING_SEGMENT_DURATION", 5*time.Minute),
+		RecordingMaxFileSize: recordingMaxFileSize,
+
+		ClipsDir:     os.Getenv("CLIPS_DIR"),
+		ClipPreRoll:  getEnvDuration("CLIP_PRE_ROLL", 10*time.Second),
+		ClipPostRoll: getEnvDuration("CLIP_POST_ROLL", 10*time.Second),
+		ClipOnMotion: getEnvBool("CLIP_ON_MOTION", true),
+
+		RetentionMaxAge:       getEnvDuration("RETENTION_MAX_AGE", 0),
+		RetentionMaxBytes:     retentionMaxBytes,
+		RetentionMinFreeBytes: retentionMinFreeBytes,
+		RetentionInterval:     getEnvDuration("RETENTION_INTERVAL", time.Minute),
+
+		RecordingKeyFile:        os.Getenv("RECORDING_KEY_FILE"),
+		RecordingSigningKeyFile: os.Getenv("RECORDING_SIGNING_KEY_FILE"),
+
+		TimelapseDir:        os.Getenv("TIMELAPSE_DIR"),
+		TimelapseInterval:   getEnvDuration("TIMELAPSE_INTERVAL", time.Minute),
+		TimelapseFps:        getEnvInt("TIMELAPSE_FPS", 30),
+		TimelapseStart:      getEnv("TIMELAPSE_START", "00:00"),
+		TimelapseStop:       getEnv("TIMELAPSE_STOP", "24:00"),
+		TimelapseDaylight:   getEnvBool("TIMELAPSE_DAYLIGHT", false),
+		TimelapseLatitude:   getEnvFloat("TIMELAPSE_LATITUDE", 0),
+		TimelapseLongitude:  getEnvFloat("TIMELAPSE_LONGITUDE", 0),
+		TimelapseKeepFrames: getEnvBool("TIMELAPSE_KEEP_FRAMES", false),
+		TimelapseMaxAge:     getEnvDuration("TIMELAPSE_MAX_AGE", 90*24*time.Hour),
+		TimelapseMaxBytes:   timelapseMaxBytes,
+	}, nil
+}
+
+func getEnv(key string, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func getEnvInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getEnvInt64 parses a 64-bit integer, unlike the other helpers it fails on an invalid value
+func getEnvInt64(key string, def int64) (int64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %v: %v", key, err)
+	}
+	return n, nil
+}
+
+func getEnvFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func getEnvBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+func getEnvList(key string) []string {
+	list := []string{}
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
 	}
-	return nil
+	return list
 }
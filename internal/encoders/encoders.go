@@ -1,63 +1,143 @@
 package encoders
 
 import (
-	"bytes"
 	"fmt"
 	"image"
 	"math"
+	"sync"
+	"unsafe"
 
 	"github.com/acentior/camera-pipeline-sender/pkg/size"
 	x264 "github.com/gen2brain/x264-go"
+	"github.com/gen2brain/x264-go/x264c"
 )
 
-// H264Encoder h264 encoder
+// H264Encoder h264 encoder.
+// It drives libx264 directly, instead of through x264-go, to change the bitrate and force keyframes while encoding.
 type H264Encoder struct {
-	buffer   *bytes.Buffer
-	encoder  *x264.Encoder
+	mu      sync.Mutex
+	encoder *x264c.T
+	// param and picIn are handed to C, they must not live in a struct holding Go pointers
+	param    *x264c.Param
+	picIn    *x264c.Picture
+	img      *x264.YCbCr
+	nals     []*x264c.Nal
+	nnals    int32
+	headers  []byte
+	pts      int64
+	keyframe bool
 	realSize size.Size
 }
 
 const h264SupportedProfile = "3.1"
 
+// bitsPerPixel sets the default bitrate from the resolution and the frame rate
+const bitsPerPixel = 0.07
+
 func newH264Encoder(size size.Size, frameRate int) (Encoder, error) {
-	buffer := bytes.NewBuffer(make([]byte, 0))
 	realSize, err := findBestSizeForH264Profile(h264SupportedProfile, size)
 	fmt.Printf(realSize.String())
 	if err != nil {
 		return nil, err
 	}
-	opts := x264.Options{
-		Width:     realSize.Width,
-		Height:    realSize.Height,
-		FrameRate: frameRate,
-		Tune:      "zerolatency",
-		Preset:    "veryfast",
-		Profile:   "baseline",
-		LogLevel:  x264.LogWarning,
+	e := &H264Encoder{
+		img:      x264.NewYCbCr(image.Rect(0, 0, realSize.Width, realSize.Height)),
+		param:    &x264c.Param{},
+		picIn:    &x264c.Picture{},
+		nals:     make([]*x264c.Nal, 3),
+		realSize: realSize,
 	}
-	encoder, err := x264.NewEncoder(buffer, &opts)
-	if err != nil {
-		return nil, err
+
+	if x264c.ParamDefaultPreset(e.param, "veryfast", "zerolatency") < 0 {
+		return nil, fmt.Errorf("x264: invalid preset/tune name")
 	}
-	return &H264Encoder{
-		buffer:   buffer,
-		encoder:  encoder,
-		realSize: realSize,
-	}, nil
+	e.param.IWidth = int32(realSize.Width)
+	e.param.IHeight = int32(realSize.Height)
+	e.param.ICsp = x264c.CspI420
+	e.param.ILogLevel = x264.LogWarning
+	e.param.IBitdepth = 8
+	e.param.BRepeatHeaders = 1
+	e.param.BAnnexb = 1
+	e.param.BIntraRefresh = 1
+	e.param.IKeyintMax = int32(frameRate)
+	e.param.IFpsNum = uint32(frameRate)
+	e.param.IFpsDen = 1
+	// a variable frame rate input would delay every frame by one
+	e.param.BVfrInput = 0
+	// average bitrate with a VBV limit, the only rate control whose bitrate can change while encoding
+	kbps := int(bitsPerPixel * float64(realSize.Width*realSize.Height*frameRate) / 1000)
+	e.param.Rc.IRcMethod = x264c.RcAbr
+	setBitrate(e.param, kbps)
+	if x264c.ParamApplyProfile(e.param, "baseline") < 0 {
+		return nil, fmt.Errorf("x264: invalid profile name")
+	}
+
+	if x264c.PictureAlloc(e.picIn, x264c.CspI420, e.param.IWidth, e.param.IHeight) < 0 {
+		return nil, fmt.Errorf("x264: cannot allocate picture")
+	}
+	e.encoder = x264c.EncoderOpen(e.param)
+	if e.encoder == nil {
+		x264c.PictureClean(e.picIn)
+		return nil, fmt.Errorf("x264: cannot open the encoder")
+	}
+	ret := x264c.EncoderHeaders(e.encoder, e.nals, &e.nnals)
+	if ret < 0 {
+		e.Close()
+		return nil, fmt.Errorf("x264: cannot encode headers")
+	}
+	// the headers go out with the first frame
+	e.headers = e.payload(ret)
+	return e, nil
+}
+
+func setBitrate(param *x264c.Param, kbps int) {
+	param.Rc.IBitrate = int32(kbps)
+	param.Rc.IVbvMaxBitrate = int32(kbps)
+	// half a second of buffer keeps the frame sizes even
+	param.Rc.IVbvBufferSize = int32(max(1, kbps/2))
+}
+
+// payload copies the NAL units of the last x264 call, they are stored one after another
+func (e *H264Encoder) payload(size int32) []byte {
+	if size <= 0 {
+		return nil
+	}
+	return append([]byte(nil), unsafe.Slice((*byte)(e.nals[0].PPayload), size)...)
 }
 
 // Encode encodes a frame into a h264 payload
 func (e *H264Encoder) Encode(frame *image.RGBA) ([]byte, error) {
-	err := e.encoder.Encode(frame)
-	if err != nil {
-		return nil, err
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.encoder == nil {
+		return nil, fmt.Errorf("x264: encoder closed")
 	}
-	err = e.encoder.Flush()
-	if err != nil {
-		return nil, err
+	if frame.Bounds().Dx() != e.realSize.Width || frame.Bounds().Dy() != e.realSize.Height {
+		return nil, fmt.Errorf("x264: frame size %v doesn't match %v", frame.Bounds().Size(), e.realSize)
+	}
+
+	e.img.ToYCbCr(frame)
+	w, h := e.realSize.Width, e.realSize.Height
+	copy(unsafe.Slice((*byte)(e.picIn.Img.Plane[0]), w*h), e.img.Y)
+	copy(unsafe.Slice((*byte)(e.picIn.Img.Plane[1]), w*h/4), e.img.Cb)
+	copy(unsafe.Slice((*byte)(e.picIn.Img.Plane[2]), w*h/4), e.img.Cr)
+
+	e.picIn.IPts = e.pts
+	e.pts++
+	e.picIn.IType = x264c.TypeAuto
+	if e.keyframe {
+		e.picIn.IType = x264c.TypeIdr
+		e.keyframe = false
 	}
-	payload := e.buffer.Bytes()
-	e.buffer.Reset()
+
+	var picOut x264c.Picture
+	ret := x264c.EncoderEncode(e.encoder, e.nals, &e.nnals, e.picIn, &picOut)
+	if ret < 0 {
+		return nil, fmt.Errorf("x264: cannot encode picture")
+	}
+	// zerolatency doesn't delay frames, each picture comes out of its own call
+	payload := append(e.headers, e.payload(ret)...)
+	e.headers = nil
 	return payload, nil
 }
 
@@ -66,12 +146,54 @@ func (e *H264Encoder) VideoSize() (size.Size, error) {
 	return e.realSize, nil
 }
 
-// Close flushes and closes the inner x264 encoder
+// Bitrate returns the target bitrate in kbit/s
+func (e *H264Encoder) Bitrate() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return int(e.param.Rc.IBitrate)
+}
+
+// SetBitrate changes the target bitrate in kbit/s, it applies from the next frame
+func (e *H264Encoder) SetBitrate(kbps int) error {
+	if kbps <= 0 {
+		return fmt.Errorf("Invalid bitrate %d", kbps)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.encoder == nil {
+		return fmt.Errorf("x264: encoder closed")
+	}
+	param := *e.param
+	setBitrate(&param, kbps)
+	if x264c.EncoderReconfig(e.encoder, &param) < 0 {
+		return fmt.Errorf("x264: cannot change the bitrate to %d", kbps)
+	}
+	*e.param = param
+	return nil
+}
+
+// ForceKeyframe makes the next frame an IDR frame
+func (e *H264Encoder) ForceKeyframe() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.keyframe = true
+}
+
+// Close closes the inner x264 encoder
 func (e *H264Encoder) Close() error {
-	return e.encoder.Close()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.encoder == nil {
+		return nil
+	}
+	x264c.EncoderClose(e.encoder)
+	x264c.PictureClean(e.picIn)
+	e.encoder = nil
+	return nil
 }
 
-// findBestSizeForH264Profile finds the best match given the size constraint and H264 profile
+// findBestSizeForH264Profile finds the best match given the size constraint and H264 profile.
+// Portrait constraints, e.g. from a camera rotated by 90 degrees, match the portrait version of the profile sizes.
 func findBestSizeForH264Profile(profile string, constraints size.Size) (size.Size, error) {
 	profileSizes := map[string][]size.Size{
 		"3.1": {
@@ -85,15 +207,19 @@ func findBestSizeForH264Profile(profile string, constraints size.Size) (size.Siz
 		},
 	}
 	if sizes, exists := profileSizes[profile]; exists {
+		portrait := constraints.Height > constraints.Width
 		minRatioDiff := math.MaxFloat64
 		var minRatioSize size.Size
 		for _, size := range sizes {
+			if portrait {
+				size.Width, size.Height = size.Height, size.Width
+			}
 			if size == constraints {
 				return size, nil
 			}
 			lowerRes := size.Width <= constraints.Width && size.Height <= constraints.Height
-			hRatio := float64(constraints.Width) / float64(size.Height)
-			vRatio := float64(constraints.Width) / float64(size.Height)
+			hRatio := float64(constraints.Width) / float64(constraints.Height)
+			vRatio := float64(size.Width) / float64(size.Height)
 			ratioDiff := math.Abs(hRatio - vRatio)
 			if lowerRes && (ratioDiff) < 0.0001 {
 				return size, nil
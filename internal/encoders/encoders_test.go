@@ -0,0 +1,90 @@
+package encoders
+
+import (
+	"image"
+	"testing"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/stretchr/testify/suite"
+)
+
+type EncodersSuit struct {
+	suite.Suite
+}
+
+func TestEncodersSuite(t *testing.T) {
+	suite.Run(t, new(EncodersSuit))
+}
+
+func (s *EncodersSuit) Test_FindBestSizeExactMatch() {
+	found, err := findBestSizeForH264Profile(h264SupportedProfile, size.Size{Width: 1280, Height: 720})
+	s.NoError(err)
+	s.Equal(size.Size{Width: 1280, Height: 720}, found)
+}
+
+func (s *EncodersSuit) Test_FindBestSizeKeepsAspectRatio() {
+	found, err := findBestSizeForH264Profile(h264SupportedProfile, size.Size{Width: 1600, Height: 900})
+	s.NoError(err)
+	s.Equal(size.Size{Width: 1280, Height: 720}, found)
+
+	found, err = findBestSizeForH264Profile(h264SupportedProfile, size.Size{Width: 800, Height: 600})
+	s.NoError(err)
+	s.Equal(size.Size{Width: 320, Height: 240}, found)
+}
+
+func (s *EncodersSuit) Test_FindBestSizePortrait() {
+	// a 1920x1440 camera rotated by 90 degrees
+	found, err := findBestSizeForH264Profile(h264SupportedProfile, size.Size{Width: 1440, Height: 1920})
+	s.NoError(err)
+	s.Equal(size.Size{Width: 1440, Height: 1920}, found)
+
+	found, err = findBestSizeForH264Profile(h264SupportedProfile, size.Size{Width: 900, Height: 1600})
+	s.NoError(err)
+	s.Equal(size.Size{Width: 720, Height: 1280}, found)
+}
+
+func (s *EncodersSuit) Test_FindBestSizeUnknownProfile() {
+	_, err := findBestSizeForH264Profile("5.1", size.Size{Width: 1280, Height: 720})
+	s.Error(err)
+}
+
+// nalTypes lists the NAL unit types of an Annex-B payload
+func nalTypes(payload []byte) []byte {
+	types := []byte{}
+	for i := 0; i+3 < len(payload); i++ {
+		if payload[i] == 0 && payload[i+1] == 0 && payload[i+2] == 1 {
+			types = append(types, payload[i+3]&0x1f)
+			i += 3
+		}
+	}
+	return types
+}
+
+func (s *EncodersSuit) Test_H264ForceKeyframeAndBitrate() {
+	enc, err := newH264Encoder(size.Size{Width: 320, Height: 240}, 30)
+	s.Require().NoError(err)
+	defer enc.Close()
+
+	frame := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	payload, err := enc.Encode(frame)
+	s.Require().NoError(err)
+	// the first frame carries SPS, PPS and an IDR slice
+	s.Subset(nalTypes(payload), []byte{7, 8, 5})
+
+	payload, err = enc.Encode(frame)
+	s.Require().NoError(err)
+	s.NotContains(nalTypes(payload), byte(5))
+
+	s.NoError(enc.SetBitrate(300))
+	s.Equal(300, enc.Bitrate())
+	s.Error(enc.SetBitrate(0))
+
+	enc.ForceKeyframe()
+	payload, err = enc.Encode(frame)
+	s.Require().NoError(err)
+	s.Contains(nalTypes(payload), byte(5))
+
+	s.NoError(enc.Close())
+	_, err = enc.Encode(frame)
+	s.Error(err)
+}
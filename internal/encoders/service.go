@@ -3,6 +3,7 @@ package encoders
 import (
 	"image"
 	"io"
+	"time"
 
 	"github.com/acentior/camera-pipeline-sender/pkg/size"
 )
@@ -18,6 +19,27 @@ type Encoder interface {
 	io.Closer
 	Encode(*image.RGBA) ([]byte, error)
 	VideoSize() (size.Size, error)
+	// Bitrate returns the target bitrate in kbit/s
+	Bitrate() int
+	// SetBitrate changes the target bitrate in kbit/s while encoding
+	SetBitrate(kbps int) error
+	// ForceKeyframe makes the next encoded frame a keyframe
+	ForceKeyframe()
+}
+
+// EncodedFrame is an encoded picture with its capture metadata
+type EncodedFrame struct {
+	// Data is the access unit, Annex-B for H.264, the parameter sets come with every keyframe
+	Data []byte
+	// Time is the capture time of the picture
+	Time time.Time
+	// Duration is the nominal frame duration, the outputs time the frames from their capture times and use it
+	// for the last frame only
+	Duration time.Duration
+	// Keyframe tells if decoding can start at this frame
+	Keyframe bool
+	// Seq is the sequence number of the source frame
+	Seq uint64
 }
 
 // VideoCodec can be either h264 or vp8
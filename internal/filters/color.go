@@ -0,0 +1,32 @@
+package filters
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// ParseColor parses a #RRGGBB or #RRGGBBAA hex color
+func ParseColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.RGBA{}, fmt.Errorf("Invalid color %q", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("Invalid color %q", s)
+	}
+	// color.RGBA holds alpha premultiplied values
+	a := uint32(v & 0xff)
+	premul := func(c uint64) uint8 { return uint8(uint32(c&0xff) * a / 0xff) }
+	return color.RGBA{
+		R: premul(v >> 24),
+		G: premul(v >> 16),
+		B: premul(v >> 8),
+		A: uint8(a),
+	}, nil
+}
@@ -0,0 +1,60 @@
+package filters
+
+import (
+	"image"
+	"sync"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+)
+
+// Filter processes a captured frame before it is handed to the encoders.
+// It may draw into the frame in place or return a new one.
+type Filter interface {
+	Apply(frame *image.RGBA) *image.RGBA
+}
+
+// Chain applies a list of filters in order
+type Chain struct {
+	mu      sync.RWMutex
+	filters []Filter
+}
+
+// NewChain creates a filter chain
+func NewChain(filters ...Filter) *Chain {
+	return &Chain{filters: filters}
+}
+
+// Add appends a filter at the end of the chain
+func (c *Chain) Add(f Filter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.filters = append(c.filters, f)
+}
+
+// Apply runs every filter of the chain on the frame
+func (c *Chain) Apply(frame *image.RGBA) *image.RGBA {
+	if c == nil {
+		return frame
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, f := range c.filters {
+		frame = f.Apply(frame)
+	}
+	return frame
+}
+
+// OutputSize returns the frame size after every filter of the chain
+func (c *Chain) OutputSize(in size.Size) size.Size {
+	if c == nil {
+		return in
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, f := range c.filters {
+		if r, ok := f.(Resizer); ok {
+			in = r.OutputSize(in)
+		}
+	}
+	return in
+}
@@ -0,0 +1,208 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/stretchr/testify/suite"
+)
+
+type FiltersSuit struct {
+	suite.Suite
+}
+
+func TestFiltersSuite(t *testing.T) {
+	suite.Run(t, new(FiltersSuit))
+}
+
+func (s *FiltersSuit) Test_ParseColor() {
+	c, err := ParseColor("#ff8000")
+	s.NoError(err)
+	s.Equal(color.RGBA{R: 255, G: 128, B: 0, A: 255}, c)
+
+	c, err = ParseColor("#ffffff80")
+	s.NoError(err)
+	s.Equal(color.RGBA{R: 128, G: 128, B: 128, A: 128}, c)
+
+	_, err = ParseColor("red")
+	s.Error(err)
+}
+
+func (s *FiltersSuit) Test_OverlayDrawsInCorner() {
+	overlay, err := NewOverlay(TextOverlay{
+		Text:       "site-42",
+		TimeFormat: time.RFC3339,
+		Position:   BottomRight,
+		FontSize:   16,
+		Color:      color.RGBA{R: 255, G: 255, B: 255, A: 255},
+		Background: color.RGBA{A: 255},
+	})
+	s.Require().NoError(err)
+	overlay.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	frame := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	for i := range frame.Pix {
+		frame.Pix[i] = 0x40
+	}
+	frame = overlay.Apply(frame)
+
+	// the top left corner is untouched, the bottom right one has the black box
+	s.Equal(color.RGBA{R: 0x40, G: 0x40, B: 0x40, A: 0x40}, frame.RGBAAt(2, 2))
+	s.Equal(color.RGBA{A: 255}, frame.RGBAAt(310, 231))
+
+	white := 0
+	for y := 180; y < 240; y++ {
+		for x := 160; x < 320; x++ {
+			if frame.RGBAAt(x, y).R == 255 {
+				white++
+			}
+		}
+	}
+	s.Greater(white, 50)
+}
+
+func (s *FiltersSuit) Test_OverlayRejectsBadConfig() {
+	_, err := NewOverlay(TextOverlay{Text: "x", Position: "middle", FontSize: 12})
+	s.Error(err)
+	_, err = NewOverlay(TextOverlay{Text: "x", Position: TopLeft})
+	s.Error(err)
+}
+
+func grayFrame(w, h int) *image.RGBA {
+	frame := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// a checkerboard, so pixelate and blur have something to average
+			v := uint8(40 + 160*((x/2+y/2)%2))
+			frame.SetRGBA(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	return frame
+}
+
+func (s *FiltersSuit) Test_PrivacyMaskBlackPolygon() {
+	pm, err := NewPrivacyMask(Mask{
+		ID:     "triangle",
+		Mode:   MaskBlack,
+		Points: []Point{{0, 0}, {1, 0}, {0, 1}},
+	})
+	s.Require().NoError(err)
+
+	frame := pm.Apply(grayFrame(100, 100))
+	s.Equal(color.RGBA{A: 255}, frame.RGBAAt(10, 10))
+	s.NotEqual(uint8(0), frame.RGBAAt(90, 90).R)
+}
+
+func (s *FiltersSuit) Test_PrivacyMaskKeepsNormalizedPlace() {
+	pm, err := NewPrivacyMask(Mask{Mode: MaskBlack, Rect: &Rect{X: 0.5, Y: 0.5, W: 0.5, H: 0.5}})
+	s.Require().NoError(err)
+
+	for _, frame := range []*image.RGBA{grayFrame(64, 48), grayFrame(320, 240)} {
+		b := frame.Bounds()
+		frame = pm.Apply(frame)
+		s.Equal(color.RGBA{A: 255}, frame.RGBAAt(b.Dx()*3/4, b.Dy()*3/4))
+		s.NotEqual(color.RGBA{A: 255}, frame.RGBAAt(b.Dx()/4, b.Dy()/4))
+	}
+}
+
+func (s *FiltersSuit) Test_PrivacyMaskPixelateAndBlur() {
+	for _, mode := range []MaskMode{MaskPixelate, MaskBlur} {
+		pm, err := NewPrivacyMask(Mask{Mode: mode, Rect: &Rect{X: 0, Y: 0, W: 0.5, H: 1}})
+		s.Require().NoError(err)
+		orig := grayFrame(200, 100)
+		frame := pm.Apply(grayFrame(200, 100))
+
+		changed := 0
+		for y := 0; y < 100; y++ {
+			for x := 0; x < 100; x++ {
+				if frame.RGBAAt(x, y) != orig.RGBAAt(x, y) {
+					changed++
+				}
+			}
+		}
+		s.Greater(changed, 5000, string(mode))
+		s.Equal(orig.RGBAAt(150, 50), frame.RGBAAt(150, 50), string(mode))
+	}
+}
+
+func (s *FiltersSuit) Test_PrivacyMaskValidation() {
+	pm, err := NewPrivacyMask(Mask{ID: "a", Mode: MaskBlack, Rect: &Rect{W: 0.1, H: 0.1}})
+	s.Require().NoError(err)
+
+	s.Error(pm.SetMasks([]Mask{{Mode: "smudge", Rect: &Rect{W: 1, H: 1}}}))
+	s.Error(pm.SetMasks([]Mask{{Mode: MaskBlur, Points: []Point{{0, 0}, {1, 1}}}}))
+	s.Error(pm.SetMasks([]Mask{
+		{ID: "b", Mode: MaskBlack, Rect: &Rect{W: 1, H: 1}},
+		{ID: "b", Mode: MaskBlur, Rect: &Rect{W: 1, H: 1}},
+	}))
+	// the masks are untouched after a failed update
+	s.Equal("a", pm.Masks()[0].ID)
+}
+
+// markedFrame is a 4x2 frame with a red top left pixel and a blue top right one
+func markedFrame() *image.RGBA {
+	frame := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	frame.SetRGBA(0, 0, color.RGBA{R: 255, A: 255})
+	frame.SetRGBA(3, 0, color.RGBA{B: 255, A: 255})
+	return frame
+}
+
+func (s *FiltersSuit) Test_TransformRotation() {
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	cases := []struct {
+		rotation  int
+		size      size.Size
+		red, blue image.Point
+	}{
+		{90, size.Size{Width: 2, Height: 4}, image.Pt(1, 0), image.Pt(1, 3)},
+		{180, size.Size{Width: 4, Height: 2}, image.Pt(3, 1), image.Pt(0, 1)},
+		{270, size.Size{Width: 2, Height: 4}, image.Pt(0, 3), image.Pt(0, 0)},
+	}
+	for _, c := range cases {
+		t, err := NewTransform(image.Rectangle{}, c.rotation, false, false)
+		s.Require().NoError(err)
+		out := t.Apply(markedFrame())
+		s.Equal(c.size, size.Size{Width: out.Bounds().Dx(), Height: out.Bounds().Dy()})
+		s.Equal(c.size, t.OutputSize(size.Size{Width: 4, Height: 2}))
+		s.Equal(red, out.RGBAAt(c.red.X, c.red.Y), "rotation %d", c.rotation)
+		s.Equal(blue, out.RGBAAt(c.blue.X, c.blue.Y), "rotation %d", c.rotation)
+	}
+}
+
+func (s *FiltersSuit) Test_TransformFlipAndCrop() {
+	t, err := NewTransform(image.Rectangle{}, 0, true, true)
+	s.Require().NoError(err)
+	out := t.Apply(markedFrame())
+	s.Equal(color.RGBA{R: 255, A: 255}, out.RGBAAt(3, 1))
+	s.Equal(color.RGBA{B: 255, A: 255}, out.RGBAAt(0, 1))
+
+	t, err = NewTransform(image.Rect(2, 0, 4, 2), 90, false, false)
+	s.Require().NoError(err)
+	s.Equal(size.Size{Width: 2, Height: 2}, t.OutputSize(size.Size{Width: 4, Height: 2}))
+	out = t.Apply(markedFrame())
+	s.Equal(color.RGBA{B: 255, A: 255}, out.RGBAAt(1, 1))
+
+	// a crop alone returns a contiguous frame at 0,0
+	t, err = NewTransform(image.Rect(2, 0, 4, 2), 0, false, false)
+	s.Require().NoError(err)
+	out = t.Apply(markedFrame())
+	s.Equal(image.Rect(0, 0, 2, 2), out.Rect)
+	s.Equal(4*out.Rect.Dx(), out.Stride)
+	s.Len(out.Pix, 4*2*2)
+	s.Equal(color.RGBA{B: 255, A: 255}, out.RGBAAt(1, 0))
+
+	_, err = NewTransform(image.Rectangle{}, 45, false, false)
+	s.Error(err)
+}
+
+func (s *FiltersSuit) Test_ChainOutputSize() {
+	t, err := NewTransform(image.Rect(0, 0, 1600, 1200), 270, false, false)
+	s.Require().NoError(err)
+	pm, err := NewPrivacyMask()
+	s.Require().NoError(err)
+	chain := NewChain(t, pm)
+	s.Equal(size.Size{Width: 1200, Height: 1600}, chain.OutputSize(size.Size{Width: 1920, Height: 1440}))
+}
@@ -0,0 +1,184 @@
+package filters
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Position anchors an overlay block to a corner of the frame
+type Position string
+
+const (
+	TopLeft     Position = "top-left"
+	TopRight    Position = "top-right"
+	BottomLeft  Position = "bottom-left"
+	BottomRight Position = "bottom-right"
+)
+
+// ParsePosition converts a configuration value into a Position
+func ParsePosition(s string) (Position, error) {
+	switch Position(s) {
+	case TopLeft, TopRight, BottomLeft, BottomRight:
+		return Position(s), nil
+	}
+	return "", fmt.Errorf("Unknown overlay position %q", s)
+}
+
+// TextOverlay is a block of text burned into every frame
+type TextOverlay struct {
+	// Text is drawn as is, one line per "\n"
+	Text string
+	// TimeFormat adds a line with the local time when not empty
+	TimeFormat string
+	Position   Position
+	// FontSize is the font height in pixels
+	FontSize float64
+	Color    color.RGBA
+	// Background fills a box behind the text when its alpha is not zero
+	Background color.RGBA
+}
+
+func (t *TextOverlay) lines(now time.Time) []string {
+	lines := []string{}
+	if t.Text != "" {
+		lines = append(lines, strings.Split(t.Text, "\n")...)
+	}
+	if t.TimeFormat != "" {
+		lines = append(lines, now.Format(t.TimeFormat))
+	}
+	return lines
+}
+
+var (
+	fontOnce   sync.Once
+	parsedFont *opentype.Font
+	fontErr    error
+)
+
+func loadFont() (*opentype.Font, error) {
+	fontOnce.Do(func() {
+		parsedFont, fontErr = opentype.Parse(goregular.TTF)
+	})
+	return parsedFont, fontErr
+}
+
+// Overlay draws text overlays on the frames
+type Overlay struct {
+	mu       sync.Mutex
+	overlays []TextOverlay
+	faces    map[float64]font.Face
+	now      func() time.Time
+}
+
+// NewOverlay creates an overlay filter drawing the given text blocks
+func NewOverlay(overlays ...TextOverlay) (*Overlay, error) {
+	if _, err := loadFont(); err != nil {
+		return nil, err
+	}
+	o := &Overlay{
+		faces: map[float64]font.Face{},
+		now:   time.Now,
+	}
+	if err := o.SetOverlays(overlays); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// SetOverlays replaces the drawn text blocks
+func (o *Overlay) SetOverlays(overlays []TextOverlay) error {
+	for _, t := range overlays {
+		if _, err := ParsePosition(string(t.Position)); err != nil {
+			return err
+		}
+		if t.FontSize <= 0 {
+			return fmt.Errorf("Invalid font size %v", t.FontSize)
+		}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.overlays = overlays
+	return nil
+}
+
+func (o *Overlay) face(size float64) (font.Face, error) {
+	if face, ok := o.faces[size]; ok {
+		return face, nil
+	}
+	f, err := loadFont()
+	if err != nil {
+		return nil, err
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	o.faces[size] = face
+	return face, nil
+}
+
+// Apply draws the text blocks into the frame
+func (o *Overlay) Apply(frame *image.RGBA) *image.RGBA {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.now()
+	for i := range o.overlays {
+		t := &o.overlays[i]
+		face, err := o.face(t.FontSize)
+		if err != nil {
+			continue
+		}
+		drawTextBlock(frame, face, t, t.lines(now))
+	}
+	return frame
+}
+
+func drawTextBlock(frame *image.RGBA, face font.Face, t *TextOverlay, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	width := 0
+	for _, line := range lines {
+		if w := font.MeasureString(face, line).Ceil(); w > width {
+			width = w
+		}
+	}
+	padding := int(t.FontSize / 4)
+	boxW, boxH := width+2*padding, len(lines)*lineHeight+2*padding
+	margin := int(t.FontSize / 2)
+
+	bounds := frame.Bounds()
+	x, y := bounds.Min.X+margin, bounds.Min.Y+margin
+	if t.Position == TopRight || t.Position == BottomRight {
+		x = bounds.Max.X - margin - boxW
+	}
+	if t.Position == BottomLeft || t.Position == BottomRight {
+		y = bounds.Max.Y - margin - boxH
+	}
+	box := image.Rect(x, y, x+boxW, y+boxH)
+
+	if t.Background.A > 0 {
+		draw.Draw(frame, box, image.NewUniform(t.Background), image.Point{}, draw.Over)
+	}
+	drawer := font.Drawer{
+		Dst:  frame,
+		Src:  image.NewUniform(t.Color),
+		Face: face,
+	}
+	for i, line := range lines {
+		drawer.Dot = fixed.P(x+padding, y+padding+i*lineHeight+metrics.Ascent.Ceil())
+		drawer.DrawString(line)
+	}
+}
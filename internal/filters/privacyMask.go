@@ -0,0 +1,241 @@
+package filters
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sync"
+)
+
+// MaskMode selects how a masked region is hidden
+type MaskMode string
+
+const (
+	MaskBlack    MaskMode = "black"
+	MaskPixelate MaskMode = "pixelate"
+	MaskBlur     MaskMode = "blur"
+)
+
+// Point is a position relative to the frame, 0,0 is the top left corner and 1,1 the bottom right one
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Rect is a rectangle relative to the frame
+type Rect struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	W float64 `json:"w"`
+	H float64 `json:"h"`
+}
+
+// Mask is a region hidden on every frame, given either as a polygon or as a rectangle.
+// Normalized coordinates keep the mask in place when the resolution changes.
+type Mask struct {
+	ID     string   `json:"id"`
+	Mode   MaskMode `json:"mode"`
+	Points []Point  `json:"points,omitempty"`
+	Rect   *Rect    `json:"rect,omitempty"`
+}
+
+// Validate checks the mode and the shape of the mask
+func (m *Mask) Validate() error {
+	switch m.Mode {
+	case MaskBlack, MaskPixelate, MaskBlur:
+	default:
+		return fmt.Errorf("Unknown mask mode %q", m.Mode)
+	}
+	if m.Rect == nil && len(m.Points) < 3 {
+		return fmt.Errorf("Mask %q needs a rect or at least 3 points", m.ID)
+	}
+	if m.Rect != nil && (m.Rect.W <= 0 || m.Rect.H <= 0) {
+		return fmt.Errorf("Mask %q has an empty rect", m.ID)
+	}
+	return nil
+}
+
+// polygon returns the mask outline in pixels of the given bounds
+func (m *Mask) polygon(bounds image.Rectangle) []Point {
+	points := m.Points
+	if m.Rect != nil {
+		r := m.Rect
+		points = []Point{{r.X, r.Y}, {r.X + r.W, r.Y}, {r.X + r.W, r.Y + r.H}, {r.X, r.Y + r.H}}
+	}
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	poly := make([]Point, len(points))
+	for i, p := range points {
+		poly[i] = Point{X: float64(bounds.Min.X) + p.X*w, Y: float64(bounds.Min.Y) + p.Y*h}
+	}
+	return poly
+}
+
+// PrivacyMask hides the configured regions of every frame
+type PrivacyMask struct {
+	mu    sync.RWMutex
+	masks []Mask
+}
+
+// NewPrivacyMask creates a privacy mask filter
+func NewPrivacyMask(masks ...Mask) (*PrivacyMask, error) {
+	pm := &PrivacyMask{}
+	if err := pm.SetMasks(masks); err != nil {
+		return nil, err
+	}
+	return pm, nil
+}
+
+// Masks returns a copy of the current masks
+func (pm *PrivacyMask) Masks() []Mask {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	masks := make([]Mask, len(pm.masks))
+	copy(masks, pm.masks)
+	return masks
+}
+
+// SetMasks replaces every mask, the previous ones stay in place if any mask is invalid
+func (pm *PrivacyMask) SetMasks(masks []Mask) error {
+	ids := map[string]bool{}
+	for i := range masks {
+		if err := masks[i].Validate(); err != nil {
+			return err
+		}
+		if masks[i].ID != "" && ids[masks[i].ID] {
+			return fmt.Errorf("Duplicated mask id %q", masks[i].ID)
+		}
+		ids[masks[i].ID] = true
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.masks = append([]Mask{}, masks...)
+	return nil
+}
+
+// Apply hides the masked regions in place
+func (pm *PrivacyMask) Apply(frame *image.RGBA) *image.RGBA {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	for i := range pm.masks {
+		applyMask(frame, &pm.masks[i])
+	}
+	return frame
+}
+
+func applyMask(frame *image.RGBA, m *Mask) {
+	bounds := frame.Bounds()
+	poly := m.polygon(bounds)
+	box := polygonBounds(poly).Intersect(bounds)
+	if box.Empty() {
+		return
+	}
+	inside := func(x, y int) bool {
+		return pointInPolygon(float64(x)+0.5, float64(y)+0.5, poly)
+	}
+
+	switch m.Mode {
+	case MaskBlack:
+		for y := box.Min.Y; y < box.Max.Y; y++ {
+			for x := box.Min.X; x < box.Max.X; x++ {
+				if inside(x, y) {
+					setPixel(frame, x, y, 0, 0, 0)
+				}
+			}
+		}
+	case MaskPixelate:
+		block := int(math.Max(8, float64(bounds.Dx())/40))
+		pixelate(frame, box, block, inside)
+	case MaskBlur:
+		radius := int(math.Max(4, float64(bounds.Dx())/80))
+		blur(frame, box, radius, inside)
+	}
+}
+
+func setPixel(frame *image.RGBA, x, y int, r, g, b uint8) {
+	i := frame.PixOffset(x, y)
+	frame.Pix[i], frame.Pix[i+1], frame.Pix[i+2], frame.Pix[i+3] = r, g, b, 0xff
+}
+
+// pixelate replaces the masked pixels with the average color of their block
+func pixelate(frame *image.RGBA, box image.Rectangle, block int, inside func(x, y int) bool) {
+	for by := box.Min.Y; by < box.Max.Y; by += block {
+		for bx := box.Min.X; bx < box.Max.X; bx += block {
+			cell := image.Rect(bx, by, bx+block, by+block).Intersect(box)
+			var sr, sg, sb, n int
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					i := frame.PixOffset(x, y)
+					sr, sg, sb = sr+int(frame.Pix[i]), sg+int(frame.Pix[i+1]), sb+int(frame.Pix[i+2])
+					n++
+				}
+			}
+			r, g, b := uint8(sr/n), uint8(sg/n), uint8(sb/n)
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					if inside(x, y) {
+						setPixel(frame, x, y, r, g, b)
+					}
+				}
+			}
+		}
+	}
+}
+
+// blur box blurs the region using a summed area table, then copies the masked pixels back
+func blur(frame *image.RGBA, box image.Rectangle, radius int, inside func(x, y int) bool) {
+	w, h := box.Dx(), box.Dy()
+	// sums has one extra row and column of zeros
+	sums := make([][3]int, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		var row [3]int
+		for x := 0; x < w; x++ {
+			i := frame.PixOffset(box.Min.X+x, box.Min.Y+y)
+			for c := 0; c < 3; c++ {
+				row[c] += int(frame.Pix[i+c])
+				sums[(y+1)*(w+1)+x+1][c] = sums[y*(w+1)+x+1][c] + row[c]
+			}
+		}
+	}
+	blurred := make([]uint8, w*h*3)
+	for y := 0; y < h; y++ {
+		y0, y1 := max(0, y-radius), min(h, y+radius+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := max(0, x-radius), min(w, x+radius+1)
+			n := (x1 - x0) * (y1 - y0)
+			for c := 0; c < 3; c++ {
+				sum := sums[y1*(w+1)+x1][c] - sums[y0*(w+1)+x1][c] - sums[y1*(w+1)+x0][c] + sums[y0*(w+1)+x0][c]
+				blurred[(y*w+x)*3+c] = uint8(sum / n)
+			}
+		}
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if inside(box.Min.X+x, box.Min.Y+y) {
+				i := (y*w + x) * 3
+				setPixel(frame, box.Min.X+x, box.Min.Y+y, blurred[i], blurred[i+1], blurred[i+2])
+			}
+		}
+	}
+}
+
+func polygonBounds(poly []Point) image.Rectangle {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, p := range poly {
+		minX, minY = math.Min(minX, p.X), math.Min(minY, p.Y)
+		maxX, maxY = math.Max(maxX, p.X), math.Max(maxY, p.Y)
+	}
+	return image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX)), int(math.Ceil(maxY)))
+}
+
+// pointInPolygon uses the even-odd rule
+func pointInPolygon(x, y float64, poly []Point) bool {
+	in := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		if (a.Y > y) != (b.Y > y) && x < (b.X-a.X)*(y-a.Y)/(b.Y-a.Y)+a.X {
+			in = !in
+		}
+	}
+	return in
+}
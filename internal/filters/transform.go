@@ -0,0 +1,109 @@
+package filters
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+)
+
+// Resizer is implemented by the filters that change the frame size
+type Resizer interface {
+	OutputSize(in size.Size) size.Size
+}
+
+// Transform fixes the orientation of mounted cameras.
+// The frame is cropped first, then rotated clockwise, then flipped,
+// so the flips apply to the picture as the viewers see it.
+type Transform struct {
+	crop     image.Rectangle
+	rotation int
+	flipH    bool
+	flipV    bool
+}
+
+// NewTransform creates a transform, an empty crop keeps the whole frame
+func NewTransform(crop image.Rectangle, rotation int, flipH bool, flipV bool) (*Transform, error) {
+	switch rotation {
+	case 0, 90, 180, 270:
+	default:
+		return nil, fmt.Errorf("Rotation must be 0, 90, 180 or 270, got %d", rotation)
+	}
+	if !crop.Empty() && (crop.Min.X < 0 || crop.Min.Y < 0) {
+		return nil, fmt.Errorf("Invalid crop %v", crop)
+	}
+	return &Transform{crop: crop.Canon(), rotation: rotation, flipH: flipH, flipV: flipV}, nil
+}
+
+func (t *Transform) identity() bool {
+	return t.crop.Empty() && t.rotation == 0 && !t.flipH && !t.flipV
+}
+
+// cropRect returns the cropped region of a frame of the given bounds
+func (t *Transform) cropRect(bounds image.Rectangle) image.Rectangle {
+	if t.crop.Empty() {
+		return bounds
+	}
+	if r := t.crop.Add(bounds.Min).Intersect(bounds); !r.Empty() {
+		return r
+	}
+	return bounds
+}
+
+// OutputSize returns the frame size after the transform
+func (t *Transform) OutputSize(in size.Size) size.Size {
+	r := t.cropRect(image.Rect(0, 0, in.Width, in.Height))
+	if t.rotation == 90 || t.rotation == 270 {
+		return size.Size{Width: r.Dy(), Height: r.Dx()}
+	}
+	return size.Size{Width: r.Dx(), Height: r.Dy()}
+}
+
+// Apply returns the transformed frame
+func (t *Transform) Apply(frame *image.RGBA) *image.RGBA {
+	if t.identity() {
+		return frame
+	}
+	src := t.cropRect(frame.Bounds())
+	if t.rotation == 0 && !t.flipH && !t.flipV {
+		// a copy, the encoders read the pixels as contiguous rows from 0,0
+		out := image.NewRGBA(image.Rect(0, 0, src.Dx(), src.Dy()))
+		draw.Draw(out, out.Rect, frame, src.Min, draw.Src)
+		return out
+	}
+
+	sw, sh := src.Dx(), src.Dy()
+	ow, oh := sw, sh
+	if t.rotation == 90 || t.rotation == 270 {
+		ow, oh = sh, sw
+	}
+	out := image.NewRGBA(image.Rect(0, 0, ow, oh))
+	for oy := 0; oy < oh; oy++ {
+		for ox := 0; ox < ow; ox++ {
+			// undo the flips, then the rotation, to find the source pixel
+			x, y := ox, oy
+			if t.flipH {
+				x = ow - 1 - x
+			}
+			if t.flipV {
+				y = oh - 1 - y
+			}
+			var sx, sy int
+			switch t.rotation {
+			case 0:
+				sx, sy = x, y
+			case 90:
+				sx, sy = y, sh-1-x
+			case 180:
+				sx, sy = sw-1-x, sh-1-y
+			case 270:
+				sx, sy = sw-1-y, x
+			}
+			si := frame.PixOffset(src.Min.X+sx, src.Min.Y+sy)
+			oi := out.PixOffset(ox, oy)
+			copy(out.Pix[oi:oi+4], frame.Pix[si:si+4])
+		}
+	}
+	return out
+}
@@ -0,0 +1,294 @@
+// Package hls serves the encoded H.264 stream as Low-Latency HLS: fMP4 (CMAF) segments made of partial
+// segments, kept in memory for a window of segments, with blocking playlist reloads and preload hints
+package hls
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/fmp4"
+)
+
+var logger *log.Logger
+
+func init() {
+	logger = log.New(log.Writer(), "[hls]", log.LstdFlags)
+}
+
+// idleTimeout stops the muxer when no request came for that long, the encoder stops with it
+const idleTimeout = 30 * time.Second
+
+// Stream is the encoded stream of the muxer, every subscription starts at a keyframe
+type Stream interface {
+	Subscribe() <-chan *encoders.EncodedFrame
+	Unsubscribe(frames <-chan *encoders.EncodedFrame)
+}
+
+// Config sets the segmentation of the stream
+type Config struct {
+	// SegmentCount is the number of complete segments in the playlist
+	SegmentCount int
+	// SegmentDuration is the shortest segment, segments start at the first keyframe after it
+	SegmentDuration time.Duration
+	// PartDuration is the longest partial segment, unless a single frame lasts longer
+	PartDuration time.Duration
+}
+
+// Muxer cuts the stream into segments while the playlist is requested
+type Muxer struct {
+	stream Stream
+	cfg    Config
+
+	mu sync.Mutex
+	// changed is closed and replaced when a part is added, waking the blocked requests
+	changed  chan struct{}
+	running  bool
+	lastUsed time.Time
+	frames   <-chan *encoders.EncodedFrame
+
+	init     []byte
+	segments []*segment
+	// nextMSN numbers the segments, it keeps increasing across restarts
+	nextMSN uint64
+	// sequence numbers the fragments
+	sequence uint32
+}
+
+// segment is a media segment, its data is the concatenation of its parts
+type segment struct {
+	msn      uint64
+	parts    []*part
+	duration time.Duration
+	complete bool
+}
+
+type part struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+// NewMuxer returns a muxer of the stream, stopped until the first request
+func NewMuxer(stream Stream, cfg Config) *Muxer {
+	return &Muxer{stream: stream, cfg: cfg, changed: make(chan struct{})}
+}
+
+// touch starts the muxer if needed and delays its idle stop
+func (m *Muxer) touch() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastUsed = time.Now()
+	if m.running {
+		return
+	}
+	m.running = true
+	m.init = nil
+	m.segments = nil
+	m.frames = m.stream.Subscribe()
+	go m.run(m.frames)
+	go m.stopWhenIdle(m.frames)
+}
+
+func (m *Muxer) stopWhenIdle(frames <-chan *encoders.EncodedFrame) {
+	for {
+		time.Sleep(idleTimeout / 4)
+		m.mu.Lock()
+		if m.frames != frames {
+			m.mu.Unlock()
+			return
+		}
+		if time.Since(m.lastUsed) >= idleTimeout {
+			m.stopLocked()
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Close stops the muxer, it starts again with the next request
+func (m *Muxer) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopLocked()
+}
+
+func (m *Muxer) stopLocked() {
+	if !m.running {
+		return
+	}
+	m.running = false
+	m.stream.Unsubscribe(m.frames)
+	m.frames = nil
+	m.notifyLocked()
+}
+
+func (m *Muxer) notifyLocked() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// run muxes the frames until the subscription closes. Each frame is held back until the next one,
+// which gives its duration.
+func (m *Muxer) run(frames <-chan *encoders.EncodedFrame) {
+	var first, pending *encoders.EncodedFrame
+	var pendingTime uint64
+	var samples []fmp4.Sample
+	var partStart uint64
+	var partDuration time.Duration
+	var seg *segment
+
+	// a stopped run may still drain buffered frames, they no longer go to the window
+	flushPart := func() bool {
+		if len(samples) == 0 {
+			return true
+		}
+		m.mu.Lock()
+		if m.frames != frames {
+			m.mu.Unlock()
+			return false
+		}
+		m.sequence++
+		seg.parts = append(seg.parts, &part{
+			data:        fmp4.Fragment(m.sequence, partStart, samples),
+			duration:    partDuration,
+			independent: samples[0].Keyframe,
+		})
+		m.notifyLocked()
+		m.mu.Unlock()
+		samples, partDuration = nil, 0
+		return true
+	}
+
+	for frame := range frames {
+		if first == nil {
+			track, err := fmp4.NewTrack(frame.Data)
+			if err != nil {
+				logger.Printf("Skipping frame %d: %v\n", frame.Seq, err)
+				continue
+			}
+			first = frame
+			m.mu.Lock()
+			m.init = fmp4.InitSegment(track)
+			m.mu.Unlock()
+		}
+		decodeTime := timescaleTicks(frame.Time.Sub(first.Time))
+		if pending == nil {
+			pending, pendingTime = frame, decodeTime
+			continue
+		}
+		if decodeTime <= pendingTime {
+			// out of order capture times, the nominal duration keeps the timeline increasing
+			decodeTime = pendingTime + uint64(frame.Duration*fmp4.Timescale/time.Second) + 1
+		}
+		duration := time.Duration(decodeTime-pendingTime) * time.Second / fmp4.Timescale
+
+		// a new segment starts at a keyframe, with some slack for the keyframes coming slightly early
+		if seg == nil || pending.Keyframe && seg.duration >= m.cfg.SegmentDuration*9/10 {
+			if !flushPart() {
+				return
+			}
+			if seg = m.startSegment(frames); seg == nil {
+				return
+			}
+		}
+		if len(samples) > 0 && partDuration+duration > m.cfg.PartDuration && !flushPart() {
+			return
+		}
+		if len(samples) == 0 {
+			partStart = pendingTime
+		}
+		samples = append(samples, fmp4.NewSample(pending.Data, uint32(decodeTime-pendingTime), pending.Keyframe))
+		partDuration += duration
+		m.mu.Lock()
+		seg.duration += duration
+		m.mu.Unlock()
+		if partDuration >= m.cfg.PartDuration && !flushPart() {
+			return
+		}
+		pending, pendingTime = frame, decodeTime
+	}
+}
+
+// startSegment completes the current segment, if any, and opens the next one. It returns nil when
+// the run of frames was stopped.
+func (m *Muxer) startSegment(frames <-chan *encoders.EncodedFrame) *segment {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.frames != frames {
+		return nil
+	}
+	complete := 0
+	for _, seg := range m.segments {
+		if !seg.complete && len(seg.parts) > 0 {
+			seg.complete = true
+		}
+		if seg.complete {
+			complete++
+		}
+	}
+	// the window keeps SegmentCount complete segments
+	for complete > m.cfg.SegmentCount {
+		m.segments = m.segments[1:]
+		complete--
+	}
+	seg := &segment{msn: m.nextMSN}
+	m.nextMSN++
+	m.segments = append(m.segments, seg)
+	m.notifyLocked()
+	return seg
+}
+
+// segmentLocked returns the segment numbered msn in the window
+func (m *Muxer) segmentLocked(msn uint64) *segment {
+	for _, seg := range m.segments {
+		if seg.msn == msn {
+			return seg
+		}
+	}
+	return nil
+}
+
+// hasLocked tells whether the part of a segment is available, a negative part asks for the complete segment
+func (m *Muxer) hasLocked(msn uint64, partIndex int) bool {
+	seg := m.segmentLocked(msn)
+	if seg == nil {
+		// past segments have left the window, they are available for the playlist
+		return len(m.segments) > 0 && msn < m.segments[0].msn
+	}
+	return seg.complete || partIndex >= 0 && partIndex < len(seg.parts)
+}
+
+// wait blocks until ready returns true, the muxer stops or timeout expires
+func (m *Muxer) wait(done <-chan struct{}, timeout time.Duration, ready func() bool) bool {
+	expired := time.After(timeout)
+	for {
+		m.mu.Lock()
+		ok, changed, running := ready(), m.changed, m.running
+		m.mu.Unlock()
+		if ok {
+			return true
+		}
+		if !running {
+			return false
+		}
+		select {
+		case <-changed:
+		case <-done:
+			return false
+		case <-expired:
+			return false
+		}
+	}
+}
+
+// timescaleTicks converts an elapsed time in fmp4.Timescale units. The seconds and the rest are converted apart,
+// the product of the nanoseconds and the timescale overflows after a day. A negative time counts as zero.
+func timescaleTicks(d time.Duration) uint64 {
+	if d < 0 {
+		return 0
+	}
+	return uint64(d/time.Second)*fmp4.Timescale + uint64(d%time.Second)*fmp4.Timescale/uint64(time.Second)
+}
@@ -0,0 +1,169 @@
+package hls
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+	"github.com/stretchr/testify/suite"
+)
+
+// parameter sets of x264 at 320x240
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0xd, 0xa6, 0x81, 0x41, 0xfa, 0x10, 0x0, 0x0, 0x3, 0x0, 0x10, 0x0, 0x0, 0x3, 0x3, 0xc8, 0xf1, 0x42, 0xaa}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// fakeStream sends a keyframe every 10 frames, one frame every 10ms
+type fakeStream struct {
+	mu          sync.Mutex
+	subscribers map[<-chan *encoders.EncodedFrame]chan struct{}
+}
+
+func (f *fakeStream) Subscribe() <-chan *encoders.EncodedFrame {
+	frames := make(chan *encoders.EncodedFrame)
+	stop := make(chan struct{})
+	f.mu.Lock()
+	f.subscribers[frames] = stop
+	f.mu.Unlock()
+	go func() {
+		defer close(frames)
+		for seq := uint64(0); ; seq++ {
+			frame := &encoders.EncodedFrame{
+				Data:     h264.AnnexB([][]byte{{0x41, 0x9a, byte(seq)}}),
+				Time:     time.Now(),
+				Duration: 10 * time.Millisecond,
+				Seq:      seq,
+			}
+			if seq%10 == 0 {
+				frame.Data = h264.AnnexB([][]byte{testSPS, testPPS, {0x65, 0x88, byte(seq)}})
+				frame.Keyframe = true
+			}
+			select {
+			case frames <- frame:
+			case <-stop:
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	return frames
+}
+
+func (f *fakeStream) Unsubscribe(frames <-chan *encoders.EncodedFrame) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if stop, found := f.subscribers[frames]; found {
+		close(stop)
+		delete(f.subscribers, frames)
+	}
+}
+
+func (f *fakeStream) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subscribers)
+}
+
+type HLSSuit struct {
+	suite.Suite
+	stream *fakeStream
+	muxer  *Muxer
+	server *httptest.Server
+}
+
+func TestHLSSuite(t *testing.T) {
+	suite.Run(t, new(HLSSuit))
+}
+
+func (s *HLSSuit) SetupTest() {
+	s.stream = &fakeStream{subscribers: map[<-chan *encoders.EncodedFrame]chan struct{}{}}
+	s.muxer = NewMuxer(s.stream, Config{SegmentCount: 3, SegmentDuration: 200 * time.Millisecond, PartDuration: 50 * time.Millisecond})
+	s.server = httptest.NewServer(http.StripPrefix("/hls", s.muxer))
+}
+
+func (s *HLSSuit) TearDownTest() {
+	s.server.Close()
+	s.muxer.Close()
+}
+
+func (s *HLSSuit) get(uri string) (int, string, string) {
+	resp, err := http.Get(s.server.URL + "/hls/" + uri)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	return resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+}
+
+var preloadHint = regexp.MustCompile(`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part-(\d+)-(\d+)\.m4s\?token=abc"`)
+
+func (s *HLSSuit) Test_Playlist() {
+	status, contentType, playlist := s.get("index.m3u8?token=abc")
+	s.Require().Equal(http.StatusOK, status)
+	s.Equal("application/vnd.apple.mpegurl", contentType)
+	s.Contains(playlist, "#EXT-X-PART-INF:PART-TARGET=0.050")
+	s.Contains(playlist, "CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.150")
+	s.Contains(playlist, `#EXT-X-MAP:URI="init.mp4?token=abc"`)
+	// the stream starts at a keyframe
+	s.Contains(playlist, `URI="part-0-0.m4s?token=abc",INDEPENDENT=YES`)
+	hint := preloadHint.FindStringSubmatch(playlist)
+	s.Require().NotNil(hint)
+
+	status, contentType, init := s.get("init.mp4")
+	s.Require().Equal(http.StatusOK, status)
+	s.Equal("video/mp4", contentType)
+	s.Equal("ftyp", init[4:8])
+
+	// the hinted part is answered once it's complete
+	status, _, part := s.get("part-" + hint[1] + "-" + hint[2] + ".m4s")
+	s.Require().Equal(http.StatusOK, status)
+	s.Equal("moof", part[4:8])
+
+	// blocking reload until the segment of the hint is complete
+	status, _, playlist = s.get("index.m3u8?token=abc&_HLS_msn=" + hint[1] + "&_HLS_part=20")
+	s.Require().Equal(http.StatusOK, status)
+	s.Contains(playlist, "seg-"+hint[1]+".m4s?token=abc")
+	s.NotContains(playlist, "_HLS_")
+	status, _, segment := s.get("seg-" + hint[1] + ".m4s")
+	s.Require().Equal(http.StatusOK, status)
+	s.Equal("moof", segment[4:8])
+
+	status, _, _ = s.get("index.m3u8?_HLS_msn=1000")
+	s.Equal(http.StatusBadRequest, status)
+	status, _, _ = s.get("part-1000-0.m4s")
+	s.Equal(http.StatusNotFound, status)
+}
+
+func (s *HLSSuit) Test_Window() {
+	playlist := ""
+	for msn := 0; msn <= 5; msn++ {
+		status := 0
+		status, _, playlist = s.get(fmt.Sprintf("index.m3u8?_HLS_msn=%d", msn))
+		s.Require().Equal(http.StatusOK, status)
+	}
+	s.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:3")
+	s.Equal(3, strings.Count(playlist, "#EXTINF:"))
+	s.Contains(playlist, "#EXT-X-TARGETDURATION:1")
+	// segments out of the window are gone
+	status, _, _ := s.get("seg-0.m4s")
+	s.Equal(http.StatusNotFound, status)
+
+	s.muxer.Close()
+	s.Eventually(func() bool { return s.stream.count() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func (s *HLSSuit) Test_TimescaleTicks() {
+	s.Equal(uint64(0), timescaleTicks(-time.Second))
+	s.Equal(uint64(45000), timescaleTicks(500*time.Millisecond))
+	// 30 hours, past the overflow of nanoseconds times the timescale
+	s.Equal(uint64(30*3600*90000+90), timescaleTicks(30*time.Hour+time.Millisecond))
+}
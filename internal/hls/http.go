@@ -0,0 +1,221 @@
+package hls
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	playlistName = "index.m3u8"
+	initName     = "init.mp4"
+	// partsSegments is the number of last segments whose parts are listed
+	partsSegments = 3
+)
+
+// ServeHTTP answers the playlist, the init segment, the segments and the parts. Only the last element
+// of the path counts, so the muxer may be mounted under any prefix.
+func (m *Muxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m.touch()
+	name := path.Base(r.URL.Path)
+	switch {
+	case name == playlistName:
+		m.servePlaylist(w, r)
+	case name == initName:
+		m.serveInit(w, r)
+	case strings.HasPrefix(name, "seg-") && strings.HasSuffix(name, ".m4s"):
+		msn, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "seg-"), ".m4s"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		m.serveSegment(w, r, msn)
+	case strings.HasPrefix(name, "part-") && strings.HasSuffix(name, ".m4s"):
+		msnText, indexText, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(name, "part-"), ".m4s"), "-")
+		msn, err := strconv.ParseUint(msnText, 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		index, err := strconv.Atoi(indexText)
+		if err != nil || index < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		m.servePart(w, r, msn, index)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// blockTimeout bounds the blocking requests, 3 target durations as recommended
+func (m *Muxer) blockTimeout() time.Duration {
+	return 3 * m.cfg.SegmentDuration
+}
+
+// servePlaylist answers the playlist, once the segment and part of the _HLS_msn and _HLS_part parameters
+// are available for a blocking reload
+func (m *Muxer) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	msn, partIndex := uint64(0), -1
+	blocking := query.Has("_HLS_msn")
+	if blocking {
+		var err error
+		if msn, err = strconv.ParseUint(query.Get("_HLS_msn"), 10, 64); err != nil {
+			http.Error(w, "Invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		if query.Has("_HLS_part") {
+			if partIndex, err = strconv.Atoi(query.Get("_HLS_part")); err != nil || partIndex < 0 {
+				http.Error(w, "Invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+		m.mu.Lock()
+		tooFar := msn > m.nextMSN+1
+		m.mu.Unlock()
+		if tooFar {
+			http.Error(w, "_HLS_msn too far in the future", http.StatusBadRequest)
+			return
+		}
+	} else if query.Has("_HLS_part") {
+		http.Error(w, "_HLS_part without _HLS_msn", http.StatusBadRequest)
+		return
+	}
+
+	ready := m.wait(r.Context().Done(), m.blockTimeout(), func() bool {
+		if blocking {
+			return m.hasLocked(msn, partIndex)
+		}
+		// the first request waits for the first part
+		return len(m.segments) > 0 && len(m.segments[0].parts) > 0
+	})
+	if !ready {
+		http.Error(w, "Playlist not available", http.StatusServiceUnavailable)
+		return
+	}
+	for _, param := range []string{"_HLS_msn", "_HLS_part", "_HLS_skip"} {
+		query.Del(param)
+	}
+	suffix := ""
+	if len(query) > 0 {
+		suffix = "?" + query.Encode()
+	}
+
+	m.mu.Lock()
+	if len(m.segments) == 0 {
+		// stopped meanwhile
+		m.mu.Unlock()
+		http.Error(w, "Playlist not available", http.StatusServiceUnavailable)
+		return
+	}
+	playlist := m.playlistLocked(suffix)
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(playlist))
+}
+
+// playlistLocked renders the playlist, suffix is added to the URIs to keep the query of the request
+func (m *Muxer) playlistLocked(suffix string) string {
+	target := m.cfg.SegmentDuration
+	for _, seg := range m.segments {
+		if seg.complete {
+			target = max(target, seg.duration)
+		}
+	}
+	lines := []string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:9",
+		fmt.Sprintf("#EXT-X-TARGETDURATION:%d", int(math.Ceil(target.Seconds()))),
+		fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f", 3*m.cfg.PartDuration.Seconds()),
+		fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f", m.cfg.PartDuration.Seconds()),
+		fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d", m.segments[0].msn),
+		fmt.Sprintf(`#EXT-X-MAP:URI="%v%v"`, initName, suffix),
+	}
+	for i, seg := range m.segments {
+		if i >= len(m.segments)-partsSegments {
+			for j, p := range seg.parts {
+				line := fmt.Sprintf(`#EXT-X-PART:DURATION=%.5f,URI="part-%d-%d.m4s%v"`, p.duration.Seconds(), seg.msn, j, suffix)
+				if p.independent {
+					line += ",INDEPENDENT=YES"
+				}
+				lines = append(lines, line)
+			}
+		}
+		if seg.complete {
+			lines = append(lines, fmt.Sprintf("#EXTINF:%.5f,", seg.duration.Seconds()), fmt.Sprintf("seg-%d.m4s%v", seg.msn, suffix))
+		}
+	}
+	if last := m.segments[len(m.segments)-1]; !last.complete {
+		lines = append(lines, fmt.Sprintf(`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part-%d-%d.m4s%v"`, last.msn, len(last.parts), suffix))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (m *Muxer) serveInit(w http.ResponseWriter, r *http.Request) {
+	var init []byte
+	m.wait(r.Context().Done(), m.blockTimeout(), func() bool {
+		init = m.init
+		return init != nil
+	})
+	if init == nil {
+		http.Error(w, "Stream not available", http.StatusServiceUnavailable)
+		return
+	}
+	writeMedia(w, init)
+}
+
+func (m *Muxer) serveSegment(w http.ResponseWriter, r *http.Request, msn uint64) {
+	m.mu.Lock()
+	seg := m.segmentLocked(msn)
+	data := []byte{}
+	if seg != nil && seg.complete {
+		for _, p := range seg.parts {
+			data = append(data, p.data...)
+		}
+	}
+	m.mu.Unlock()
+	if seg == nil || !seg.complete {
+		http.NotFound(w, r)
+		return
+	}
+	writeMedia(w, data)
+}
+
+// servePart answers a part, the preload hinted part is answered once it's complete
+func (m *Muxer) servePart(w http.ResponseWriter, r *http.Request, msn uint64, index int) {
+	var data []byte
+	m.mu.Lock()
+	future := msn > m.nextMSN
+	m.mu.Unlock()
+	if !future {
+		m.wait(r.Context().Done(), m.blockTimeout(), func() bool {
+			seg := m.segmentLocked(msn)
+			if seg != nil && index < len(seg.parts) {
+				data = seg.parts[index].data
+			}
+			// the part won't come once its segment is complete or gone
+			return data != nil || seg != nil && seg.complete || len(m.segments) > 0 && msn < m.segments[0].msn
+		})
+	}
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeMedia(w, data)
+}
+
+func writeMedia(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
@@ -0,0 +1,200 @@
+package motion
+
+import (
+	"image"
+	"math"
+	"time"
+)
+
+// EventType tells whether motion started or stopped
+type EventType string
+
+const (
+	MotionStart EventType = "motion-start"
+	MotionStop  EventType = "motion-stop"
+)
+
+// Box is a rectangle relative to the frame, 0,0 is the top left corner and 1,1 the bottom right one
+type Box struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	W float64 `json:"w"`
+	H float64 `json:"h"`
+}
+
+// Event is emitted when motion starts or stops.
+// A start event carries the moving regions, a stop event the last ones seen.
+type Event struct {
+	Type  EventType `json:"type"`
+	Time  time.Time `json:"time"`
+	Boxes []Box     `json:"boxes"`
+}
+
+// Config tunes the detector
+type Config struct {
+	// Width of the downscaled analysis frame, the height keeps the aspect ratio
+	Width int
+	// Sensitivity from 0 to 1, higher values react to smaller brightness changes
+	Sensitivity float64
+	// MinArea is the smallest moving region, as a fraction of the frame area
+	MinArea float64
+	// Zones restrict the detection, the whole frame is watched when empty
+	Zones []Box
+	// Cooldown is how long the scene must stay still before a stop event
+	Cooldown time.Duration
+	// Fps is how many frames per second the caller should analyse
+	Fps int
+}
+
+const (
+	defaultWidth    = 160
+	defaultCooldown = 3 * time.Second
+	// backgroundRate is how fast the background model follows the scene
+	backgroundRate = 0.1
+)
+
+// Detector finds motion by differencing downscaled frames against a running background
+type Detector struct {
+	cfg        Config
+	background []float64
+	w, h       int
+	active     bool
+	lastMotion time.Time
+	lastBoxes  []Box
+}
+
+// NewDetector creates a detector, zero config values are replaced by defaults
+func NewDetector(cfg Config) *Detector {
+	if cfg.Width <= 0 {
+		cfg.Width = defaultWidth
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = defaultCooldown
+	}
+	cfg.Sensitivity = math.Max(0, math.Min(1, cfg.Sensitivity))
+	return &Detector{cfg: cfg}
+}
+
+// Active reports whether motion is currently going on, with the last moving regions
+func (d *Detector) Active() (bool, []Box) {
+	return d.active, d.lastBoxes
+}
+
+// Process analyses a frame captured at the given time and returns an event on a state change
+func (d *Detector) Process(frame *image.RGBA, at time.Time) *Event {
+	gray, w, h := downscaleGray(frame, d.cfg.Width)
+	if d.background == nil || w != d.w || h != d.h {
+		d.background, d.w, d.h = gray, w, h
+		return nil
+	}
+
+	// Sensitivity 1 reacts to a difference of 4 levels, 0 to 132 levels
+	threshold := 4 + (1-d.cfg.Sensitivity)*128
+	changed := make([]bool, w*h)
+	for i, v := range gray {
+		if math.Abs(v-d.background[i]) > threshold && d.inZones(i%w, i/w) {
+			changed[i] = true
+		}
+		d.background[i] += (v - d.background[i]) * backgroundRate
+	}
+
+	minPixels := int(math.Max(1, d.cfg.MinArea*float64(w*h)))
+	boxes := regions(changed, w, h, minPixels)
+
+	if len(boxes) > 0 {
+		d.lastMotion = at
+		d.lastBoxes = boxes
+		if !d.active {
+			d.active = true
+			return &Event{Type: MotionStart, Time: at, Boxes: boxes}
+		}
+		return nil
+	}
+	if d.active && at.Sub(d.lastMotion) >= d.cfg.Cooldown {
+		d.active = false
+		return &Event{Type: MotionStop, Time: at, Boxes: d.lastBoxes}
+	}
+	return nil
+}
+
+func (d *Detector) inZones(x, y int) bool {
+	if len(d.cfg.Zones) == 0 {
+		return true
+	}
+	fx, fy := (float64(x)+0.5)/float64(d.w), (float64(y)+0.5)/float64(d.h)
+	for _, z := range d.cfg.Zones {
+		if fx >= z.X && fx < z.X+z.W && fy >= z.Y && fy < z.Y+z.H {
+			return true
+		}
+	}
+	return false
+}
+
+// downscaleGray averages the frame into a width wide grayscale buffer
+func downscaleGray(frame *image.RGBA, width int) ([]float64, int, int) {
+	b := frame.Bounds()
+	if width > b.Dx() {
+		width = b.Dx()
+	}
+	height := int(math.Max(1, math.Round(float64(width)*float64(b.Dy())/float64(b.Dx()))))
+	gray := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			sum, n := 0.0, 0
+			// sample a 4x4 grid of the cell, enough for motion and much cheaper than every pixel
+			for sy := y0; sy < y1; sy += max(1, (y1-y0)/4) {
+				for sx := x0; sx < x1; sx += max(1, (x1-x0)/4) {
+					i := frame.PixOffset(sx, sy)
+					sum += 0.299*float64(frame.Pix[i]) + 0.587*float64(frame.Pix[i+1]) + 0.114*float64(frame.Pix[i+2])
+					n++
+				}
+			}
+			gray[y*width+x] = sum / float64(n)
+		}
+	}
+	return gray, width, height
+}
+
+// regions returns the bounding boxes of the connected changed areas of at least minPixels
+func regions(changed []bool, w, h int, minPixels int) []Box {
+	boxes := []Box{}
+	seen := make([]bool, len(changed))
+	stack := []int{}
+	for start := range changed {
+		if !changed[start] || seen[start] {
+			continue
+		}
+		seen[start] = true
+		stack = append(stack[:0], start)
+		minX, minY, maxX, maxY, count := w, h, 0, 0, 0
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			x, y := i%w, i/w
+			minX, minY, maxX, maxY = min(minX, x), min(minY, y), max(maxX, x), max(maxY, y)
+			count++
+			for _, n := range [4]int{i - 1, i + 1, i - w, i + w} {
+				if n < 0 || n >= len(changed) || seen[n] || !changed[n] {
+					continue
+				}
+				// don't wrap around the row ends
+				if (n == i-1 || n == i+1) && n/w != y {
+					continue
+				}
+				seen[n] = true
+				stack = append(stack, n)
+			}
+		}
+		if count >= minPixels {
+			boxes = append(boxes, Box{
+				X: float64(minX) / float64(w),
+				Y: float64(minY) / float64(h),
+				W: float64(maxX-minX+1) / float64(w),
+				H: float64(maxY-minY+1) / float64(h),
+			})
+		}
+	}
+	return boxes
+}
@@ -0,0 +1,89 @@
+package motion
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DetectorSuit struct {
+	suite.Suite
+	start time.Time
+}
+
+func TestDetectorSuite(t *testing.T) {
+	suite.Run(t, new(DetectorSuit))
+}
+
+func (s *DetectorSuit) SetupTest() {
+	s.start = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+}
+
+// scene returns a gray frame with a white square at the given position
+func scene(square image.Rectangle) *image.RGBA {
+	frame := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	draw.Draw(frame, frame.Bounds(), image.NewUniform(color.Gray{Y: 60}), image.Point{}, draw.Src)
+	draw.Draw(frame, square, image.NewUniform(color.White), image.Point{}, draw.Src)
+	return frame
+}
+
+func (s *DetectorSuit) at(frame int) time.Time {
+	return s.start.Add(time.Duration(frame) * 200 * time.Millisecond)
+}
+
+func (s *DetectorSuit) Test_StartAndStop() {
+	d := NewDetector(Config{Sensitivity: 0.5, MinArea: 0.005, Cooldown: time.Second})
+	empty := scene(image.Rectangle{})
+	s.Nil(d.Process(empty, s.at(0)))
+	s.Nil(d.Process(empty, s.at(1)))
+
+	ev := d.Process(scene(image.Rect(200, 120, 260, 180)), s.at(2))
+	s.Require().NotNil(ev)
+	s.Equal(MotionStart, ev.Type)
+	s.Require().Len(ev.Boxes, 1)
+	s.InDelta(200.0/320, ev.Boxes[0].X, 0.02)
+	s.InDelta(120.0/240, ev.Boxes[0].Y, 0.02)
+	s.InDelta(60.0/320, ev.Boxes[0].W, 0.02)
+
+	// the square is gone, motion stops once the cooldown elapsed
+	s.Nil(d.Process(empty, s.at(3)))
+	s.Nil(d.Process(empty, s.at(5)))
+	ev = d.Process(empty, s.at(8))
+	s.Require().NotNil(ev)
+	s.Equal(MotionStop, ev.Type)
+	active, _ := d.Active()
+	s.False(active)
+}
+
+func (s *DetectorSuit) Test_MinAreaIgnoresSmallChanges() {
+	d := NewDetector(Config{Sensitivity: 0.5, MinArea: 0.05})
+	d.Process(scene(image.Rectangle{}), s.at(0))
+	s.Nil(d.Process(scene(image.Rect(10, 10, 30, 30)), s.at(1)))
+}
+
+func (s *DetectorSuit) Test_ZonesRestrictDetection() {
+	d := NewDetector(Config{Sensitivity: 0.5, MinArea: 0.005, Zones: []Box{{X: 0, Y: 0, W: 0.5, H: 0.5}}})
+	d.Process(scene(image.Rectangle{}), s.at(0))
+	s.Nil(d.Process(scene(image.Rect(200, 120, 260, 180)), s.at(1)))
+
+	ev := d.Process(scene(image.Rect(20, 20, 80, 80)), s.at(2))
+	s.Require().NotNil(ev)
+	s.Equal(MotionStart, ev.Type)
+}
+
+func (s *DetectorSuit) Test_LowSensitivityIgnoresDimChanges() {
+	dim := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	draw.Draw(dim, dim.Bounds(), image.NewUniform(color.Gray{Y: 90}), image.Point{}, draw.Src)
+
+	d := NewDetector(Config{Sensitivity: 0.1, MinArea: 0.005})
+	d.Process(scene(image.Rectangle{}), s.at(0))
+	s.Nil(d.Process(dim, s.at(1)))
+
+	d = NewDetector(Config{Sensitivity: 0.9, MinArea: 0.005})
+	d.Process(scene(image.Rectangle{}), s.at(0))
+	s.NotNil(d.Process(dim, s.at(1)))
+}
@@ -0,0 +1,339 @@
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/encryption"
+	"github.com/acentior/camera-pipeline-sender/pkg/fmp4"
+)
+
+// ErrNoFootage is returned by an export of a range without recordings
+var ErrNoFootage = errors.New("no footage in the range")
+
+// Segment is a recording of the catalog
+type Segment struct {
+	Name   string    `json:"name"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Size   int64     `json:"size"`
+	Locked bool      `json:"locked"`
+	// Keyframes are the times of the keyframes in seconds from Start, where exports may start
+	Keyframes []float64 `json:"keyframes"`
+}
+
+// Catalog indexes the recordings of a directory, a file is parsed again only once it changed
+type Catalog struct {
+	dir     string
+	keyring *encryption.Keyring
+
+	mu      sync.Mutex
+	entries map[string]*catalogEntry
+}
+
+type catalogEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	// segment and track are nil when the file isn't a valid recording yet
+	segment   *Segment
+	track     *fmp4.Track
+	timescale uint32
+	// fragments locate the fragments in the file, their samples are read again when exported or played
+	fragments []fragmentIndex
+}
+
+// fragmentIndex is a fragment of a recording without its sample table
+type fragmentIndex struct {
+	// offset is the position of the moof box
+	offset   int64
+	baseTime uint64
+	duration uint64
+	// keyframe is set when the fragment starts with a keyframe
+	keyframe bool
+}
+
+// NewCatalog returns the catalog of the recordings of dir, the encrypted ones are read with the keys of keyring
+func NewCatalog(dir string, keyring *encryption.Keyring) *Catalog {
+	return &Catalog{dir: dir, keyring: keyring, entries: map[string]*catalogEntry{}}
+}
+
+// recordingFile reads a recording, decrypted when encrypted
+type recordingFile struct {
+	io.ReaderAt
+	f    *os.File
+	size int64
+}
+
+// openRecording opens a recording, an encrypted one needs its key in keyring
+func openRecording(path string, keyring *encryption.Keyring) (*recordingFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !encryption.IsEncrypted(f) {
+		return &recordingFile{ReaderAt: f, f: f, size: info.Size()}, nil
+	}
+	if keyring == nil {
+		f.Close()
+		return nil, fmt.Errorf("%v is encrypted, no keyring", filepath.Base(path))
+	}
+	r, err := encryption.NewReader(f, info.Size(), keyring)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &recordingFile{ReaderAt: r, f: f, size: r.Size()}, nil
+}
+
+func (r *recordingFile) Close() error {
+	return r.f.Close()
+}
+
+// ticks converts a time in timescale units
+func ticks(t uint64, timescale uint32) time.Duration {
+	ts := uint64(timescale)
+	return time.Duration(t/ts)*time.Second + time.Duration(t%ts)*time.Second/time.Duration(ts)
+}
+
+// refresh updates the index from the directory and returns the valid recordings by start time
+func (c *Catalog) refresh() ([]*catalogEntry, error) {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := map[string]bool{}
+	valid := []*catalogEntry{}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		start, err := ParseFileName(name)
+		if err != nil || !dirEntry.Type().IsRegular() {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		seen[name] = true
+		entry := c.entries[name]
+		if entry == nil || entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+			entry = &catalogEntry{path: filepath.Join(c.dir, name), size: info.Size(), modTime: info.ModTime()}
+			entry.index(name, start, c.keyring)
+			c.entries[name] = entry
+		}
+		if entry.segment != nil {
+			entry.segment.Locked = IsLocked(entry.path)
+			valid = append(valid, entry)
+		}
+	}
+	for name := range c.entries {
+		if !seen[name] {
+			delete(c.entries, name)
+		}
+	}
+	sort.Slice(valid, func(i, j int) bool { return valid[i].segment.Start.Before(valid[j].segment.Start) })
+	return valid, nil
+}
+
+// index parses the file, it stays out of the catalog when it isn't valid
+func (e *catalogEntry) index(name string, start time.Time, keyring *encryption.Keyring) {
+	f, err := openRecording(e.path, keyring)
+	if err != nil {
+		logger.Printf("Can't index %v: %v\n", e.path, err)
+		return
+	}
+	defer f.Close()
+	file, err := fmp4.Parse(f, f.size)
+	if err != nil || len(file.Fragments) == 0 || file.Timescale == 0 {
+		return
+	}
+	segment := &Segment{
+		Name:      name,
+		Start:     start,
+		End:       start.Add(ticks(file.Duration(), file.Timescale)),
+		Size:      e.size,
+		Keyframes: []float64{},
+	}
+	fragments := make([]fragmentIndex, 0, len(file.Fragments))
+	for _, fragment := range file.Fragments {
+		// a fragment without samples has nothing to export or play
+		if len(fragment.Samples) == 0 {
+			continue
+		}
+		t := fragment.BaseTime
+		for _, s := range fragment.Samples {
+			if s.Keyframe {
+				segment.Keyframes = append(segment.Keyframes, ticks(t, file.Timescale).Seconds())
+			}
+			t += uint64(s.Duration)
+		}
+		fragments = append(fragments, fragmentIndex{
+			offset:   fragment.Offset,
+			baseTime: fragment.BaseTime,
+			duration: fragment.Duration(),
+			keyframe: fragment.Samples[0].Keyframe,
+		})
+	}
+	e.segment, e.track, e.timescale, e.fragments = segment, file.Track, file.Timescale, fragments
+}
+
+// List returns the recordings overlapping the range, by start time
+func (c *Catalog) List(from time.Time, to time.Time) ([]Segment, error) {
+	entries, err := c.refresh()
+	if err != nil {
+		return nil, err
+	}
+	segments := []Segment{}
+	for _, entry := range entries {
+		if entry.segment.End.After(from) && entry.segment.Start.Before(to) {
+			segments = append(segments, *entry.segment)
+		}
+	}
+	return segments, nil
+}
+
+// exportFragment is a fragment of a recording with its time
+type exportFragment struct {
+	entry    *catalogEntry
+	fragment *fragmentIndex
+	start    time.Time
+	end      time.Time
+}
+
+// maxTime bounds the ranges without end
+var maxTime = time.Unix(1<<40, 0)
+
+// fragments returns the fragments of the recordings overlapping the range, in time order
+func (c *Catalog) fragments(from time.Time, to time.Time) ([]exportFragment, error) {
+	entries, err := c.refresh()
+	if err != nil {
+		return nil, err
+	}
+	fragments := []exportFragment{}
+	for _, entry := range entries {
+		if !entry.segment.End.After(from) || !entry.segment.Start.Before(to) {
+			continue
+		}
+		for i := range entry.fragments {
+			fragment := &entry.fragments[i]
+			start := entry.segment.Start.Add(ticks(fragment.baseTime, entry.timescale))
+			end := start.Add(ticks(fragment.duration, entry.timescale))
+			fragments = append(fragments, exportFragment{entry: entry, fragment: fragment, start: start, end: end})
+		}
+	}
+	return fragments, nil
+}
+
+// firstKeyframe returns the index of the first keyframe fragment reaching from, the one holding from or the next
+// one, -1 when there is none
+func firstKeyframe(fragments []exportFragment, from time.Time) int {
+	for i, f := range fragments {
+		if f.fragment.keyframe && f.end.After(from) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Export writes the footage of the range to w as a single fragmented MP4, without re-encoding. It starts at the
+// keyframe at or before from, so the first frame decodes, and the recordings follow each other without their gaps.
+// It stops early where the stream parameters change.
+func (c *Catalog) Export(w io.Writer, from time.Time, to time.Time) error {
+	fragments, err := c.fragments(from, to)
+	if err != nil {
+		return err
+	}
+	first := firstKeyframe(fragments, from)
+	if first < 0 || !fragments[first].start.Before(to) {
+		return ErrNoFootage
+	}
+
+	track := fragments[first].entry.track
+	if _, err := w.Write(fmp4.InitSegment(track)); err != nil {
+		return err
+	}
+	files := map[*catalogEntry]*recordingFile{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	sequence, decodeTime := uint32(0), uint64(0)
+	for _, f := range fragments[first:] {
+		if !f.start.Before(to) {
+			break
+		}
+		if t := f.entry.track; !bytes.Equal(t.SPS, track.SPS) || !bytes.Equal(t.PPS, track.PPS) {
+			logger.Printf("Export stopped at %v, the stream parameters changed\n", f.entry.segment.Name)
+			break
+		}
+		file := files[f.entry]
+		if file == nil {
+			if file, err = openRecording(f.entry.path, c.keyring); err != nil {
+				return err
+			}
+			files[f.entry] = file
+		}
+		samples, err := readFragment(file, f, to)
+		if err != nil {
+			return err
+		}
+		sequence++
+		if _, err := w.Write(fmp4.Fragment(sequence, decodeTime, samples)); err != nil {
+			return err
+		}
+		for _, s := range samples {
+			decodeTime += uint64(s.Duration)
+		}
+	}
+	return nil
+}
+
+// readFragment returns the samples of a fragment before to, with durations in the export timescale
+func readFragment(file *recordingFile, f exportFragment, to time.Time) ([]fmp4.Sample, error) {
+	fragment, err := fmp4.ReadFragment(file, file.size, f.fragment.offset)
+	if err != nil {
+		return nil, err
+	}
+	infos := fragment.Samples
+	if len(infos) == 0 {
+		return nil, nil
+	}
+	timescale := f.entry.timescale
+	// the samples of a fragment follow each other in its mdat
+	last := infos[len(infos)-1]
+	data := make([]byte, last.Offset+int64(last.Size)-infos[0].Offset)
+	if _, err := file.ReadAt(data, infos[0].Offset); err != nil {
+		return nil, err
+	}
+	samples := []fmp4.Sample{}
+	t := uint64(0)
+	for _, info := range infos {
+		if !f.start.Add(ticks(t, timescale)).Before(to) {
+			break
+		}
+		offset := info.Offset - infos[0].Offset
+		duration := uint64(info.Duration) * fmp4.Timescale / uint64(timescale)
+		samples = append(samples, fmp4.Sample{
+			Data:     data[offset : offset+int64(info.Size)],
+			Duration: uint32(duration),
+			Keyframe: info.Keyframe,
+		})
+		t += uint64(info.Duration)
+	}
+	return samples, nil
+}
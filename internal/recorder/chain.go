@@ -0,0 +1,336 @@
+package recorder
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/encryption"
+)
+
+// ManifestName is the file of the hash chain of a directory, next to the recordings
+const ManifestName = "manifest.jsonl"
+
+// Link is a line of the manifest, it seals a complete recording. Each link holds the digest of the one before,
+// and is signed by the device key with its digest, so no link can be edited, removed or moved unnoticed.
+type Link struct {
+	Seq  uint64 `json:"seq"`
+	Name string `json:"name"`
+	// Size is that of the file as stored, Hash the SHA-256 in hex of its content after the encryption header when
+	// encrypted, which the key rotation rewrites
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+	// Prev is the digest of the link before in hex, empty for the first one
+	Prev string    `json:"prev"`
+	Time time.Time `json:"time"`
+	// Key is the public key of the device, Signature signs the digest, both in base64
+	Key       string `json:"key"`
+	Signature string `json:"signature"`
+}
+
+// digest returns the digest of the signed fields of the link
+func (l *Link) digest() []byte {
+	d := sha256.Sum256([]byte(fmt.Sprintf("%d\n%s\n%d\n%s\n%s\n%s\n%s",
+		l.Seq, l.Name, l.Size, l.Hash, l.Prev, l.Time.UTC().Format(time.RFC3339Nano), l.Key)))
+	return d[:]
+}
+
+// LoadSigningKey reads the Ed25519 device key of a file holding its base64 seed, a new key is written to a
+// missing file
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key.Seed())+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("recorder: %v is not a base64 Ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// PublicKeyString returns the base64 public key of a device key, as found in the manifests
+func PublicKeyString(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// Chain appends the recordings of a directory to its manifest as they are completed
+type Chain struct {
+	dir string
+	key ed25519.PrivateKey
+
+	mu   sync.Mutex
+	last *Link
+}
+
+// OpenChain returns the chain of dir, which goes on from the last link of its manifest. A last line cut short by a
+// power loss is dropped.
+func OpenChain(dir string, key ed25519.PrivateKey) (*Chain, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	links, size, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(filepath.Join(dir, ManifestName)); err == nil && info.Size() > size {
+		if err := os.Truncate(filepath.Join(dir, ManifestName), size); err != nil {
+			return nil, err
+		}
+	}
+	c := &Chain{dir: dir, key: key}
+	if len(links) > 0 {
+		c.last = &links[len(links)-1]
+	}
+	return c, nil
+}
+
+// Append seals a complete recording of the directory, with the size and the SHA-256 of its content
+func (c *Chain) Append(name string, size int64, sum []byte) (*Link, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	link := &Link{
+		Seq:  1,
+		Name: name,
+		Size: size,
+		Hash: hex.EncodeToString(sum),
+		Time: time.Now().UTC(),
+		Key:  PublicKeyString(c.key),
+	}
+	if c.last != nil {
+		link.Seq = c.last.Seq + 1
+		link.Prev = hex.EncodeToString(c.last.digest())
+	}
+	link.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(c.key, link.digest()))
+	data, err := json.Marshal(link)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(c.dir, ManifestName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.last = link
+	return link, nil
+}
+
+// ReadManifest returns the links of the manifest of dir, none without manifest
+func ReadManifest(dir string) ([]Link, error) {
+	links, _, err := readManifest(dir)
+	return links, err
+}
+
+// readManifest returns the links of the manifest and the size of its complete lines, the last line is ignored
+// when it's cut short
+func readManifest(dir string) ([]Link, int64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	links := []Link{}
+	size := int64(0)
+	for line := 1; len(data) > 0; line++ {
+		text, rest, complete := bytes.Cut(data, []byte("\n"))
+		if !complete {
+			break
+		}
+		link := Link{}
+		if err := json.Unmarshal(text, &link); err != nil {
+			return nil, 0, fmt.Errorf("recorder: line %d of the manifest: %v", line, err)
+		}
+		links = append(links, link)
+		size += int64(len(text)) + 1
+		data = rest
+	}
+	return links, size, nil
+}
+
+// hashWriter hashes and counts what's written to the file of a recording, the first skip bytes aren't hashed
+type hashWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+	skip int64
+}
+
+func newHashWriter(w io.Writer, skip int64) *hashWriter {
+	return &hashWriter{w: w, hash: sha256.New(), skip: skip}
+}
+
+func (h *hashWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	if skipped := max(0, min(int64(n), h.skip-h.size)); skipped < int64(n) {
+		h.hash.Write(p[skipped:n])
+	}
+	h.size += int64(n)
+	return n, err
+}
+
+// Verification statuses of the recordings
+const (
+	StatusOK = "ok"
+	// StatusPruned is a missing recording the retention could have removed: only locked ones are left before it
+	StatusPruned   = "pruned"
+	StatusMissing  = "missing"
+	StatusModified = "modified"
+	// StatusReordered is a link of a recording older than the one before
+	StatusReordered = "reordered"
+	// StatusBroken is a link that isn't chained to the one before, or whose signature is invalid
+	StatusBroken = "broken"
+	// StatusUnlisted is a recording without link: added afterwards, being written or interrupted by a power loss
+	StatusUnlisted = "unlisted"
+)
+
+// SegmentStatus is the verification of a recording
+type SegmentStatus struct {
+	Name   string `json:"name"`
+	Seq    uint64 `json:"seq,omitempty"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// VerifyReport is the verification of a directory against its manifest
+type VerifyReport struct {
+	// Key is the public key the links were checked with
+	Key      string          `json:"key"`
+	Links    int             `json:"links"`
+	Segments []SegmentStatus `json:"segments"`
+	// Problems counts the segments neither ok nor pruned, an unlisted one may have been added afterwards
+	Problems int `json:"problems"`
+}
+
+// Verify checks the recordings of dir against its manifest: the chain of the links, their signatures by key,
+// or by the key of the first link when nil, their order and the content of the recordings.
+func Verify(dir string, key ed25519.PublicKey) (*VerifyReport, error) {
+	links, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{Links: len(links), Segments: []SegmentStatus{}}
+	if key == nil && len(links) > 0 {
+		if decoded, err := base64.StdEncoding.DecodeString(links[0].Key); err == nil && len(decoded) == ed25519.PublicKeySize {
+			key = decoded
+		}
+	}
+	if key != nil {
+		report.Key = base64.StdEncoding.EncodeToString(key)
+	}
+
+	listed := map[string]bool{}
+	// onlyLocked tells whether every recording present so far is locked, so the retention removed the missing ones
+	onlyLocked := true
+	var previous *Link
+	var previousStart time.Time
+	for i := range links {
+		link := &links[i]
+		listed[link.Name] = true
+		status := SegmentStatus{Name: link.Name, Seq: link.Seq, Status: StatusOK}
+		start, nameErr := ParseFileName(link.Name)
+		signature, _ := base64.StdEncoding.DecodeString(link.Signature)
+		switch {
+		case link.Key != report.Key || key == nil || !ed25519.Verify(key, link.digest(), signature):
+			status.Status, status.Detail = StatusBroken, "invalid signature"
+		case previous == nil && (link.Seq != 1 || link.Prev != ""):
+			// the manifest is never pruned
+			status.Status, status.Detail = StatusBroken, "the links before are missing"
+		case previous != nil && (link.Seq != previous.Seq+1 || link.Prev != hex.EncodeToString(previous.digest())):
+			status.Status, status.Detail = StatusBroken, fmt.Sprintf("not chained to link %d", previous.Seq)
+		case nameErr != nil || filepath.Base(link.Name) != link.Name:
+			status.Status, status.Detail = StatusBroken, "invalid name"
+		case previous != nil && !start.After(previousStart):
+			status.Status, status.Detail = StatusReordered, "older than "+previous.Name
+		}
+		previous, previousStart = link, start
+		if status.Status == StatusOK {
+			status.Status, status.Detail = verifyFile(filepath.Join(dir, link.Name), link, onlyLocked)
+			if status.Status != StatusPruned && status.Status != StatusMissing {
+				onlyLocked = onlyLocked && IsLocked(filepath.Join(dir, link.Name))
+			}
+		}
+		report.Segments = append(report.Segments, status)
+	}
+
+	files, err := listRecordings(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].start.Before(files[j].start) })
+	for _, f := range files {
+		if name := filepath.Base(f.path); !listed[name] {
+			report.Segments = append(report.Segments, SegmentStatus{Name: name, Status: StatusUnlisted})
+		}
+	}
+	for _, s := range report.Segments {
+		if s.Status != StatusOK && s.Status != StatusPruned {
+			report.Problems++
+		}
+	}
+	return report, nil
+}
+
+// verifyFile compares a recording with its link
+func verifyFile(path string, link *Link, onlyLocked bool) (string, string) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if onlyLocked {
+			return StatusPruned, ""
+		}
+		return StatusMissing, ""
+	}
+	if err != nil {
+		return StatusMissing, err.Error()
+	}
+	defer f.Close()
+	skip := int64(0)
+	if encryption.IsEncrypted(f) {
+		skip = encryption.HeaderSize
+	}
+	h := newHashWriter(io.Discard, skip)
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return StatusMissing, err.Error()
+	}
+	if size != link.Size {
+		return StatusModified, fmt.Sprintf("%d bytes instead of %d", size, link.Size)
+	}
+	if hex.EncodeToString(h.hash.Sum(nil)) != link.Hash {
+		return StatusModified, "content changed"
+	}
+	return StatusOK, ""
+}
@@ -0,0 +1,183 @@
+package recorder
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/encryption"
+)
+
+// ClipConfig sets the clips written around the triggers
+type ClipConfig struct {
+	Dir string
+	// PreRoll is the shortest footage before a trigger, the clip starts at the keyframe before it
+	PreRoll time.Duration
+	// PostRoll is the footage after the last trigger of a clip
+	PostRoll time.Duration
+	// Keyring encrypts the clips with its current key, nil writes them in the clear
+	Keyring *encryption.Keyring
+	// Chain seals the complete clips in the manifest of Dir, nil disables it
+	Chain *Chain
+}
+
+// ClipRecorder keeps the last GOPs of the stream in memory and writes them, followed by the next frames,
+// to a clip when triggered. Triggers during a clip extend it.
+type ClipRecorder struct {
+	stream Stream
+	cfg    ClipConfig
+
+	// mu guards the triggers, the buffer and the clip belong to the run goroutine so the writes never block them
+	mu     sync.Mutex
+	frames <-chan *encoders.EncodedFrame
+	done   chan struct{}
+	// until is the end of the requested footage
+	until   time.Time
+	reasons []string
+
+	// buffer holds the GOPs of the pre-roll, each starts at a keyframe
+	buffer [][]*encoders.EncodedFrame
+	clip   *file
+}
+
+// NewClipRecorder returns a clip recorder writing to cfg.Dir, created if needed
+func NewClipRecorder(stream Stream, cfg ClipConfig) (*ClipRecorder, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &ClipRecorder{stream: stream, cfg: cfg}, nil
+}
+
+// Start buffers the stream in the background
+func (c *ClipRecorder) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frames != nil {
+		return
+	}
+	c.frames = c.stream.Subscribe()
+	c.done = make(chan struct{})
+	go c.run(c.frames, c.done)
+}
+
+// Close stops buffering and completes the current clip
+func (c *ClipRecorder) Close() {
+	c.mu.Lock()
+	frames, done := c.frames, c.done
+	c.frames = nil
+	c.mu.Unlock()
+	if frames == nil {
+		return
+	}
+	c.stream.Unsubscribe(frames)
+	<-done
+}
+
+// Trigger requests the footage from the pre-roll until the post-roll after now, and returns the end of the clip
+func (c *ClipRecorder) Trigger(reason string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if until := time.Now().Add(c.cfg.PostRoll); until.After(c.until) {
+		c.until = until
+	}
+	c.reasons = append(c.reasons, reason)
+	return c.until
+}
+
+func (c *ClipRecorder) run(frames <-chan *encoders.EncodedFrame, done chan struct{}) {
+	defer close(done)
+	for frame := range frames {
+		c.buffered(frame)
+		c.record(frame)
+	}
+	if c.clip != nil {
+		c.finishClip(c.triggered())
+	}
+}
+
+// triggered returns the end of the requested footage and the reasons of the triggers
+func (c *ClipRecorder) triggered() (time.Time, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.until, c.reasons
+}
+
+// handled clears the triggers up to until, along with their reasons. Those that came since are kept.
+func (c *ClipRecorder) handled(until time.Time, reasons []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.until.After(until) {
+		c.until = time.Time{}
+	}
+	c.reasons = c.reasons[min(len(reasons), len(c.reasons)):]
+}
+
+// buffered adds the frame to the pre-roll and drops the GOPs no longer needed
+func (c *ClipRecorder) buffered(frame *encoders.EncodedFrame) {
+	if frame.Keyframe {
+		c.buffer = append(c.buffer, []*encoders.EncodedFrame{frame})
+	} else if n := len(c.buffer); n > 0 {
+		c.buffer[n-1] = append(c.buffer[n-1], frame)
+	}
+	// the oldest GOP goes once the next one covers the pre-roll
+	for len(c.buffer) > 1 && frame.Time.Sub(c.buffer[1][0].Time) >= c.cfg.PreRoll {
+		c.buffer = c.buffer[1:]
+	}
+}
+
+// record writes the frame to the clip, opening a clip with the pre-roll when triggered
+func (c *ClipRecorder) record(frame *encoders.EncodedFrame) {
+	until, reasons := c.triggered()
+	if c.clip == nil {
+		if !frame.Time.Before(until) {
+			// the reasons of a trigger that came without frames are outdated
+			c.handled(until, reasons)
+			return
+		}
+		if len(c.buffer) == 0 {
+			return
+		}
+		var err error
+		if c.clip, err = create(c.cfg.Dir, c.buffer[0][0], c.cfg.Keyring, c.cfg.Chain); err != nil {
+			logger.Printf("Failed to create a clip: %v\n", err)
+			c.handled(until, reasons)
+			return
+		}
+		logger.Printf("Clip %v triggered by %v\n", c.clip.path, reasons)
+		// the current frame is the last of the buffer
+		for _, gop := range c.buffer {
+			for _, f := range gop {
+				if !c.add(f, until, reasons) {
+					return
+				}
+			}
+		}
+		return
+	}
+	if frame.Time.After(until) {
+		c.finishClip(until, reasons)
+		return
+	}
+	c.add(frame, until, reasons)
+}
+
+func (c *ClipRecorder) add(frame *encoders.EncodedFrame, until time.Time, reasons []string) bool {
+	if err := c.clip.add(frame); err != nil {
+		logger.Printf("Failed to write %v: %v\n", c.clip.path, err)
+		c.finishClip(until, reasons)
+		return false
+	}
+	return true
+}
+
+// finishClip completes the clip of the triggers up to until
+func (c *ClipRecorder) finishClip(until time.Time, reasons []string) {
+	if err := c.clip.finish(); err != nil {
+		logger.Printf("Failed to complete %v: %v\n", c.clip.path, err)
+	} else {
+		logger.Printf("Clip %v complete, triggered by %v\n", c.clip.path, reasons)
+	}
+	c.clip = nil
+	c.handled(until, reasons)
+}
@@ -0,0 +1,298 @@
+package recorder
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/fmp4"
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+)
+
+// MaxPlaybackRate bounds the playback rate, both ways
+const MaxPlaybackRate = 16.0
+
+// maxPlaybackLag is how late a sample may be sent before the pace starts over, rather than catching up in a burst
+const maxPlaybackLag = time.Second
+
+// PlaybackSample is an access unit of recorded footage, keyframes carry their parameter sets
+type PlaybackSample struct {
+	// Data is the access unit in Annex-B
+	Data []byte
+	// Time is the capture time of the footage
+	Time time.Time
+	// Duration is the time the sample is shown at the playback rate
+	Duration time.Duration
+	Keyframe bool
+}
+
+// PlayerState is the state of a playback
+type PlayerState struct {
+	// Position is the capture time of the last sample sent, or where the next one is looked for
+	Position time.Time `json:"position"`
+	Paused   bool      `json:"paused"`
+	Rate     float64   `json:"rate"`
+	Ended    bool      `json:"ended"`
+}
+
+// Player sends the footage of a catalog from a time at real-time pace, times the rate. It starts and seeks at the
+// keyframe at or before the requested time, skips the gaps between the recordings and follows the recordings still
+// being written. It ends with the footage, or with the first error of write.
+type Player struct {
+	catalog *Catalog
+	write   func(PlaybackSample) error
+
+	mu      sync.Mutex
+	started bool
+	state   PlayerState
+	// seek is set when the position changed, the next sample is looked for from there
+	seek bool
+	err  error
+
+	// wake interrupts the wait for the next sample on a change
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewPlayer returns a player of the catalog from a time, writing the samples to write
+func NewPlayer(catalog *Catalog, from time.Time, write func(PlaybackSample) error) *Player {
+	return &Player{
+		catalog: catalog,
+		write:   write,
+		state:   PlayerState{Position: from, Rate: 1},
+		seek:    true,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start starts the playback in the background
+func (p *Player) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.started {
+		p.started = true
+		go p.run()
+	}
+}
+
+// Close stops the playback and waits for it
+func (p *Player) Close() {
+	p.once.Do(func() { close(p.stop) })
+	p.mu.Lock()
+	started := p.started
+	p.mu.Unlock()
+	if started {
+		<-p.done
+	}
+}
+
+// Done is closed once the playback ended or was closed
+func (p *Player) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns the error that ended the playback, nil at the end of the footage
+func (p *Player) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// State returns the state of the playback
+func (p *Player) State() PlayerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// Pause holds the playback on the last sample sent
+func (p *Player) Pause() {
+	p.update(func() { p.state.Paused = true })
+}
+
+// Resume goes on from the last sample sent
+func (p *Player) Resume() {
+	p.update(func() { p.state.Paused = false })
+}
+
+// Seek goes on from the keyframe at or before t
+func (p *Player) Seek(t time.Time) {
+	p.update(func() { p.state.Position, p.seek = t, true })
+}
+
+// SetRate changes the pace, 2 plays twice as fast
+func (p *Player) SetRate(rate float64) error {
+	if rate < 1/MaxPlaybackRate || rate > MaxPlaybackRate {
+		return fmt.Errorf("Rate must be between %v and %v", 1/MaxPlaybackRate, MaxPlaybackRate)
+	}
+	p.update(func() { p.state.Rate = rate })
+	return nil
+}
+
+func (p *Player) update(fn func()) {
+	p.mu.Lock()
+	fn()
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sleep waits for d, or for a change when d is 0, it returns false once the player is closed
+func (p *Player) sleep(d time.Duration) bool {
+	var timer <-chan time.Time
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timer = t.C
+	}
+	select {
+	case <-timer:
+	case <-p.wake:
+	case <-p.stop:
+		return false
+	}
+	return true
+}
+
+func (p *Player) run() {
+	var (
+		// queue holds the fragments to play after the current one
+		queue []exportFragment
+		// samples are the samples of the current fragment left to send, from the capture time next
+		current exportFragment
+		samples []PlaybackSample
+		next    time.Time
+		// last is the start of the last fragment queued, zero to look for a keyframe
+		last time.Time
+		// due is when the next sample is sent, zero to send it now
+		due  time.Time
+		file *recordingFile
+		err  error
+	)
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+		p.mu.Lock()
+		p.state.Ended, p.err = true, err
+		p.mu.Unlock()
+		close(p.done)
+	}()
+	for {
+		p.mu.Lock()
+		state, seek := p.state, p.seek
+		p.seek = false
+		p.mu.Unlock()
+		if seek {
+			queue, samples, last, due = nil, nil, time.Time{}, time.Time{}
+		}
+		if state.Paused {
+			due = time.Time{}
+			if !p.sleep(0) {
+				return
+			}
+			continue
+		}
+
+		if len(samples) == 0 {
+			if len(queue) == 0 {
+				if queue, err = p.queue(state.Position, last); err != nil || len(queue) == 0 {
+					return
+				}
+				last = queue[len(queue)-1].start
+			}
+			current, queue = queue[0], queue[1:]
+			if file == nil || file.f.Name() != current.entry.path {
+				if file != nil {
+					file.Close()
+				}
+				if file, err = openRecording(current.entry.path, p.catalog.keyring); err != nil {
+					return
+				}
+			}
+			if samples, err = readPlaybackSamples(file, current); err != nil {
+				return
+			}
+			next = current.start
+			continue
+		}
+
+		now := time.Now()
+		if due.IsZero() || now.Sub(due) > maxPlaybackLag {
+			due = now
+		}
+		if wait := due.Sub(now); wait > 0 {
+			if !p.sleep(wait) {
+				return
+			}
+			continue
+		}
+		sample := samples[0]
+		samples = samples[1:]
+		sample.Time = next
+		next = next.Add(sample.Duration)
+		sample.Duration = time.Duration(float64(sample.Duration) / state.Rate)
+		if err = p.write(sample); err != nil {
+			return
+		}
+		due = due.Add(sample.Duration)
+		p.mu.Lock()
+		if !p.seek {
+			p.state.Position = sample.Time
+		}
+		p.mu.Unlock()
+	}
+}
+
+// queue returns the fragments to play from position, from the keyframe at or before it when last is zero, or
+// else the fragments starting after last
+func (p *Player) queue(position time.Time, last time.Time) ([]exportFragment, error) {
+	fragments, err := p.catalog.fragments(position, maxTime)
+	if err != nil {
+		return nil, err
+	}
+	if last.IsZero() {
+		if first := firstKeyframe(fragments, position); first >= 0 {
+			return fragments[first:], nil
+		}
+		return nil, nil
+	}
+	for i, f := range fragments {
+		if f.start.After(last) {
+			return fragments[i:], nil
+		}
+	}
+	return nil, nil
+}
+
+// readPlaybackSamples returns the samples of a fragment in Annex-B, with the parameter sets before the keyframes
+func readPlaybackSamples(file *recordingFile, f exportFragment) ([]PlaybackSample, error) {
+	samples, err := readFragment(file, f, maxTime)
+	if err != nil {
+		return nil, err
+	}
+	track := f.entry.track
+	if track.SPS == nil || track.PPS == nil {
+		return nil, errors.New("no parameter sets")
+	}
+	played := make([]PlaybackSample, 0, len(samples))
+	for _, s := range samples {
+		nalus := h264.SplitAVCC(s.Data)
+		if s.Keyframe {
+			nalus = append([][]byte{track.SPS, track.PPS}, nalus...)
+		}
+		played = append(played, PlaybackSample{
+			Data:     h264.AnnexB(nalus),
+			Duration: ticks(uint64(s.Duration), fmp4.Timescale),
+			Keyframe: s.Keyframe,
+		})
+	}
+	return played, nil
+}
@@ -0,0 +1,271 @@
+// Package recorder writes the encoded H.264 stream to fragmented MP4 files, one fragment per GOP, so a file
+// is playable up to its last complete GOP even after a crash. Files rotate at a keyframe by duration or size
+// and are named by the capture time of their first frame.
+package recorder
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/encryption"
+	"github.com/acentior/camera-pipeline-sender/pkg/fmp4"
+)
+
+var logger *log.Logger
+
+func init() {
+	logger = log.New(log.Writer(), "[recorder]", log.LstdFlags)
+}
+
+// TimeLayout names the files by their start time in UTC, without colons for FAT formatted cards
+const TimeLayout = "2006-01-02T15-04-05.000Z"
+
+// Ext is the extension of the recordings
+const Ext = ".mp4"
+
+// FileName returns the name of a recording starting at t
+func FileName(t time.Time) string {
+	return t.UTC().Format(TimeLayout) + Ext
+}
+
+// ParseFileName returns the start time of a recording from its name
+func ParseFileName(name string) (time.Time, error) {
+	base, found := strings.CutSuffix(filepath.Base(name), Ext)
+	if !found {
+		return time.Time{}, fmt.Errorf("recorder: %q is not a recording", name)
+	}
+	return time.Parse(TimeLayout, base)
+}
+
+// Stream is the recorded stream, every subscription starts at a keyframe
+type Stream interface {
+	Subscribe() <-chan *encoders.EncodedFrame
+	Unsubscribe(frames <-chan *encoders.EncodedFrame)
+}
+
+// Config sets where the files go and when they rotate
+type Config struct {
+	Dir string
+	// SegmentDuration is the shortest file, the next file starts at the first keyframe after it
+	SegmentDuration time.Duration
+	// MaxFileSize rotates a file at the first keyframe after it's reached, 0 disables it
+	MaxFileSize int64
+	// Keyring encrypts the files with its current key, nil writes them in the clear
+	Keyring *encryption.Keyring
+	// Chain seals the complete files in the manifest of Dir, nil disables it
+	Chain *Chain
+}
+
+// Recorder records the stream until it's closed
+type Recorder struct {
+	stream Stream
+	cfg    Config
+
+	mu     sync.Mutex
+	frames <-chan *encoders.EncodedFrame
+	done   chan struct{}
+}
+
+// New returns a recorder writing to cfg.Dir, created if needed
+func New(stream Stream, cfg Config) (*Recorder, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Recorder{stream: stream, cfg: cfg}, nil
+}
+
+// Start starts recording in the background
+func (r *Recorder) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.frames != nil {
+		return
+	}
+	r.frames = r.stream.Subscribe()
+	r.done = make(chan struct{})
+	go r.run(r.frames, r.done)
+}
+
+// Close stops recording, once the current file is complete
+func (r *Recorder) Close() {
+	r.mu.Lock()
+	frames, done := r.frames, r.done
+	r.frames = nil
+	r.mu.Unlock()
+	if frames == nil {
+		return
+	}
+	r.stream.Unsubscribe(frames)
+	<-done
+}
+
+// file is the recording being written. Each frame is held back until the next one, which gives its duration,
+// and a GOP is written as a fragment at the next keyframe.
+type file struct {
+	path string
+	f    *os.File
+	// w writes to f, through enc when encrypted and digest when sealed
+	w         io.Writer
+	enc       *encryption.Writer
+	digest    *hashWriter
+	chain     *Chain
+	firstTime time.Time
+	size      int64
+	sequence  uint32
+	// decodeTime is the decode time of the next fragment
+	decodeTime uint64
+	pending    *encoders.EncodedFrame
+	gop        []fmp4.Sample
+}
+
+// create starts a file in dir with the keyframe, encrypted when the keyring isn't nil and sealed in the chain
+// once finished when it isn't nil
+func create(dir string, keyframe *encoders.EncodedFrame, keyring *encryption.Keyring, chain *Chain) (*file, error) {
+	track, err := fmp4.NewTrack(keyframe.Data)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, FileName(keyframe.Time))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	out := &file{path: path, f: f, w: f, chain: chain, firstTime: keyframe.Time}
+	if chain != nil {
+		// the header is left out of the digest, the key rotation rewrites it
+		skip := int64(0)
+		if keyring != nil {
+			skip = encryption.HeaderSize
+		}
+		out.digest = newHashWriter(f, skip)
+		out.w = out.digest
+	}
+	if keyring != nil {
+		if out.enc, err = encryption.NewWriter(out.w, keyring); err != nil {
+			f.Close()
+			return nil, err
+		}
+		out.w = out.enc
+	}
+	if err := out.write(fmp4.InitSegment(track)); err != nil {
+		out.f.Close()
+		return nil, err
+	}
+	return out, nil
+}
+
+func (f *file) write(data []byte) error {
+	n, err := f.w.Write(data)
+	f.size += int64(n)
+	return err
+}
+
+// add appends a frame to the file
+func (f *file) add(frame *encoders.EncodedFrame) error {
+	err := f.flush(frame)
+	f.pending = frame
+	return err
+}
+
+// flush completes the held back frame with the time of next, and writes the GOP when next is a keyframe,
+// or nil at the end of the file
+func (f *file) flush(next *encoders.EncodedFrame) error {
+	if p := f.pending; p != nil {
+		duration := int64(p.Duration * fmp4.Timescale / time.Second)
+		if next != nil {
+			// out of order capture times keep the nominal duration, so the timeline keeps increasing
+			if d := f.decodeTimeOf(next) - f.decodeTimeOf(p); d > 0 {
+				duration = d
+			}
+		}
+		f.gop = append(f.gop, fmp4.NewSample(p.Data, uint32(duration), p.Keyframe))
+		f.pending = nil
+	}
+	if len(f.gop) == 0 || next != nil && !next.Keyframe {
+		return nil
+	}
+	f.sequence++
+	err := f.write(fmp4.Fragment(f.sequence, f.decodeTime, f.gop))
+	for _, s := range f.gop {
+		f.decodeTime += uint64(s.Duration)
+	}
+	f.gop = nil
+	return err
+}
+
+// decodeTimeOf returns the decode time of a frame in the file, from the capture times
+func (f *file) decodeTimeOf(frame *encoders.EncodedFrame) int64 {
+	return int64(frame.Time.Sub(f.firstTime) * fmp4.Timescale / time.Second)
+}
+
+// finish writes the frames left, the last one lasting its nominal duration, closes the file and seals it
+func (f *file) finish() error {
+	err := f.flush(nil)
+	if f.enc != nil {
+		if encErr := f.enc.Close(); err == nil {
+			err = encErr
+		}
+	}
+	if syncErr := f.f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := f.f.Close(); err == nil {
+		err = closeErr
+	}
+	// a file that failed is left out of the chain
+	if err == nil && f.chain != nil {
+		_, err = f.chain.Append(filepath.Base(f.path), f.digest.size, f.digest.hash.Sum(nil))
+	}
+	return err
+}
+
+// run records the frames until the subscription closes
+func (r *Recorder) run(frames <-chan *encoders.EncodedFrame, done chan struct{}) {
+	defer close(done)
+	var out *file
+	finish := func() {
+		if err := out.finish(); err != nil {
+			logger.Printf("Failed to complete %v: %v\n", out.path, err)
+		}
+		out = nil
+	}
+	defer func() {
+		if out != nil {
+			finish()
+		}
+	}()
+
+	for frame := range frames {
+		if out != nil && frame.Keyframe {
+			err := out.flush(frame)
+			if err != nil {
+				logger.Printf("Failed to write %v: %v\n", out.path, err)
+			}
+			if err != nil || frame.Time.Sub(out.firstTime) >= r.cfg.SegmentDuration || r.cfg.MaxFileSize > 0 && out.size >= r.cfg.MaxFileSize {
+				finish()
+			}
+		}
+		if out == nil {
+			if !frame.Keyframe {
+				continue
+			}
+			var err error
+			if out, err = create(r.cfg.Dir, frame, r.cfg.Keyring, r.cfg.Chain); err != nil {
+				logger.Printf("Failed to create a recording: %v\n", err)
+				continue
+			}
+			logger.Printf("Recording to %v\n", out.path)
+		}
+		if err := out.add(frame); err != nil {
+			logger.Printf("Failed to write %v: %v\n", out.path, err)
+			finish()
+		}
+	}
+}
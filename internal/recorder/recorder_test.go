@@ -0,0 +1,533 @@
+package recorder
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/encryption"
+	"github.com/acentior/camera-pipeline-sender/pkg/fmp4"
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+	"github.com/stretchr/testify/suite"
+)
+
+// parameter sets of x264 at 320x240
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0xd, 0xa6, 0x81, 0x41, 0xfa, 0x10, 0x0, 0x0, 0x3, 0x0, 0x10, 0x0, 0x0, 0x3, 0x3, 0xc8, 0xf1, 0x42, 0xaa}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// fakeStream sends a keyframe every 10 frames, one frame every 10ms
+type fakeStream struct {
+	mu          sync.Mutex
+	subscribers map[<-chan *encoders.EncodedFrame]chan struct{}
+}
+
+func (f *fakeStream) Subscribe() <-chan *encoders.EncodedFrame {
+	frames := make(chan *encoders.EncodedFrame)
+	stop := make(chan struct{})
+	f.mu.Lock()
+	f.subscribers[frames] = stop
+	f.mu.Unlock()
+	go func() {
+		defer close(frames)
+		for seq := uint64(0); ; seq++ {
+			frame := &encoders.EncodedFrame{
+				Data:     h264.AnnexB([][]byte{{0x41, 0x9a, byte(seq)}}),
+				Time:     time.Now(),
+				Duration: 10 * time.Millisecond,
+				Seq:      seq,
+			}
+			if seq%10 == 0 {
+				frame.Data = h264.AnnexB([][]byte{testSPS, testPPS, {0x65, 0x88, byte(seq)}})
+				frame.Keyframe = true
+			}
+			select {
+			case frames <- frame:
+			case <-stop:
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	return frames
+}
+
+func (f *fakeStream) Unsubscribe(frames <-chan *encoders.EncodedFrame) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if stop, found := f.subscribers[frames]; found {
+		close(stop)
+		delete(f.subscribers, frames)
+	}
+}
+
+type RecorderSuit struct {
+	suite.Suite
+	stream *fakeStream
+	dir    string
+}
+
+func TestRecorderSuite(t *testing.T) {
+	suite.Run(t, new(RecorderSuit))
+}
+
+func (s *RecorderSuit) SetupTest() {
+	s.stream = &fakeStream{subscribers: map[<-chan *encoders.EncodedFrame]chan struct{}{}}
+	s.dir = s.T().TempDir()
+}
+
+// boxes returns the types of the top level boxes of a file, the sizes must add up
+func (s *RecorderSuit) boxes(path string) []string {
+	data, err := os.ReadFile(path)
+	s.Require().NoError(err)
+	types := []string{}
+	for len(data) > 0 {
+		s.Require().GreaterOrEqual(len(data), 8)
+		size := int(binary.BigEndian.Uint32(data))
+		s.Require().GreaterOrEqual(size, 8)
+		s.Require().LessOrEqual(size, len(data))
+		types = append(types, string(data[4:8]))
+		data = data[size:]
+	}
+	return types
+}
+
+func (s *RecorderSuit) record(cfg Config, d time.Duration) []string {
+	cfg.Dir = filepath.Join(s.dir, "recordings")
+	recorder, err := New(s.stream, cfg)
+	s.Require().NoError(err)
+	recorder.Start()
+	time.Sleep(d)
+	recorder.Close()
+	files, err := filepath.Glob(filepath.Join(cfg.Dir, "*"+Ext))
+	s.Require().NoError(err)
+	return files
+}
+
+func (s *RecorderSuit) Test_RotateByDuration() {
+	files := s.record(Config{SegmentDuration: 200 * time.Millisecond}, 700*time.Millisecond)
+	s.Require().GreaterOrEqual(len(files), 3)
+	var last time.Time
+	for _, file := range files {
+		start, err := ParseFileName(file)
+		s.Require().NoError(err)
+		s.True(start.After(last))
+		last = start
+		// the last file is complete too
+		types := s.boxes(file)
+		s.Equal([]string{"ftyp", "moov", "moof", "mdat"}, types[:4])
+		s.Equal("mdat", types[len(types)-1])
+	}
+}
+
+func (s *RecorderSuit) Test_RotateBySize() {
+	// every GOP exceeds the limit
+	files := s.record(Config{SegmentDuration: time.Hour, MaxFileSize: 100}, 350*time.Millisecond)
+	s.Require().GreaterOrEqual(len(files), 3)
+	for _, file := range files[:len(files)-1] {
+		s.Equal([]string{"ftyp", "moov", "moof", "mdat"}, s.boxes(file))
+	}
+}
+
+func (s *RecorderSuit) Test_FileName() {
+	start := time.Date(2024, 3, 1, 12, 30, 15, 250e6, time.FixedZone("CET", 3600))
+	s.Equal("2024-03-01T11-30-15.250Z.mp4", FileName(start))
+	parsed, err := ParseFileName("/recordings/" + FileName(start))
+	s.Require().NoError(err)
+	s.True(parsed.Equal(start))
+	_, err = ParseFileName("notes.txt")
+	s.Error(err)
+}
+
+func (s *RecorderSuit) Test_Clips() {
+	dir := filepath.Join(s.dir, "clips")
+	clips, err := NewClipRecorder(s.stream, ClipConfig{Dir: dir, PreRoll: 150 * time.Millisecond, PostRoll: 100 * time.Millisecond})
+	s.Require().NoError(err)
+	clips.Start()
+	defer clips.Close()
+	time.Sleep(400 * time.Millisecond)
+
+	// overlapping triggers make a single clip
+	triggered := time.Now()
+	clips.Trigger("api")
+	time.Sleep(50 * time.Millisecond)
+	until := clips.Trigger("motion")
+	s.True(until.After(triggered.Add(140 * time.Millisecond)))
+	time.Sleep(300 * time.Millisecond)
+	// a later trigger starts another clip
+	clips.Trigger("api")
+	time.Sleep(200 * time.Millisecond)
+	clips.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+Ext))
+	s.Require().NoError(err)
+	s.Require().Len(files, 2)
+	start, err := ParseFileName(files[0])
+	s.Require().NoError(err)
+	// the pre-roll starts at a keyframe
+	s.True(start.Before(triggered.Add(-150 * time.Millisecond)))
+	s.True(start.After(triggered.Add(-300 * time.Millisecond)))
+	// GOPs of 100ms, at least 150ms before and 150ms after the first trigger
+	moofs := 0
+	for _, box := range s.boxes(files[0]) {
+		if box == "moof" {
+			moofs++
+		}
+	}
+	s.GreaterOrEqual(moofs, 4)
+	s.Less(moofs, 7)
+}
+
+func (s *RecorderSuit) Test_ClipTriggeredDuringWrite() {
+	clips, err := NewClipRecorder(s.stream, ClipConfig{Dir: filepath.Join(s.dir, "clips"), PostRoll: time.Second})
+	s.Require().NoError(err)
+	clips.Trigger("api")
+	until, reasons := clips.triggered()
+	// a trigger while the clip is written isn't lost when it completes
+	later := clips.Trigger("motion")
+	s.True(later.After(until))
+	clips.handled(until, reasons)
+	until, reasons = clips.triggered()
+	s.Equal(later, until)
+	s.Equal([]string{"motion"}, reasons)
+}
+
+// writeRecording creates a recording of size bytes whose footage ended at end
+func (s *RecorderSuit) writeRecording(dir string, end time.Time, size int) string {
+	s.Require().NoError(os.MkdirAll(dir, 0o755))
+	path := filepath.Join(dir, FileName(end.Add(-time.Minute)))
+	s.Require().NoError(os.WriteFile(path, make([]byte, size), 0o644))
+	s.Require().NoError(os.Chtimes(path, end, end))
+	return path
+}
+
+func (s *RecorderSuit) Test_Retention() {
+	now := time.Now()
+	dir := filepath.Join(s.dir, "recordings")
+	evidence := s.writeRecording(dir, now.Add(-5*time.Hour), 100)
+	old := s.writeRecording(dir, now.Add(-4*time.Hour), 100)
+	middle := s.writeRecording(dir, now.Add(-30*time.Minute), 100)
+	recent := s.writeRecording(dir, now.Add(-20*time.Minute), 100)
+	current := s.writeRecording(dir, now, 100)
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o644))
+	s.Require().NoError(Lock(evidence))
+
+	retention := NewRetention([]string{dir, filepath.Join(s.dir, "missing")}, RetentionPolicy{MaxAge: time.Hour, MaxBytes: 300})
+	report := retention.Enforce()
+	s.Empty(report.Errors)
+	s.Equal([]RemovedFile{
+		{Path: old, Size: 100, Start: report.Removed[0].Start, Reason: ReasonMaxAge},
+		{Path: middle, Size: 100, Start: report.Removed[1].Start, Reason: ReasonMaxBytes},
+	}, report.Removed)
+	// the locked and the newest recordings stay, even over the limit
+	s.Equal(3, report.Files)
+	s.Equal(int64(300), report.Bytes)
+	s.Equal(1, report.Locked)
+	s.Same(report, retention.LastReport())
+	for _, path := range []string{evidence, recent, current} {
+		s.FileExists(path)
+	}
+
+	s.Require().NoError(Unlock(evidence))
+	s.Equal(ReasonMaxAge, retention.Enforce().Removed[0].Reason)
+	s.NoFileExists(evidence)
+}
+
+func (s *RecorderSuit) Test_RetentionFreeSpace() {
+	now := time.Now()
+	dir := filepath.Join(s.dir, "clips")
+	paths := []string{}
+	for i := 4; i >= 0; i-- {
+		paths = append(paths, s.writeRecording(dir, now.Add(-time.Duration(i)*time.Minute), 100))
+	}
+	retention := NewRetention([]string{dir}, RetentionPolicy{MinFreeBytes: 500})
+	// a 800 bytes file system
+	retention.freeSpace = func(string) (int64, error) {
+		files, err := filepath.Glob(filepath.Join(dir, "*"+Ext))
+		return 800 - int64(len(files))*100, err
+	}
+	report := retention.Enforce()
+	s.Require().Len(report.Removed, 2)
+	s.Equal(paths[0], report.Removed[0].Path)
+	s.Equal(ReasonMinFreeSpace, report.Removed[1].Reason)
+	s.Equal(3, report.Files)
+}
+
+func (s *RecorderSuit) Test_Catalog() {
+	files := s.record(Config{SegmentDuration: 200 * time.Millisecond}, 700*time.Millisecond)
+	s.Require().GreaterOrEqual(len(files), 3)
+	catalog := NewCatalog(filepath.Join(s.dir, "recordings"), nil)
+	all, err := catalog.List(time.Time{}, time.Now().Add(time.Hour))
+	s.Require().NoError(err)
+	s.Require().Len(all, len(files))
+	for _, segment := range all {
+		s.True(segment.End.After(segment.Start))
+		// a keyframe every 10 frames of 10ms
+		s.Require().NotEmpty(segment.Keyframes)
+		s.Equal(0.0, segment.Keyframes[0])
+	}
+	middle, err := catalog.List(all[1].Start.Add(time.Millisecond), all[1].End.Add(-time.Millisecond))
+	s.Require().NoError(err)
+	s.Require().Len(middle, 1)
+	s.Equal(all[1].Name, middle[0].Name)
+
+	// from the middle of the first file to the start of the third one
+	from, to := all[0].Start.Add(150*time.Millisecond), all[2].Start.Add(50*time.Millisecond)
+	out := &bytes.Buffer{}
+	s.Require().NoError(catalog.Export(out, from, to))
+	exported, err := fmp4.Parse(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	s.Require().NoError(err)
+	s.Require().NotEmpty(exported.Fragments)
+	s.True(exported.Fragments[0].Samples[0].Keyframe)
+	s.Equal(uint64(0), exported.Fragments[0].BaseTime)
+	for i := 1; i < len(exported.Fragments); i++ {
+		previous := exported.Fragments[i-1]
+		s.Equal(previous.BaseTime+previous.Duration(), exported.Fragments[i].BaseTime)
+	}
+	// it starts at most a GOP before from and ends at to
+	duration := time.Duration(exported.Duration()) * time.Second / fmp4.Timescale
+	s.GreaterOrEqual(duration, to.Sub(from)-50*time.Millisecond)
+	s.LessOrEqual(duration, to.Sub(from)+150*time.Millisecond)
+
+	s.ErrorIs(catalog.Export(&bytes.Buffer{}, time.Now().Add(time.Hour), time.Now().Add(2*time.Hour)), ErrNoFootage)
+}
+
+func (s *RecorderSuit) Test_CatalogEmptyFragment() {
+	track, err := fmp4.NewTrack(h264.AnnexB([][]byte{testSPS, testPPS, {0x65, 0x88}}))
+	s.Require().NoError(err)
+	second := uint32(fmp4.Timescale)
+	keyframe := fmp4.Sample{Data: h264.AVCC([][]byte{{0x65, 0x88}}), Duration: second, Keyframe: true}
+	data := fmp4.InitSegment(track)
+	data = append(data, fmp4.Fragment(1, 0, []fmp4.Sample{keyframe})...)
+	data = append(data, fmp4.Fragment(2, uint64(second), nil)...)
+	data = append(data, fmp4.Fragment(3, uint64(second), []fmp4.Sample{keyframe})...)
+	data = append(data, fmp4.Fragment(4, 2*uint64(second), nil)...)
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	s.Require().NoError(os.WriteFile(filepath.Join(s.dir, FileName(start)), data, 0o644))
+
+	catalog := NewCatalog(s.dir, nil)
+	out := &bytes.Buffer{}
+	s.Require().NoError(catalog.Export(out, start, start.Add(time.Hour)))
+	exported, err := fmp4.Parse(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	s.Require().NoError(err)
+	s.Require().Len(exported.Fragments, 2)
+	s.Equal(2*uint64(fmp4.Timescale), exported.Duration())
+}
+
+func (s *RecorderSuit) Test_Player() {
+	files := s.record(Config{SegmentDuration: 200 * time.Millisecond}, 500*time.Millisecond)
+	s.Require().GreaterOrEqual(len(files), 2)
+	catalog := NewCatalog(filepath.Join(s.dir, "recordings"), nil)
+	all, err := catalog.List(time.Time{}, maxTime)
+	s.Require().NoError(err)
+	footage := all[len(all)-1].End.Sub(all[0].Start)
+
+	samples := make(chan PlaybackSample, 1000)
+	player := NewPlayer(catalog, all[0].Start.Add(50*time.Millisecond), func(sample PlaybackSample) error {
+		samples <- sample
+		return nil
+	})
+	s.Require().NoError(player.SetRate(4))
+	s.Error(player.SetRate(100))
+	start := time.Now()
+	player.Start()
+	<-player.Done()
+	elapsed := time.Since(start)
+	s.NoError(player.Err())
+	s.True(player.State().Ended)
+	close(samples)
+
+	// from the keyframe before the start, with its parameter sets
+	first := <-samples
+	s.True(first.Keyframe)
+	s.Equal(all[0].Start, first.Time)
+	s.Equal([][]byte{testSPS, testPPS}, h264.SplitAnnexB(first.Data)[:2])
+	s.Equal(10*time.Millisecond/4, first.Duration.Round(time.Millisecond/2))
+	last := first
+	for sample := range samples {
+		s.True(sample.Time.After(last.Time))
+		last = sample
+	}
+	s.Less(elapsed, footage/2)
+}
+
+func (s *RecorderSuit) Test_PlayerControls() {
+	s.record(Config{SegmentDuration: time.Hour}, 400*time.Millisecond)
+	catalog := NewCatalog(filepath.Join(s.dir, "recordings"), nil)
+	all, err := catalog.List(time.Time{}, maxTime)
+	s.Require().NoError(err)
+	s.Require().Len(all, 1)
+
+	samples := make(chan PlaybackSample, 1000)
+	player := NewPlayer(catalog, all[0].Start, func(sample PlaybackSample) error {
+		samples <- sample
+		return nil
+	})
+	player.Start()
+	defer player.Close()
+	<-samples
+	player.Pause()
+	time.Sleep(30 * time.Millisecond)
+	for len(samples) > 0 {
+		<-samples
+	}
+	time.Sleep(50 * time.Millisecond)
+	s.Empty(samples)
+	s.True(player.State().Paused)
+
+	// a seek starts again from the keyframe before
+	keyframe := 0.0
+	for _, t := range all[0].Keyframes {
+		if t <= 0.25 {
+			keyframe = t
+		}
+	}
+	s.Greater(keyframe, 0.0)
+	player.Seek(all[0].Start.Add(250 * time.Millisecond))
+	player.Resume()
+	sample := <-samples
+	s.True(sample.Keyframe)
+	s.WithinDuration(all[0].Start.Add(time.Duration(keyframe*float64(time.Second))), sample.Time, time.Millisecond)
+}
+
+func (s *RecorderSuit) Test_Encrypted() {
+	keyring := encryption.NewKeyring()
+	key, err := encryption.GenerateKey()
+	s.Require().NoError(err)
+	s.Require().NoError(keyring.Add("k1", key))
+	files := s.record(Config{SegmentDuration: 200 * time.Millisecond, Keyring: keyring}, 500*time.Millisecond)
+	s.Require().GreaterOrEqual(len(files), 2)
+	for _, path := range files {
+		f, err := os.Open(path)
+		s.Require().NoError(err)
+		s.True(encryption.IsEncrypted(f))
+		f.Close()
+	}
+
+	// the catalog reads them with the keyring only
+	dir := filepath.Join(s.dir, "recordings")
+	all, err := NewCatalog(dir, nil).List(time.Time{}, maxTime)
+	s.Require().NoError(err)
+	s.Empty(all)
+	catalog := NewCatalog(dir, keyring)
+	all, err = catalog.List(time.Time{}, maxTime)
+	s.Require().NoError(err)
+	s.Require().Len(all, len(files))
+	out := &bytes.Buffer{}
+	s.Require().NoError(catalog.Export(out, all[0].Start, all[len(all)-1].End))
+	exported, err := fmp4.Parse(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	s.Require().NoError(err)
+	s.True(exported.Fragments[0].Samples[0].Keyframe)
+}
+
+func (s *RecorderSuit) Test_HashChain() {
+	keyPath := filepath.Join(s.dir, "device.key")
+	key, err := LoadSigningKey(keyPath)
+	s.Require().NoError(err)
+	loaded, err := LoadSigningKey(keyPath)
+	s.Require().NoError(err)
+	s.True(key.Equal(loaded))
+
+	dir := filepath.Join(s.dir, "recordings")
+	keyring := encryption.NewKeyring()
+	dataKey, err := encryption.GenerateKey()
+	s.Require().NoError(err)
+	s.Require().NoError(keyring.Add("k1", dataKey))
+	chain, err := OpenChain(dir, key)
+	s.Require().NoError(err)
+	s.record(Config{SegmentDuration: 200 * time.Millisecond, Keyring: keyring, Chain: chain}, 500*time.Millisecond)
+	// a restart goes on with the chain
+	chain, err = OpenChain(dir, key)
+	s.Require().NoError(err)
+	files := s.record(Config{SegmentDuration: 200 * time.Millisecond, Chain: chain}, 500*time.Millisecond)
+	s.Require().GreaterOrEqual(len(files), 4)
+
+	pub := key.Public().(ed25519.PublicKey)
+	report, err := Verify(dir, pub)
+	s.Require().NoError(err)
+	s.Equal(len(files), report.Links)
+	s.Zero(report.Problems)
+	for i, segment := range report.Segments {
+		s.Equal(StatusOK, segment.Status, segment.Name)
+		s.Equal(uint64(i+1), segment.Seq)
+	}
+	_, other, err := ed25519.GenerateKey(nil)
+	s.Require().NoError(err)
+	report, err = Verify(dir, other.Public().(ed25519.PublicKey))
+	s.Require().NoError(err)
+	s.Equal(len(files), report.Problems)
+
+	// the key rotation rewrites the headers, not the sealed content
+	newKey, err := encryption.GenerateKey()
+	s.Require().NoError(err)
+	s.Require().NoError(keyring.Add("k2", newKey))
+	rewrapped := 0
+	for _, path := range files {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		s.Require().NoError(err)
+		if encryption.IsEncrypted(f) {
+			id, err := encryption.Rewrap(f, keyring)
+			s.Require().NoError(err)
+			s.Equal("k1", id)
+			rewrapped++
+		}
+		s.Require().NoError(f.Close())
+	}
+	s.NotZero(rewrapped)
+	report, err = Verify(dir, pub)
+	s.Require().NoError(err)
+	s.Zero(report.Problems)
+
+	// the oldest file pruned, one missing in the middle, one modified and one added
+	s.Require().NoError(os.Remove(files[0]))
+	s.Require().NoError(os.Remove(files[2]))
+	data, err := os.ReadFile(files[1])
+	s.Require().NoError(err)
+	data[len(data)/2] ^= 1
+	s.Require().NoError(os.WriteFile(files[1], data, 0o644))
+	s.writeRecording(dir, time.Now().Add(time.Hour), 100)
+	report, err = Verify(dir, nil)
+	s.Require().NoError(err)
+	s.Equal(base64.StdEncoding.EncodeToString(pub), report.Key)
+	statuses := []string{}
+	for _, segment := range report.Segments {
+		statuses = append(statuses, segment.Status)
+	}
+	s.Equal(StatusPruned, statuses[0])
+	s.Equal(StatusModified, statuses[1])
+	s.Equal(StatusMissing, statuses[2])
+	s.Equal(StatusOK, statuses[3])
+	s.Equal(StatusUnlisted, statuses[len(statuses)-1])
+	s.Equal(3, report.Problems)
+
+	// links swapped in the manifest
+	manifest := filepath.Join(dir, ManifestName)
+	data, err = os.ReadFile(manifest)
+	s.Require().NoError(err)
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	lines[2], lines[3] = lines[3], lines[2]
+	s.Require().NoError(os.WriteFile(manifest, bytes.Join(lines, nil), 0o644))
+	report, err = Verify(dir, pub)
+	s.Require().NoError(err)
+	s.Equal(StatusBroken, report.Segments[2].Status)
+	s.Equal(StatusBroken, report.Segments[3].Status)
+
+	// a line torn by a power loss is dropped when the chain opens
+	s.Require().NoError(os.WriteFile(manifest, append(data, `{"seq":`...), 0o644))
+	chain, err = OpenChain(dir, key)
+	s.Require().NoError(err)
+	link, err := chain.Append(FileName(time.Now().Add(2*time.Hour)), 0, nil)
+	s.Require().NoError(err)
+	s.Equal(uint64(len(files)+1), link.Seq)
+	links, err := ReadManifest(dir)
+	s.Require().NoError(err)
+	s.Len(links, len(files)+1)
+}
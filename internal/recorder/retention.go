@@ -0,0 +1,260 @@
+package recorder
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LockExt marks a recording as locked, e.g. kept as evidence, when a file of the same name plus LockExt exists
+const LockExt = ".lock"
+
+// Lock protects a recording from the retention
+func Lock(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	return os.WriteFile(path+LockExt, nil, 0o644)
+}
+
+// Unlock lets the retention remove a recording again
+func Unlock(path string) error {
+	err := os.Remove(path + LockExt)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// IsLocked tells whether a recording is protected from the retention
+func IsLocked(path string) bool {
+	_, err := os.Stat(path + LockExt)
+	return err == nil
+}
+
+// RetentionPolicy limits the recordings, a 0 limit is disabled
+type RetentionPolicy struct {
+	// MaxAge removes the recordings whose footage ended before
+	MaxAge time.Duration
+	// MaxBytes removes the oldest recordings while they take more
+	MaxBytes int64
+	// MinFreeBytes removes the oldest recordings while the file system has less free space
+	MinFreeBytes int64
+}
+
+// RemovedFile is a recording removed by the retention
+type RemovedFile struct {
+	Path   string    `json:"path"`
+	Size   int64     `json:"size"`
+	Start  time.Time `json:"start"`
+	Reason string    `json:"reason"`
+}
+
+// Removal reasons
+const (
+	ReasonMaxAge       = "max-age"
+	ReasonMaxBytes     = "max-bytes"
+	ReasonMinFreeSpace = "min-free-space"
+)
+
+// RetentionReport tells what a pass of the retention removed and what's left
+type RetentionReport struct {
+	Time    time.Time     `json:"time"`
+	Removed []RemovedFile `json:"removed"`
+	Files   int           `json:"files"`
+	Bytes   int64         `json:"bytes"`
+	Locked  int           `json:"locked"`
+	Errors  []string      `json:"errors,omitempty"`
+}
+
+// Retention enforces a policy on the recordings of directories, oldest first. The locked recordings
+// and the newest recording of every directory, which may be being written, are never removed.
+type Retention struct {
+	dirs   []string
+	policy RetentionPolicy
+	// freeSpace returns the free bytes of the file system of a directory
+	freeSpace func(dir string) (int64, error)
+
+	mu     sync.Mutex
+	last   *RetentionReport
+	stop   chan struct{}
+	passMu sync.Mutex
+}
+
+// NewRetention returns the retention of the recordings of dirs
+func NewRetention(dirs []string, policy RetentionPolicy) *Retention {
+	return &Retention{dirs: dirs, policy: policy, freeSpace: diskFree}
+}
+
+func diskFree(dir string) (int64, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// Dirs returns the directories of the recordings
+func (r *Retention) Dirs() []string {
+	return r.dirs
+}
+
+// Start enforces the policy every interval in the background
+func (r *Retention) Start(interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			r.Enforce()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}(r.stop)
+}
+
+// Close stops the background passes
+func (r *Retention) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+// LastReport returns the report of the last pass, nil before the first one
+func (r *Retention) LastReport() *RetentionReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// recording is a recording file found by the retention
+type recording struct {
+	path    string
+	dir     string
+	start   time.Time
+	size    int64
+	modTime time.Time
+	locked  bool
+	newest  bool
+}
+
+// Enforce removes the recordings the policy doesn't keep
+func (r *Retention) Enforce() *RetentionReport {
+	r.passMu.Lock()
+	defer r.passMu.Unlock()
+	report := &RetentionReport{Time: time.Now(), Removed: []RemovedFile{}}
+	files := []*recording{}
+	for _, dir := range r.dirs {
+		found, err := listRecordings(dir)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		files = append(files, found...)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].start.Before(files[j].start) })
+	for _, f := range files {
+		report.Bytes += f.size
+	}
+
+	kept := []*recording{}
+	for _, f := range files {
+		reason := ""
+		if !f.locked && !f.newest {
+			reason = r.removalReason(f, report.Time, report.Bytes)
+		}
+		if reason == "" {
+			kept = append(kept, f)
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			kept = append(kept, f)
+			continue
+		}
+		logger.Printf("Removed %v (%v)\n", f.path, reason)
+		report.Bytes -= f.size
+		report.Removed = append(report.Removed, RemovedFile{Path: f.path, Size: f.size, Start: f.start, Reason: reason})
+	}
+	report.Files = len(kept)
+	for _, f := range kept {
+		if f.locked {
+			report.Locked++
+		}
+	}
+	if r.policy.MinFreeBytes > 0 {
+		for _, dir := range r.dirs {
+			if free, err := r.freeSpace(dir); err == nil && free < r.policy.MinFreeBytes {
+				logger.Printf("Only %d bytes free for %v, the rest is locked or being written\n", free, dir)
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.last = report
+	r.mu.Unlock()
+	return report
+}
+
+// removalReason tells why a recording goes, empty when it stays
+func (r *Retention) removalReason(f *recording, now time.Time, total int64) string {
+	if r.policy.MaxAge > 0 && now.Sub(f.modTime) > r.policy.MaxAge {
+		return ReasonMaxAge
+	}
+	if r.policy.MaxBytes > 0 && total > r.policy.MaxBytes {
+		return ReasonMaxBytes
+	}
+	if r.policy.MinFreeBytes > 0 {
+		if free, err := r.freeSpace(f.dir); err == nil && free < r.policy.MinFreeBytes {
+			return ReasonMinFreeSpace
+		}
+	}
+	return ""
+}
+
+// listRecordings returns the recordings of a directory, a missing directory has none
+func listRecordings(dir string) ([]*recording, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := []*recording{}
+	var newest *recording
+	for _, entry := range entries {
+		start, err := ParseFileName(entry.Name())
+		if err != nil || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		f := &recording{path: path, dir: dir, start: start, size: info.Size(), modTime: info.ModTime(), locked: IsLocked(path)}
+		if newest == nil || start.After(newest.start) {
+			newest = f
+		}
+		files = append(files, f)
+	}
+	if newest != nil {
+		newest.newest = true
+	}
+	return files, nil
+}
@@ -0,0 +1,225 @@
+// Package rtpout sends the encoded H.264 stream as plain RTP over UDP (RFC 6184), optionally SRTP,
+// for receivers without WebRTC such as ffmpeg or GStreamer, described by a generated .sdp file
+package rtpout
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/srtp/v2"
+	"golang.org/x/net/ipv4"
+)
+
+var logger *log.Logger
+
+func init() {
+	logger = log.New(log.Writer(), "[rtpout]", log.LstdFlags)
+}
+
+// PayloadType is the dynamic RTP payload type of the H.264 stream
+const PayloadType = 96
+
+const (
+	clockRate = 90000
+	// mtu leaves room for the SRTP tag and IP options on the usual 1500 bytes links
+	mtu = 1200
+	// srtpKeyLen is the master key and salt of AES_CM_128_HMAC_SHA1_80, base64 encoded like in SDP
+	srtpKeyLen = 30
+)
+
+// Config describes the RTP destination
+type Config struct {
+	// Addr is the unicast or multicast host:port the packets go to
+	Addr string
+	// TTL is the time to live of multicast packets
+	TTL int
+	// SDPFile is written with the description of the stream once its parameter sets are known
+	SDPFile string
+	// SRTPKey is the base64 master key and salt of AES_CM_128_HMAC_SHA1_80, empty sends plain RTP
+	SRTPKey string
+}
+
+// Packetizer turns encoded frames into RTP packets stamped with their capture times
+type Packetizer struct {
+	packetizer rtp.Packetizer
+	// timestamps are the capture times on the RTP clock, from BaseTimestamp
+	BaseTimestamp uint32
+	firstTime     time.Time
+}
+
+// NewPacketizer returns a packetizer numbering the packets from firstSeq
+func NewPacketizer(ssrc uint32, firstSeq uint16) *Packetizer {
+	return &Packetizer{
+		packetizer:    rtp.NewPacketizer(mtu, PayloadType, ssrc, &codecs.H264Payloader{}, rtp.NewFixedSequencer(firstSeq), clockRate),
+		BaseTimestamp: rand.Uint32(),
+	}
+}
+
+// Packetize returns the packets of a frame, the marker bit ends the frame
+func (p *Packetizer) Packetize(frame *encoders.EncodedFrame) []*rtp.Packet {
+	if p.firstTime.IsZero() {
+		p.firstTime = frame.Time
+	}
+	timestamp := p.BaseTimestamp + rtpTicks(frame.Time.Sub(p.firstTime))
+	packets := p.packetizer.Packetize(frame.Data, 0)
+	for _, packet := range packets {
+		packet.Timestamp = timestamp
+	}
+	return packets
+}
+
+// rtpTicks converts a duration to the RTP clock, wrapping around like the timestamps. It computes in integers,
+// a float out of the uint32 range doesn't wrap.
+func rtpTicks(d time.Duration) uint32 {
+	return uint32(int64(d/time.Second)*clockRate + int64(d%time.Second)*clockRate/int64(time.Second))
+}
+
+// Sender packetizes encoded frames and sends them to the destination
+type Sender struct {
+	cfg        Config
+	conn       *net.UDPConn
+	packetizer *Packetizer
+	srtp       *srtp.Context
+	sdpWritten bool
+}
+
+// NewSender opens the UDP socket of the destination
+func NewSender(cfg Config) (*Sender, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Sender{
+		cfg:        cfg,
+		packetizer: NewPacketizer(rand.Uint32(), uint16(rand.Uint32())),
+	}
+	if cfg.SRTPKey != "" {
+		key, err := base64.StdEncoding.DecodeString(cfg.SRTPKey)
+		if err != nil || len(key) != srtpKeyLen {
+			return nil, fmt.Errorf("SRTP key must be %d bytes in base64", srtpKeyLen)
+		}
+		s.srtp, err = srtp.CreateContext(key[:16], key[16:], srtp.ProtectionProfileAes128CmHmacSha1_80)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.conn, err = net.DialUDP("udp", nil, addr); err != nil {
+		return nil, err
+	}
+	if addr.IP.IsMulticast() && addr.IP.To4() != nil {
+		if err := ipv4.NewPacketConn(s.conn).SetMulticastTTL(cfg.TTL); err != nil {
+			logger.Printf("Failed to set the multicast TTL: %v\n", err)
+		}
+	}
+	return s, nil
+}
+
+// Run sends the frames until the channel closes
+func (s *Sender) Run(frames <-chan *encoders.EncodedFrame) {
+	for frame := range frames {
+		if err := s.WriteFrame(frame); err != nil {
+			logger.Printf("Failed to send frame %v: %v\n", frame.Seq, err)
+		}
+	}
+}
+
+// WriteFrame sends the packets of a frame, all stamped with its capture time
+func (s *Sender) WriteFrame(frame *encoders.EncodedFrame) error {
+	if !s.sdpWritten && frame.Keyframe {
+		if err := s.writeSDP(frame.Data); err != nil {
+			logger.Printf("Failed to write %v: %v\n", s.cfg.SDPFile, err)
+		}
+		s.sdpWritten = true
+	}
+	for _, packet := range s.packetizer.Packetize(frame) {
+		raw, err := packet.Marshal()
+		if err != nil {
+			return err
+		}
+		if s.srtp != nil {
+			if raw, err = s.srtp.EncryptRTP(nil, raw, nil); err != nil {
+				return err
+			}
+		}
+		if _, err := s.conn.Write(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Addr returns the destination of the packets
+func (s *Sender) Addr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close closes the socket
+func (s *Sender) Close() error {
+	return s.conn.Close()
+}
+
+// SDP returns the description of the stream, sps and pps make the decoder start on any packet
+func (s *Sender) SDP(sps []byte, pps []byte) string {
+	local := s.conn.LocalAddr().(*net.UDPAddr)
+	remote := s.conn.RemoteAddr().(*net.UDPAddr)
+	family := "IP4"
+	if remote.IP.To4() == nil {
+		family = "IP6"
+	}
+	connection := remote.IP.String()
+	if remote.IP.IsMulticast() && family == "IP4" {
+		connection = fmt.Sprintf("%v/%d", connection, s.cfg.TTL)
+	}
+	proto := "RTP/AVP"
+	if s.srtp != nil {
+		proto = "RTP/SAVP"
+	}
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=- %d 1 IN %v %v", time.Now().Unix(), family, local.IP),
+		"s=camera-pipeline-sender",
+		fmt.Sprintf("c=IN %v %v", family, connection),
+		"t=0 0",
+		fmt.Sprintf("m=video %d %v %d", remote.Port, proto, PayloadType),
+	}
+	lines = append(lines, MediaAttributes(sps, pps)...)
+	if s.srtp != nil {
+		lines = append(lines, "a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:"+s.cfg.SRTPKey)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// MediaAttributes returns the rtpmap and fmtp SDP attributes of the stream
+func MediaAttributes(sps []byte, pps []byte) []string {
+	fmtp := []string{"packetization-mode=1"}
+	if len(sps) >= 4 {
+		fmtp = append(fmtp, "profile-level-id="+hex.EncodeToString(sps[1:4]))
+	}
+	if sps != nil && pps != nil {
+		fmtp = append(fmtp, "sprop-parameter-sets="+base64.StdEncoding.EncodeToString(sps)+","+base64.StdEncoding.EncodeToString(pps))
+	}
+	return []string{
+		fmt.Sprintf("a=rtpmap:%d H264/%d", PayloadType, clockRate),
+		fmt.Sprintf("a=fmtp:%d %v", PayloadType, strings.Join(fmtp, ";")),
+	}
+}
+
+func (s *Sender) writeSDP(keyframe []byte) error {
+	if s.cfg.SDPFile == "" {
+		return nil
+	}
+	sps, pps := h264.ParameterSets(keyframe)
+	// the SDP holds the SRTP key, only the owner reads it
+	return os.WriteFile(s.cfg.SDPFile, []byte(s.SDP(sps, pps)), 0o600)
+}
@@ -0,0 +1,160 @@
+package rtpout
+
+import (
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+	"github.com/stretchr/testify/suite"
+)
+
+type RTPOutSuit struct {
+	suite.Suite
+	receiver *net.UDPConn
+	sdpFile  string
+}
+
+func TestRTPOutSuite(t *testing.T) {
+	suite.Run(t, new(RTPOutSuit))
+}
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+func (s *RTPOutSuit) SetupTest() {
+	var err error
+	s.receiver, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	s.Require().NoError(err)
+	s.sdpFile = filepath.Join(s.T().TempDir(), "stream.sdp")
+}
+
+func (s *RTPOutSuit) TearDownTest() {
+	s.receiver.Close()
+}
+
+// frames returns a keyframe with a slice bigger than the MTU, then a small frame 40ms later
+func (s *RTPOutSuit) frames() []*encoders.EncodedFrame {
+	idr := make([]byte, 3000)
+	idr[0] = 0x65
+	for i := 1; i < len(idr); i++ {
+		idr[i] = byte(i)
+	}
+	start := time.Now()
+	return []*encoders.EncodedFrame{
+		{Data: h264.AnnexB([][]byte{testSPS, testPPS, idr}), Time: start, Keyframe: true, Seq: 1},
+		{Data: h264.AnnexB([][]byte{{0x41, 0x9a, 0x02}}), Time: start.Add(40 * time.Millisecond), Seq: 2},
+	}
+}
+
+// read returns the packets received until none comes for a while
+func (s *RTPOutSuit) read() [][]byte {
+	packets := [][]byte{}
+	buf := make([]byte, 1500)
+	for {
+		s.receiver.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := s.receiver.Read(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, append([]byte(nil), buf[:n]...))
+	}
+}
+
+func (s *RTPOutSuit) Test_PlainRTP() {
+	sender, err := NewSender(Config{Addr: s.receiver.LocalAddr().String(), TTL: 1, SDPFile: s.sdpFile})
+	s.Require().NoError(err)
+	defer sender.Close()
+	for _, frame := range s.frames() {
+		s.Require().NoError(sender.WriteFrame(frame))
+	}
+
+	packets := s.read()
+	// STAP-A with the parameter sets, 3 FU-A fragments of the IDR slice, the small slice
+	s.Require().Len(packets, 5)
+	timestamps := []uint32{}
+	markers := 0
+	for _, raw := range packets {
+		packet := rtp.Packet{}
+		s.Require().NoError(packet.Unmarshal(raw))
+		s.Equal(uint8(PayloadType), packet.PayloadType)
+		s.LessOrEqual(len(raw), mtu+12)
+		timestamps = append(timestamps, packet.Timestamp)
+		if packet.Marker {
+			markers++
+		}
+	}
+	s.Equal(2, markers)
+	s.Equal(timestamps[0], timestamps[3])
+	// 40ms on the 90kHz clock
+	s.Equal(uint32(3600), timestamps[4]-timestamps[0])
+
+	sdp, err := os.ReadFile(s.sdpFile)
+	s.Require().NoError(err)
+	s.Contains(string(sdp), "m=video "+portOf(s.receiver)+" RTP/AVP 96")
+	s.Contains(string(sdp), "c=IN IP4 127.0.0.1")
+	s.Contains(string(sdp), "profile-level-id=42c01f")
+	s.Contains(string(sdp), "sprop-parameter-sets="+base64.StdEncoding.EncodeToString(testSPS)+","+base64.StdEncoding.EncodeToString(testPPS))
+}
+
+func (s *RTPOutSuit) Test_SRTP() {
+	key := make([]byte, srtpKeyLen)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	encoded := base64.StdEncoding.EncodeToString(key)
+	sender, err := NewSender(Config{Addr: s.receiver.LocalAddr().String(), SDPFile: s.sdpFile, SRTPKey: encoded})
+	s.Require().NoError(err)
+	defer sender.Close()
+	s.Require().NoError(sender.WriteFrame(s.frames()[0]))
+
+	decrypt, err := srtp.CreateContext(key[:16], key[16:], srtp.ProtectionProfileAes128CmHmacSha1_80)
+	s.Require().NoError(err)
+	packets := s.read()
+	s.Require().NotEmpty(packets)
+	plain, err := decrypt.DecryptRTP(nil, packets[0], nil)
+	s.Require().NoError(err)
+	packet := rtp.Packet{}
+	s.Require().NoError(packet.Unmarshal(plain))
+	// STAP-A
+	s.Equal(byte(24), packet.Payload[0]&0x1f)
+
+	sdp, err := os.ReadFile(s.sdpFile)
+	s.Require().NoError(err)
+	s.Contains(string(sdp), "RTP/SAVP 96")
+	s.Contains(string(sdp), "a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:"+encoded)
+
+	_, err = NewSender(Config{Addr: s.receiver.LocalAddr().String(), SRTPKey: "c2hvcnQ="})
+	s.Error(err)
+}
+
+func portOf(conn *net.UDPConn) string {
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	return port
+}
+
+func (s *RTPOutSuit) Test_LongRunningTimestamps() {
+	p := NewPacketizer(1, 1)
+	p.BaseTimestamp = 1000
+	start := time.Now()
+	frame := func(elapsed time.Duration) uint32 {
+		packets := p.Packetize(&encoders.EncodedFrame{Data: h264.AnnexB([][]byte{{0x41, 0x9a, 0x02}}), Time: start.Add(elapsed)})
+		s.Require().NotEmpty(packets)
+		return packets[0].Timestamp
+	}
+	s.Equal(uint32(1000), frame(0))
+	// past 2^32 ticks, about 13.25 hours, the timestamps wrap around instead of freezing
+	for _, elapsed := range []time.Duration{14 * time.Hour, 14*time.Hour + 40*time.Millisecond, 100 * time.Hour} {
+		ticks := uint64(elapsed/time.Second)*clockRate + uint64(elapsed%time.Second)*clockRate/uint64(time.Second)
+		s.Equal(uint32(1000+ticks%(1<<32)), frame(elapsed), elapsed)
+	}
+	s.Equal(uint32(3600), frame(14*time.Hour+40*time.Millisecond)-frame(14*time.Hour))
+}
@@ -0,0 +1,78 @@
+package rtsp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// realm is the protection space of the digest authentication
+const realm = "camera-pipeline-sender"
+
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// digestResponse computes the response of RFC 2617 digest authentication without qop,
+// the variant RTSP clients implement
+func digestResponse(username string, password string, nonce string, method string, uri string) string {
+	ha1 := md5Hex(username + ":" + realm + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+	return md5Hex(ha1 + ":" + nonce + ":" + ha2)
+}
+
+// digestChallenge is the WWW-Authenticate header of a nonce
+func digestChallenge(nonce string) string {
+	return fmt.Sprintf(`Digest realm="%v", nonce="%v"`, realm, nonce)
+}
+
+// parseDigest returns the parameters of a Digest Authorization header, nil for another scheme
+func parseDigest(header string) map[string]string {
+	rest, found := strings.CutPrefix(header, "Digest ")
+	if !found {
+		return nil
+	}
+	params := map[string]string{}
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key = strings.TrimSpace(key)
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(value)
+		}
+	}
+	return params
+}
+
+// checkDigest tells if an Authorization header answers the nonce with the credentials
+func checkDigest(header string, method string, username string, password string, nonce string) bool {
+	params := parseDigest(header)
+	if params == nil || params["username"] != username || params["realm"] != realm || params["nonce"] != nonce {
+		return false
+	}
+	expected := digestResponse(username, password, nonce, method, params["uri"])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(params["response"])) == 1
+}
@@ -0,0 +1,104 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxBodySize bounds the body of a request, clients only send small parameter bodies
+const maxBodySize = 64 << 10
+
+const (
+	statusOK                   = 200
+	statusBadRequest           = 400
+	statusUnauthorized         = 401
+	statusMethodNotAllowed     = 405
+	statusSessionNotFound      = 454
+	statusMethodNotValid       = 455
+	statusUnsupportedTransport = 461
+	statusInternalError        = 500
+	statusServiceUnavailable   = 503
+)
+
+var statusText = map[int]string{
+	statusOK:                   "OK",
+	statusBadRequest:           "Bad Request",
+	statusUnauthorized:         "Unauthorized",
+	statusMethodNotAllowed:     "Method Not Allowed",
+	statusSessionNotFound:      "Session Not Found",
+	statusMethodNotValid:       "Method Not Valid in This State",
+	statusUnsupportedTransport: "Unsupported Transport",
+	statusInternalError:        "Internal Server Error",
+	statusServiceUnavailable:   "Service Unavailable",
+}
+
+type request struct {
+	method string
+	url    string
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// response headers keep the order and the case they are written with, some clients care
+type response struct {
+	status int
+	header [][2]string
+	body   []byte
+}
+
+func newResponse(status int) *response {
+	return &response{status: status}
+}
+
+func (r *response) set(key string, value string) *response {
+	r.header = append(r.header, [2]string{key, value})
+	return r
+}
+
+func readRequest(r *bufio.Reader) (*request, error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("Invalid request line %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	req := &request{method: parts[0], url: parts[1], header: header}
+	if length := header.Get("Content-Length"); length != "" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 || n > maxBodySize {
+			return nil, fmt.Errorf("Invalid Content-Length %q", length)
+		}
+		req.body = make([]byte, n)
+		if _, err := io.ReadFull(r, req.body); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func (r *response) write(w io.Writer, cseq string) error {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "RTSP/1.0 %d %v\r\n", r.status, statusText[r.status])
+	fmt.Fprintf(&b, "CSeq: %v\r\n", cseq)
+	for _, h := range r.header {
+		fmt.Fprintf(&b, "%v: %v\r\n", h[0], h[1])
+	}
+	if len(r.body) > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(r.body))
+	}
+	b.WriteString("\r\n")
+	b.Write(r.body)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,319 @@
+// Package rtsp serves the encoded H.264 stream to RTSP clients such as NVRs and VMS products:
+// DESCRIBE, SETUP, PLAY and TEARDOWN, RTP over UDP or interleaved in the RTSP connection, digest authentication
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/internal/rtpout"
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+)
+
+var logger *log.Logger
+
+func init() {
+	logger = log.New(log.Writer(), "[rtsp]", log.LstdFlags)
+}
+
+const (
+	// sessionTimeout closes the UDP sessions of clients sending neither requests nor RTCP
+	sessionTimeout = 60 * time.Second
+	// describeTimeout bounds the wait for the parameter sets of the first DESCRIBE
+	describeTimeout = 5 * time.Second
+	// trackControl is the control URL of the only track, relative to the stream URL
+	trackControl = "trackID=0"
+)
+
+// Stream is the encoded stream served to the clients, every subscription starts at a keyframe
+type Stream interface {
+	Subscribe() <-chan *encoders.EncodedFrame
+	Unsubscribe(frames <-chan *encoders.EncodedFrame)
+}
+
+// Server serves a single stream on every path
+type Server struct {
+	stream   Stream
+	username string
+	password string
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	sps      []byte
+	pps      []byte
+	listener net.Listener
+}
+
+// NewServer returns a server of the stream, an empty username disables the authentication
+func NewServer(stream Stream, username string, password string) *Server {
+	return &Server{
+		stream:   stream,
+		username: username,
+		password: password,
+		sessions: map[string]*session{},
+	}
+}
+
+// ListenAndServe accepts RTSP connections on addr, e.g. ":8554"
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts RTSP connections on the listener until it's closed
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		c := &conn{server: s, netConn: netConn, reader: bufio.NewReader(netConn), nonce: newNonce()}
+		go c.serve()
+	}
+}
+
+// Close stops accepting connections and closes the sessions
+func (s *Server) Close() error {
+	s.mu.Lock()
+	listener := s.listener
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.Unlock()
+	for _, session := range sessions {
+		session.close()
+	}
+	if listener == nil {
+		return nil
+	}
+	return listener.Close()
+}
+
+func (s *Server) session(id string) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[id]
+}
+
+func (s *Server) addSession(session *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.id] = session
+}
+
+func (s *Server) removeSession(session *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[session.id] == session {
+		delete(s.sessions, session.id)
+	}
+}
+
+func (s *Server) setParameterSets(sps []byte, pps []byte) {
+	if sps == nil || pps == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sps, s.pps = sps, pps
+}
+
+// parameterSets returns the SPS and PPS of the stream, waiting for a keyframe the first time
+func (s *Server) parameterSets() ([]byte, []byte) {
+	s.mu.Lock()
+	sps, pps := s.sps, s.pps
+	s.mu.Unlock()
+	if sps != nil {
+		return sps, pps
+	}
+	frames := s.stream.Subscribe()
+	defer s.stream.Unsubscribe(frames)
+	timeout := time.After(describeTimeout)
+	for {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				return nil, nil
+			}
+			if sps, pps := h264.ParameterSets(frame.Data); sps != nil && pps != nil {
+				s.setParameterSets(sps, pps)
+				return sps, pps
+			}
+		case <-timeout:
+			return nil, nil
+		}
+	}
+}
+
+// sdp describes the stream, the parameter sets let the clients decode from any keyframe
+func (s *Server) sdp(host string) string {
+	sps, pps := s.parameterSets()
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=- %d 1 IN IP4 %v", time.Now().Unix(), host),
+		"s=camera-pipeline-sender",
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		"a=range:npt=now-",
+		fmt.Sprintf("m=video 0 RTP/AVP %d", rtpout.PayloadType),
+	}
+	lines = append(lines, rtpout.MediaAttributes(sps, pps)...)
+	lines = append(lines, "a=control:"+trackControl)
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// conn is a RTSP connection, its sessions end with it
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	reader  *bufio.Reader
+	// nonce is the digest challenge of the connection
+	nonce    string
+	writeMu  sync.Mutex
+	sessions []*session
+}
+
+func (c *conn) serve() {
+	defer func() {
+		for _, session := range c.sessions {
+			session.close()
+		}
+		c.netConn.Close()
+	}()
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return
+		}
+		if b[0] == '$' {
+			// interleaved RTCP of the client
+			if err := c.skipInterleaved(); err != nil {
+				return
+			}
+			continue
+		}
+		req, err := readRequest(c.reader)
+		if err != nil {
+			if err != io.EOF {
+				logger.Printf("Closing %v: %v\n", c.netConn.RemoteAddr(), err)
+			}
+			return
+		}
+		resp := c.handle(req)
+		c.writeMu.Lock()
+		err = resp.write(c.netConn, req.header.Get("CSeq"))
+		c.writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) skipInterleaved() error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	size := int(header[2])<<8 | int(header[3])
+	if _, err := c.reader.Discard(size); err != nil {
+		return err
+	}
+	for _, session := range c.sessions {
+		session.touch()
+	}
+	return nil
+}
+
+// writeInterleaved writes a RTP packet on a channel of the connection
+func (c *conn) writeInterleaved(channel byte, packet []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	frame := append([]byte{'$', channel, byte(len(packet) >> 8), byte(len(packet))}, packet...)
+	_, err := c.netConn.Write(frame)
+	return err
+}
+
+func (c *conn) handle(req *request) *response {
+	if c.server.username != "" && req.method != "OPTIONS" &&
+		!checkDigest(req.header.Get("Authorization"), req.method, c.server.username, c.server.password, c.nonce) {
+		return newResponse(statusUnauthorized).set("WWW-Authenticate", digestChallenge(c.nonce))
+	}
+	var session *session
+	if id, _, _ := strings.Cut(req.header.Get("Session"), ";"); id != "" {
+		if session = c.server.session(id); session == nil {
+			return newResponse(statusSessionNotFound)
+		}
+		session.touch()
+	}
+
+	switch req.method {
+	case "OPTIONS":
+		return newResponse(statusOK).set("Public", "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER")
+	case "DESCRIBE":
+		host, _, _ := net.SplitHostPort(c.netConn.LocalAddr().String())
+		resp := newResponse(statusOK).
+			set("Content-Base", strings.TrimSuffix(req.url, "/")+"/").
+			set("Content-Type", "application/sdp")
+		resp.body = []byte(c.server.sdp(host))
+		return resp
+	case "SETUP":
+		if session != nil {
+			// a single track, nothing more to set up
+			return newResponse(statusMethodNotValid)
+		}
+		t, err := parseTransport(req.header.Get("Transport"))
+		if err != nil {
+			return newResponse(statusUnsupportedTransport)
+		}
+		session, err := newSession(c, t)
+		if err != nil {
+			logger.Printf("Failed to set up a session: %v\n", err)
+			return newResponse(statusInternalError)
+		}
+		c.server.addSession(session)
+		c.sessions = append(c.sessions, session)
+		return newResponse(statusOK).
+			set("Transport", session.transportHeader()).
+			set("Session", fmt.Sprintf("%v;timeout=%d", session.id, int(sessionTimeout.Seconds())))
+	case "PLAY":
+		if session == nil {
+			return newResponse(statusSessionNotFound)
+		}
+		if !session.play(c.server.stream, sessionTimeout) {
+			return newResponse(statusMethodNotValid)
+		}
+		trackURL := strings.TrimSuffix(req.url, "/")
+		if !strings.HasSuffix(trackURL, trackControl) {
+			trackURL += "/" + trackControl
+		}
+		return newResponse(statusOK).
+			set("Session", session.id).
+			set("Range", "npt=now-").
+			set("RTP-Info", session.rtpInfo(trackURL))
+	case "TEARDOWN":
+		if session == nil {
+			return newResponse(statusSessionNotFound)
+		}
+		session.close()
+		return newResponse(statusOK).set("Session", session.id)
+	case "GET_PARAMETER", "SET_PARAMETER":
+		// keepalive
+		return newResponse(statusOK)
+	default:
+		return newResponse(statusMethodNotAllowed).set("Allow", "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER")
+	}
+}
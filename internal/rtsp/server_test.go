@@ -0,0 +1,274 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/suite"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// fakeStream sends a keyframe then slices every 10ms to each subscriber
+type fakeStream struct {
+	mu          sync.Mutex
+	subscribers map[<-chan *encoders.EncodedFrame]chan struct{}
+}
+
+func (f *fakeStream) Subscribe() <-chan *encoders.EncodedFrame {
+	frames := make(chan *encoders.EncodedFrame)
+	stop := make(chan struct{})
+	f.mu.Lock()
+	f.subscribers[frames] = stop
+	f.mu.Unlock()
+	go func() {
+		defer close(frames)
+		for seq := uint64(0); ; seq++ {
+			frame := &encoders.EncodedFrame{Data: h264.AnnexB([][]byte{{0x41, 0x9a, byte(seq)}}), Time: time.Now(), Seq: seq}
+			if seq%5 == 0 {
+				frame.Data = h264.AnnexB([][]byte{testSPS, testPPS, {0x65, 0x88, byte(seq)}})
+				frame.Keyframe = true
+			}
+			select {
+			case frames <- frame:
+			case <-stop:
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	return frames
+}
+
+func (f *fakeStream) Unsubscribe(frames <-chan *encoders.EncodedFrame) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if stop, found := f.subscribers[frames]; found {
+		close(stop)
+		delete(f.subscribers, frames)
+	}
+}
+
+func (f *fakeStream) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subscribers)
+}
+
+// client is a minimal RTSP client
+type client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	cseq   int
+	// interleaved holds the packets read while waiting for a response
+	interleaved [][]byte
+}
+
+type clientResponse struct {
+	status int
+	header textproto.MIMEHeader
+	body   string
+}
+
+func (c *client) do(method string, url string, headers ...string) (*clientResponse, error) {
+	c.cseq++
+	req := fmt.Sprintf("%v %v RTSP/1.0\r\nCSeq: %d\r\n", method, url, c.cseq)
+	for _, h := range headers {
+		req += h + "\r\n"
+	}
+	if _, err := io.WriteString(c.conn, req+"\r\n"); err != nil {
+		return nil, err
+	}
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			break
+		}
+		packet, err := c.readInterleaved()
+		if err != nil {
+			return nil, err
+		}
+		c.interleaved = append(c.interleaved, packet)
+	}
+	tp := textproto.NewReader(c.reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	status, err := strconv.Atoi(strings.Fields(line)[1])
+	if err != nil {
+		return nil, err
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	if header.Get("Cseq") != strconv.Itoa(c.cseq) {
+		return nil, fmt.Errorf("CSeq %v instead of %v", header.Get("Cseq"), c.cseq)
+	}
+	resp := &clientResponse{status: status, header: header}
+	if length, _ := strconv.Atoi(header.Get("Content-Length")); length > 0 {
+		body := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, body); err != nil {
+			return nil, err
+		}
+		resp.body = string(body)
+	}
+	return resp, nil
+}
+
+func (c *client) readInterleaved() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, int(header[2])<<8|int(header[3]))
+	_, err := io.ReadFull(c.reader, packet)
+	return packet, err
+}
+
+type ServerSuit struct {
+	suite.Suite
+	stream *fakeStream
+	server *Server
+	addr   string
+	client *client
+}
+
+func TestServerSuite(t *testing.T) {
+	suite.Run(t, new(ServerSuit))
+}
+
+func (s *ServerSuit) SetupTest() {
+	s.stream = &fakeStream{subscribers: map[<-chan *encoders.EncodedFrame]chan struct{}{}}
+	s.server = NewServer(s.stream, "admin", "secret")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	s.addr = listener.Addr().String()
+	go s.server.Serve(listener)
+
+	conn, err := net.Dial("tcp", s.addr)
+	s.Require().NoError(err)
+	s.client = &client{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (s *ServerSuit) TearDownTest() {
+	s.client.conn.Close()
+	s.server.Close()
+}
+
+func (s *ServerSuit) url() string {
+	return "rtsp://" + s.addr + "/stream"
+}
+
+// auth returns the Authorization header of a request, after the challenge of the connection
+func (s *ServerSuit) auth(method string, uri string) string {
+	resp, err := s.client.do("DESCRIBE", s.url())
+	s.Require().NoError(err)
+	s.Require().Equal(statusUnauthorized, resp.status)
+	nonce := parseDigest(resp.header.Get("Www-Authenticate"))["nonce"]
+	s.Require().NotEmpty(nonce)
+	return fmt.Sprintf(`Authorization: Digest username="admin", realm="%v", nonce="%v", uri="%v", response="%v"`,
+		realm, nonce, uri, digestResponse("admin", "secret", nonce, method, uri))
+}
+
+func (s *ServerSuit) Test_InterleavedWithDigestAuth() {
+	resp, err := s.client.do("OPTIONS", s.url())
+	s.Require().NoError(err)
+	s.Equal(statusOK, resp.status)
+	s.Contains(resp.header.Get("Public"), "DESCRIBE")
+
+	wrong := strings.Replace(s.auth("DESCRIBE", s.url()), `username="admin"`, `username="guest"`, 1)
+	resp, err = s.client.do("DESCRIBE", s.url(), wrong)
+	s.Require().NoError(err)
+	s.Equal(statusUnauthorized, resp.status)
+
+	resp, err = s.client.do("DESCRIBE", s.url(), s.auth("DESCRIBE", s.url()))
+	s.Require().NoError(err)
+	s.Require().Equal(statusOK, resp.status)
+	s.Equal("application/sdp", resp.header.Get("Content-Type"))
+	s.Contains(resp.body, "m=video 0 RTP/AVP 96")
+	s.Contains(resp.body, "sprop-parameter-sets=")
+	s.Contains(resp.body, "a=control:trackID=0")
+
+	track := s.url() + "/trackID=0"
+	resp, err = s.client.do("SETUP", track, s.auth("SETUP", track), "Transport: RTP/AVP/TCP;unicast;interleaved=0-1")
+	s.Require().NoError(err)
+	s.Require().Equal(statusOK, resp.status)
+	s.Equal("RTP/AVP/TCP;unicast;interleaved=0-1", resp.header.Get("Transport"))
+	session, _, _ := strings.Cut(resp.header.Get("Session"), ";")
+
+	resp, err = s.client.do("PLAY", s.url(), s.auth("PLAY", s.url()), "Session: "+session)
+	s.Require().NoError(err)
+	s.Require().Equal(statusOK, resp.status)
+	s.Contains(resp.header.Get("Rtp-Info"), "url="+track)
+
+	packets := []*rtp.Packet{}
+	for len(packets) < 10 {
+		raw, err := s.client.readInterleaved()
+		s.Require().NoError(err)
+		packet := &rtp.Packet{}
+		s.Require().NoError(packet.Unmarshal(raw))
+		packets = append(packets, packet)
+	}
+	s.Contains(resp.header.Get("Rtp-Info"), fmt.Sprintf("seq=%d;rtptime=%d", packets[0].SequenceNumber, packets[0].Timestamp))
+	// STAP-A with the parameter sets first, the stream starts at a keyframe
+	s.Equal(byte(24), packets[0].Payload[0]&0x1f)
+	s.Equal(1, s.stream.count())
+
+	resp, err = s.client.do("TEARDOWN", s.url(), s.auth("TEARDOWN", s.url()), "Session: "+session)
+	s.Require().NoError(err)
+	s.Equal(statusOK, resp.status)
+	s.Eventually(func() bool { return s.stream.count() == 0 }, time.Second, 10*time.Millisecond)
+
+	resp, err = s.client.do("PLAY", s.url(), s.auth("PLAY", s.url()), "Session: "+session)
+	s.Require().NoError(err)
+	s.Equal(statusSessionNotFound, resp.status)
+}
+
+func (s *ServerSuit) Test_UDP() {
+	s.server.username = ""
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	s.Require().NoError(err)
+	defer receiver.Close()
+	port := receiver.LocalAddr().(*net.UDPAddr).Port
+
+	resp, err := s.client.do("SETUP", s.url()+"/trackID=0", fmt.Sprintf("Transport: RTP/AVP;multicast,RTP/AVP;unicast;client_port=%d-%d", port, port+1))
+	s.Require().NoError(err)
+	s.Require().Equal(statusOK, resp.status)
+	s.Contains(resp.header.Get("Transport"), fmt.Sprintf("client_port=%d-%d;server_port=", port, port+1))
+	session, _, _ := strings.Cut(resp.header.Get("Session"), ";")
+
+	resp, err = s.client.do("PLAY", s.url(), "Session: "+session)
+	s.Require().NoError(err)
+	s.Require().Equal(statusOK, resp.status)
+
+	buf := make([]byte, 1500)
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := receiver.Read(buf)
+	s.Require().NoError(err)
+	packet := rtp.Packet{}
+	s.Require().NoError(packet.Unmarshal(buf[:n]))
+	s.Equal(uint8(96), packet.PayloadType)
+
+	// the sessions end with the connection
+	s.client.conn.Close()
+	s.Eventually(func() bool { return s.stream.count() == 0 }, time.Second, 10*time.Millisecond)
+}
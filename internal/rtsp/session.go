@@ -0,0 +1,246 @@
+package rtsp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/internal/rtpout"
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+)
+
+// transport is the RTP transport of a session, either UDP or interleaved in the RTSP connection
+type transport struct {
+	interleaved bool
+	// channel is the interleaved channel of RTP, RTCP goes on the next one
+	channel byte
+	// clientPorts are the UDP ports of RTP and RTCP on the client
+	clientPorts [2]int
+}
+
+// parseTransport picks the first supported alternative of a Transport header
+func parseTransport(header string) (*transport, error) {
+	for _, alternative := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(alternative), ";")
+		t := &transport{}
+		switch fields[0] {
+		case "RTP/AVP", "RTP/AVP/UDP":
+		case "RTP/AVP/TCP":
+			t.interleaved = true
+		default:
+			continue
+		}
+		unicast := true
+		ports := false
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			switch key {
+			case "multicast":
+				unicast = false
+			case "client_port":
+				first, second, _ := strings.Cut(value, "-")
+				p1, err := strconv.Atoi(first)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid client_port %q", value)
+				}
+				p2, err := strconv.Atoi(second)
+				if err != nil {
+					p2 = p1 + 1
+				}
+				t.clientPorts = [2]int{p1, p2}
+				ports = true
+			case "interleaved":
+				first, _, _ := strings.Cut(value, "-")
+				channel, err := strconv.Atoi(first)
+				if err != nil || channel < 0 || channel > 254 {
+					return nil, fmt.Errorf("Invalid interleaved %q", value)
+				}
+				t.channel = byte(channel)
+			}
+		}
+		if !unicast || (!t.interleaved && !ports) {
+			continue
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("No supported transport in %q", header)
+}
+
+// session sends the stream to one client after PLAY
+type session struct {
+	id        string
+	conn      *conn
+	transport *transport
+	// rtpConn and rtcpConn are the server side of a UDP transport
+	rtpConn    *net.UDPConn
+	rtcpConn   *net.UDPConn
+	clientRTP  *net.UDPAddr
+	packetizer *rtpout.Packetizer
+	firstSeq   uint16
+
+	mu       sync.Mutex
+	playing  bool
+	lastSeen time.Time
+	stop     chan struct{}
+	closed   bool
+}
+
+func newSession(c *conn, t *transport) (*session, error) {
+	s := &session{
+		id:        newNonce()[:16],
+		conn:      c,
+		transport: t,
+		firstSeq:  uint16(rand.Uint32()),
+		lastSeen:  time.Now(),
+		stop:      make(chan struct{}),
+	}
+	s.packetizer = rtpout.NewPacketizer(rand.Uint32(), s.firstSeq)
+	if t.interleaved {
+		return s, nil
+	}
+	remote := c.netConn.RemoteAddr().(*net.TCPAddr)
+	local := c.netConn.LocalAddr().(*net.TCPAddr)
+	s.clientRTP = &net.UDPAddr{IP: remote.IP, Port: t.clientPorts[0]}
+	var err error
+	if s.rtpConn, s.rtcpConn, err = listenUDPPair(local.IP); err != nil {
+		return nil, err
+	}
+	go s.readRTCP()
+	return s, nil
+}
+
+// listenUDPPair opens the UDP sockets of RTP and RTCP on consecutive ports, RTP on the even one
+func listenUDPPair(ip net.IP) (*net.UDPConn, *net.UDPConn, error) {
+	for try := 0; try < 20; try++ {
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			return nil, nil, err
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port + 1})
+			if err == nil {
+				return rtpConn, rtcpConn, nil
+			}
+		}
+		rtpConn.Close()
+	}
+	return nil, nil, fmt.Errorf("No free UDP port pair")
+}
+
+// transportHeader is the Transport header answering the SETUP
+func (s *session) transportHeader() string {
+	if s.transport.interleaved {
+		return fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", s.transport.channel, s.transport.channel+1)
+	}
+	rtpPort := s.rtpConn.LocalAddr().(*net.UDPAddr).Port
+	return fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d",
+		s.transport.clientPorts[0], s.transport.clientPorts[1], rtpPort, rtpPort+1)
+}
+
+// readRTCP takes the receiver reports of a UDP client as keepalives
+func (s *session) readRTCP() {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := s.rtcpConn.ReadFromUDP(buf); err != nil {
+			return
+		}
+		s.touch()
+	}
+}
+
+func (s *session) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen = time.Now()
+}
+
+// play starts sending the stream, it returns false if the session already plays or is closed
+func (s *session) play(stream Stream, timeout time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.playing || s.closed {
+		return false
+	}
+	s.playing = true
+	frames := stream.Subscribe()
+	go func() {
+		defer stream.Unsubscribe(frames)
+		for {
+			select {
+			case <-s.stop:
+				return
+			case frame, ok := <-frames:
+				if !ok {
+					s.close()
+					return
+				}
+				if frame.Keyframe {
+					s.conn.server.setParameterSets(h264.ParameterSets(frame.Data))
+				}
+				if err := s.send(frame); err != nil {
+					logger.Printf("Session %v: %v\n", s.id, err)
+					s.close()
+					return
+				}
+				if !s.transport.interleaved && s.idle() > timeout {
+					logger.Printf("Session %v timed out\n", s.id)
+					s.close()
+					return
+				}
+			}
+		}
+	}()
+	return true
+}
+
+func (s *session) idle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastSeen)
+}
+
+// send writes the packets of a frame to the client
+func (s *session) send(frame *encoders.EncodedFrame) error {
+	for _, packet := range s.packetizer.Packetize(frame) {
+		raw, err := packet.Marshal()
+		if err != nil {
+			return err
+		}
+		if s.transport.interleaved {
+			err = s.conn.writeInterleaved(s.transport.channel, raw)
+		} else {
+			_, err = s.rtpConn.WriteToUDP(raw, s.clientRTP)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rtpInfo is the RTP-Info header answering the PLAY of url
+func (s *session) rtpInfo(url string) string {
+	return fmt.Sprintf("url=%v;seq=%d;rtptime=%d", url, s.firstSeq, s.packetizer.BaseTimestamp)
+}
+
+// close stops the stream and releases the UDP sockets, it's safe to call several times
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.stop)
+	if s.rtpConn != nil {
+		s.rtpConn.Close()
+		s.rtcpConn.Close()
+	}
+	s.conn.server.removeSession(s)
+}
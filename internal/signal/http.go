@@ -2,23 +2,67 @@ package signal
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"strconv"
 )
 
+// maxSDPSize bounds the body of a posted SDP
+const maxSDPSize = 1 << 20
+
+// SDPRequest is a SDP posted to HTTPSDPServer, the HTTP request waits for its reply
+type SDPRequest struct {
+	SDP   string
+	reply chan sdpReply
+}
+
+type sdpReply struct {
+	status int
+	body   string
+}
+
+// Reply answers the request with body
+func (r *SDPRequest) Reply(body string) {
+	r.reply <- sdpReply{status: http.StatusOK, body: body}
+}
+
+// Fail answers the request with an error
+func (r *SDPRequest) Fail(status int, err error) {
+	r.reply <- sdpReply{status: status, body: err.Error()}
+}
+
 // HTTPSDPServer starts a HTTP Server that consumes SDPs
-func HTTPSDPServer(port int) chan string {
-	sdpChan := make(chan string)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		body, _ := ioutil.ReadAll(r.Body)
-		fmt.Fprintf(w, "done")
-		sdpChan <- string(body)
+func HTTPSDPServer(port int) chan *SDPRequest {
+	sdpChan := make(chan *SDPRequest)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST the SDP", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the reply is buffered, so a late reply never blocks after the client left
+		req := &SDPRequest{SDP: string(body), reply: make(chan sdpReply, 1)}
+		select {
+		case sdpChan <- req:
+		case <-r.Context().Done():
+			return
+		}
+		select {
+		case reply := <-req.reply:
+			w.WriteHeader(reply.status)
+			fmt.Fprintln(w, reply.body)
+		case <-r.Context().Done():
+		}
 	})
 
 	go func() {
 		// nolint: gosec
-		err := http.ListenAndServe(":"+strconv.Itoa(port), nil)
+		err := http.ListenAndServe(":"+strconv.Itoa(port), mux)
 		if err != nil {
 			panic(err)
 		}
@@ -8,36 +8,47 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"strings"
 )
 
-// Allows compressing offer/answer to bypass terminal input limits.
-const compress = false
+// Compress allows compressing offer/answer to bypass terminal input limits.
+// Decode recognizes compressed input whatever its value.
+var Compress = false
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// maxDecompressedSize bounds a compressed input once decompressed, a session description is a few KB
+const maxDecompressedSize = 1 << 20
 
 // MustReadStdin blocks until input is received from stdin
 func MustReadStdin() string {
-	r := bufio.NewReader(os.Stdin)
+	in, err := ReadLine(bufio.NewReader(os.Stdin))
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("")
+
+	return in
+}
 
-	var in string
+// ReadLine blocks until a non empty line is read, it returns io.EOF once the input ends without one
+func ReadLine(r *bufio.Reader) (string, error) {
 	for {
-		var err error
-		in, err = r.ReadString('\n')
-		if err != io.EOF {
-			if err != nil {
-				panic(err)
-			}
+		in, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
 		}
 		in = strings.TrimSpace(in)
 		if len(in) > 0 {
-			break
+			return in, nil
+		}
+		if err == io.EOF {
+			return "", err
 		}
 	}
-
-	fmt.Println("")
-
-	return in
 }
 
 // Encode encodes the input in base64
@@ -48,7 +59,7 @@ func Encode(obj interface{}) string {
 		panic(err)
 	}
 
-	if compress {
+	if Compress {
 		b = zip(b)
 	}
 
@@ -58,19 +69,32 @@ func Encode(obj interface{}) string {
 // Decode decodes the input from base64
 // It can optionally unzip the input after decoding
 func Decode(in string, obj interface{}) {
-	b, err := base64.StdEncoding.DecodeString(in)
-	if err != nil {
+	if err := TryDecode(in, obj); err != nil {
 		panic(err)
 	}
+}
 
-	if compress {
-		b = unzip(b)
+// TryDecode decodes the input like Decode, returning an error for a malformed input
+func TryDecode(in string, obj interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(in)
+	if err != nil {
+		return err
 	}
 
-	err = json.Unmarshal(b, obj)
-	if err != nil {
-		panic(err)
+	if bytes.HasPrefix(b, gzipMagic) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		if b, err = io.ReadAll(io.LimitReader(r, maxDecompressedSize+1)); err != nil {
+			return err
+		}
+		if len(b) > maxDecompressedSize {
+			return fmt.Errorf("decompressed input over %d bytes", maxDecompressedSize)
+		}
 	}
+
+	return json.Unmarshal(b, obj)
 }
 
 func zip(in []byte) []byte {
@@ -90,20 +114,3 @@ func zip(in []byte) []byte {
 	}
 	return b.Bytes()
 }
-
-func unzip(in []byte) []byte {
-	var b bytes.Buffer
-	_, err := b.Write(in)
-	if err != nil {
-		panic(err)
-	}
-	r, err := gzip.NewReader(&b)
-	if err != nil {
-		panic(err)
-	}
-	res, err := ioutil.ReadAll(r)
-	if err != nil {
-		panic(err)
-	}
-	return res
-}
@@ -0,0 +1,124 @@
+package signaling
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+//go:embed viewer.html
+var viewerPage []byte
+
+// MsgSender sends messages to the other side of a signaling connection
+type MsgSender interface {
+	SendMsg(data *WsMsg) error
+}
+
+// Peer is a viewer connected to the built-in signaling server
+type Peer struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+// SendMsg sends a message to the viewer
+func (p *Peer) SendMsg(data *WsMsg) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.conn.WriteMessage(websocket.TextMessage, jsonData)
+}
+
+// Server is a built-in signaling server speaking the WsMsg protocol,
+// so viewers can send their offers to the sender without an external server.
+// It also serves a minimal viewer page.
+type Server struct {
+	upgrader  websocket.Upgrader
+	onMessage func(peer *Peer, msg *WsMsg)
+
+	mu    sync.Mutex
+	peers map[*Peer]struct{}
+}
+
+// NewServer creates a signaling server calling onMessage for every message of the viewers
+func NewServer(onMessage func(peer *Peer, msg *WsMsg)) *Server {
+	return &Server{
+		onMessage: onMessage,
+		peers:     map[*Peer]struct{}{},
+	}
+}
+
+// Handler serves the viewer page on / and the websocket on /ws
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.serveWebsocket)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(viewerPage)
+	})
+	return mux
+}
+
+// ListenAndServe serves the signaling server on addr until it fails
+func (s *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+func (s *Server) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already answered with an error
+		return
+	}
+	peer := &Peer{conn: conn}
+	s.mu.Lock()
+	s.peers[peer] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.peers, peer)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	if err := peer.SendMsg(&WsMsg{Sender: true, WSType: CONNECTED}); err != nil {
+		return
+	}
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg := NewWsMsg()
+		if err := json.Unmarshal(message, msg); err != nil {
+			log.Printf("Invalid signaling message: %v\n", err)
+			continue
+		}
+		s.onMessage(peer, msg)
+	}
+}
+
+// Broadcast sends a message to every connected viewer
+func (s *Server) Broadcast(data *WsMsg) {
+	s.mu.Lock()
+	peers := make([]*Peer, 0, len(s.peers))
+	for p := range s.peers {
+		peers = append(peers, p)
+	}
+	s.mu.Unlock()
+	for _, p := range peers {
+		if err := p.SendMsg(data); err != nil {
+			log.Printf("Failed to send signaling message: %v\n", err)
+		}
+	}
+}
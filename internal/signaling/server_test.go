@@ -0,0 +1,76 @@
+package signaling
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ServerSuit struct {
+	suite.Suite
+	server *httptest.Server
+	sgl    *Signaling
+}
+
+func TestServerSuite(t *testing.T) {
+	suite.Run(t, new(ServerSuit))
+}
+
+func (s *ServerSuit) SetupTest() {
+	var sigServer *Server
+	sigServer = NewServer(func(peer *Peer, msg *WsMsg) {
+		// answer the offer, then tell every viewer
+		peer.SendMsg(&WsMsg{Sender: true, WSType: SDP, SDP: "answer-" + msg.SDP, ID: msg.ID})
+		sigServer.Broadcast(&WsMsg{Sender: true, WSType: MOTION_START, Data: "{}"})
+	})
+	s.server = httptest.NewServer(sigServer.Handler())
+	s.sgl = &Signaling{}
+	s.Require().NoError(s.sgl.Init("ws" + strings.TrimPrefix(s.server.URL, "http") + "/ws"))
+}
+
+func (s *ServerSuit) TearDownTest() {
+	s.sgl.Close()
+	s.server.Close()
+}
+
+func (s *ServerSuit) Test_OfferAnswer() {
+	msg, err := s.sgl.ReadMsg()
+	s.Require().NoError(err)
+	s.Equal(CONNECTED, msg.WSType)
+
+	s.Require().NoError(s.sgl.SendMsg(&WsMsg{WSType: SDP, SDP: "offer", ID: "viewer-1"}))
+	msg, err = s.sgl.ReadMsg()
+	s.Require().NoError(err)
+	s.Equal(SDP, msg.WSType)
+	s.Equal("answer-offer", msg.SDP)
+	s.Equal("viewer-1", msg.ID)
+
+	msg, err = s.sgl.ReadMsg()
+	s.Require().NoError(err)
+	s.Equal(MOTION_START, msg.WSType)
+}
+
+func (s *ServerSuit) Test_ViewerPage() {
+	resp, err := http.Get(s.server.URL)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.Contains(string(body), "RTCPeerConnection")
+
+	resp, err = http.Get(s.server.URL + "/missing")
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusNotFound, resp.StatusCode)
+
+	// plain HTTP requests to the websocket endpoint are refused
+	resp, err = http.Get(s.server.URL + "/ws")
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusBadRequest, resp.StatusCode)
+}
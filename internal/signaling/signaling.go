@@ -2,6 +2,7 @@ package signaling
 
 import (
 	"encoding/json"
+	"sync"
 
 	"github.com/gorilla/websocket"
 )
@@ -13,6 +14,11 @@ const (
 	SDP       WSType = "SDP"
 	ICE       WSType = "ICE"
 	ERROR     WSType = "Error"
+	// Motion events from the sender, Data holds the JSON event
+	MOTION_START WSType = "MotionStart"
+	MOTION_STOP  WSType = "MotionStop"
+	// Clip trigger to the sender, Data holds the reason
+	TRIGGER WSType = "Trigger"
 )
 
 type WsMsg struct {
@@ -39,6 +45,8 @@ type Signaling struct {
 	TIMESWAIT    int
 	TIMESWAITMAX int
 	wsConn       *websocket.Conn
+	// websocket connections support a single concurrent writer
+	writeMu sync.Mutex
 }
 
 func (sig *Signaling) Init(urlStr string) error {
@@ -55,6 +63,8 @@ func (sig *Signaling) SendMsg(data *WsMsg) error {
 	if err != nil {
 		return err
 	}
+	sig.writeMu.Lock()
+	defer sig.writeMu.Unlock()
 	return sig.wsConn.WriteMessage(websocket.TextMessage, jsonData)
 }
 
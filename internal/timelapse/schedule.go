@@ -0,0 +1,79 @@
+package timelapse
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseTimeOfDay parses a "15:04" time of day into the time since midnight, "24:00" is the end of the day
+func ParseTimeOfDay(s string) (time.Duration, error) {
+	hours, minutes, found := strings.Cut(s, ":")
+	h, err := strconv.Atoi(hours)
+	if err != nil || !found || len(minutes) != 2 {
+		return 0, fmt.Errorf("Invalid time of day %q, expected HH:MM", s)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("Invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// at returns the time of day offset of the day of t in loc, wall clock time across the daylight saving changes
+func at(t time.Time, offset time.Duration, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, int(offset/time.Minute), 0, 0, loc)
+}
+
+// Window returns the capture window of the day of t, empty when nothing is captured that day
+func (c *Config) Window(t time.Time) (time.Time, time.Time) {
+	start, end := at(t, c.Start, c.Location), at(t, c.Stop, c.Location)
+	if c.Daylight {
+		sunrise, sunset := SunTimes(at(t, 12*time.Hour, c.Location), c.Latitude, c.Longitude)
+		if sunrise.After(start) {
+			start = sunrise
+		}
+		if sunset.Before(end) {
+			end = sunset
+		}
+	}
+	if end.Before(start) {
+		end = start
+	}
+	return start, end
+}
+
+// SunTimes returns the sunrise and the sunset of the day of t, UTC, at a latitude and a longitude in degrees,
+// east and north positive. Sunset equals sunrise during a polar night, and they span the day under the midnight
+// sun.
+func SunTimes(t time.Time, latitude float64, longitude float64) (time.Time, time.Time) {
+	const j2000 = 2451545.0
+	rad := math.Pi / 180
+	// the sunrise equation, from the Julian day of the solar noon
+	julian := float64(t.Unix())/86400 + 2440587.5
+	n := math.Round(julian - j2000 - 0.0008)
+	mean := n - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*mean, 360)
+	center := 1.9148*math.Sin(anomaly*rad) + 0.02*math.Sin(2*anomaly*rad) + 0.0003*math.Sin(3*anomaly*rad)
+	ecliptic := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := j2000 + mean + 0.0053*math.Sin(anomaly*rad) - 0.0069*math.Sin(2*ecliptic*rad)
+	declination := math.Asin(math.Sin(ecliptic*rad) * math.Sin(23.4397*rad))
+	// -0.833° accounts for the refraction and the disc of the sun
+	cosHour := (math.Sin(-0.833*rad) - math.Sin(latitude*rad)*math.Sin(declination)) /
+		(math.Cos(latitude*rad) * math.Cos(declination))
+	toTime := func(julian float64) time.Time {
+		return time.Unix(0, int64((julian-2440587.5)*86400*float64(time.Second))).UTC()
+	}
+	noon := toTime(transit)
+	switch {
+	case cosHour > 1:
+		return noon, noon
+	case cosHour < -1:
+		return noon.Add(-12 * time.Hour), noon.Add(12 * time.Hour)
+	}
+	hour := math.Acos(cosHour) / rad
+	return toTime(transit - hour/360), toTime(transit + hour/360)
+}
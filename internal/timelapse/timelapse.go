@@ -0,0 +1,455 @@
+package timelapse
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/fmp4"
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/nfnt/resize"
+)
+
+var logger = log.New(log.Writer(), "[timelapse]", log.LstdFlags)
+
+const (
+	// dayLayout names the frame directories and the videos, by local date
+	dayLayout = "2006-01-02"
+	// frameLayout names the frames by UTC capture time, so they sort in order across the daylight saving changes
+	frameLayout  = "20060102T150405Z"
+	frameExt     = ".jpg"
+	framesDir    = "frames"
+	frameQuality = 90
+	// Ext is the extension of the videos
+	Ext = ".mp4"
+)
+
+// Config sets when the frames are captured and how the videos are played
+type Config struct {
+	Dir string
+	// Interval is the time between two frames
+	Interval time.Duration
+	// Fps is the playback frame rate of the videos
+	Fps int
+	// Start and Stop bound the daily capture window, as times since midnight in Location
+	Start time.Duration
+	Stop  time.Duration
+	// Daylight narrows the window to between the sunrise and the sunset, at Latitude and Longitude in degrees
+	Daylight  bool
+	Latitude  float64
+	Longitude float64
+	// KeepFrames keeps the frames of a day once its video is encoded
+	KeepFrames bool
+	// MaxAge and MaxBytes remove the oldest days, video and frames, past the current one, no limit when 0
+	MaxAge   time.Duration
+	MaxBytes int64
+	// Location sets the days and the window, time.Local when nil
+	Location *time.Location
+}
+
+// Grabber returns the next frame of the camera, it must not be modified
+type Grabber func() (*image.RGBA, error)
+
+// Timelapse captures a frame every interval of the daily window, and encodes the frames of a day into a video
+// once the window is over
+type Timelapse struct {
+	cfg        Config
+	grab       Grabber
+	encService encoders.Service
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+	// failed holds the days whose video failed, they aren't tried again until a restart
+	failed map[string]bool
+}
+
+// New returns a timelapse writing to cfg.Dir, created if needed
+func New(grab Grabber, encService encoders.Service, cfg Config) (*Timelapse, error) {
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("Invalid timelapse interval %v", cfg.Interval)
+	}
+	if cfg.Fps <= 0 {
+		return nil, fmt.Errorf("Invalid timelapse frame rate %d", cfg.Fps)
+	}
+	if cfg.Stop <= cfg.Start {
+		return nil, fmt.Errorf("The timelapse stops at %v, before it starts at %v", cfg.Stop, cfg.Start)
+	}
+	if cfg.Daylight && (cfg.Latitude < -90 || cfg.Latitude > 90 || cfg.Longitude < -180 || cfg.Longitude > 180) {
+		return nil, fmt.Errorf("Invalid timelapse position %v, %v", cfg.Latitude, cfg.Longitude)
+	}
+	// 0, 0 is in the ocean, the position was left unset
+	if cfg.Daylight && cfg.Latitude == 0 && cfg.Longitude == 0 {
+		return nil, errors.New("The timelapse daylight needs the latitude and the longitude of the camera")
+	}
+	if cfg.MaxAge < 0 || cfg.MaxBytes < 0 {
+		return nil, fmt.Errorf("Invalid timelapse limits %v, %d bytes", cfg.MaxAge, cfg.MaxBytes)
+	}
+	if cfg.Location == nil {
+		cfg.Location = time.Local
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.Dir, framesDir), 0o755); err != nil {
+		return nil, err
+	}
+	return &Timelapse{cfg: cfg, grab: grab, encService: encService, failed: map[string]bool{}}, nil
+}
+
+// Start captures in the background
+func (t *Timelapse) Start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stop != nil {
+		return
+	}
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	go t.run(t.stop, t.done)
+}
+
+// Close stops capturing, after the video being encoded
+func (t *Timelapse) Close() {
+	t.mu.Lock()
+	stop, done := t.stop, t.done
+	t.stop = nil
+	t.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (t *Timelapse) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(t.cfg.Interval)
+	defer ticker.Stop()
+	for now := time.Now(); ; {
+		t.tick(now)
+		select {
+		case <-stop:
+			return
+		case now = <-ticker.C:
+		}
+	}
+}
+
+// tick captures a frame when now is in the window, and encodes the days whose window is over
+func (t *Timelapse) tick(now time.Time) {
+	if start, end := t.cfg.Window(now); !now.Before(start) && now.Before(end) {
+		if err := t.capture(now); err != nil {
+			logger.Printf("Failed to capture a frame: %v\n", err)
+		}
+	}
+	days, err := t.pendingDays(now)
+	if err != nil {
+		logger.Printf("Failed to list the frames: %v\n", err)
+		return
+	}
+	for _, day := range days {
+		path, err := t.Encode(day)
+		if err != nil {
+			logger.Printf("Failed to encode the timelapse of %v: %v\n", day, err)
+			t.failed[day] = true
+			continue
+		}
+		logger.Printf("Timelapse of %v encoded to %v\n", day, path)
+	}
+	if err := t.prune(now); err != nil {
+		logger.Printf("Failed to prune the timelapses: %v\n", err)
+	}
+}
+
+// capture stores the next frame of the camera as taken at now
+func (t *Timelapse) capture(now time.Time) error {
+	img, err := t.grab()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(t.cfg.Dir, framesDir, now.In(t.cfg.Location).Format(dayLayout))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, now.UTC().Format(frameLayout)+frameExt)
+	return writeFile(path, func(f *os.File) error {
+		return jpeg.Encode(f, img, &jpeg.Options{Quality: frameQuality})
+	})
+}
+
+// writeFile writes a file through a temporary file, so a power loss never leaves a partial one
+func writeFile(path string, write func(f *os.File) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// pendingDays returns the days with frames whose window is over and which have no video yet
+func (t *Timelapse) pendingDays(now time.Time) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(t.cfg.Dir, framesDir))
+	if err != nil {
+		return nil, err
+	}
+	today := now.In(t.cfg.Location).Format(dayLayout)
+	days := []string{}
+	for _, entry := range entries {
+		day := entry.Name()
+		date, err := time.ParseInLocation(dayLayout, day, t.cfg.Location)
+		if err != nil || !entry.IsDir() || t.failed[day] {
+			continue
+		}
+		if _, err := os.Stat(t.VideoPath(day)); err == nil {
+			continue
+		}
+		// the window may have changed since the frames were taken
+		if _, end := t.cfg.Window(date); now.Before(end) && day >= today {
+			continue
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// prune removes the oldest days, video and frames, while they're older than the max age or the directory is over
+// the max size. The current day is always kept.
+func (t *Timelapse) prune(now time.Time) error {
+	if t.cfg.MaxAge == 0 && t.cfg.MaxBytes == 0 {
+		return nil
+	}
+	sizes, err := t.daySizes()
+	if err != nil {
+		return err
+	}
+	days := []string{}
+	total := int64(0)
+	for day, size := range sizes {
+		days = append(days, day)
+		total += size
+	}
+	sort.Strings(days)
+	today := now.In(t.cfg.Location).Format(dayLayout)
+	for _, day := range days {
+		if day >= today {
+			break
+		}
+		date, _ := time.ParseInLocation(dayLayout, day, t.cfg.Location)
+		expired := t.cfg.MaxAge > 0 && now.Sub(date.AddDate(0, 0, 1)) > t.cfg.MaxAge
+		if !expired && (t.cfg.MaxBytes == 0 || total <= t.cfg.MaxBytes) {
+			break
+		}
+		if err := os.RemoveAll(filepath.Join(t.cfg.Dir, framesDir, day)); err != nil {
+			return err
+		}
+		if err := os.Remove(t.VideoPath(day)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		delete(t.failed, day)
+		total -= sizes[day]
+		logger.Printf("Timelapse of %v removed\n", day)
+	}
+	return nil
+}
+
+// daySizes returns the size of every day, video and frames
+func (t *Timelapse) daySizes() (map[string]int64, error) {
+	sizes := map[string]int64{}
+	days, err := t.Videos()
+	if err != nil {
+		return nil, err
+	}
+	for _, day := range days {
+		if info, err := os.Stat(t.VideoPath(day)); err == nil {
+			sizes[day] += info.Size()
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(t.cfg.Dir, framesDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		day := entry.Name()
+		if _, err := time.Parse(dayLayout, day); err != nil || !entry.IsDir() {
+			continue
+		}
+		frames, err := os.ReadDir(filepath.Join(t.cfg.Dir, framesDir, day))
+		if err != nil {
+			return nil, err
+		}
+		size := sizes[day]
+		for _, frame := range frames {
+			if info, err := frame.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		sizes[day] = size
+	}
+	return sizes, nil
+}
+
+// VideoPath returns the path of the video of a day, as 2006-01-02
+func (t *Timelapse) VideoPath(day string) string {
+	return filepath.Join(t.cfg.Dir, day+Ext)
+}
+
+// Encode encodes the frames of a day, as 2006-01-02, into its H.264 video and removes them unless they're kept.
+// The video plays the frames at the configured frame rate, with a keyframe every second.
+func (t *Timelapse) Encode(day string) (string, error) {
+	dir := filepath.Join(t.cfg.Dir, framesDir, day)
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+frameExt))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(paths)
+	out := t.VideoPath(day)
+	err = writeFile(out, func(f *os.File) error {
+		return t.encode(f, paths)
+	})
+	if err != nil {
+		return "", err
+	}
+	if !t.cfg.KeepFrames {
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Printf("Failed to remove the frames of %v: %v\n", day, err)
+		}
+	}
+	return out, nil
+}
+
+// encode writes the frames of paths to f as a fragmented MP4, one fragment per GOP
+func (t *Timelapse) encode(f *os.File, paths []string) error {
+	var encoder encoders.Encoder
+	var encodedSize size.Size
+	defer func() {
+		if encoder != nil {
+			encoder.Close()
+		}
+	}()
+	duration := uint32(fmp4.Timescale / t.cfg.Fps)
+	var sequence uint32
+	var decodeTime uint64
+	gop := []fmp4.Sample{}
+	flush := func() error {
+		if len(gop) == 0 {
+			return nil
+		}
+		sequence++
+		_, err := f.Write(fmp4.Fragment(sequence, decodeTime, gop))
+		decodeTime += uint64(len(gop)) * uint64(duration)
+		gop = gop[:0]
+		return err
+	}
+
+	frames := 0
+	for _, path := range paths {
+		img, err := readFrame(path)
+		if err != nil {
+			// a frame that can't be read is left out
+			logger.Printf("Skipping frame %v: %v\n", path, err)
+			continue
+		}
+		if encoder == nil {
+			b := img.Bounds()
+			if encoder, err = t.encService.NewEncoder(encoders.H264Codec, size.Size{Width: b.Dx(), Height: b.Dy()}, t.cfg.Fps); err != nil {
+				return err
+			}
+			if encodedSize, err = encoder.VideoSize(); err != nil {
+				return err
+			}
+		}
+		if b := img.Bounds(); b.Dx() != encodedSize.Width || b.Dy() != encodedSize.Height {
+			img = resize.Resize(uint(encodedSize.Width), uint(encodedSize.Height), img, resize.Lanczos3).(*image.RGBA)
+		}
+		if frames%t.cfg.Fps == 0 {
+			encoder.ForceKeyframe()
+		}
+		data, err := encoder.Encode(img)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		keyframe := h264.IsKeyframe(data)
+		if frames == 0 {
+			if !keyframe {
+				return errors.New("the first frame isn't a keyframe")
+			}
+			track, err := fmp4.NewTrack(data)
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(fmp4.InitSegment(track)); err != nil {
+				return err
+			}
+		}
+		if keyframe {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		gop = append(gop, fmp4.NewSample(data, duration, keyframe))
+		frames++
+	}
+	if frames == 0 {
+		return errors.New("no frames")
+	}
+	return flush()
+}
+
+// readFrame decodes a stored frame
+func readFrame(path string) (*image.RGBA, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba, nil
+}
+
+// Videos returns the days with a video, oldest first
+func (t *Timelapse) Videos() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(t.cfg.Dir, "*"+Ext))
+	if err != nil {
+		return nil, err
+	}
+	days := []string{}
+	for _, path := range paths {
+		day := strings.TrimSuffix(filepath.Base(path), Ext)
+		if _, err := time.Parse(dayLayout, day); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
@@ -0,0 +1,182 @@
+package timelapse
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/fmp4"
+	"github.com/stretchr/testify/suite"
+)
+
+type TimelapseSuit struct {
+	suite.Suite
+	dir    string
+	grabs  int
+	paris  *time.Location
+	london *time.Location
+}
+
+func TestTimelapseSuite(t *testing.T) {
+	suite.Run(t, new(TimelapseSuit))
+}
+
+func (s *TimelapseSuit) SetupTest() {
+	s.dir = s.T().TempDir()
+	s.grabs = 0
+	s.paris = time.FixedZone("CEST", 2*60*60)
+	s.london = time.FixedZone("BST", 60*60)
+}
+
+// grab returns 320x240 gray frames with a moving dot
+func (s *TimelapseSuit) grab() (*image.RGBA, error) {
+	img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	for i := range img.Pix {
+		img.Pix[i] = 128
+	}
+	img.Set(s.grabs%320, s.grabs%240, color.RGBA{R: 255, A: 255})
+	s.grabs++
+	return img, nil
+}
+
+func (s *TimelapseSuit) Test_ParseTimeOfDay() {
+	d, err := ParseTimeOfDay("07:30")
+	s.Require().NoError(err)
+	s.Equal(7*time.Hour+30*time.Minute, d)
+	d, err = ParseTimeOfDay("24:00")
+	s.Require().NoError(err)
+	s.Equal(24*time.Hour, d)
+	for _, invalid := range []string{"", "7", "7:5", "24:01", "12:60", "-1:00"} {
+		_, err = ParseTimeOfDay(invalid)
+		s.Error(err, invalid)
+	}
+}
+
+func (s *TimelapseSuit) Test_Window() {
+	// London on the summer solstice, sunrise at 04:43 and sunset at 21:21 BST
+	sunrise, sunset := SunTimes(time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC), 51.5, -0.13)
+	s.WithinDuration(time.Date(2024, 6, 21, 3, 43, 0, 0, time.UTC), sunrise, 3*time.Minute)
+	s.WithinDuration(time.Date(2024, 6, 21, 20, 21, 0, 0, time.UTC), sunset, 3*time.Minute)
+
+	cfg := Config{Start: 6 * time.Hour, Stop: 20 * time.Hour, Location: s.london}
+	day := time.Date(2024, 6, 21, 15, 0, 0, 0, s.london)
+	start, end := cfg.Window(day)
+	s.Equal(time.Date(2024, 6, 21, 6, 0, 0, 0, s.london), start)
+	s.Equal(time.Date(2024, 6, 21, 20, 0, 0, 0, s.london), end)
+	cfg.Stop = 24 * time.Hour
+	_, end = cfg.Window(day)
+	s.Equal(time.Date(2024, 6, 22, 0, 0, 0, 0, s.london), end)
+
+	// the daylight narrows the window
+	cfg.Daylight, cfg.Latitude, cfg.Longitude = true, 51.5, -0.13
+	start, end = cfg.Window(day)
+	s.Equal(time.Date(2024, 6, 21, 6, 0, 0, 0, s.london), start)
+	s.WithinDuration(time.Date(2024, 6, 21, 21, 21, 0, 0, s.london), end, 3*time.Minute)
+	// no daylight during the polar night
+	cfg.Latitude, cfg.Longitude = 78.2, 15.6
+	start, end = cfg.Window(time.Date(2024, 12, 21, 12, 0, 0, 0, s.london))
+	s.Equal(start, end)
+}
+
+func (s *TimelapseSuit) Test_Encode() {
+	timelapse, err := New(s.grab, encoders.NewEncoderService(), Config{
+		Dir:      s.dir,
+		Interval: time.Minute,
+		Fps:      10,
+		Start:    8 * time.Hour,
+		Stop:     17 * time.Hour,
+		Location: s.paris,
+	})
+	s.Require().NoError(err)
+
+	// a frame a minute from 07:00 to 18:00, the window keeps 9 hours of them
+	now := time.Date(2024, 5, 2, 7, 0, 0, 0, s.paris)
+	for ; now.Before(time.Date(2024, 5, 2, 17, 0, 0, 0, s.paris)); now = now.Add(time.Minute) {
+		timelapse.tick(now)
+	}
+	s.Equal(9*60, s.grabs)
+	frames, err := filepath.Glob(filepath.Join(s.dir, framesDir, "2024-05-02", "*"+frameExt))
+	s.Require().NoError(err)
+	s.Len(frames, 9*60)
+	s.NoFileExists(timelapse.VideoPath("2024-05-02"))
+
+	// encoded once the window is over
+	timelapse.tick(now)
+	s.NoDirExists(filepath.Join(s.dir, framesDir, "2024-05-02"))
+	data, err := os.ReadFile(timelapse.VideoPath("2024-05-02"))
+	s.Require().NoError(err)
+	video, err := fmp4.Parse(bytes.NewReader(data), int64(len(data)))
+	s.Require().NoError(err)
+	samples := 0
+	for _, fragment := range video.Fragments {
+		// a keyframe a second
+		s.Len(fragment.Samples, 10)
+		s.True(fragment.Samples[0].Keyframe)
+		for _, sample := range fragment.Samples {
+			s.Equal(uint32(fmp4.Timescale/10), sample.Duration)
+			samples++
+		}
+	}
+	s.Equal(9*60, samples)
+	days, err := timelapse.Videos()
+	s.Require().NoError(err)
+	s.Equal([]string{"2024-05-02"}, days)
+
+	// the unreadable frames are left out, a day without frames fails once
+	dir := filepath.Join(s.dir, framesDir, "2024-05-03")
+	s.Require().NoError(os.MkdirAll(dir, 0o755))
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, "20240503T060000Z"+frameExt), []byte("torn"), 0o644))
+	timelapse.tick(time.Date(2024, 5, 4, 7, 0, 0, 0, s.paris))
+	s.NoFileExists(timelapse.VideoPath("2024-05-03"))
+	s.True(timelapse.failed["2024-05-03"])
+}
+
+func (s *TimelapseSuit) Test_Config() {
+	_, err := New(s.grab, encoders.NewEncoderService(), Config{Dir: s.dir, Interval: time.Minute, Fps: 30, Start: 18 * time.Hour, Stop: 6 * time.Hour})
+	s.Error(err)
+	_, err = New(s.grab, encoders.NewEncoderService(), Config{Dir: s.dir, Fps: 30, Stop: 24 * time.Hour})
+	s.Error(err)
+	_, err = New(s.grab, encoders.NewEncoderService(), Config{Dir: s.dir, Interval: time.Minute, Fps: 30, Stop: 24 * time.Hour, Daylight: true, Latitude: 91})
+	s.Error(err)
+	// the daylight needs the position
+	_, err = New(s.grab, encoders.NewEncoderService(), Config{Dir: s.dir, Interval: time.Minute, Fps: 30, Stop: 24 * time.Hour, Daylight: true})
+	s.Error(err)
+}
+
+func (s *TimelapseSuit) Test_Prune() {
+	timelapse, err := New(s.grab, encoders.NewEncoderService(), Config{
+		Dir:        s.dir,
+		Interval:   time.Minute,
+		Fps:        10,
+		Stop:       24 * time.Hour,
+		KeepFrames: true,
+		MaxAge:     3 * 24 * time.Hour,
+		MaxBytes:   1300,
+		Location:   s.paris,
+	})
+	s.Require().NoError(err)
+	write := func(path string, size int) {
+		s.Require().NoError(os.MkdirAll(filepath.Dir(path), 0o755))
+		s.Require().NoError(os.WriteFile(path, make([]byte, size), 0o644))
+	}
+	for _, day := range []string{"2024-05-01", "2024-05-05", "2024-05-06", "2024-05-07"} {
+		write(timelapse.VideoPath(day), 200)
+		write(filepath.Join(s.dir, framesDir, day, "frame"+frameExt), 100)
+	}
+	write(filepath.Join(s.dir, framesDir, "2024-05-08", "frame"+frameExt), 700)
+
+	// 05-01 is too old, 05-05 goes for the size, the current day stays even over it
+	s.Require().NoError(timelapse.prune(time.Date(2024, 5, 8, 12, 0, 0, 0, s.paris)))
+	days, err := timelapse.Videos()
+	s.Require().NoError(err)
+	s.Equal([]string{"2024-05-06", "2024-05-07"}, days)
+	s.NoDirExists(filepath.Join(s.dir, framesDir, "2024-05-01"))
+	s.NoDirExists(filepath.Join(s.dir, framesDir, "2024-05-05"))
+	s.DirExists(filepath.Join(s.dir, framesDir, "2024-05-06"))
+	s.DirExists(filepath.Join(s.dir, framesDir, "2024-05-08"))
+}
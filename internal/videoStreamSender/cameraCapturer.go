@@ -3,9 +3,9 @@ package vidoestreamsender
 import (
 	"errors"
 	"fmt"
-	"image"
 	"time"
 
+	"github.com/acentior/camera-pipeline-sender/internal/filters"
 	"github.com/acentior/camera-pipeline-sender/pkg/size"
 	"github.com/pion/mediadevices"
 	"github.com/pion/mediadevices/pkg/io/video"
@@ -13,19 +13,26 @@ import (
 )
 
 type CameraCapturer struct {
-	fps          int
-	agentNum     int
-	frames       chan *image.RGBA
-	stop         chan struct{}
-	agentAdded   chan struct{}
-	agentRemoved chan struct{}
-	frameReader  *video.Reader
-	size         size.Size
+	fps    int
+	fanOut frameFanOut
+	stop   chan struct{}
+	// done is closed when the capture loop ends, stopped or on a camera error
+	done        chan struct{}
+	subscribe   chan chan *Frame
+	unsubscribe chan (<-chan *Frame)
+	frameReader *video.Reader
+	size        size.Size
+	filters     *filters.Chain
+	seq         uint64
 }
 
-func CreateCameraCapturer(width int, height int, fps int) (*CameraCapturer, error) {
+// CreateCameraCapturer opens the camera with the given device id, an empty id picks any camera
+func CreateCameraCapturer(deviceID string, width int, height int, fps int) (*CameraCapturer, error) {
 	stream, err := mediadevices.GetUserMedia(mediadevices.MediaStreamConstraints{
 		Video: func(mtc *mediadevices.MediaTrackConstraints) {
+			if deviceID != "" {
+				mtc.DeviceID = prop.StringExact(deviceID)
+			}
 			mtc.Width = prop.Int(width)
 			mtc.Height = prop.Int(height)
 		},
@@ -51,14 +58,14 @@ func CreateCameraCapturer(width int, height int, fps int) (*CameraCapturer, erro
 	// }
 
 	return &CameraCapturer{
-		fps:          fps,
-		agentNum:     0,
-		frames:       make(chan *image.RGBA),
-		stop:         make(chan struct{}),
-		agentAdded:   make(chan struct{}),
-		agentRemoved: make(chan struct{}),
-		frameReader:  &freader,
-		size:         vSize,
+		fps:         fps,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		subscribe:   make(chan chan *Frame),
+		unsubscribe: make(chan (<-chan *Frame)),
+		frameReader: &freader,
+		size:        vSize,
+		filters:     filters.NewChain(),
 	}, nil
 }
 
@@ -67,29 +74,31 @@ func (cc *CameraCapturer) Start() {
 	fmt.Println("capturer started")
 	delta := time.Duration(1000/cc.fps) * time.Millisecond
 	go func() {
+		defer close(cc.done)
 		for {
 			startedAt := time.Now()
 			select {
 			case <-cc.stop:
 				fmt.Println("Close cam capturer")
-				close(cc.frames)
+				cc.fanOut.closeAll()
 				return
-			case <-cc.agentAdded:
-				cc.agentNum += 1
-				fmt.Printf("new agent added %v\n", cc.agentNum)
-			case <-cc.agentRemoved:
-				cc.agentNum -= 1
-				fmt.Printf("new agent removed %v\n", cc.agentNum)
+			case ch := <-cc.subscribe:
+				cc.fanOut.add(ch)
+				fmt.Printf("new agent added %v\n", cc.fanOut.len())
+			case ch := <-cc.unsubscribe:
+				cc.fanOut.remove(ch)
+				fmt.Printf("new agent removed %v\n", cc.fanOut.len())
 			default:
 				img, _, err := (*cc.frameReader).Read()
 				if err != nil {
 					fmt.Printf("Error while read cam: %v\n", err)
+					cc.fanOut.closeAll()
 					return
 				}
-				rgbaImage := imgToRGPA(img)
-				for i := 0; i < cc.agentNum; i++ {
-					cc.frames <- rgbaImage
-				}
+				capturedAt := time.Now()
+				rgbaImage := cc.filters.Apply(imgToRGPA(img))
+				cc.fanOut.send(&Frame{Image: rgbaImage, Time: capturedAt, Seq: cc.seq})
+				cc.seq++
 				ellapsed := time.Now().Sub(startedAt)
 				sleepDuration := delta - ellapsed
 				if sleepDuration > 0 {
@@ -100,9 +109,14 @@ func (cc *CameraCapturer) Start() {
 	}()
 }
 
-// Frames returns a channel that will receive an image stream
-func (cc *CameraCapturer) Frames() <-chan *image.RGBA {
-	return cc.frames
+// Subscribe returns a new channel that will receive the image stream
+func (cc *CameraCapturer) Subscribe() <-chan *Frame {
+	return subscribeTo(cc.subscribe, cc.stop, cc.done)
+}
+
+// Unsubscribe stops and closes a channel returned by Subscribe
+func (cc *CameraCapturer) Unsubscribe(frames <-chan *Frame) {
+	unsubscribeFrom(cc.unsubscribe, frames, cc.stop, cc.done)
 }
 
 // Stop sends a stop signal to the capture loop
@@ -115,15 +129,12 @@ func (cc *CameraCapturer) Fps() int {
 	return cc.fps
 }
 
-// Get size (width and height of the captured image)
+// Get size (width and height of the captured image, after the filters)
 func (cc *CameraCapturer) Size() size.Size {
-	return cc.size
-}
-
-func (cc *CameraCapturer) AgentAdded() {
-	cc.agentAdded <- struct{}{}
+	return cc.filters.OutputSize(cc.size)
 }
 
-func (cc *CameraCapturer) AgentRemoved() {
-	cc.agentRemoved <- struct{}{}
+// Filters returns the filter chain applied to every captured frame
+func (cc *CameraCapturer) Filters() *filters.Chain {
+	return cc.filters
 }
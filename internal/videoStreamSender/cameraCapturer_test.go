@@ -0,0 +1,58 @@
+package vidoestreamsender
+
+import (
+	"errors"
+	"image"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/filters"
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/stretchr/testify/suite"
+)
+
+type CameraCapturerSuit struct {
+	suite.Suite
+}
+
+func TestCameraCapturerSuite(t *testing.T) {
+	suite.Run(t, new(CameraCapturerSuit))
+}
+
+func (s *CameraCapturerSuit) Test_ReadErrorEndsSubscriptions() {
+	var reader video.Reader = video.ReaderFunc(func() (image.Image, func(), error) {
+		return nil, func() {}, errors.New("unplugged")
+	})
+	cc := &CameraCapturer{
+		fps:         30,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		subscribe:   make(chan chan *Frame),
+		unsubscribe: make(chan (<-chan *Frame)),
+		frameReader: &reader,
+		size:        size.Size{Width: 16, Height: 16},
+		filters:     filters.NewChain(),
+	}
+	cc.Start()
+	select {
+	case <-cc.done:
+	case <-time.After(time.Second):
+		s.FailNow("the capture loop didn't end")
+	}
+
+	// neither blocks once the loop is gone
+	subscribed := make(chan struct{})
+	go func() {
+		defer close(subscribed)
+		frames := cc.Subscribe()
+		_, ok := <-frames
+		s.False(ok)
+		cc.Unsubscribe(frames)
+	}()
+	select {
+	case <-subscribed:
+	case <-time.After(time.Second):
+		s.Fail("Subscribe blocked on a dead capturer")
+	}
+}
@@ -0,0 +1,53 @@
+package vidoestreamsender
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxTriggerSize bounds the body of a clip trigger
+const maxTriggerSize = 4 << 10
+
+// triggerClip records a clip around now, it does nothing when clips are disabled
+func (vss *VideoStreamSender) triggerClip(reason string) (time.Time, bool) {
+	if vss.clips == nil {
+		return time.Time{}, false
+	}
+	if reason == "" {
+		reason = "unknown"
+	}
+	return vss.clips.Trigger(reason), true
+}
+
+// handleClips triggers a clip with an optional JSON body {"reason": "..."}, the response tells when it ends
+func (vss *VideoStreamSender) handleClips(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	req := struct {
+		Reason string `json:"reason"`
+	}{}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxTriggerSize))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			httpError(w, http.StatusBadRequest, "Invalid trigger: "+err.Error())
+			return
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = "api"
+	}
+	until, ok := vss.triggerClip(req.Reason)
+	if !ok {
+		httpError(w, http.StatusNotFound, "Clips are disabled")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"reason": req.Reason, "until": until})
+}
@@ -0,0 +1,291 @@
+package vidoestreamsender
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/filters"
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/nfnt/resize"
+)
+
+// LayoutKind selects how the compositor arranges its sources
+type LayoutKind string
+
+const (
+	// LayoutGrid tiles every source in an evenly sized grid
+	LayoutGrid LayoutKind = "grid"
+	// LayoutPiP shows one source full frame with the others as insets
+	LayoutPiP LayoutKind = "pip"
+)
+
+const defaultInsetScale = 0.25
+
+// Layout describes the arrangement of the compositor output
+type Layout struct {
+	Kind LayoutKind `json:"kind"`
+	// Main is the index of the full frame source in LayoutPiP
+	Main int `json:"main"`
+	// InsetScale is the inset width relative to the output width in LayoutPiP
+	InsetScale float64 `json:"insetScale"`
+}
+
+// Compositor combines several frame sources into a single frame source
+type Compositor struct {
+	fps         int
+	fanOut      frameFanOut
+	stop        chan struct{}
+	done        chan struct{}
+	subscribe   chan chan *Frame
+	unsubscribe chan (<-chan *Frame)
+	size        size.Size
+	sources     []FrameSource
+	filters     *filters.Chain
+
+	seq uint64
+
+	mu     sync.Mutex
+	latest []*Frame
+	layout Layout
+}
+
+// NewCompositor creates a compositor rendering the sources at the given size and fps.
+// The compositor owns the sources, it starts and stops them with itself.
+func NewCompositor(sources []FrameSource, outSize size.Size, fps int, layout Layout) (*Compositor, error) {
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("Compositor needs at least one source")
+	}
+	if fps <= 0 {
+		return nil, fmt.Errorf("Invalid compositor frame rate %d", fps)
+	}
+	if err := validateLayout(layout, len(sources), outSize); err != nil {
+		return nil, err
+	}
+	return &Compositor{
+		fps:         fps,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		subscribe:   make(chan chan *Frame),
+		unsubscribe: make(chan (<-chan *Frame)),
+		layout:      layout,
+		size:        outSize,
+		sources:     sources,
+		filters:     filters.NewChain(),
+		latest:      make([]*Frame, len(sources)),
+	}, nil
+}
+
+// ParseLayoutKind converts a configuration value into a LayoutKind
+func ParseLayoutKind(kind string) (LayoutKind, error) {
+	switch LayoutKind(kind) {
+	case LayoutGrid, LayoutPiP:
+		return LayoutKind(kind), nil
+	}
+	return "", fmt.Errorf("Unknown compositor layout %q", kind)
+}
+
+func validateLayout(layout Layout, sourceNum int, out size.Size) error {
+	if _, err := ParseLayoutKind(string(layout.Kind)); err != nil {
+		return err
+	}
+	if layout.Main < 0 || layout.Main >= sourceNum {
+		return fmt.Errorf("Main source %d out of range", layout.Main)
+	}
+	if layout.InsetScale < 0 || layout.InsetScale >= 1 {
+		return fmt.Errorf("Inset scale %v out of range", layout.InsetScale)
+	}
+	if layout.Kind == LayoutPiP && sourceNum > 1 {
+		insets := pipInsets(layout, out)
+		if insets.perRow == 0 || (sourceNum-1+insets.perRow-1)/insets.perRow > insets.rows {
+			return fmt.Errorf("%d insets at scale %v don't fit in %dx%d", sourceNum-1, layout.InsetScale, out.Width, out.Height)
+		}
+	}
+	return nil
+}
+
+// pipGrid is the placement of the insets of LayoutPiP, in rows from the bottom right corner
+type pipGrid struct {
+	width, height, margin int
+	// perRow and rows are the number of insets fitting in a row and the number of rows fitting in the output
+	perRow, rows int
+}
+
+func pipInsets(layout Layout, out size.Size) pipGrid {
+	scale := layout.InsetScale
+	if scale == 0 {
+		scale = defaultInsetScale
+	}
+	g := pipGrid{
+		width:  int(float64(out.Width) * scale),
+		height: int(float64(out.Height) * scale),
+		margin: out.Width / 50,
+	}
+	// every inset takes a margin on its right and below it
+	if g.width+g.margin > 0 && g.height+g.margin > 0 {
+		g.perRow = out.Width / (g.width + g.margin)
+		g.rows = out.Height / (g.height + g.margin)
+	}
+	return g
+}
+
+// Start starts the sources and the compose loop
+func (c *Compositor) Start() {
+	for i, src := range c.sources {
+		src.Start()
+		go c.collect(i, src.Subscribe())
+	}
+	ticker := time.NewTicker(time.Second / time.Duration(c.fps))
+	go func() {
+		defer close(c.done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				c.fanOut.closeAll()
+				return
+			case ch := <-c.subscribe:
+				c.fanOut.add(ch)
+			case ch := <-c.unsubscribe:
+				c.fanOut.remove(ch)
+			case now := <-ticker.C:
+				if c.fanOut.len() == 0 {
+					continue
+				}
+				frame := c.compose(now)
+				frame.Image = c.filters.Apply(frame.Image)
+				c.fanOut.send(frame)
+				c.seq++
+			}
+		}
+	}()
+}
+
+// collect keeps the most recent frame of a source
+func (c *Compositor) collect(index int, frames <-chan *Frame) {
+	for frame := range frames {
+		c.mu.Lock()
+		c.latest[index] = frame
+		c.mu.Unlock()
+	}
+}
+
+// compose draws the latest frame of every source, the composed frame is stamped with the tick time
+// since the sources capture at their own pace
+func (c *Compositor) compose(now time.Time) *Frame {
+	out := image.NewRGBA(image.Rect(0, 0, c.size.Width, c.size.Height))
+	c.mu.Lock()
+	latest := make([]*Frame, len(c.latest))
+	copy(latest, c.latest)
+	layout := c.layout
+	c.mu.Unlock()
+
+	for i, rect := range layoutRects(layout, len(latest), c.size) {
+		if latest[i] == nil {
+			continue
+		}
+		drawFitted(out, rect, latest[i].Image)
+	}
+	return &Frame{Image: out, Time: now, Seq: c.seq}
+}
+
+// layoutRects returns the output rectangle of every source, in drawing order
+func layoutRects(layout Layout, n int, out size.Size) []image.Rectangle {
+	rects := make([]image.Rectangle, n)
+	switch layout.Kind {
+	case LayoutPiP:
+		rects[layout.Main] = image.Rect(0, 0, out.Width, out.Height)
+		g := pipInsets(layout, out)
+		// the insets fill the bottom row from the right, then the rows above it
+		inset := 0
+		for i := range rects {
+			if i == layout.Main {
+				continue
+			}
+			col, row := inset, 0
+			if g.perRow > 0 {
+				col, row = inset%g.perRow, inset/g.perRow
+			}
+			x := out.Width - g.margin - g.width - col*(g.width+g.margin)
+			y := out.Height - g.margin - g.height - row*(g.height+g.margin)
+			rects[i] = image.Rect(x, y, x+g.width, y+g.height)
+			inset++
+		}
+	default:
+		cols := int(math.Ceil(math.Sqrt(float64(n))))
+		rows := int(math.Ceil(float64(n) / float64(cols)))
+		cellW, cellH := out.Width/cols, out.Height/rows
+		for i := range rects {
+			x, y := (i%cols)*cellW, (i/cols)*cellH
+			rects[i] = image.Rect(x, y, x+cellW, y+cellH)
+		}
+	}
+	return rects
+}
+
+// drawFitted scales src into rect keeping the aspect ratio, centered
+func drawFitted(dst *image.RGBA, rect image.Rectangle, src *image.RGBA) {
+	sb := src.Bounds()
+	if rect.Empty() || sb.Empty() {
+		return
+	}
+	scale := math.Min(float64(rect.Dx())/float64(sb.Dx()), float64(rect.Dy())/float64(sb.Dy()))
+	w, h := int(float64(sb.Dx())*scale), int(float64(sb.Dy())*scale)
+	scaled := resize.Resize(uint(w), uint(h), src, resize.Bilinear)
+	offset := image.Pt(rect.Min.X+(rect.Dx()-w)/2, rect.Min.Y+(rect.Dy()-h)/2)
+	draw.Draw(dst, image.Rectangle{Min: offset, Max: offset.Add(image.Pt(w, h))}, scaled, scaled.Bounds().Min, draw.Src)
+}
+
+// SetLayout changes the layout, from the next composed frame
+func (c *Compositor) SetLayout(layout Layout) error {
+	if err := validateLayout(layout, len(c.sources), c.size); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.layout = layout
+	return nil
+}
+
+// Layout returns the current layout
+func (c *Compositor) Layout() Layout {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.layout
+}
+
+// Subscribe returns a new channel that will receive the composed frames
+func (c *Compositor) Subscribe() <-chan *Frame {
+	return subscribeTo(c.subscribe, c.stop, c.done)
+}
+
+// Unsubscribe stops and closes a channel returned by Subscribe
+func (c *Compositor) Unsubscribe(frames <-chan *Frame) {
+	unsubscribeFrom(c.unsubscribe, frames, c.stop, c.done)
+}
+
+// Stop stops the compose loop and the sources
+func (c *Compositor) Stop() {
+	close(c.stop)
+	for _, src := range c.sources {
+		src.Stop()
+	}
+}
+
+// Fps returns the frames per sec. of the composed output
+func (c *Compositor) Fps() int {
+	return c.fps
+}
+
+// Size returns the size of the composed output, after the filters
+func (c *Compositor) Size() size.Size {
+	return c.filters.OutputSize(c.size)
+}
+
+// Filters returns the filter chain applied to every composed frame
+func (c *Compositor) Filters() *filters.Chain {
+	return c.filters
+}
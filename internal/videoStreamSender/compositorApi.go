@@ -0,0 +1,34 @@
+package vidoestreamsender
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleLayout reads or changes the layout of the compositor, with several cameras only
+//
+//	GET the current layout
+//	PUT the JSON layout in the body, {"kind":"pip","main":1,"insetScale":0.3}
+func (vss *VideoStreamSender) handleLayout(w http.ResponseWriter, r *http.Request) {
+	if vss.compositor == nil {
+		httpError(w, http.StatusNotFound, "No compositor, a single camera is configured")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		layout := vss.compositor.Layout()
+		if err := json.NewDecoder(r.Body).Decode(&layout); err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := vss.compositor.SetLayout(layout); err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, vss.compositor.Layout())
+}
@@ -0,0 +1,165 @@
+package vidoestreamsender
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/filters"
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/stretchr/testify/suite"
+)
+
+// solidSource is a FrameSource sending a single colored frame forever
+type solidSource struct {
+	stop  chan struct{}
+	frame *image.RGBA
+}
+
+func newSolidSource(c color.Color, s size.Size) *solidSource {
+	frame := image.NewRGBA(image.Rect(0, 0, s.Width, s.Height))
+	draw.Draw(frame, frame.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return &solidSource{stop: make(chan struct{}), frame: frame}
+}
+
+func (s *solidSource) Start() {}
+func (s *solidSource) Stop()  { close(s.stop) }
+
+func (s *solidSource) Subscribe() <-chan *Frame {
+	frames := make(chan *Frame)
+	go func() {
+		defer close(frames)
+		for seq := uint64(0); ; seq++ {
+			select {
+			case <-s.stop:
+				return
+			case frames <- &Frame{Image: s.frame, Time: time.Now(), Seq: seq}:
+			}
+		}
+	}()
+	return frames
+}
+
+func (s *solidSource) Unsubscribe(<-chan *Frame) {}
+func (s *solidSource) Fps() int                  { return 30 }
+func (s *solidSource) Filters() *filters.Chain   { return nil }
+func (s *solidSource) Size() size.Size {
+	return size.Size{Width: s.frame.Rect.Dx(), Height: s.frame.Rect.Dy()}
+}
+
+type CompositorSuit struct {
+	suite.Suite
+}
+
+func TestCompositorSuite(t *testing.T) {
+	suite.Run(t, new(CompositorSuit))
+}
+
+func (s *CompositorSuit) Test_GridRects() {
+	rects := layoutRects(Layout{Kind: LayoutGrid}, 3, size.Size{Width: 640, Height: 480})
+	s.Equal(image.Rect(0, 0, 320, 240), rects[0])
+	s.Equal(image.Rect(320, 0, 640, 240), rects[1])
+	s.Equal(image.Rect(0, 240, 320, 480), rects[2])
+}
+
+func (s *CompositorSuit) Test_PiPRects() {
+	rects := layoutRects(Layout{Kind: LayoutPiP, Main: 1, InsetScale: 0.25}, 2, size.Size{Width: 800, Height: 600})
+	s.Equal(image.Rect(0, 0, 800, 600), rects[1])
+	s.Equal(image.Rect(584, 434, 784, 584), rects[0])
+}
+
+func (s *CompositorSuit) Test_PiPRows() {
+	out := size.Size{Width: 800, Height: 600}
+	layout := Layout{Kind: LayoutPiP, InsetScale: 0.25}
+	// three insets of 200 and their margins fit in a row, the fourth one starts the row above
+	rects := layoutRects(layout, 6, out)
+	s.Equal(image.Rect(584, 434, 784, 584), rects[1])
+	s.Equal(image.Rect(152, 434, 352, 584), rects[3])
+	s.Equal(image.Rect(584, 268, 784, 418), rects[4])
+	s.Equal(image.Rect(368, 268, 568, 418), rects[5])
+	for _, rect := range rects {
+		s.True(rect.In(image.Rect(0, 0, out.Width, out.Height)), rect)
+	}
+
+	// three rows of three
+	s.NoError(validateLayout(layout, 10, out))
+	s.Error(validateLayout(layout, 11, out))
+	s.Error(validateLayout(Layout{Kind: LayoutPiP, InsetScale: 0.6}, 3, out))
+	s.NoError(validateLayout(Layout{Kind: LayoutPiP, InsetScale: 0.6}, 2, out))
+}
+
+func (s *CompositorSuit) Test_InvalidLayout() {
+	src := newSolidSource(color.White, size.Size{Width: 16, Height: 16})
+	_, err := NewCompositor([]FrameSource{src}, size.Size{Width: 32, Height: 32}, 30, Layout{Kind: LayoutPiP, Main: 1})
+	s.Error(err)
+	_, err = NewCompositor([]FrameSource{src}, size.Size{Width: 32, Height: 32}, 30, Layout{Kind: "mosaic"})
+	s.Error(err)
+	_, err = NewCompositor([]FrameSource{src}, size.Size{Width: 32, Height: 32}, 0, Layout{Kind: LayoutGrid})
+	s.Error(err)
+}
+
+func (s *CompositorSuit) Test_LayoutAPI() {
+	red := newSolidSource(color.RGBA{R: 255, A: 255}, size.Size{Width: 64, Height: 48})
+	blue := newSolidSource(color.RGBA{B: 255, A: 255}, size.Size{Width: 64, Height: 48})
+	vss := newTestSender(red)
+	vss.handleAPI("/api/layout", vss.handleLayout)
+	server := httptest.NewServer(vss.httpMux)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/api/layout")
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusNotFound, resp.StatusCode)
+
+	// the compositor isn't started, a change must not wait for its loop
+	vss.compositor, err = NewCompositor([]FrameSource{red, blue}, size.Size{Width: 128, Height: 48}, 30, Layout{Kind: LayoutGrid})
+	s.Require().NoError(err)
+	put := func(body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/api/layout", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		s.Require().NoError(err)
+		return resp
+	}
+	resp = put(`{"kind":"pip","main":1,"insetScale":0.3}`)
+	defer resp.Body.Close()
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	layout := Layout{}
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&layout))
+	s.Equal(Layout{Kind: LayoutPiP, Main: 1, InsetScale: 0.3}, layout)
+	s.Equal(layout, vss.compositor.Layout())
+
+	resp = put(`{"main":2}`)
+	resp.Body.Close()
+	s.Equal(http.StatusBadRequest, resp.StatusCode)
+	s.Equal(layout, vss.compositor.Layout())
+}
+
+func (s *CompositorSuit) Test_ComposeAndSwitchLayout() {
+	red := newSolidSource(color.RGBA{R: 255, A: 255}, size.Size{Width: 64, Height: 48})
+	blue := newSolidSource(color.RGBA{B: 255, A: 255}, size.Size{Width: 64, Height: 48})
+	c, err := NewCompositor([]FrameSource{red, blue}, size.Size{Width: 128, Height: 48}, 30, Layout{Kind: LayoutGrid})
+	s.Require().NoError(err)
+	c.Start()
+	defer c.Stop()
+	frames := c.Subscribe()
+	defer c.Unsubscribe(frames)
+
+	frame := <-frames
+	for frame.Image.RGBAAt(96, 24).B != 255 {
+		// the first ticks may happen before every source delivered a frame
+		frame = <-frames
+	}
+	s.Equal(uint8(255), frame.Image.RGBAAt(32, 24).R)
+
+	s.Require().NoError(c.SetLayout(Layout{Kind: LayoutPiP, Main: 1}))
+	// skip the frame composed before the layout change, if it is still waiting
+	<-frames
+	frame = <-frames
+	s.Equal(uint8(255), frame.Image.RGBAAt(64, 10).B)
+	s.Equal(uint8(255), frame.Image.RGBAAt(110, 40).R)
+}
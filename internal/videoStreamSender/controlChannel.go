@@ -0,0 +1,398 @@
+package vidoestreamsender
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/recorder"
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/pion/webrtc/v3"
+)
+
+// ControlProtocolVersion is the version of the control data channel protocol.
+// Requests carrying another version are refused, so old viewers fail loudly instead of misbehaving.
+const ControlProtocolVersion = 1
+
+// Control request types
+const (
+	ControlAuth            = "auth"
+	ControlGetStatus       = "get-status"
+	ControlSetBitrate      = "set-bitrate"
+	ControlSetFps          = "set-fps"
+	ControlRequestKeyframe = "request-keyframe"
+	ControlSnapshot        = "snapshot"
+	ControlPlayback        = "playback"
+	ControlPause           = "pause"
+	ControlResume          = "resume"
+	ControlSeek            = "seek"
+	ControlSetRate         = "set-rate"
+	ControlLive            = "live"
+)
+
+// ControlPlaybackEnded is the event sent when the footage played ends and the live stream comes back
+const ControlPlaybackEnded = "playback-ended"
+
+// controlRole is the permission level of a control channel
+type controlRole int
+
+const (
+	// roleViewer may only query and act on its own stream
+	roleViewer controlRole = iota
+	// roleAdmin may also change the settings of every viewer
+	roleAdmin
+)
+
+func (r controlRole) String() string {
+	if r == roleAdmin {
+		return "admin"
+	}
+	return "viewer"
+}
+
+// controlRoles is the role needed by each request type
+var controlRoles = map[string]controlRole{
+	ControlAuth:            roleViewer,
+	ControlGetStatus:       roleViewer,
+	ControlRequestKeyframe: roleViewer,
+	ControlSnapshot:        roleViewer,
+	ControlPlayback:        roleViewer,
+	ControlPause:           roleViewer,
+	ControlResume:          roleViewer,
+	ControlSeek:            roleViewer,
+	ControlSetRate:         roleViewer,
+	ControlLive:            roleViewer,
+	ControlSetBitrate:      roleAdmin,
+	ControlSetFps:          roleAdmin,
+}
+
+const (
+	minBitrate = 50
+	maxBitrate = 50000
+	// snapshotChunkSize keeps every message below the 64KiB data channel limit of most browsers
+	snapshotChunkSize = 48 * 1024
+	snapshotTimeout   = 2 * time.Second
+)
+
+// controlRequest is a JSON message of the control data channel, the parameters depend on the type
+type controlRequest struct {
+	V    int    `json:"v"`
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Token of the auth request
+	Token string `json:"token,omitempty"`
+	// Bitrate in kbit/s of the set-bitrate request
+	Bitrate int `json:"bitrate,omitempty"`
+	// Fps of the set-fps request, 0 restores the source frame rate
+	Fps int `json:"fps,omitempty"`
+	// Width and Quality of the snapshot request, the defaults are the frame width and 85
+	Width   int `json:"width,omitempty"`
+	Quality int `json:"quality,omitempty"`
+	// Time in RFC 3339 of the playback and seek requests, Kind the recordings played, recordings or clips
+	Time string `json:"time,omitempty"`
+	Kind string `json:"kind,omitempty"`
+	// Rate of the playback and set-rate requests, 2 plays twice as fast
+	Rate float64 `json:"rate,omitempty"`
+}
+
+// controlResponse answers a request with the same id
+type controlResponse struct {
+	V      int         `json:"v"`
+	ID     string      `json:"id"`
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// controlStatus is the result of get-status and of the requests changing the stream
+type controlStatus struct {
+	Protocol  int      `json:"protocol"`
+	Role      string   `json:"role"`
+	Width     int      `json:"width"`
+	Height    int      `json:"height"`
+	Fps       int      `json:"fps"`
+	SourceFps int      `json:"sourceFps"`
+	Bitrate   int      `json:"bitrate"`
+	Viewers   int      `json:"viewers"`
+	PTZ       PTZState `json:"ptz"`
+	// Playback is the state of the recorded footage played, missing when live
+	Playback *recorder.PlayerState `json:"playback,omitempty"`
+}
+
+// controlEvent is sent by the sender without a request
+type controlEvent struct {
+	V      int         `json:"v"`
+	Type   string      `json:"type"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// snapshotResult describes the JPEG following the response in chunks
+type snapshotResult struct {
+	ContentType string `json:"contentType"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Bytes       int    `json:"bytes"`
+	Chunks      int    `json:"chunks"`
+}
+
+// snapshotChunk carries a base64 part of a snapshot, in order
+type snapshotChunk struct {
+	V     int    `json:"v"`
+	ID    string `json:"id"`
+	Chunk int    `json:"chunk"`
+	Data  string `json:"data"`
+}
+
+// controlChannel serves the requests of one viewer
+type controlChannel struct {
+	vss     *VideoStreamSender
+	session *viewerSession
+	dc      *webrtc.DataChannel
+	role    controlRole
+}
+
+// handleControlChannel serves the control requests received on a data channel.
+// The requests are handled one at a time, in the order they arrive.
+func (vss *VideoStreamSender) handleControlChannel(dc *webrtc.DataChannel, session *viewerSession) {
+	c := &controlChannel{vss: vss, session: session, dc: dc, role: roleViewer}
+	session.control = c
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		req := controlRequest{}
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			c.send(controlResponse{V: ControlProtocolVersion, Error: fmt.Sprintf("Invalid request: %v", err)})
+			return
+		}
+		c.handle(req)
+	})
+}
+
+func (c *controlChannel) handle(req controlRequest) {
+	resp := controlResponse{V: ControlProtocolVersion, ID: req.ID}
+	result, err := c.dispatch(req)
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.OK = true
+		resp.Result = result
+	}
+	c.send(resp)
+
+	if snapshot, ok := result.(*snapshot); ok && err == nil {
+		c.sendSnapshot(req.ID, snapshot.data)
+	}
+}
+
+func (c *controlChannel) dispatch(req controlRequest) (interface{}, error) {
+	if req.V != ControlProtocolVersion {
+		return nil, fmt.Errorf("Unsupported protocol version %d, expected %d", req.V, ControlProtocolVersion)
+	}
+	role, found := controlRoles[req.Type]
+	if !found {
+		return nil, fmt.Errorf("Unknown request type %q", req.Type)
+	}
+	if c.role < role {
+		return nil, fmt.Errorf("%q needs the %v role", req.Type, role)
+	}
+
+	streamer := c.session.streamer
+	switch req.Type {
+	case ControlAuth:
+		token := c.vss.controlAdminToken
+		if token == "" || subtle.ConstantTimeCompare([]byte(req.Token), []byte(token)) != 1 {
+			return nil, fmt.Errorf("Invalid token")
+		}
+		c.role = roleAdmin
+	case ControlGetStatus:
+	case ControlRequestKeyframe:
+		streamer.forceKeyframe()
+	case ControlSnapshot:
+		return takeSnapshot(c.vss.source, req.Width, req.Quality)
+	case ControlSetBitrate:
+		if req.Bitrate < minBitrate || req.Bitrate > maxBitrate {
+			return nil, fmt.Errorf("Bitrate must be between %d and %d kbit/s", minBitrate, maxBitrate)
+		}
+		c.vss.setStreamBitrate(req.Bitrate)
+	case ControlSetFps:
+		if req.Fps < 0 || req.Fps > c.vss.source.Fps() {
+			return nil, fmt.Errorf("Fps must be between 1 and %d, 0 restores the source rate", c.vss.source.Fps())
+		}
+		c.vss.setStreamFps(req.Fps)
+	case ControlPlayback:
+		from, err := time.Parse(time.RFC3339Nano, req.Time)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid time %q", req.Time)
+		}
+		if _, err := c.vss.startPlayback(c.session, &playbackRequest{from: from, kind: req.Kind, rate: req.Rate}); err != nil {
+			return nil, err
+		}
+	case ControlLive:
+		c.vss.stopPlayback(c.session)
+	case ControlPause, ControlResume, ControlSeek, ControlSetRate:
+		if err := c.controlPlayback(req); err != nil {
+			return nil, err
+		}
+	}
+	return c.status(), nil
+}
+
+// controlPlayback applies a request on the ongoing playback
+func (c *controlChannel) controlPlayback(req controlRequest) error {
+	player := c.session.player()
+	if player == nil {
+		return fmt.Errorf("No playback, the stream is live")
+	}
+	switch req.Type {
+	case ControlPause:
+		player.Pause()
+	case ControlResume:
+		player.Resume()
+	case ControlSeek:
+		t, err := time.Parse(time.RFC3339Nano, req.Time)
+		if err != nil {
+			return fmt.Errorf("Invalid time %q", req.Time)
+		}
+		player.Seek(t)
+	case ControlSetRate:
+		return player.SetRate(req.Rate)
+	}
+	return nil
+}
+
+func (c *controlChannel) status() controlStatus {
+	fps, bitrate := c.session.streamer.settings()
+	viewers := 0
+	c.vss.eachSession(func(*viewerSession) { viewers++ })
+	status := controlStatus{
+		Protocol:  ControlProtocolVersion,
+		Role:      c.role.String(),
+		Width:     c.session.streamer.size.Width,
+		Height:    c.session.streamer.size.Height,
+		Fps:       fps,
+		SourceFps: c.vss.source.Fps(),
+		Bitrate:   bitrate,
+		Viewers:   viewers,
+	}
+	if ptz := c.session.streamer.ptz; ptz != nil {
+		status.PTZ = ptz.state()
+	}
+	if player := c.session.player(); player != nil {
+		state := player.State()
+		status.Playback = &state
+	}
+	return status
+}
+
+func (c *controlChannel) send(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logger.Printf("Failed to encode control message: %v\n", err)
+		return
+	}
+	if err := c.dc.SendText(string(data)); err != nil {
+		logger.Printf("Failed to send control message to %v: %v\n", c.session.id, err)
+	}
+}
+
+func (c *controlChannel) sendSnapshot(id string, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for i := 0; len(encoded) > 0; i++ {
+		n := min(snapshotChunkSize, len(encoded))
+		c.send(snapshotChunk{V: ControlProtocolVersion, ID: id, Chunk: i, Data: encoded[:n]})
+		encoded = encoded[n:]
+	}
+}
+
+// snapshot is a JPEG of the current frame, its data is sent after the response
+type snapshot struct {
+	snapshotResult
+	data []byte
+}
+
+// takeSnapshot encodes the next frame of the source into a JPEG no wider than width
+func takeSnapshot(source FrameSource, width int, quality int) (*snapshot, error) {
+	frame, err := grabFrame(source, snapshotTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if quality <= 0 || quality > 100 {
+		quality = 85
+	}
+	data, encodedSize, err := encodeJPEG(frame.Image, size.Size{Width: width}, quality)
+	if err != nil {
+		return nil, err
+	}
+	chunks := (base64.StdEncoding.EncodedLen(len(data)) + snapshotChunkSize - 1) / snapshotChunkSize
+	return &snapshot{
+		snapshotResult: snapshotResult{
+			ContentType: "image/jpeg",
+			Width:       encodedSize.Width,
+			Height:      encodedSize.Height,
+			Bytes:       len(data),
+			Chunks:      chunks,
+		},
+		data: data,
+	}, nil
+}
+
+// encodeJPEG encodes a frame scaled down to fit in bounds, keeping its aspect ratio.
+// A zero bound doesn't constrain its dimension, frames are never scaled up.
+func encodeJPEG(frame *image.RGBA, bounds size.Size, quality int) ([]byte, size.Size, error) {
+	b := frame.Bounds()
+	scale := 1.0
+	if bounds.Width > 0 && bounds.Width < b.Dx() {
+		scale = float64(bounds.Width) / float64(b.Dx())
+	}
+	if bounds.Height > 0 && bounds.Height < b.Dy() {
+		scale = min(scale, float64(bounds.Height)/float64(b.Dy()))
+	}
+	var img image.Image = frame
+	if scale < 1 {
+		img = resizeImage(frame, size.Size{
+			Width:  max(1, int(float64(b.Dx())*scale+0.5)),
+			Height: max(1, int(float64(b.Dy())*scale+0.5)),
+		})
+	}
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, size.Size{}, err
+	}
+	return buf.Bytes(), size.Size{Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}, nil
+}
+
+// setStreamBitrate changes the bitrate of every viewer, and of the viewers to come
+func (vss *VideoStreamSender) setStreamBitrate(kbps int) {
+	vss.streamMu.Lock()
+	vss.streamBitrate = kbps
+	vss.streamMu.Unlock()
+	vss.eachSession(func(s *viewerSession) {
+		if err := s.streamer.setBitrate(kbps); err != nil {
+			logger.Printf("Failed to change the bitrate of %v: %v\n", s.id, err)
+		}
+	})
+}
+
+// setStreamFps changes the frame rate of every viewer, and of the viewers to come
+func (vss *VideoStreamSender) setStreamFps(fps int) {
+	vss.streamMu.Lock()
+	vss.streamFps = fps
+	vss.streamMu.Unlock()
+	vss.eachSession(func(s *viewerSession) {
+		s.streamer.setFps(fps)
+	})
+}
+
+// applyStreamSettings gives a new streamer the settings changed over the control channels
+func (vss *VideoStreamSender) applyStreamSettings(streamer *rtcStreamer) error {
+	vss.streamMu.Lock()
+	defer vss.streamMu.Unlock()
+	streamer.setFps(vss.streamFps)
+	if vss.streamBitrate > 0 {
+		return streamer.setBitrate(vss.streamBitrate)
+	}
+	return nil
+}
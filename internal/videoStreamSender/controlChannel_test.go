@@ -0,0 +1,166 @@
+package vidoestreamsender
+
+import (
+	"bytes"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/internal/recorder"
+	"github.com/acentior/camera-pipeline-sender/pkg/fmp4"
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/suite"
+)
+
+// newTestSender returns a sender streaming a source, without signaling
+func newTestSender(source FrameSource) *VideoStreamSender {
+	return &VideoStreamSender{
+		source:       source,
+		encService:   encoders.NewEncoderService().(*encoders.EncoderService),
+		webrtcConfig: &webrtc.Configuration{},
+		webrtcCodec:  &webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}},
+		sessions:     map[string]*viewerSession{},
+		whepSessions: map[string]*viewerSession{},
+		httpMux:      http.NewServeMux(),
+	}
+}
+
+type ControlChannelSuit struct {
+	suite.Suite
+	source *solidSource
+	vss    *VideoStreamSender
+	ctrl   *controlChannel
+}
+
+func TestControlChannelSuite(t *testing.T) {
+	suite.Run(t, new(ControlChannelSuit))
+}
+
+func (s *ControlChannelSuit) SetupTest() {
+	s.source = newSolidSource(color.RGBA{R: 255, A: 255}, size.Size{Width: 320, Height: 240})
+	s.vss = newTestSender(s.source)
+	s.vss.controlAdminToken = "secret"
+	streamer, err := s.vss.GetRTCStreamer(&s.vss.webrtcCodec.RTPCodecCapability, s.source)
+	s.Require().NoError(err)
+	session := &viewerSession{id: "viewer", streamer: streamer, track: streamer.tracks[0]}
+	s.vss.sessions[session.id] = session
+	s.ctrl = &controlChannel{vss: s.vss, session: session, role: roleViewer}
+}
+
+func (s *ControlChannelSuit) TearDownTest() {
+	s.source.Stop()
+	s.ctrl.session.streamer.Close()
+}
+
+func (s *ControlChannelSuit) Test_Status() {
+	result, err := s.ctrl.dispatch(controlRequest{V: 1, ID: "1", Type: ControlGetStatus})
+	s.Require().NoError(err)
+	status := result.(controlStatus)
+	s.Equal("viewer", status.Role)
+	s.Equal(30, status.Fps)
+	s.Equal(1, status.Viewers)
+	s.Equal(320, status.Width)
+	s.Positive(status.Bitrate)
+}
+
+func (s *ControlChannelSuit) Test_VersionAndUnknownType() {
+	_, err := s.ctrl.dispatch(controlRequest{V: 2, Type: ControlGetStatus})
+	s.ErrorContains(err, "version")
+	_, err = s.ctrl.dispatch(controlRequest{V: 1, Type: "reboot"})
+	s.ErrorContains(err, "Unknown")
+}
+
+func (s *ControlChannelSuit) Test_AdminRequestsNeedAuth() {
+	_, err := s.ctrl.dispatch(controlRequest{V: 1, Type: ControlSetBitrate, Bitrate: 500})
+	s.ErrorContains(err, "admin")
+	_, err = s.ctrl.dispatch(controlRequest{V: 1, Type: ControlAuth, Token: "wrong"})
+	s.Error(err)
+
+	_, err = s.ctrl.dispatch(controlRequest{V: 1, Type: ControlAuth, Token: "secret"})
+	s.Require().NoError(err)
+	result, err := s.ctrl.dispatch(controlRequest{V: 1, Type: ControlSetBitrate, Bitrate: 500})
+	s.Require().NoError(err)
+	s.Equal(500, result.(controlStatus).Bitrate)
+
+	result, err = s.ctrl.dispatch(controlRequest{V: 1, Type: ControlSetFps, Fps: 10})
+	s.Require().NoError(err)
+	s.Equal(10, result.(controlStatus).Fps)
+	_, err = s.ctrl.dispatch(controlRequest{V: 1, Type: ControlSetFps, Fps: 60})
+	s.Error(err)
+
+	// the encoder reopened for the new frame rate keeps the bitrate
+	_, fps, err := s.ctrl.session.streamer.applyFps()
+	s.Require().NoError(err)
+	s.Equal(10, fps)
+	_, bitrate := s.ctrl.session.streamer.settings()
+	s.Equal(500, bitrate)
+}
+
+func (s *ControlChannelSuit) Test_Snapshot() {
+	result, err := s.ctrl.dispatch(controlRequest{V: 1, Type: ControlSnapshot, Width: 160})
+	s.Require().NoError(err)
+	snap := result.(*snapshot)
+	s.Equal("image/jpeg", snap.ContentType)
+	s.Equal(160, snap.Width)
+	s.Equal(120, snap.Height)
+	s.Equal(1, snap.Chunks)
+
+	img, err := jpeg.Decode(bytes.NewReader(snap.data))
+	s.Require().NoError(err)
+	r, _, _, _ := img.At(80, 60).RGBA()
+	s.Greater(r>>8, uint32(200))
+}
+
+func (s *ControlChannelSuit) Test_Playback() {
+	// a minute of footage, a keyframe every second
+	sps := []byte{0x67, 0x42, 0xc0, 0xd, 0xa6, 0x81, 0x41, 0xfa, 0x10, 0x0, 0x0, 0x3, 0x0, 0x10, 0x0, 0x0, 0x3, 0x3, 0xc8, 0xf1, 0x42, 0xaa}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	track, err := fmp4.NewTrack(h264.AnnexB([][]byte{sps, pps, {0x65, 0x88}}))
+	s.Require().NoError(err)
+	data := fmp4.InitSegment(track)
+	for i := 0; i < 60; i++ {
+		samples := []fmp4.Sample{fmp4.NewSample(h264.AnnexB([][]byte{{0x65, 0x88, byte(i)}}), fmp4.Timescale/10, true)}
+		for j := 1; j < 10; j++ {
+			samples = append(samples, fmp4.NewSample(h264.AnnexB([][]byte{{0x41, 0x9a, byte(j)}}), fmp4.Timescale/10, false))
+		}
+		data = append(data, fmp4.Fragment(uint32(i+1), uint64(i)*fmp4.Timescale, samples)...)
+	}
+	dir := s.T().TempDir()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, recorder.FileName(start)), data, 0o644))
+	s.vss.catalogs = map[string]*recorder.Catalog{kindRecordings: recorder.NewCatalog(dir, nil)}
+
+	_, err = s.ctrl.dispatch(controlRequest{V: 1, Type: ControlPause})
+	s.ErrorContains(err, "live")
+	_, err = s.ctrl.dispatch(controlRequest{V: 1, Type: ControlPlayback, Time: start.Format(time.RFC3339), Kind: "clips"})
+	s.Error(err)
+
+	result, err := s.ctrl.dispatch(controlRequest{V: 1, Type: ControlPlayback, Time: start.Add(10 * time.Second).Format(time.RFC3339)})
+	s.Require().NoError(err)
+	s.Require().NotNil(result.(controlStatus).Playback)
+	s.True(s.ctrl.session.streamer.isHeld())
+
+	result, err = s.ctrl.dispatch(controlRequest{V: 1, Type: ControlPause})
+	s.Require().NoError(err)
+	s.True(result.(controlStatus).Playback.Paused)
+	_, err = s.ctrl.dispatch(controlRequest{V: 1, Type: ControlSetRate, Rate: 100})
+	s.Error(err)
+	result, err = s.ctrl.dispatch(controlRequest{V: 1, Type: ControlSetRate, Rate: 2})
+	s.Require().NoError(err)
+	s.Equal(2.0, result.(controlStatus).Playback.Rate)
+	result, err = s.ctrl.dispatch(controlRequest{V: 1, Type: ControlSeek, Time: start.Add(30 * time.Second).Format(time.RFC3339)})
+	s.Require().NoError(err)
+	s.Equal(start.Add(30*time.Second), result.(controlStatus).Playback.Position)
+
+	result, err = s.ctrl.dispatch(controlRequest{V: 1, Type: ControlLive})
+	s.Require().NoError(err)
+	s.Nil(result.(controlStatus).Playback)
+	s.False(s.ctrl.session.streamer.isHeld())
+}
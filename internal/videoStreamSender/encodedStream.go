@@ -0,0 +1,183 @@
+package vidoestreamsender
+
+import (
+	"sync"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+)
+
+// encodedStream encodes the source once for the outputs taking the H.264 stream as is (RTP, RTSP,
+// HLS, recordings) and for the WebRTC viewers without a zoom, frame rate or bitrate of their own.
+// It encodes while it has subscribers, and every subscriber starts at a keyframe.
+type encodedStream struct {
+	source     FrameSource
+	newEncoder func() (encoders.Encoder, error)
+	// keyframeInterval is the longest time between two keyframes, outputs cut their segments there
+	keyframeInterval time.Duration
+
+	mu          sync.Mutex
+	subscribers []*encodedSubscriber
+	stop        chan struct{}
+	// wantKeyframe makes the next frame a keyframe, for a new or lagging subscriber
+	wantKeyframe bool
+}
+
+type encodedSubscriber struct {
+	frames chan *encoders.EncodedFrame
+	// synced is false until the subscriber got a keyframe, frames before one are useless
+	synced bool
+}
+
+// encodedBuffer is the number of frames a subscriber may lag behind before losing frames
+const encodedBuffer = 64
+
+func newEncodedStream(source FrameSource, newEncoder func() (encoders.Encoder, error), keyframeInterval time.Duration) *encodedStream {
+	return &encodedStream{
+		source:           source,
+		newEncoder:       newEncoder,
+		keyframeInterval: keyframeInterval,
+	}
+}
+
+// Subscribe returns a channel of the encoded frames, starting at the next keyframe
+func (e *encodedStream) Subscribe() <-chan *encoders.EncodedFrame {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sub := &encodedSubscriber{frames: make(chan *encoders.EncodedFrame, encodedBuffer)}
+	e.subscribers = append(e.subscribers, sub)
+	e.wantKeyframe = true
+	if e.stop == nil {
+		e.stop = make(chan struct{})
+		go e.run(e.stop)
+	}
+	return sub.frames
+}
+
+// Unsubscribe closes a channel returned by Subscribe, the encoder stops with the last subscriber
+func (e *encodedStream) Unsubscribe(frames <-chan *encoders.EncodedFrame) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	kept := []*encodedSubscriber{}
+	for _, sub := range e.subscribers {
+		if sub.frames == frames {
+			close(sub.frames)
+		} else {
+			kept = append(kept, sub)
+		}
+	}
+	e.subscribers = kept
+	if len(kept) == 0 && e.stop != nil {
+		close(e.stop)
+		e.stop = nil
+	}
+}
+
+// run encodes the source frames until stop is closed
+func (e *encodedStream) run(stop chan struct{}) {
+	encoder, err := e.newEncoder()
+	if err != nil {
+		logger.Printf("Encoded stream: %v\n", err)
+		e.closeSubscribers(stop)
+		return
+	}
+	defer encoder.Close()
+	size, err := encoder.VideoSize()
+	if err != nil {
+		logger.Printf("Encoded stream: %v\n", err)
+		e.closeSubscribers(stop)
+		return
+	}
+	frames := e.source.Subscribe()
+	defer e.source.Unsubscribe(frames)
+
+	var lastKeyframe time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case frame, ok := <-frames:
+			if !ok {
+				e.closeSubscribers(stop)
+				return
+			}
+			encoded, err := e.encode(encoder, size, frame, lastKeyframe)
+			if err != nil {
+				logger.Printf("Encoded stream: %v\n", err)
+				e.closeSubscribers(stop)
+				return
+			}
+			if encoded == nil {
+				continue
+			}
+			if encoded.Keyframe {
+				lastKeyframe = frame.Time
+			}
+			e.send(encoded)
+		}
+	}
+}
+
+func (e *encodedStream) encode(encoder encoders.Encoder, size size.Size, frame *Frame, lastKeyframe time.Time) (*encoders.EncodedFrame, error) {
+	e.mu.Lock()
+	if e.wantKeyframe || frame.Time.Sub(lastKeyframe) >= e.keyframeInterval {
+		encoder.ForceKeyframe()
+		e.wantKeyframe = false
+	}
+	e.mu.Unlock()
+
+	data, err := encoder.Encode(resizeImage(frame.Image, size))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return &encoders.EncodedFrame{
+		Data:     data,
+		Time:     frame.Time,
+		Duration: time.Second / time.Duration(max(1, e.source.Fps())),
+		Keyframe: h264.IsKeyframe(data),
+		Seq:      frame.Seq,
+	}, nil
+}
+
+// forceKeyframe makes the next frame a keyframe, for a viewer that lost frames
+func (e *encodedStream) forceKeyframe() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.wantKeyframe = true
+}
+
+// send hands a frame to every subscriber. A subscriber too slow to take it loses the frames up to
+// the next keyframe, its decoder could not use them anyway.
+func (e *encodedStream) send(frame *encoders.EncodedFrame) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, sub := range e.subscribers {
+		if !sub.synced && !frame.Keyframe {
+			continue
+		}
+		select {
+		case sub.frames <- frame:
+			sub.synced = true
+		default:
+			sub.synced = false
+			e.wantKeyframe = true
+		}
+	}
+}
+
+// closeSubscribers ends the subscriptions after the encoder failed, unless they already moved on to another run
+func (e *encodedStream) closeSubscribers(stop chan struct{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stop != stop {
+		return
+	}
+	for _, sub := range e.subscribers {
+		close(sub.frames)
+	}
+	e.subscribers = nil
+	close(e.stop)
+	e.stop = nil
+}
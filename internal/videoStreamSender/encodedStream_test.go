@@ -0,0 +1,81 @@
+package vidoestreamsender
+
+import (
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/stretchr/testify/suite"
+)
+
+type EncodedStreamSuit struct {
+	suite.Suite
+	source  *solidSource
+	encoded *encodedStream
+}
+
+func TestEncodedStreamSuite(t *testing.T) {
+	suite.Run(t, new(EncodedStreamSuit))
+}
+
+func (s *EncodedStreamSuit) SetupTest() {
+	s.source = newSolidSource(color.RGBA{R: 255, A: 255}, size.Size{Width: 320, Height: 240})
+	vss := newTestSender(s.source)
+	s.encoded = newEncodedStream(s.source, func() (encoders.Encoder, error) {
+		return vss.encService.NewEncoder(encoders.H264Codec, s.source.Size(), s.source.Fps())
+	}, 100*time.Millisecond)
+}
+
+func (s *EncodedStreamSuit) TearDownTest() {
+	s.source.Stop()
+}
+
+func (s *EncodedStreamSuit) next(frames <-chan *encoders.EncodedFrame) *encoders.EncodedFrame {
+	select {
+	case frame, ok := <-frames:
+		s.Require().True(ok)
+		return frame
+	case <-time.After(5 * time.Second):
+		s.FailNow("no encoded frame")
+		return nil
+	}
+}
+
+func (s *EncodedStreamSuit) Test_SubscribersStartAtKeyframes() {
+	first := s.encoded.Subscribe()
+	frame := s.next(first)
+	s.True(frame.Keyframe)
+	sps, pps := h264.ParameterSets(frame.Data)
+	s.NotNil(sps)
+	s.NotNil(pps)
+
+	for i := 0; i < 3; i++ {
+		s.next(first)
+	}
+	second := s.encoded.Subscribe()
+	s.True(s.next(second).Keyframe)
+
+	s.encoded.Unsubscribe(first)
+	s.encoded.Unsubscribe(second)
+	// the buffered frames are still delivered before the channel ends
+	for range first {
+	}
+	s.Nil(s.encoded.stop)
+}
+
+func (s *EncodedStreamSuit) Test_KeyframeInterval() {
+	frames := s.encoded.Subscribe()
+	defer s.encoded.Unsubscribe(frames)
+	keyframes := []time.Time{}
+	for len(keyframes) < 3 {
+		frame := s.next(frames)
+		if frame.Keyframe {
+			keyframes = append(keyframes, frame.Time)
+		}
+	}
+	s.GreaterOrEqual(keyframes[2].Sub(keyframes[1]), 100*time.Millisecond)
+	s.Less(keyframes[2].Sub(keyframes[1]), 500*time.Millisecond)
+}
@@ -0,0 +1,76 @@
+package vidoestreamsender
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/acentior/camera-pipeline-sender/internal/config"
+	"github.com/acentior/camera-pipeline-sender/internal/filters"
+)
+
+// newOverlayFilter builds the text overlay from the configuration, it returns nil when disabled
+func newOverlayFilter(cfg *config.Config) (*filters.Overlay, error) {
+	if !cfg.OverlayEnabled {
+		return nil, nil
+	}
+	position, err := filters.ParsePosition(cfg.OverlayPosition)
+	if err != nil {
+		return nil, err
+	}
+	textColor, err := filters.ParseColor(cfg.OverlayColor)
+	if err != nil {
+		return nil, err
+	}
+	background, err := filters.ParseColor(cfg.OverlayBackground)
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	for _, line := range []string{cfg.OverlayDeviceName, cfg.OverlayText} {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return filters.NewOverlay(filters.TextOverlay{
+		Text:       strings.Join(lines, "\n"),
+		TimeFormat: cfg.OverlayTimeFormat,
+		Position:   position,
+		FontSize:   cfg.OverlayFontSize,
+		Color:      textColor,
+		Background: background,
+	})
+}
+
+// newTransformFilter builds the orientation fix from the configuration, it returns nil when there is nothing to do
+func newTransformFilter(cfg *config.Config) (*filters.Transform, error) {
+	crop, err := parseCrop(cfg.TransformCrop)
+	if err != nil {
+		return nil, err
+	}
+	if crop.Empty() && cfg.TransformRotation == 0 && !cfg.TransformFlipH && !cfg.TransformFlipV {
+		return nil, nil
+	}
+	return filters.NewTransform(crop, cfg.TransformRotation, cfg.TransformFlipH, cfg.TransformFlipV)
+}
+
+// parseCrop parses a "x,y,w,h" rectangle in pixels of the captured frame
+func parseCrop(s string) (image.Rectangle, error) {
+	if strings.TrimSpace(s) == "" {
+		return image.Rectangle{}, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("Invalid crop %q, expected x,y,w,h", s)
+	}
+	values := [4]int{}
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || v < 0 {
+			return image.Rectangle{}, fmt.Errorf("Invalid crop %q, expected x,y,w,h", s)
+		}
+		values[i] = v
+	}
+	return image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3]), nil
+}
@@ -0,0 +1,85 @@
+package vidoestreamsender
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// frameMetadata describes a sent frame, receivers match it to the decoded frame by RTP timestamp
+type frameMetadata struct {
+	RTPTimestamp uint32       `json:"rtpTimestamp"`
+	Seq          uint64       `json:"seq"`
+	CaptureTime  time.Time    `json:"captureTime"`
+	Motion       *motionState `json:"motion,omitempty"`
+}
+
+// rtpTimestampRecorder remembers the timestamp of the last RTP packet sent by a peer connection.
+// Samples are packetized and written synchronously, so right after WriteSample
+// it holds the RTP timestamp the packetizer gave to the sample.
+type rtpTimestampRecorder struct {
+	interceptor.NoOp
+	mu        sync.Mutex
+	timestamp uint32
+	sent      bool
+}
+
+// NewInterceptor hands the recorder itself to the peer connection, a recorder serves a single one
+func (r *rtpTimestampRecorder) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return r, nil
+}
+
+// BindLocalStream records the timestamps of the outgoing packets
+func (r *rtpTimestampRecorder) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		r.mu.Lock()
+		r.timestamp = header.Timestamp
+		r.sent = true
+		r.mu.Unlock()
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+// take returns the last RTP timestamp, if a packet was sent since the previous call
+func (r *rtpTimestampRecorder) take() (uint32, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sent := r.sent
+	r.sent = false
+	return r.timestamp, sent
+}
+
+// newMetadataChannel creates the unordered data channel of the frame metadata.
+// Late metadata is useless, so lost messages are not retransmitted.
+func newMetadataChannel(pc *webrtc.PeerConnection) (*webrtc.DataChannel, error) {
+	ordered := false
+	maxRetransmits := uint16(0)
+	return pc.CreateDataChannel("metadata", &webrtc.DataChannelInit{
+		Ordered:        &ordered,
+		MaxRetransmits: &maxRetransmits,
+	})
+}
+
+// sendFrameMetadata publishes the metadata of the frame just written to the track
+func (vss *VideoStreamSender) sendFrameMetadata(s *viewerSession, frame *Frame) {
+	timestamp, sent := s.rtpTimestamps.take()
+	if !sent || s.metadata == nil || s.metadata.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	data, err := json.Marshal(frameMetadata{
+		RTPTimestamp: timestamp,
+		Seq:          frame.Seq,
+		CaptureTime:  frame.Time,
+		Motion:       vss.motionState(),
+	})
+	if err != nil {
+		return
+	}
+	if err := s.metadata.SendText(string(data)); err != nil {
+		logger.Printf("Failed to send frame metadata to %v: %v\n", s.id, err)
+	}
+}
@@ -0,0 +1,43 @@
+package vidoestreamsender
+
+import (
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/suite"
+)
+
+type FrameMetadataSuit struct {
+	suite.Suite
+}
+
+func TestFrameMetadataSuite(t *testing.T) {
+	suite.Run(t, new(FrameMetadataSuit))
+}
+
+func (s *FrameMetadataSuit) Test_RecorderTakesLastTimestampOnce() {
+	recorder := &rtpTimestampRecorder{}
+	written := 0
+	writer := recorder.BindLocalStream(&interceptor.StreamInfo{}, interceptor.RTPWriterFunc(
+		func(header *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+			written++
+			return len(payload), nil
+		}))
+
+	_, sent := recorder.take()
+	s.False(sent)
+
+	// a frame split into several packets shares one timestamp
+	for i := 0; i < 3; i++ {
+		_, err := writer.Write(&rtp.Header{Timestamp: 9000}, []byte{1}, nil)
+		s.NoError(err)
+	}
+	timestamp, sent := recorder.take()
+	s.True(sent)
+	s.Equal(uint32(9000), timestamp)
+	s.Equal(3, written)
+
+	_, sent = recorder.take()
+	s.False(sent)
+}
@@ -0,0 +1,120 @@
+package vidoestreamsender
+
+import (
+	"fmt"
+	"image"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/filters"
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+)
+
+// Frame is a picture of a FrameSource with its capture metadata
+type Frame struct {
+	Image *image.RGBA
+	// Time is when the picture was captured, or composed for a compositor
+	Time time.Time
+	// Seq numbers the frames of a source, it increases by one per frame
+	Seq uint64
+}
+
+// FrameSource produces the RGBA frames a streamer encodes.
+// Every consumer gets its own channel from Subscribe and hands it back with Unsubscribe,
+// so consumers never take each other's frames. The Filters chain runs once per frame,
+// before the frame is fanned out, consumers must not modify the frames they receive.
+type FrameSource interface {
+	Start()
+	Stop()
+	Subscribe() <-chan *Frame
+	Unsubscribe(frames <-chan *Frame)
+	Fps() int
+	Size() size.Size
+	Filters() *filters.Chain
+}
+
+// frameFanOut hands every frame to all the subscribers.
+// A subscriber still busy with the previous frame gets the new one in its place,
+// so a slow consumer only drops its own frames and never blocks the source.
+type frameFanOut struct {
+	subscribers []chan *Frame
+}
+
+func (f *frameFanOut) add(ch chan *Frame) {
+	f.subscribers = append(f.subscribers, ch)
+}
+
+func (f *frameFanOut) remove(frames <-chan *Frame) {
+	kept := []chan *Frame{}
+	for _, ch := range f.subscribers {
+		if ch == frames {
+			close(ch)
+		} else {
+			kept = append(kept, ch)
+		}
+	}
+	f.subscribers = kept
+}
+
+func (f *frameFanOut) len() int {
+	return len(f.subscribers)
+}
+
+func (f *frameFanOut) send(frame *Frame) {
+	for _, ch := range f.subscribers {
+		select {
+		case ch <- frame:
+		default:
+			// drop the stale frame, only this loop sends so there is room afterwards
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- frame
+		}
+	}
+}
+
+func (f *frameFanOut) closeAll() {
+	for _, ch := range f.subscribers {
+		close(ch)
+	}
+	f.subscribers = nil
+}
+
+// subscribeTo registers a new subscriber channel with a source loop, the channel is closed once the source stopped
+// or its loop ended
+func subscribeTo(subscribe chan<- chan *Frame, stop <-chan struct{}, done <-chan struct{}) <-chan *Frame {
+	ch := make(chan *Frame, 1)
+	select {
+	case subscribe <- ch:
+		return ch
+	case <-stop:
+	case <-done:
+	}
+	close(ch)
+	return ch
+}
+
+// unsubscribeFrom removes a subscriber channel from a source loop
+func unsubscribeFrom(unsubscribe chan<- (<-chan *Frame), frames <-chan *Frame, stop <-chan struct{}, done <-chan struct{}) {
+	select {
+	case unsubscribe <- frames:
+	case <-stop:
+	case <-done:
+	}
+}
+
+// grabFrame returns the next frame of a source, waiting at most timeout
+func grabFrame(source FrameSource, timeout time.Duration) (*Frame, error) {
+	frames := source.Subscribe()
+	defer source.Unsubscribe(frames)
+	select {
+	case frame, ok := <-frames:
+		if !ok {
+			return nil, fmt.Errorf("Frame source stopped")
+		}
+		return frame, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("No frame within %v", timeout)
+	}
+}
@@ -0,0 +1,76 @@
+package vidoestreamsender
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/acentior/camera-pipeline-sender/internal/config"
+)
+
+func (vss *VideoStreamSender) initHTTPServer(cfg *config.Config) {
+	vss.httpAddr = cfg.HTTPAddr
+	vss.httpToken = cfg.HTTPToken
+	vss.httpMux = http.NewServeMux()
+}
+
+// handleAPI registers a handler protected by the HTTP token
+func (vss *VideoStreamSender) handleAPI(pattern string, handler http.HandlerFunc) {
+	vss.httpMux.Handle(pattern, requireBearerToken(vss.httpToken, handler))
+}
+
+// requireTokenFor refuses the requests with the given methods, any method when none is given, while no HTTP token
+// is set. They edit the privacy masks or the footage or hand it out, which must not be open to the whole network.
+func (vss *VideoStreamSender) requireTokenFor(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if vss.httpToken == "" && (len(methods) == 0 || slices.Contains(methods, r.Method)) {
+			httpError(w, http.StatusForbidden, "Set HTTP_TOKEN to use "+r.URL.Path)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// startHTTPServer serves the HTTP API in the background when an address is configured
+func (vss *VideoStreamSender) startHTTPServer() {
+	if vss.httpAddr == "" {
+		return
+	}
+	go func() {
+		logger.Printf("HTTP API listening on %v\n", vss.httpAddr)
+		if err := http.ListenAndServe(vss.httpAddr, vss.httpMux); err != nil {
+			logger.Printf("HTTP API stopped: %v\n", err)
+		}
+	}()
+}
+
+// requireBearerToken rejects requests without the "Authorization: Bearer <token>" header.
+// An empty token disables the check.
+func requireBearerToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Printf("Failed to write response: %v\n", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
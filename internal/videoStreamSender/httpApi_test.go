@@ -0,0 +1,36 @@
+package vidoestreamsender
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type HTTPAPISuit struct {
+	suite.Suite
+}
+
+func TestHTTPAPISuite(t *testing.T) {
+	suite.Run(t, new(HTTPAPISuit))
+}
+
+func (s *HTTPAPISuit) Test_RequireTokenFor() {
+	vss := &VideoStreamSender{}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	status := func(handler http.HandlerFunc, method string) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, "/api/recordings/lock", nil))
+		return w.Code
+	}
+	// without a token, the listed methods or every method are refused
+	s.Equal(http.StatusForbidden, status(vss.requireTokenFor(ok), http.MethodGet))
+	s.Equal(http.StatusForbidden, status(vss.requireTokenFor(ok), http.MethodDelete))
+	s.Equal(http.StatusForbidden, status(vss.requireTokenFor(ok, http.MethodPost), http.MethodPost))
+	s.Equal(http.StatusOK, status(vss.requireTokenFor(ok, http.MethodPost), http.MethodGet))
+
+	vss.httpToken = "secret"
+	s.Equal(http.StatusOK, status(vss.requireTokenFor(ok), http.MethodDelete))
+	s.Equal(http.StatusOK, status(vss.requireTokenFor(ok, http.MethodPost), http.MethodPost))
+}
@@ -0,0 +1,83 @@
+package vidoestreamsender
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/acentior/camera-pipeline-sender/internal/signal"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+// manualSignaling exchanges the session descriptions by hand, base64 encoded like the pion examples,
+// for a stream brought up without any signaling server
+type manualSignaling struct {
+	stdin    bool
+	httpPort int
+}
+
+// runManualSignaling answers the offers pasted on stdin and posted to the HTTP port in the background
+func (vss *VideoStreamSender) runManualSignaling() {
+	if vss.manual == nil {
+		return
+	}
+	if vss.manual.httpPort != 0 {
+		offers := signal.HTTPSDPServer(vss.manual.httpPort)
+		logger.Printf("Manual signaling: POST base64 offers to port %v\n", vss.manual.httpPort)
+		go func() {
+			for req := range offers {
+				go func(req *signal.SDPRequest) {
+					answer, err := vss.answerManualOffer(req.SDP)
+					if err != nil {
+						req.Fail(http.StatusBadRequest, err)
+						return
+					}
+					req.Reply(answer)
+				}(req)
+			}
+		}()
+	}
+	if vss.manual.stdin {
+		go vss.answerStdinOffers()
+	}
+}
+
+// answerStdinOffers prints the answer of every offer pasted on stdin, until stdin ends
+func (vss *VideoStreamSender) answerStdinOffers() {
+	in := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Println("Paste a base64 offer:")
+		offer, err := signal.ReadLine(in)
+		if err != nil {
+			logger.Printf("Manual signaling stopped reading stdin: %v\n", err)
+			return
+		}
+		answer, err := vss.answerManualOffer(offer)
+		if err != nil {
+			fmt.Printf("Invalid offer: %v\n", err)
+			continue
+		}
+		fmt.Printf("Answer:\n%v\n", answer)
+	}
+}
+
+// answerManualOffer creates a viewer session for a base64 offer and returns its base64 answer,
+// holding every local candidate since nothing else can be exchanged
+func (vss *VideoStreamSender) answerManualOffer(encoded string) (string, error) {
+	offer := webrtc.SessionDescription{}
+	if err := signal.TryDecode(encoded, &offer); err != nil {
+		return "", err
+	}
+	if offer.Type != webrtc.SDPTypeOffer {
+		return "", fmt.Errorf("Expected an offer, got %q", offer.Type)
+	}
+	id := "manual-" + uuid.New().String()
+	_, answer, err := vss.newViewerSession(id, offer, nil)
+	if err != nil {
+		logger.Printf("Failed to answer viewer %v: %v\n", id, err)
+		return "", err
+	}
+	return signal.Encode(answer), nil
+}
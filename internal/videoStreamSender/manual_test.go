@@ -0,0 +1,80 @@
+package vidoestreamsender
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"image/color"
+	"testing"
+
+	"github.com/acentior/camera-pipeline-sender/internal/signal"
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/suite"
+)
+
+type ManualSignalingSuit struct {
+	suite.Suite
+	source *solidSource
+	vss    *VideoStreamSender
+	viewer *webrtc.PeerConnection
+}
+
+func TestManualSignalingSuite(t *testing.T) {
+	suite.Run(t, new(ManualSignalingSuit))
+}
+
+func (s *ManualSignalingSuit) SetupTest() {
+	s.source = newSolidSource(color.RGBA{G: 255, A: 255}, size.Size{Width: 320, Height: 240})
+	s.vss = newTestSender(s.source)
+	var err error
+	s.viewer, err = webrtc.NewPeerConnection(webrtc.Configuration{})
+	s.Require().NoError(err)
+}
+
+func (s *ManualSignalingSuit) TearDownTest() {
+	signal.Compress = false
+	s.viewer.Close()
+	s.vss.eachSession(func(session *viewerSession) { session.close() })
+	s.source.Stop()
+}
+
+// offer returns the complete offer of the viewer, base64 encoded
+func (s *ManualSignalingSuit) offer() string {
+	_, err := s.viewer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	s.Require().NoError(err)
+	offer, err := s.viewer.CreateOffer(nil)
+	s.Require().NoError(err)
+	gathered := webrtc.GatheringCompletePromise(s.viewer)
+	s.Require().NoError(s.viewer.SetLocalDescription(offer))
+	<-gathered
+	return signal.Encode(s.viewer.LocalDescription())
+}
+
+func (s *ManualSignalingSuit) Test_CompressedExchange() {
+	signal.Compress = true
+	answer, err := s.vss.answerManualOffer(s.offer())
+	s.Require().NoError(err)
+
+	desc := webrtc.SessionDescription{}
+	s.Require().NoError(signal.TryDecode(answer, &desc))
+	s.Equal(webrtc.SDPTypeAnswer, desc.Type)
+	s.Contains(desc.SDP, "a=candidate:")
+	s.Require().NoError(s.viewer.SetRemoteDescription(desc))
+}
+
+func (s *ManualSignalingSuit) Test_InvalidOffer() {
+	_, err := s.vss.answerManualOffer("not base64")
+	s.Error(err)
+	_, err = s.vss.answerManualOffer(signal.Encode(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "v=0"}))
+	s.ErrorContains(err, "offer")
+
+	// a small input inflating to gigabytes is refused
+	var bomb bytes.Buffer
+	gz := gzip.NewWriter(&bomb)
+	_, err = gz.Write(bytes.Repeat([]byte(" "), 4<<20))
+	s.Require().NoError(err)
+	s.Require().NoError(gz.Close())
+	_, err = s.vss.answerManualOffer(base64.StdEncoding.EncodeToString(bomb.Bytes()))
+	s.ErrorContains(err, "decompressed")
+}
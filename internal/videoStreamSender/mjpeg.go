@@ -0,0 +1,164 @@
+package vidoestreamsender
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+)
+
+// mjpegBoundary separates the JPEG parts of the multipart/x-mixed-replace responses
+const mjpegBoundary = "frame"
+
+// mjpegSettings are the defaults of the MJPEG clients, and the highest frame rate they may ask for,
+// 0 for the source rate
+type mjpegSettings struct {
+	quality int
+	width   int
+	maxFps  int
+}
+
+// handleMJPEG registers the MJPEG stream and the snapshot endpoints
+func (vss *VideoStreamSender) handleMJPEG() {
+	vss.handleImage("/mjpeg", vss.serveMJPEG)
+	vss.handleImage("/snapshot.jpg", vss.serveSnapshot)
+}
+
+// handleImage registers a handler protected by the HTTP token. The token may also come in the "token" query
+// parameter, since <img> tags can't send an Authorization header.
+func (vss *VideoStreamSender) handleImage(pattern string, handler http.HandlerFunc) {
+	token := vss.httpToken
+	vss.httpMux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if query := r.URL.Query().Get("token"); token != "" && query != "" {
+			if subtle.ConstantTimeCompare([]byte(query), []byte(token)) == 1 {
+				handler(w, r)
+				return
+			}
+		}
+		requireBearerToken(token, handler).ServeHTTP(w, r)
+	}))
+}
+
+// imageParams reads the size and quality query parameters of an image request
+func (vss *VideoStreamSender) imageParams(r *http.Request) (size.Size, int, error) {
+	bounds := size.Size{Width: vss.mjpeg.width}
+	quality := vss.mjpeg.quality
+	for _, param := range []struct {
+		name  string
+		value *int
+		max   int
+	}{
+		{"width", &bounds.Width, 1 << 14},
+		{"height", &bounds.Height, 1 << 14},
+		{"quality", &quality, 100},
+	} {
+		v := r.URL.Query().Get(param.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > param.max {
+			return size.Size{}, 0, fmt.Errorf("Invalid %v %q", param.name, v)
+		}
+		*param.value = n
+	}
+	return bounds, quality, nil
+}
+
+// serveSnapshot answers a JPEG of the next frame
+func (vss *VideoStreamSender) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	bounds, quality, err := vss.imageParams(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	frame, err := grabFrame(vss.source, snapshotTimeout)
+	if err != nil {
+		httpError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	data, _, err := encodeJPEG(frame.Image, bounds, quality)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
+
+// serveMJPEG streams JPEG frames until the client leaves. Every client subscribes to the source,
+// so a slow client only drops its own frames.
+func (vss *VideoStreamSender) serveMJPEG(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	bounds, quality, err := vss.imageParams(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fps := vss.mjpeg.maxFps
+	if fps <= 0 {
+		fps = vss.source.Fps()
+	}
+	if v := r.URL.Query().Get("fps"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("Invalid fps %q", v))
+			return
+		}
+		fps = min(n, fps)
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	frames := vss.source.Subscribe()
+	defer vss.source.Unsubscribe(frames)
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	interval := time.Second / time.Duration(fps)
+	var last time.Time
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+			// a little slack keeps the rate when the source frames come slightly early
+			if !last.IsZero() && frame.Time.Sub(last) < interval*9/10 {
+				continue
+			}
+			last = frame.Time
+			data, _, err := encodeJPEG(frame.Image, bounds, quality)
+			if err != nil {
+				logger.Printf("MJPEG: %v\n", err)
+				return
+			}
+			_, err = fmt.Fprintf(w, "--%v\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, len(data))
+			if err != nil {
+				return
+			}
+			if _, err := w.Write(append(data, '\r', '\n')); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package vidoestreamsender
+
+import (
+	"image/color"
+	"image/jpeg"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/stretchr/testify/suite"
+)
+
+type MJPEGSuit struct {
+	suite.Suite
+	source *solidSource
+	vss    *VideoStreamSender
+	server *httptest.Server
+}
+
+func TestMJPEGSuite(t *testing.T) {
+	suite.Run(t, new(MJPEGSuit))
+}
+
+func (s *MJPEGSuit) SetupTest() {
+	s.source = newSolidSource(color.RGBA{B: 255, A: 255}, size.Size{Width: 320, Height: 240})
+	s.vss = newTestSender(s.source)
+	s.vss.httpToken = "secret"
+	s.vss.mjpeg = mjpegSettings{quality: 80, maxFps: 10}
+	s.vss.handleMJPEG()
+	s.server = httptest.NewServer(s.vss.httpMux)
+}
+
+func (s *MJPEGSuit) TearDownTest() {
+	s.server.Close()
+	s.source.Stop()
+}
+
+func (s *MJPEGSuit) Test_Snapshot() {
+	resp, err := http.Get(s.server.URL + "/snapshot.jpg")
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodGet, s.server.URL+"/snapshot.jpg?height=60", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	s.Equal("image/jpeg", resp.Header.Get("Content-Type"))
+	img, err := jpeg.Decode(resp.Body)
+	s.Require().NoError(err)
+	s.Equal(80, img.Bounds().Dx())
+	s.Equal(60, img.Bounds().Dy())
+
+	resp, err = http.Get(s.server.URL + "/snapshot.jpg?token=secret&quality=101")
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *MJPEGSuit) Test_StreamRateAndSize() {
+	start := time.Now()
+	// more than the maximum, the client gets 10 fps
+	resp, err := http.Get(s.server.URL + "/mjpeg?token=secret&width=160&fps=30")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	s.Require().NoError(err)
+	s.Equal("multipart/x-mixed-replace", mediaType)
+
+	parts := multipart.NewReader(resp.Body, params["boundary"])
+	for i := 0; i < 4; i++ {
+		part, err := parts.NextPart()
+		s.Require().NoError(err)
+		s.Equal("image/jpeg", part.Header.Get("Content-Type"))
+		img, err := jpeg.Decode(part)
+		s.Require().NoError(err)
+		s.Equal(160, img.Bounds().Dx())
+		s.Equal(120, img.Bounds().Dy())
+	}
+	// 3 intervals of 100ms, with the slack
+	s.GreaterOrEqual(time.Since(start), 270*time.Millisecond)
+}
@@ -0,0 +1,171 @@
+package vidoestreamsender
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/config"
+	"github.com/acentior/camera-pipeline-sender/internal/motion"
+	"github.com/acentior/camera-pipeline-sender/internal/signaling"
+)
+
+// newMotionConfig returns the detector configuration, nil when motion detection is disabled
+func newMotionConfig(cfg *config.Config) (*motion.Config, error) {
+	if !cfg.MotionEnabled {
+		return nil, nil
+	}
+	zones, err := parseMotionZones(cfg.MotionZones)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid MOTION_ZONES: %v", err)
+	}
+	return &motion.Config{
+		Sensitivity: cfg.MotionSensitivity,
+		MinArea:     cfg.MotionMinArea,
+		Zones:       zones,
+		Cooldown:    cfg.MotionCooldown,
+		Fps:         cfg.MotionFps,
+	}, nil
+}
+
+// parseMotionZones parses "x,y,w,h;x,y,w,h" relative rectangles
+func parseMotionZones(s string) ([]motion.Box, error) {
+	zones := []motion.Box{}
+	for _, zone := range strings.Split(s, ";") {
+		if strings.TrimSpace(zone) == "" {
+			continue
+		}
+		parts := strings.Split(zone, ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("Invalid zone %q", zone)
+		}
+		values := [4]float64{}
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid zone %q", zone)
+			}
+			values[i] = v
+		}
+		x, y, w, h := values[0], values[1], values[2], values[3]
+		// the epsilon accepts the rounding of sums like 0.7+0.3
+		if x < 0 || y < 0 || w <= 0 || h <= 0 || x+w > 1+1e-9 || y+h > 1+1e-9 {
+			return nil, fmt.Errorf("Invalid zone %q, expected a non-empty box within 0 and 1", zone)
+		}
+		zones = append(zones, motion.Box{X: x, Y: y, W: w, H: h})
+	}
+	return zones, nil
+}
+
+// motionTap is a filter handing copies of the frames to the motion detector, at the detector frame rate. It goes
+// before the overlay, whose clock would count as motion.
+type motionTap struct {
+	interval time.Duration
+	last     time.Time
+	frames   chan *Frame
+}
+
+func newMotionTap(fps int) *motionTap {
+	return &motionTap{interval: time.Second / time.Duration(max(1, fps)), frames: make(chan *Frame, 1)}
+}
+
+// Apply copies the frame when the detector is due and idle, the frame goes on unchanged
+func (t *motionTap) Apply(frame *image.RGBA) *image.RGBA {
+	now := time.Now()
+	if now.Sub(t.last) < t.interval {
+		return frame
+	}
+	t.last = now
+	copied := image.NewRGBA(image.Rect(0, 0, frame.Rect.Dx(), frame.Rect.Dy()))
+	draw.Draw(copied, copied.Rect, frame, frame.Rect.Min, draw.Src)
+	select {
+	case t.frames <- &Frame{Image: copied, Time: now}:
+	default:
+	}
+	return frame
+}
+
+// startMotionDetector analyses the tapped frames in the background and publishes the motion events
+func (vss *VideoStreamSender) startMotionDetector() {
+	if vss.motionCfg == nil {
+		return
+	}
+	detector := motion.NewDetector(*vss.motionCfg)
+	tap := vss.motionTap
+	go func() {
+		// the subscription keeps the source capturing without viewers
+		frames := vss.source.Subscribe()
+		defer vss.source.Unsubscribe(frames)
+		for {
+			var frame *Frame
+			select {
+			case _, ok := <-frames:
+				if !ok {
+					return
+				}
+				continue
+			case frame = <-tap.frames:
+			}
+			event := detector.Process(frame.Image, frame.Time)
+			active, boxes := detector.Active()
+			if !active {
+				boxes = []motion.Box{}
+			}
+			vss.motionMu.Lock()
+			vss.motion = motionState{Active: active, Boxes: boxes}
+			vss.motionMu.Unlock()
+			if event != nil {
+				vss.publishMotion(event)
+			}
+		}
+	}()
+}
+
+// motionState is the detector result attached to the frame metadata
+type motionState struct {
+	Active bool         `json:"active"`
+	Boxes  []motion.Box `json:"boxes"`
+}
+
+// motionState returns the last detector result, nil when motion detection is disabled
+func (vss *VideoStreamSender) motionState() *motionState {
+	if vss.motionCfg == nil {
+		return nil
+	}
+	vss.motionMu.Lock()
+	defer vss.motionMu.Unlock()
+	state := vss.motion
+	return &state
+}
+
+// publishMotion sends a motion event over the signaling websocket and the viewers' data channels
+func (vss *VideoStreamSender) publishMotion(event *motion.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Printf("Failed to encode motion event: %v\n", err)
+		return
+	}
+	logger.Printf("Motion: %s\n", data)
+	if vss.clipOnMotion {
+		// the stop extends the clip, so it covers the whole motion
+		vss.triggerClip(string(event.Type))
+	}
+
+	wsType := signaling.MOTION_START
+	if event.Type == motion.MotionStop {
+		wsType = signaling.MOTION_STOP
+	}
+	vss.broadcastSignaling(&signaling.WsMsg{
+		Sender: true,
+		WSType: wsType,
+		Data:   string(data),
+	})
+
+	vss.eachSession(func(s *viewerSession) {
+		s.sendMotion(string(data))
+	})
+}
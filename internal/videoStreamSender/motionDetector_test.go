@@ -0,0 +1,64 @@
+package vidoestreamsender
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/config"
+	"github.com/acentior/camera-pipeline-sender/internal/filters"
+	"github.com/stretchr/testify/suite"
+)
+
+type MotionDetectorSuit struct {
+	suite.Suite
+}
+
+func TestMotionDetectorSuite(t *testing.T) {
+	suite.Run(t, new(MotionDetectorSuit))
+}
+
+func (s *MotionDetectorSuit) Test_InvalidZones() {
+	for _, zones := range []string{"0,0,0.5", "0,0,x,0.5", "-0.1,0,0.5,0.5", "0,-0.1,0.5,0.5", "0,0,0,0.5",
+		"0,0,0.5,-0.5", "0.6,0,0.5,0.5", "0,0.6,0.5,0.5", "0,0,1,1;0,0,2,1"} {
+		_, err := newMotionConfig(&config.Config{MotionEnabled: true, MotionZones: zones})
+		s.Error(err, zones)
+	}
+	cfg, err := newMotionConfig(&config.Config{MotionEnabled: true, MotionZones: "0,0,0.5,0.5; 0.5,0.5,0.5,0.5"})
+	s.Require().NoError(err)
+	s.Len(cfg.Zones, 2)
+}
+
+func (s *MotionDetectorSuit) Test_TapBeforeOverlay() {
+	tap := newMotionTap(5)
+	overlay, err := filters.NewOverlay(filters.TextOverlay{
+		TimeFormat: time.RFC3339,
+		Position:   filters.TopLeft,
+		FontSize:   16,
+		Color:      color.RGBA{R: 255, G: 255, B: 255, A: 255},
+		Background: color.RGBA{A: 255},
+	})
+	s.Require().NoError(err)
+	chain := filters.NewChain(tap, overlay)
+
+	blank := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	frame := image.NewRGBA(blank.Rect)
+	out := chain.Apply(frame)
+	s.NotEqual(blank.Pix, out.Pix)
+	tapped := <-tap.frames
+	s.Equal(blank.Pix, tapped.Image.Pix)
+
+	// at most a frame per interval
+	chain.Apply(frame)
+	s.Empty(tap.frames)
+
+	// a sub-image keeps the stride of its parent
+	frame = image.NewRGBA(image.Rect(0, 0, 8, 8))
+	frame.SetRGBA(5, 3, color.RGBA{R: 255, A: 255})
+	tap.last = time.Time{}
+	tap.Apply(frame.SubImage(image.Rect(4, 2, 8, 6)).(*image.RGBA))
+	tapped = <-tap.frames
+	s.Equal(image.Rect(0, 0, 4, 4), tapped.Image.Rect)
+	s.Equal(color.RGBA{R: 255, A: 255}, tapped.Image.RGBAAt(1, 1))
+}
@@ -0,0 +1,130 @@
+package vidoestreamsender
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/recorder"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// playbackRequest asks for recorded footage from a time instead of the live stream
+type playbackRequest struct {
+	from time.Time
+	// kind is the catalog played, the recordings by default
+	kind string
+	// rate is the pace, 0 keeps real time
+	rate float64
+}
+
+// parsePlaybackRequest reads playback=<RFC 3339>, kind= and rate= of a WHEP query or of the data of a signaling
+// offer, it returns nil without playback
+func parsePlaybackRequest(values url.Values) (*playbackRequest, error) {
+	from := values.Get("playback")
+	if from == "" {
+		return nil, nil
+	}
+	req := &playbackRequest{kind: values.Get("kind")}
+	var err error
+	if req.from, err = time.Parse(time.RFC3339Nano, from); err != nil {
+		return nil, fmt.Errorf("Invalid playback time %q", from)
+	}
+	if rate := values.Get("rate"); rate != "" {
+		if req.rate, err = strconv.ParseFloat(rate, 64); err != nil {
+			return nil, fmt.Errorf("Invalid playback rate %q", rate)
+		}
+	}
+	return req, nil
+}
+
+// playbackCatalog returns the catalog of a kind of recordings, the recordings by default
+func (vss *VideoStreamSender) playbackCatalog(kind string) (*recorder.Catalog, error) {
+	if kind == "" {
+		kind = kindRecordings
+	}
+	catalog := vss.catalogs[kind]
+	if catalog == nil {
+		return nil, fmt.Errorf("No %v", kind)
+	}
+	return catalog, nil
+}
+
+// startPlayback replaces the live stream of a viewer with recorded footage, or moves an ongoing playback to
+// another catalog or time. The live stream comes back with a keyframe once the footage ends.
+func (vss *VideoStreamSender) startPlayback(session *viewerSession, req *playbackRequest) (*recorder.Player, error) {
+	catalog, err := vss.playbackCatalog(req.kind)
+	if err != nil {
+		return nil, err
+	}
+	// the recorded samples take the path of the encoded frames, through the sample track of the viewer
+	track := session.track
+	player := recorder.NewPlayer(catalog, req.from, func(sample recorder.PlaybackSample) error {
+		return track.WriteSample(media.Sample{Data: sample.Data, Timestamp: sample.Time, Duration: sample.Duration})
+	})
+	if req.rate != 0 {
+		if err := player.SetRate(req.rate); err != nil {
+			return nil, err
+		}
+	}
+	session.playbackMu.Lock()
+	old := session.playback
+	session.playback = player
+	session.playbackMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	session.streamer.hold(true)
+	player.Start()
+	go vss.watchPlayback(session, player)
+	return player, nil
+}
+
+// stopPlayback returns a viewer to the live stream
+func (vss *VideoStreamSender) stopPlayback(session *viewerSession) {
+	session.playbackMu.Lock()
+	player := session.playback
+	session.playback = nil
+	session.playbackMu.Unlock()
+	if player != nil {
+		player.Close()
+		session.streamer.hold(false)
+	}
+}
+
+// watchPlayback returns the viewer to the live stream at the end of the footage, and tells it over the control
+// channel. The player is closed with the session.
+func (vss *VideoStreamSender) watchPlayback(session *viewerSession, player *recorder.Player) {
+	select {
+	case <-player.Done():
+	case <-session.done:
+		player.Close()
+		return
+	}
+	session.playbackMu.Lock()
+	current := session.playback == player
+	if current {
+		session.playback = nil
+	}
+	session.playbackMu.Unlock()
+	if !current {
+		// stopped or replaced
+		return
+	}
+	session.streamer.hold(false)
+	if err := player.Err(); err != nil {
+		logger.Printf("Playback of %v stopped: %v\n", session.id, err)
+	}
+	if session.control != nil {
+		state := player.State()
+		session.control.send(controlEvent{V: ControlProtocolVersion, Type: ControlPlaybackEnded, Result: state})
+	}
+}
+
+// player returns the ongoing playback of the viewer, nil when live
+func (s *viewerSession) player() *recorder.Player {
+	s.playbackMu.Lock()
+	defer s.playbackMu.Unlock()
+	return s.playback
+}
@@ -0,0 +1,147 @@
+package vidoestreamsender
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/acentior/camera-pipeline-sender/internal/filters"
+	"github.com/google/uuid"
+)
+
+// loadPrivacyMasks reads the masks of every camera, a missing file means no masks
+func loadPrivacyMasks(path string) ([][]filters.Mask, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	masks := [][]filters.Mask{}
+	if err := json.Unmarshal(data, &masks); err != nil {
+		return nil, fmt.Errorf("Invalid privacy masks file %v: %v", path, err)
+	}
+	return masks, nil
+}
+
+// savePrivacyMasks writes the masks of every camera so they survive a restart
+func (vss *VideoStreamSender) savePrivacyMasks() error {
+	if vss.masksFile == "" {
+		return nil
+	}
+	masks := make([][]filters.Mask, len(vss.privacyMasks))
+	for i, pm := range vss.privacyMasks {
+		masks[i] = pm.Masks()
+	}
+	data, err := json.MarshalIndent(masks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(vss.masksFile), "."+filepath.Base(vss.masksFile)+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, vss.masksFile)
+}
+
+// PrivacyMask returns the mask filter of a camera
+func (vss *VideoStreamSender) PrivacyMask(camera int) (*filters.PrivacyMask, error) {
+	if camera < 0 || camera >= len(vss.privacyMasks) {
+		return nil, fmt.Errorf("Unknown camera %d", camera)
+	}
+	return vss.privacyMasks[camera], nil
+}
+
+// handlePrivacyMasks edits the masks of a camera, selected with ?camera=N (0 by default). The edits need the
+// HTTP token, the masks may be required by law.
+//
+//	GET    list the masks
+//	PUT    replace every mask with the JSON list in the body
+//	POST   add the JSON mask in the body, an id is generated when missing
+//	DELETE remove the mask given by ?id=
+func (vss *VideoStreamSender) handlePrivacyMasks(w http.ResponseWriter, r *http.Request) {
+	camera := 0
+	if v := r.URL.Query().Get("camera"); v != "" {
+		var err error
+		if camera, err = strconv.Atoi(v); err != nil {
+			httpError(w, http.StatusBadRequest, "Invalid camera")
+			return
+		}
+	}
+	pm, err := vss.PrivacyMask(camera)
+	if err != nil {
+		httpError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	// Serialize the edits so concurrent requests don't drop each other's masks
+	vss.masksMu.Lock()
+	defer vss.masksMu.Unlock()
+	previous := pm.Masks()
+	masks := pm.Masks()
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, masks)
+		return
+	case http.MethodPut:
+		masks = []filters.Mask{}
+		if err := json.NewDecoder(r.Body).Decode(&masks); err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for i := range masks {
+			if masks[i].ID == "" {
+				masks[i].ID = uuid.New().String()
+			}
+		}
+	case http.MethodPost:
+		mask := filters.Mask{}
+		if err := json.NewDecoder(r.Body).Decode(&mask); err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if mask.ID == "" {
+			mask.ID = uuid.New().String()
+		}
+		masks = append(masks, mask)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		kept := []filters.Mask{}
+		for _, m := range masks {
+			if m.ID != id {
+				kept = append(kept, m)
+			}
+		}
+		if len(kept) == len(masks) {
+			httpError(w, http.StatusNotFound, fmt.Sprintf("Unknown mask %q", id))
+			return
+		}
+		masks = kept
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if err := pm.SetMasks(masks); err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := vss.savePrivacyMasks(); err != nil {
+		// an edit lost on restart must not look applied
+		logger.Printf("Failed to save privacy masks: %v\n", err)
+		if err := pm.SetMasks(previous); err != nil {
+			logger.Printf("Failed to restore privacy masks: %v\n", err)
+		}
+		httpError(w, http.StatusInternalServerError, "Failed to save the privacy masks: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, pm.Masks())
+}
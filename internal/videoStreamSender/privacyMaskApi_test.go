@@ -0,0 +1,77 @@
+package vidoestreamsender
+
+import (
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/acentior/camera-pipeline-sender/internal/filters"
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/stretchr/testify/suite"
+)
+
+type PrivacyMaskSuit struct {
+	suite.Suite
+	source *solidSource
+	vss    *VideoStreamSender
+	server *httptest.Server
+}
+
+func TestPrivacyMaskSuite(t *testing.T) {
+	suite.Run(t, new(PrivacyMaskSuit))
+}
+
+func (s *PrivacyMaskSuit) SetupTest() {
+	s.source = newSolidSource(color.RGBA{G: 255, A: 255}, size.Size{Width: 320, Height: 240})
+	s.vss = newTestSender(s.source)
+	pm, err := filters.NewPrivacyMask()
+	s.Require().NoError(err)
+	s.vss.privacyMasks = []*filters.PrivacyMask{pm}
+	s.vss.masksFile = filepath.Join(s.T().TempDir(), "masks.json")
+	s.vss.handleAPI("/api/masks", s.vss.requireTokenFor(s.vss.handlePrivacyMasks, http.MethodPut, http.MethodPost, http.MethodDelete))
+	s.server = httptest.NewServer(s.vss.httpMux)
+}
+
+func (s *PrivacyMaskSuit) TearDownTest() {
+	s.server.Close()
+	s.source.Stop()
+}
+
+func (s *PrivacyMaskSuit) add() *http.Response {
+	req, _ := http.NewRequest(http.MethodPost, s.server.URL+"/api/masks?camera=0",
+		strings.NewReader(`{"mode":"black","rect":{"x":0,"y":0,"w":0.5,"h":0.5}}`))
+	req.Header.Set("Authorization", "Bearer "+s.vss.httpToken)
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	resp.Body.Close()
+	return resp
+}
+
+func (s *PrivacyMaskSuit) Test_EditsNeedToken() {
+	s.Equal(http.StatusForbidden, s.add().StatusCode)
+	s.Empty(s.vss.privacyMasks[0].Masks())
+
+	resp, err := http.Get(s.server.URL + "/api/masks?camera=0")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Equal(http.StatusOK, resp.StatusCode)
+	masks := []filters.Mask{}
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&masks))
+	s.Empty(masks)
+
+	s.vss.httpToken = "secret"
+	s.Equal(http.StatusOK, s.add().StatusCode)
+	s.Len(s.vss.privacyMasks[0].Masks(), 1)
+	s.FileExists(s.vss.masksFile)
+}
+
+func (s *PrivacyMaskSuit) Test_FailedSaveIsUndone() {
+	s.vss.httpToken = "secret"
+	s.vss.masksFile = filepath.Join(s.T().TempDir(), "missing", "masks.json")
+	s.Equal(http.StatusInternalServerError, s.add().StatusCode)
+	s.Empty(s.vss.privacyMasks[0].Masks())
+}
@@ -0,0 +1,124 @@
+package vidoestreamsender
+
+import (
+	"encoding/json"
+	"image"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// PTZ control modes
+const (
+	// PTZModeViewer gives every viewer its own pan/tilt/zoom
+	PTZModeViewer = "viewer"
+	// PTZModeGlobal shares one pan/tilt/zoom between every viewer
+	PTZModeGlobal = "global"
+)
+
+// PTZState is a digital pan/tilt/zoom position.
+// X and Y are the center of the view relative to the full frame, Zoom 1 shows the full frame.
+type PTZState struct {
+	Zoom float64 `json:"zoom"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+}
+
+// ptzCommand is a JSON message of the ptz data channel, missing fields are left unchanged
+type ptzCommand struct {
+	Zoom *float64 `json:"zoom"`
+	X    *float64 `json:"x"`
+	Y    *float64 `json:"y"`
+}
+
+// ptzController moves a crop window over the full resolution frames.
+// The window glides towards the requested position instead of jumping to it.
+type ptzController struct {
+	mu        sync.Mutex
+	current   PTZState
+	target    PTZState
+	last      time.Time
+	maxZoom   float64
+	smoothing time.Duration
+}
+
+func newPTZController(maxZoom float64, smoothing time.Duration) *ptzController {
+	center := PTZState{Zoom: 1, X: 0.5, Y: 0.5}
+	return &ptzController{
+		current:   center,
+		target:    center,
+		maxZoom:   math.Max(1, maxZoom),
+		smoothing: smoothing,
+	}
+}
+
+// apply updates the target position with a command and returns the new target
+func (p *ptzController) apply(cmd ptzCommand) PTZState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cmd.Zoom != nil {
+		p.target.Zoom = math.Max(1, math.Min(p.maxZoom, *cmd.Zoom))
+	}
+	if cmd.X != nil {
+		p.target.X = math.Max(0, math.Min(1, *cmd.X))
+	}
+	if cmd.Y != nil {
+		p.target.Y = math.Max(0, math.Min(1, *cmd.Y))
+	}
+	return p.target
+}
+
+// state returns the requested position
+func (p *ptzController) state() PTZState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.target
+}
+
+// crop advances the window towards the target and returns it for a frame of the given bounds
+func (p *ptzController) crop(bounds image.Rectangle, now time.Time) image.Rectangle {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last.IsZero() || p.smoothing <= 0 {
+		p.current = p.target
+	} else {
+		// exponential smoothing, independent of the frame rate and of the number of callers
+		alpha := 1 - math.Exp(-float64(now.Sub(p.last))/float64(p.smoothing))
+		p.current.Zoom += (p.target.Zoom - p.current.Zoom) * alpha
+		p.current.X += (p.target.X - p.current.X) * alpha
+		p.current.Y += (p.target.Y - p.current.Y) * alpha
+	}
+	p.last = now
+	return ptzWindow(p.current, bounds)
+}
+
+// ptzWindow returns the crop rectangle of a position, kept inside the frame
+func ptzWindow(s PTZState, bounds image.Rectangle) image.Rectangle {
+	w := int(math.Round(float64(bounds.Dx()) / s.Zoom))
+	h := int(math.Round(float64(bounds.Dy()) / s.Zoom))
+	x := int(math.Round(s.X*float64(bounds.Dx()))) - w/2
+	y := int(math.Round(s.Y*float64(bounds.Dy()))) - h/2
+	x = max(0, min(bounds.Dx()-w, x))
+	y = max(0, min(bounds.Dy()-h, y))
+	return image.Rect(x, y, x+w, y+h).Add(bounds.Min)
+}
+
+// handlePTZChannel applies the commands received on a ptz data channel and answers with the new target
+func handlePTZChannel(dc *webrtc.DataChannel, ptz *ptzController) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		cmd := ptzCommand{}
+		if err := json.Unmarshal(msg.Data, &cmd); err != nil {
+			logger.Printf("Invalid ptz command: %v\n", err)
+			return
+		}
+		data, err := json.Marshal(ptz.apply(cmd))
+		if err != nil {
+			return
+		}
+		if err := dc.SendText(string(data)); err != nil {
+			logger.Printf("Failed to answer ptz command: %v\n", err)
+		}
+	})
+}
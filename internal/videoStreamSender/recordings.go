@@ -0,0 +1,213 @@
+package vidoestreamsender
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/config"
+	"github.com/acentior/camera-pipeline-sender/internal/recorder"
+	"github.com/acentior/camera-pipeline-sender/pkg/encryption"
+)
+
+// recordingDirs returns the directories of the recordings and the clips
+func recordingDirs(cfg *config.Config) []string {
+	dirs := []string{}
+	for _, dir := range []string{cfg.RecordingDir, cfg.ClipsDir} {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// Kinds of recordings of the catalogs
+const (
+	kindRecordings = "recordings"
+	kindClips      = "clips"
+)
+
+// openChain returns the hash chain of a recordings directory, nil without signing key
+func openChain(dir string, key ed25519.PrivateKey) (*recorder.Chain, error) {
+	if key == nil {
+		return nil, nil
+	}
+	chain, err := recorder.OpenChain(dir, key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open the hash chain of %v: %v", dir, err)
+	}
+	return chain, nil
+}
+
+// recordingCatalogs returns the catalogs of the recordings and the clips by kind
+func recordingCatalogs(cfg *config.Config, keyring *encryption.Keyring) map[string]*recorder.Catalog {
+	catalogs := map[string]*recorder.Catalog{}
+	if cfg.RecordingDir != "" {
+		catalogs[kindRecordings] = recorder.NewCatalog(cfg.RecordingDir, keyring)
+	}
+	if cfg.ClipsDir != "" {
+		catalogs[kindClips] = recorder.NewCatalog(cfg.ClipsDir, keyring)
+	}
+	return catalogs
+}
+
+// catalogRange returns the catalog of ?kind=, the recordings by default, and the range of ?from= and ?to= in
+// RFC 3339, unbounded when missing
+func (vss *VideoStreamSender) catalogRange(r *http.Request) (*recorder.Catalog, time.Time, time.Time, error) {
+	query := r.URL.Query()
+	kind := query.Get("kind")
+	if kind == "" {
+		kind = kindRecordings
+	}
+	catalog := vss.catalogs[kind]
+	if catalog == nil {
+		return nil, time.Time{}, time.Time{}, fmt.Errorf("No %v", kind)
+	}
+	from, to := time.Time{}, time.Unix(1<<40, 0)
+	for _, param := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if value := query.Get(param.name); value != "" {
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, time.Time{}, time.Time{}, fmt.Errorf("Invalid %v %q", param.name, value)
+			}
+			*param.t = t
+		}
+	}
+	if !from.Before(to) {
+		return nil, time.Time{}, time.Time{}, fmt.Errorf("Empty range")
+	}
+	return catalog, from, to, nil
+}
+
+// handleRecordings lists the recordings overlapping a range
+//
+//	GET /api/recordings?kind=recordings|clips&from=<RFC 3339>&to=<RFC 3339>
+func (vss *VideoStreamSender) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	catalog, from, to, err := vss.catalogRange(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	segments, err := catalog.List(from, to)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"recordings": segments})
+}
+
+// handleRecordingExport streams a range as a single MP4, from the keyframe at or before from
+//
+//	GET /api/recordings/export?kind=recordings|clips&from=<RFC 3339>&to=<RFC 3339>
+func (vss *VideoStreamSender) handleRecordingExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	catalog, from, to, err := vss.catalogRange(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// the headers wait for the first write, so a range without footage is still a 404
+	out := &exportWriter{w: w, name: "export-" + recorder.FileName(from)}
+	err = catalog.Export(out, from, to)
+	if errors.Is(err, recorder.ErrNoFootage) {
+		httpError(w, http.StatusNotFound, err.Error())
+	} else if err != nil && !out.started {
+		httpError(w, http.StatusInternalServerError, err.Error())
+	} else if err != nil {
+		logger.Printf("Export of %v to %v failed: %v\n", from, to, err)
+	}
+}
+
+// exportWriter sends the MP4 headers with the first write
+type exportWriter struct {
+	w       http.ResponseWriter
+	name    string
+	started bool
+}
+
+func (e *exportWriter) Write(p []byte) (int, error) {
+	if !e.started {
+		e.started = true
+		e.w.Header().Set("Content-Type", "video/mp4")
+		e.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", e.name))
+		e.w.WriteHeader(http.StatusOK)
+	}
+	return e.w.Write(p)
+}
+
+// findRecording returns the path of a recording or clip by name
+func (vss *VideoStreamSender) findRecording(name string) (string, error) {
+	if _, err := recorder.ParseFileName(name); err != nil || filepath.Base(name) != name {
+		return "", fmt.Errorf("Invalid recording %q", name)
+	}
+	if vss.retention != nil {
+		for _, dir := range vss.retention.Dirs() {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Unknown recording %q", name)
+}
+
+// handleRetention returns the report of the last retention pass, POST runs a pass first
+func (vss *VideoStreamSender) handleRetention(w http.ResponseWriter, r *http.Request) {
+	if vss.retention == nil {
+		httpError(w, http.StatusNotFound, "Recording is disabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		report := vss.retention.LastReport()
+		if report == nil {
+			httpError(w, http.StatusNotFound, "No retention pass yet")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	case http.MethodPost:
+		writeJSON(w, http.StatusOK, vss.retention.Enforce())
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleRecordingLock protects the recording given by ?file=<name> from the retention, e.g. as evidence
+//
+//	POST   lock the recording
+//	DELETE unlock it
+func (vss *VideoStreamSender) handleRecordingLock(w http.ResponseWriter, r *http.Request) {
+	path, err := vss.findRecording(r.URL.Query().Get("file"))
+	if err != nil {
+		httpError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		err = recorder.Lock(path)
+	case http.MethodDelete:
+		err = recorder.Unlock(path)
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"file": filepath.Base(path), "locked": recorder.IsLocked(path)})
+}
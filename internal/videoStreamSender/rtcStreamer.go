@@ -3,6 +3,7 @@ package vidoestreamsender
 import (
 	"image"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/acentior/camera-pipeline-sender/internal/encoders"
@@ -18,14 +19,42 @@ type rtcStreamer struct {
 	removeTrack chan *webrtc.TrackLocalStaticSample
 	encoder     *encoders.Encoder
 	size        size.Size
-	camCapturer *CameraCapturer
+	source      FrameSource
+	// ptz is the digital pan/tilt/zoom window cropped before scaling, nil streams the full frame
+	ptz *ptzController
+	// shared is the encoded stream of the other outputs, sent as is while the viewer has no zoom, frame rate or
+	// bitrate of its own. nil always encodes for the viewer.
+	shared *encodedStream
+	// newEncoder opens an encoder for another frame rate
+	newEncoder func(fps int) (encoders.Encoder, error)
+	// onSent is called after each frame written to the tracks
+	onSent func(frame *Frame)
+	// skip accumulates the source frames to drop when sending below the source rate
+	skip float64
+	// pacer holds each encoded frame until the next one gives its duration
+	pacer samplePacer
+
+	// mu guards the encoder swap and the settings below
+	mu      sync.Mutex
+	started bool
+	closed  bool
+	// fps is the rate the encoder was opened for, wantFps the requested one, 0 sends every source frame
+	fps     int
+	wantFps int
+	// bitrate is the requested bitrate in kbit/s, 0 keeps the encoder default
+	bitrate int
+	// held stops the live frames while the tracks play recorded footage, released restarts the pacer
+	held     bool
+	released bool
+	// sharing is set while the viewer gets the shared stream, the own encoder is idle meanwhile
+	sharing bool
 }
 
 func init() {
 	logger = log.New(log.Writer(), "[videoStreamer/rtcStreamer]", log.LstdFlags)
 }
 
-func newRTCStreamer(tracks []*webrtc.TrackLocalStaticSample, capturer *CameraCapturer, encoder *encoders.Encoder, size size.Size) *rtcStreamer {
+func newRTCStreamer(tracks []*webrtc.TrackLocalStaticSample, source FrameSource, encoder *encoders.Encoder, size size.Size) *rtcStreamer {
 	return &rtcStreamer{
 		tracks:      tracks,
 		stop:        make(chan struct{}),
@@ -33,19 +62,54 @@ func newRTCStreamer(tracks []*webrtc.TrackLocalStaticSample, capturer *CameraCap
 		removeTrack: make(chan *webrtc.TrackLocalStaticSample),
 		encoder:     encoder,
 		size:        size,
-		camCapturer: capturer,
+		source:      source,
+		fps:         source.Fps(),
 	}
 }
 
 func (s *rtcStreamer) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started || s.closed {
+		return
+	}
+	s.started = true
 	go func() {
-		capturer := *s.camCapturer
-		// capturer.agentAdded <- struct{}{}
-		frames := capturer.Frames()
+		// one of frames and encoded is subscribed, following the encoding the viewer gets
+		var frames <-chan *Frame
+		var encoded <-chan *encoders.EncodedFrame
+		defer func() {
+			if frames != nil {
+				s.source.Unsubscribe(frames)
+			}
+			if encoded != nil {
+				s.shared.Unsubscribe(encoded)
+			}
+		}()
+		defer func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			(*s.encoder).Close()
+		}()
 		for {
+			if sharing := s.wantsShared(); frames == nil && encoded == nil || sharing != (encoded != nil) {
+				if frames != nil {
+					s.source.Unsubscribe(frames)
+					frames = nil
+				}
+				if encoded != nil {
+					s.shared.Unsubscribe(encoded)
+					encoded = nil
+				}
+				if sharing {
+					encoded = s.shared.Subscribe()
+				} else {
+					frames = s.source.Subscribe()
+				}
+				s.setSharing(sharing)
+			}
 			select {
 			case <-s.stop:
-				// capturer.agentRemoved <- struct{}{}
 				// logger.Println("completed streamer")
 				return
 			case newTrack := <-s.newTrack:
@@ -58,40 +122,255 @@ func (s *rtcStreamer) start() {
 					}
 				}
 				s.tracks = tracks
-			case frame := <-frames:
+			case frame, ok := <-frames:
+				if !ok {
+					return
+				}
 				err := s.stream(frame)
 				if err != nil {
 					logger.Printf("Streamer: %v\n", err)
 					return
 				}
+			case frame, ok := <-encoded:
+				if !ok {
+					return
+				}
+				s.streamEncoded(frame)
 			}
 		}
 	}()
 }
 
-func (s *rtcStreamer) stream(frame *image.RGBA) error {
-	resized := resizeImage(frame, s.size)
-	payload, err := (*s.encoder).Encode(resized)
+// wantsShared tells whether the viewer can get the shared stream: its zoom window is the full frame and it has
+// no frame rate or bitrate of its own
+func (s *rtcStreamer) wantsShared() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shared == nil || s.bitrate > 0 || s.wantFps > 0 && s.wantFps < s.source.Fps() {
+		return false
+	}
+	if s.ptz == nil {
+		return true
+	}
+	full := image.Rectangle{Max: image.Pt(s.source.Size().Width, s.source.Size().Height)}
+	return s.ptz.crop(full, time.Now()) == full
+}
+
+// setSharing records the encoding the viewer gets, the samples restart with a keyframe of the new one
+func (s *rtcStreamer) setSharing(sharing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sharing != s.sharing {
+		logger.Printf("Streamer sharing the encoded stream: %v\n", sharing)
+	}
+	s.sharing = sharing
+	s.skip = 0
+	s.pacer.reset()
+	if !sharing {
+		(*s.encoder).ForceKeyframe()
+	}
+}
+
+// streamEncoded sends a frame of the shared stream, which starts at a keyframe
+func (s *rtcStreamer) streamEncoded(encoded *encoders.EncodedFrame) {
+	if s.isHeld() {
+		return
+	}
+	s.send(encoded.Data, &Frame{Time: encoded.Time, Seq: encoded.Seq})
+}
+
+func (s *rtcStreamer) stream(frame *Frame) error {
+	if s.isHeld() {
+		return nil
+	}
+	encoder, fps, err := s.applyFps()
+	if err != nil {
+		return err
+	}
+	if sourceFps := s.source.Fps(); fps < sourceFps {
+		// keep fps frames out of every sourceFps, evenly spread
+		s.skip += float64(fps) / float64(sourceFps)
+		if s.skip < 1 {
+			return nil
+		}
+		s.skip--
+	}
+	img := frame.Image
+	if s.ptz != nil {
+		img = img.SubImage(s.ptz.crop(img.Bounds(), time.Now())).(*image.RGBA)
+	}
+	resized := resizeImage(img, s.size)
+	payload, err := encoder.Encode(resized)
 	if err != nil {
 		return err
 	}
 	if payload == nil {
 		return nil
 	}
-	delta := time.Duration(1000/s.camCapturer.Fps()) * time.Millisecond
+	s.send(payload, frame)
+	return nil
+}
+
+// send writes an encoded frame to the tracks once the next one gives its duration
+func (s *rtcStreamer) send(payload []byte, frame *Frame) {
+	sample, sent, ok := s.pacer.push(payload, frame)
+	if !ok {
+		return
+	}
 	for _, track := range s.tracks {
-		err := track.WriteSample(media.Sample{
-			Data:      payload,
-			Timestamp: time.Now(),
-			Duration:  delta,
-		})
-		if err != nil {
+		if err := track.WriteSample(sample); err != nil {
 			logger.Printf("Sample is not written into the track %v", track.ID())
 		}
 	}
+	if s.onSent != nil {
+		s.onSent(sent)
+	}
+}
+
+// samplePacer times the samples written to a track. The packetizer stamps a sample with the RTP clock, then
+// advances the clock by the sample duration, so a sample must last until the next capture for every frame to be
+// stamped with its own capture time, whatever frames were dropped on the way. Each frame is held back until the
+// next one, which delays the stream by a frame.
+type samplePacer struct {
+	payload []byte
+	frame   *Frame
+}
+
+// push holds an encoded frame and returns the one held before, lasting until the capture of the new one
+func (p *samplePacer) push(payload []byte, frame *Frame) (media.Sample, *Frame, bool) {
+	held, heldFrame := p.payload, p.frame
+	p.payload, p.frame = payload, frame
+	if heldFrame == nil {
+		return media.Sample{}, nil, false
+	}
+	return media.Sample{
+		Data:      held,
+		Timestamp: heldFrame.Time,
+		Duration:  sampleDuration(heldFrame.Time, frame.Time),
+	}, heldFrame, true
+}
+
+// reset drops the held frame
+func (p *samplePacer) reset() {
+	p.payload, p.frame = nil, nil
+}
+
+// sampleDuration returns the duration of a sample captured at captured and followed by a capture at next
+func sampleDuration(captured time.Time, next time.Time) time.Duration {
+	// frames must not share an RTP timestamp
+	return max(time.Millisecond, next.Sub(captured))
+}
+
+// applyFps reopens the encoder when another frame rate was requested, and returns the encoder to use
+func (s *rtcStreamer) applyFps() (encoders.Encoder, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fps := s.source.Fps()
+	if s.wantFps > 0 && s.wantFps < fps {
+		fps = s.wantFps
+	}
+	if fps == s.fps || s.newEncoder == nil {
+		return *s.encoder, s.fps, nil
+	}
+	// the rate control of x264 is tied to the frame rate it was opened with
+	encoder, err := s.newEncoder(fps)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.bitrate > 0 {
+		if err := encoder.SetBitrate(s.bitrate); err != nil {
+			encoder.Close()
+			return nil, 0, err
+		}
+	}
+	(*s.encoder).Close()
+	s.encoder = &encoder
+	s.fps = fps
+	s.skip = 0
+	return encoder, fps, nil
+}
+
+// hold stops or restarts the live frames, which restart with a keyframe
+func (s *rtcStreamer) hold(held bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held && !held {
+		s.forceKeyframeLocked()
+		s.released = true
+	}
+	s.held = held
+}
+
+// isHeld tells whether the live frames are stopped. The live frame held back when the footage started is
+// dropped, the RTP clock went on with the footage.
+func (s *rtcStreamer) isHeld() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		s.released = false
+		s.pacer.reset()
+	}
+	if s.held {
+		s.pacer.reset()
+	}
+	return s.held
+}
+
+// setFps changes the frame rate sent to the viewer, 0 or more than the source rate sends every frame
+func (s *rtcStreamer) setFps(fps int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wantFps = fps
+}
+
+// setBitrate changes the target bitrate in kbit/s
+func (s *rtcStreamer) setBitrate(kbps int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := (*s.encoder).SetBitrate(kbps); err != nil {
+		return err
+	}
+	s.bitrate = kbps
 	return nil
 }
 
+// forceKeyframe makes the next frame sent a keyframe
+func (s *rtcStreamer) forceKeyframe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forceKeyframeLocked()
+}
+
+// forceKeyframeLocked asks the encoding the viewer gets for a keyframe, s.mu must be held
+func (s *rtcStreamer) forceKeyframeLocked() {
+	if s.sharing {
+		s.shared.forceKeyframe()
+	} else {
+		(*s.encoder).ForceKeyframe()
+	}
+}
+
+// settings returns the frame rate and the bitrate in kbit/s the viewer gets
+func (s *rtcStreamer) settings() (fps int, kbps int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fps = s.source.Fps()
+	if s.wantFps > 0 && s.wantFps < fps {
+		fps = s.wantFps
+	}
+	return fps, (*s.encoder).Bitrate()
+}
+
+// Close stops the streamer, the encoder is released with it
 func (s *rtcStreamer) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
 	close(s.stop)
+	if !s.started {
+		(*s.encoder).Close()
+	}
 }
@@ -0,0 +1,114 @@
+package vidoestreamsender
+
+import (
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/stretchr/testify/suite"
+)
+
+type RTCStreamerSuit struct {
+	suite.Suite
+}
+
+func TestRTCStreamerSuite(t *testing.T) {
+	suite.Run(t, new(RTCStreamerSuit))
+}
+
+func (s *RTCStreamerSuit) Test_RTPTimestampsFollowCaptureTimes() {
+	// the packetizer of the sample tracks, which stamps a sample before advancing by its duration
+	packetizer := rtp.NewPacketizer(1200, 96, 1, &codecs.H264Payloader{}, rtp.NewRandomSequencer(), 90000)
+	pacer := samplePacer{}
+	start := time.Now()
+	// 30 fps with jitter and two dropped frames
+	captures := []time.Duration{0, 33, 70, 99, 200, 233, 266}
+	timestamps := []uint32{}
+	for i, offset := range captures {
+		frame := &Frame{Time: start.Add(offset * time.Millisecond), Seq: uint64(i)}
+		sample, sent, ok := pacer.push([]byte{0x65, byte(i)}, frame)
+		if i == 0 {
+			// held until the next capture
+			s.False(ok)
+			continue
+		}
+		s.Require().True(ok)
+		s.Equal(uint64(i-1), sent.Seq)
+		packets := packetizer.Packetize(sample.Data, uint32(sample.Duration.Seconds()*90000))
+		s.Require().Len(packets, 1)
+		timestamps = append(timestamps, packets[0].Timestamp)
+	}
+	// every frame is stamped with its own capture time
+	for i, timestamp := range timestamps {
+		s.Equal(uint32(captures[i]*90), timestamp-timestamps[0], "frame %d", i)
+	}
+
+	s.Equal(time.Millisecond, sampleDuration(start, start))
+	pacer.reset()
+	_, _, ok := pacer.push([]byte{0x65}, &Frame{Time: start})
+	s.False(ok)
+}
+
+func (s *RTCStreamerSuit) Test_SharedEncoding() {
+	source := newSolidSource(color.RGBA{G: 255, A: 255}, size.Size{Width: 320, Height: 240})
+	defer source.Stop()
+	vss := newTestSender(source)
+	vss.encoded = newEncodedStream(source, func() (encoders.Encoder, error) {
+		return vss.encService.NewEncoder(encoders.H264Codec, source.Size(), source.Fps())
+	}, time.Second)
+	streamer, err := vss.GetRTCStreamer(&vss.webrtcCodec.RTPCodecCapability, source)
+	s.Require().NoError(err)
+	defer streamer.Close()
+	streamer.ptz = newPTZController(4, 0)
+	sent := make(chan *Frame, 1)
+	streamer.onSent = func(frame *Frame) {
+		select {
+		case sent <- frame:
+		default:
+		}
+	}
+	sharing := func() bool {
+		streamer.mu.Lock()
+		defer streamer.mu.Unlock()
+		return streamer.sharing
+	}
+	subscribers := func() int {
+		vss.encoded.mu.Lock()
+		defer vss.encoded.mu.Unlock()
+		return len(vss.encoded.subscribers)
+	}
+	streamer.start()
+
+	// without zoom, frame rate or bitrate of its own, the viewer gets the shared stream
+	s.Eventually(func() bool { return sharing() && len(sent) > 0 }, 5*time.Second, 10*time.Millisecond)
+	s.Equal(1, subscribers())
+
+	// a zoom needs the own encoder, zooming out shares again
+	zoom := 2.0
+	streamer.ptz.apply(ptzCommand{Zoom: &zoom})
+	s.Eventually(func() bool { return !sharing() && subscribers() == 0 }, 5*time.Second, 10*time.Millisecond)
+	received := func() bool {
+		select {
+		case <-sent:
+			return true
+		default:
+			return false
+		}
+	}
+	received()
+	s.Eventually(received, 5*time.Second, 10*time.Millisecond)
+	zoom = 1
+	streamer.ptz.apply(ptzCommand{Zoom: &zoom})
+	s.Eventually(func() bool { return sharing() && subscribers() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	streamer.setFps(10)
+	s.Eventually(func() bool { return !sharing() && subscribers() == 0 }, 5*time.Second, 10*time.Millisecond)
+	streamer.setFps(0)
+	s.Eventually(sharing, 5*time.Second, 10*time.Millisecond)
+	s.Require().NoError(streamer.setBitrate(500))
+	s.Eventually(func() bool { return !sharing() }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,98 @@
+package vidoestreamsender
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// sdpFragContentType is the body of the trickle ICE PATCH requests of WHIP and WHEP
+const sdpFragContentType = "application/trickle-ice-sdpfrag"
+
+// sdpFrag is the content of a trickle ICE SDP fragment (RFC 8840)
+type sdpFrag struct {
+	ufrag      string
+	pwd        string
+	candidates []webrtc.ICECandidateInit
+}
+
+// parseSDPFrag reads the ICE credentials and the candidates of an SDP fragment,
+// each candidate is tagged with the mid of its media section
+func parseSDPFrag(body string) sdpFrag {
+	frag := sdpFrag{}
+	var mid *string
+	var mLineIndex *uint16
+	index := -1
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			index++
+			i := uint16(index)
+			mLineIndex, mid = &i, nil
+		case strings.HasPrefix(line, "a=mid:"):
+			m := strings.TrimPrefix(line, "a=mid:")
+			mid = &m
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			frag.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			frag.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			frag.candidates = append(frag.candidates, webrtc.ICECandidateInit{
+				Candidate:     strings.TrimPrefix(line, "a="),
+				SDPMid:        mid,
+				SDPMLineIndex: mLineIndex,
+			})
+		}
+	}
+	return frag
+}
+
+// buildSDPFrag writes candidates of a local description into an SDP fragment.
+// Every candidate goes under the media section of its mid, with the ICE credentials of the description.
+// Candidates without a mid belong to the first section, the one every section is bundled on.
+func buildSDPFrag(local string, candidates []webrtc.ICECandidateInit) string {
+	ufrag, pwd := "", ""
+	// media lines by mid, in the order of the description
+	mids := []string{}
+	mLines := map[string]string{}
+	mLine := ""
+	for _, line := range strings.Split(local, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:") && ufrag == "":
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:") && pwd == "":
+			pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "m="):
+			mLine = line
+		case strings.HasPrefix(line, "a=mid:"):
+			mid := strings.TrimPrefix(line, "a=mid:")
+			mids = append(mids, mid)
+			mLines[mid] = mLine
+		}
+	}
+
+	b := strings.Builder{}
+	b.WriteString("a=ice-ufrag:" + ufrag + "\r\n")
+	b.WriteString("a=ice-pwd:" + pwd + "\r\n")
+	for _, mid := range mids {
+		section := []string{}
+		for _, c := range candidates {
+			candidateMid := mids[0]
+			if c.SDPMid != nil && *c.SDPMid != "" {
+				candidateMid = *c.SDPMid
+			}
+			if candidateMid == mid {
+				section = append(section, "a="+c.Candidate+"\r\n")
+			}
+		}
+		if len(section) == 0 {
+			continue
+		}
+		b.WriteString(mLines[mid] + "\r\n")
+		b.WriteString("a=mid:" + mid + "\r\n")
+		b.WriteString(strings.Join(section, ""))
+	}
+	return b.String()
+}
@@ -0,0 +1,258 @@
+package vidoestreamsender
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/acentior/camera-pipeline-sender/internal/recorder"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// viewerSession is a peer connection sending the stream to one viewer.
+// The signaling path and the HTTP endpoints all create their viewers through newViewerSession,
+// the WHIP client publishes through the same sessions, without the data channels.
+type viewerSession struct {
+	id       string
+	pc       *webrtc.PeerConnection
+	streamer *rtcStreamer
+	// track is the sample track of the viewer, written by the streamer or by the playback
+	track *webrtc.TrackLocalStaticSample
+	// motion carries the motion events, it opens only if the viewer offered a data channel
+	motion *webrtc.DataChannel
+	// metadata carries the capture metadata of every frame sent, keyed by RTP timestamp
+	metadata      *webrtc.DataChannel
+	rtpTimestamps *rtpTimestampRecorder
+	// control serves the control requests, nil without the data channels
+	control *controlChannel
+	// playback replaces the live stream with recorded footage, nil when live
+	playback   *recorder.Player
+	playbackMu sync.Mutex
+	// pendingPlayback is the playback requested with the offer, started once ICE connects
+	pendingPlayback *playbackRequest
+
+	closeOnce sync.Once
+	onClose   func()
+	// done is closed with the session
+	done chan struct{}
+}
+
+// newViewerSession answers a viewer offer and starts streaming once ICE connects, the recorded footage of
+// playback if not nil. The returned answer already holds every local ICE candidate.
+func (vss *VideoStreamSender) newViewerSession(id string, offer webrtc.SessionDescription, playback *playbackRequest) (*viewerSession, *webrtc.SessionDescription, error) {
+	if playback != nil {
+		if _, err := vss.playbackCatalog(playback.kind); err != nil {
+			return nil, nil, fmt.Errorf("Playback unavailable: %v", err)
+		}
+	}
+	session, err := vss.newPeerSession(id, *vss.webrtcCodec)
+	if err != nil {
+		return nil, nil, err
+	}
+	fail := func(err error) (*viewerSession, *webrtc.SessionDescription, error) {
+		session.close()
+		return nil, nil, err
+	}
+	if err := vss.openDataChannels(session); err != nil {
+		return fail(err)
+	}
+	session.pendingPlayback = playback
+
+	vss.addSession(session)
+
+	// Set the remote SessionDescription
+	if err = session.pc.SetRemoteDescription(offer); err != nil {
+		return fail(err)
+	}
+
+	answer, err := session.pc.CreateAnswer(nil)
+	if err != nil {
+		return fail(err)
+	}
+
+	// Create channel that is blocked until ICE Gathering is complete
+	gatherComplete := webrtc.GatheringCompletePromise(session.pc)
+
+	// Sets the LocalDescription, and starts our UDP listeners
+	if err = session.pc.SetLocalDescription(answer); err != nil {
+		return fail(err)
+	}
+
+	// Block until ICE Gathering is complete, disabling trickle ICE
+	// we do this because we only can exchange one signaling message
+	<-gatherComplete
+
+	return session, session.pc.LocalDescription(), nil
+}
+
+// newPeerSession creates a peer connection sending the stream with the given codec.
+// The stream starts once ICE connects and the session closes when ICE fails.
+func (vss *VideoStreamSender) newPeerSession(id string, codec webrtc.RTPCodecParameters) (*viewerSession, error) {
+	streamer, err := vss.GetRTCStreamer(&codec.RTPCodecCapability, vss.source)
+	if err != nil {
+		return nil, err
+	}
+	track := streamer.tracks[0]
+
+	mediaEngine := webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+		streamer.Close()
+		return nil, err
+	}
+	rtpTimestamps := &rtpTimestampRecorder{}
+	interceptors := &interceptor.Registry{}
+	interceptors.Add(rtpTimestamps)
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(&mediaEngine), webrtc.WithInterceptorRegistry(interceptors))
+	peerConnection, err := api.NewPeerConnection(*vss.webrtcConfig)
+	if err != nil {
+		streamer.Close()
+		return nil, err
+	}
+	session := &viewerSession{
+		id:            id,
+		pc:            peerConnection,
+		streamer:      streamer,
+		track:         track,
+		rtpTimestamps: rtpTimestamps,
+		done:          make(chan struct{}),
+	}
+
+	_, err = peerConnection.AddTransceiverFromTrack(track, webrtc.RtpTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	if err != nil {
+		session.close()
+		return nil, err
+	}
+	if err := vss.applyStreamSettings(streamer); err != nil {
+		session.close()
+		return nil, err
+	}
+
+	// Set the handler for ICE connection state
+	// This will notify you when the peer has connected/disconnected
+	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		logger.Printf("Connection State has changed %s \n", connectionState.String())
+		switch connectionState {
+		case webrtc.ICEConnectionStateConnected:
+			logger.Println("start streamer")
+			streamer.start()
+			if req := session.pendingPlayback; req != nil {
+				session.pendingPlayback = nil
+				if _, err := vss.startPlayback(session, req); err != nil {
+					logger.Printf("Failed to start the playback of %v: %v\n", session.id, err)
+				}
+			}
+		case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+			session.close()
+		}
+	})
+
+	// Set the handler for Peer connection state
+	// This will notify you when the peer has connected/disconnected
+	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		logger.Printf("Peer Connection State has changed: %s\n", s.String())
+
+		if s == webrtc.PeerConnectionStateFailed {
+			logger.Println("Peer Connection has gone to failed exiting", track.ID())
+		}
+		if s == webrtc.PeerConnectionStateClosed {
+			logger.Println("Peer Connection has been closed", track.ID())
+		}
+	})
+	return session, nil
+}
+
+// openDataChannels creates the data channels of a viewer, they are negotiated once the SCTP association is up
+func (vss *VideoStreamSender) openDataChannels(session *viewerSession) error {
+	var err error
+	pc, streamer := session.pc, session.streamer
+	if session.motion, err = pc.CreateDataChannel("motion", nil); err != nil {
+		return err
+	}
+	// Digital pan/tilt/zoom, shared by every viewer in the global mode
+	ptz := vss.globalPTZ
+	if ptz == nil {
+		ptz = newPTZController(vss.ptzMaxZoom, vss.ptzSmoothing)
+	}
+	streamer.ptz = ptz
+	ptzChannel, err := pc.CreateDataChannel("ptz", nil)
+	if err != nil {
+		return err
+	}
+	handlePTZChannel(ptzChannel, ptz)
+	// Requests on the stream settings, versioned JSON messages
+	controlChannel, err := pc.CreateDataChannel("control", nil)
+	if err != nil {
+		return err
+	}
+	vss.handleControlChannel(controlChannel, session)
+	if session.metadata, err = newMetadataChannel(pc); err != nil {
+		return err
+	}
+	streamer.onSent = func(frame *Frame) {
+		vss.sendFrameMetadata(session, frame)
+	}
+	return nil
+}
+
+// close stops the stream and the peer connection, it's safe to call several times
+func (s *viewerSession) close() {
+	s.closeOnce.Do(func() {
+		s.streamer.Close()
+		if err := s.pc.Close(); err != nil {
+			logger.Printf("Failed to close peer connection %v: %v\n", s.id, err)
+		}
+		if s.onClose != nil {
+			s.onClose()
+		}
+		close(s.done)
+	})
+}
+
+// sendMotion sends a motion event to the viewer if its data channel is open
+func (s *viewerSession) sendMotion(event string) {
+	if s.motion == nil || s.motion.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	if err := s.motion.SendText(event); err != nil {
+		logger.Printf("Failed to send motion event to %v: %v\n", s.id, err)
+	}
+}
+
+func (vss *VideoStreamSender) addSession(session *viewerSession) {
+	vss.sessionsMu.Lock()
+	defer vss.sessionsMu.Unlock()
+	if old, found := vss.sessions[session.id]; found {
+		// the viewer renegotiated with a new offer
+		go old.close()
+	}
+	session.onClose = func() {
+		vss.sessionsMu.Lock()
+		defer vss.sessionsMu.Unlock()
+		if vss.sessions[session.id] == session {
+			delete(vss.sessions, session.id)
+		}
+	}
+	vss.sessions[session.id] = session
+}
+
+// session returns the viewer session with the given id, nil if there is none
+func (vss *VideoStreamSender) session(id string) *viewerSession {
+	vss.sessionsMu.Lock()
+	defer vss.sessionsMu.Unlock()
+	return vss.sessions[id]
+}
+
+// eachSession calls fn for every connected viewer
+func (vss *VideoStreamSender) eachSession(fn func(*viewerSession)) {
+	vss.sessionsMu.Lock()
+	sessions := make([]*viewerSession, 0, len(vss.sessions))
+	for _, s := range vss.sessions {
+		sessions = append(sessions, s)
+	}
+	vss.sessionsMu.Unlock()
+	for _, s := range sessions {
+		fn(s)
+	}
+}
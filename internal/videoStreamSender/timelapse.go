@@ -0,0 +1,108 @@
+package vidoestreamsender
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/acentior/camera-pipeline-sender/internal/config"
+	"github.com/acentior/camera-pipeline-sender/internal/timelapse"
+)
+
+// initTimelapse creates the timelapse of the frame source, it does nothing when disabled
+func (vss *VideoStreamSender) initTimelapse(cfg *config.Config) error {
+	if cfg.TimelapseDir == "" {
+		return nil
+	}
+	start, err := timelapse.ParseTimeOfDay(cfg.TimelapseStart)
+	if err != nil {
+		return fmt.Errorf("Invalid TIMELAPSE_START: %v", err)
+	}
+	stop, err := timelapse.ParseTimeOfDay(cfg.TimelapseStop)
+	if err != nil {
+		return fmt.Errorf("Invalid TIMELAPSE_STOP: %v", err)
+	}
+	source := vss.source
+	vss.timelapse, err = timelapse.New(func() (*image.RGBA, error) {
+		frame, err := grabFrame(source, snapshotTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return frame.Image, nil
+	}, vss.encService, timelapse.Config{
+		Dir:        cfg.TimelapseDir,
+		Interval:   cfg.TimelapseInterval,
+		Fps:        cfg.TimelapseFps,
+		Start:      start,
+		Stop:       stop,
+		Daylight:   cfg.TimelapseDaylight,
+		Latitude:   cfg.TimelapseLatitude,
+		Longitude:  cfg.TimelapseLongitude,
+		KeepFrames: cfg.TimelapseKeepFrames,
+		MaxAge:     cfg.TimelapseMaxAge,
+		MaxBytes:   cfg.TimelapseMaxBytes,
+	})
+	return err
+}
+
+// handleTimelapses lists the days with a timelapse video
+func (vss *VideoStreamSender) handleTimelapses(w http.ResponseWriter, r *http.Request) {
+	if vss.timelapse == nil {
+		httpError(w, http.StatusNotFound, "Timelapse is disabled")
+		return
+	}
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	days, err := vss.timelapse.Videos()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"timelapses": days})
+}
+
+// serveTimelapse serves the video of a day, with ranges
+//
+//	GET /api/timelapses/<2006-01-02>.mp4
+func (vss *VideoStreamSender) serveTimelapse(w http.ResponseWriter, r *http.Request) {
+	if vss.timelapse == nil {
+		httpError(w, http.StatusNotFound, "Timelapse is disabled")
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	day, found := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/timelapses/"), timelapse.Ext)
+	days, err := vss.timelapse.Videos()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// only the listed days, the path never leaves the directory
+	listed := false
+	for _, d := range days {
+		listed = listed || d == day
+	}
+	if !found || !listed {
+		httpError(w, http.StatusNotFound, "No timelapse for "+day)
+		return
+	}
+	f, err := os.Open(vss.timelapse.VideoPath(day))
+	if err != nil {
+		httpError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, day+timelapse.Ext, info.ModTime(), f)
+}
@@ -1,18 +1,33 @@
 package vidoestreamsender
 
 import (
+	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"image"
 	"image/draw"
 	"log"
+	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	// encoders "github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/internal/config"
 	"github.com/acentior/camera-pipeline-sender/internal/encoders"
+	"github.com/acentior/camera-pipeline-sender/internal/filters"
+	"github.com/acentior/camera-pipeline-sender/internal/hls"
+	"github.com/acentior/camera-pipeline-sender/internal/motion"
+	"github.com/acentior/camera-pipeline-sender/internal/recorder"
+	"github.com/acentior/camera-pipeline-sender/internal/rtpout"
+	"github.com/acentior/camera-pipeline-sender/internal/rtsp"
+	"github.com/acentior/camera-pipeline-sender/internal/signal"
 	"github.com/acentior/camera-pipeline-sender/internal/signaling"
+	"github.com/acentior/camera-pipeline-sender/internal/timelapse"
+	"github.com/acentior/camera-pipeline-sender/pkg/encryption"
 	"github.com/acentior/camera-pipeline-sender/pkg/size"
 	"github.com/google/uuid"
 
@@ -28,36 +43,210 @@ func init() {
 }
 
 type VideoStreamSender struct {
-	sgl          *signaling.Signaling
-	webrtcConfig *webrtc.Configuration
-	camCapturer  *CameraCapturer
-	encService   *encoders.EncoderService
-	webrtcCodec  *webrtc.RTPCodecParameters
+	// sgl is the external signaling server, sigServer the built-in one, either may be nil
+	sgl       *signaling.Signaling
+	sigServer *signaling.Server
+	sigAddr   string
+	// whip publishes the stream to a WHIP endpoint, nil when disabled
+	whip *whipClient
+	// manual answers offers pasted on stdin or posted over HTTP, nil when disabled
+	manual *manualSignaling
+	// encoded is the H.264 stream shared by the outputs without WebRTC
+	encoded *encodedStream
+	// rtpOut sends the encoded stream as plain RTP, nil when disabled
+	rtpOut *rtpout.Sender
+	// rtspServer serves the encoded stream over RTSP, nil when disabled
+	rtspServer *rtsp.Server
+	rtspAddr   string
+	// hls muxes the encoded stream for the HLS players, nil when disabled
+	hls *hls.Muxer
+	// recorder writes the encoded stream to files, nil when disabled
+	recorder *recorder.Recorder
+	// clips records the pre-roll and post-roll of the triggers, nil when disabled
+	clips        *recorder.ClipRecorder
+	clipOnMotion bool
+	// timelapse captures a frame every interval and encodes the videos of the days, nil when disabled
+	timelapse *timelapse.Timelapse
+	// compositor combines the cameras into the source, nil with a single camera
+	compositor *Compositor
+	// retention removes the old recordings and clips, nil without any, and catalogs index them by kind
+	retention         *recorder.Retention
+	catalogs          map[string]*recorder.Catalog
+	retentionInterval time.Duration
+	mjpeg             mjpegSettings
+	webrtcConfig      *webrtc.Configuration
+	source            FrameSource
+	encService        *encoders.EncoderService
+	webrtcCodec       *webrtc.RTPCodecParameters
+	privacyMasks      []*filters.PrivacyMask
+	masksFile         string
+	masksMu           sync.Mutex
+	sessions          map[string]*viewerSession
+	whepSessions      map[string]*viewerSession
+	sessionsMu        sync.Mutex
+	motionCfg         *motion.Config
+	motionTap         *motionTap
+	motion            motionState
+	motionMu          sync.Mutex
+	globalPTZ         *ptzController
+	ptzMaxZoom        float64
+	ptzSmoothing      time.Duration
+	// stream settings changed over the control channels, 0 keeps the defaults
+	controlAdminToken string
+	streamBitrate     int
+	streamFps         int
+	streamMu          sync.Mutex
+	httpAddr          string
+	httpToken         string
+	httpMux           *http.ServeMux
 }
 
-func (vss *VideoStreamSender) Init(websocktUrl string, stunUrl string) error {
-	s := signaling.Signaling{}
-	if err := s.Init(websocktUrl); err != nil {
-		return err
+func (vss *VideoStreamSender) Init(cfg *config.Config) error {
+	manual := cfg.ManualSignaling || cfg.ManualHTTPPort != 0
+	if cfg.WebsocketURL == "" && cfg.SignalingAddr == "" && cfg.WHIPURL == "" && cfg.RTPOutputAddr == "" && cfg.RTSPAddr == "" && !cfg.HLSEnabled && cfg.RecordingDir == "" && cfg.ClipsDir == "" && cfg.TimelapseDir == "" && !manual {
+		return fmt.Errorf("Set WEBSOCKET_URL, SIGNALING_ADDR, WHIP_URL, RTP_OUTPUT_ADDR, RTSP_ADDR, HLS_ENABLED, RECORDING_DIR, CLIPS_DIR, TIMELAPSE_DIR or a manual signaling mode")
+	}
+	if cfg.HLSEnabled && cfg.HTTPAddr == "" {
+		return fmt.Errorf("HLS_ENABLED needs HTTP_ADDR")
+	}
+	if cfg.WebsocketURL != "" {
+		s := signaling.Signaling{}
+		if err := s.Init(cfg.WebsocketURL); err != nil {
+			return err
+		}
+		vss.sgl = &s
+	}
+	if cfg.SignalingAddr != "" {
+		vss.sigAddr = cfg.SignalingAddr
+		vss.sigServer = signaling.NewServer(func(peer *signaling.Peer, msg *signaling.WsMsg) {
+			switch msg.WSType {
+			case signaling.SDP:
+				go vss.answerOffer(peer, msg)
+			case signaling.TRIGGER:
+				vss.triggerClip(msg.Data)
+			}
+		})
+	}
+
+	if cfg.WHIPURL != "" {
+		vss.whip = newWHIPClient(cfg.WHIPURL, cfg.WHIPToken, cfg.WHIPRetry)
+	}
+	if manual {
+		vss.manual = &manualSignaling{stdin: cfg.ManualSignaling, httpPort: cfg.ManualHTTPPort}
+		signal.Compress = cfg.ManualGzip
 	}
 
 	// Init webrtc configuration
 	peerConConfig := webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{
 			{
-				URLs: []string{stunUrl},
+				URLs: []string{cfg.StunURL},
 			},
 		},
 	}
-	if stunUrl == "" {
+	if cfg.StunURL == "" {
 		peerConConfig = webrtc.Configuration{}
 	}
 
-	// Init camera capturer
-	cc, err := CreateCameraCapturer(1920, 1440, 60)
+	// Init the frame source
+	if err := vss.initFrameSource(cfg); err != nil {
+		return err
+	}
+	// The motion detector taps the frames before the overlay
+	motionCfg, err := newMotionConfig(cfg)
+	if err != nil {
+		return err
+	}
+	vss.motionCfg = motionCfg
+	if vss.motionCfg != nil {
+		vss.motionTap = newMotionTap(vss.motionCfg.Fps)
+		vss.source.Filters().Add(vss.motionTap)
+	}
+	// The overlay goes on the final frames, after the compositor if any
+	overlay, err := newOverlayFilter(cfg)
 	if err != nil {
 		return err
 	}
+	if overlay != nil {
+		vss.source.Filters().Add(overlay)
+	}
+	source := vss.source
+	vss.encoded = newEncodedStream(source, func() (encoders.Encoder, error) {
+		return vss.encService.NewEncoder(encoders.H264Codec, source.Size(), source.Fps())
+	}, cfg.KeyframeInterval)
+	if cfg.RTPOutputAddr != "" {
+		vss.rtpOut, err = rtpout.NewSender(rtpout.Config{
+			Addr:    cfg.RTPOutputAddr,
+			TTL:     cfg.RTPOutputTTL,
+			SDPFile: cfg.RTPOutputSDPFile,
+			SRTPKey: cfg.RTPOutputSRTPKey,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.RTSPAddr != "" {
+		vss.rtspAddr = cfg.RTSPAddr
+		vss.rtspServer = rtsp.NewServer(vss.encoded, cfg.RTSPUsername, cfg.RTSPPassword)
+	}
+	var keyring *encryption.Keyring
+	if cfg.RecordingKeyFile != "" {
+		if keyring, err = encryption.LoadKeyring(cfg.RecordingKeyFile); err != nil {
+			return fmt.Errorf("Failed to load the recording keys: %v", err)
+		}
+	}
+	var signingKey ed25519.PrivateKey
+	if cfg.RecordingSigningKeyFile != "" {
+		if signingKey, err = recorder.LoadSigningKey(cfg.RecordingSigningKeyFile); err != nil {
+			return fmt.Errorf("Failed to load the signing key: %v", err)
+		}
+		logger.Printf("Recordings signed by the device key %v\n", recorder.PublicKeyString(signingKey))
+	}
+	if cfg.RecordingDir != "" {
+		chain, err := openChain(cfg.RecordingDir, signingKey)
+		if err != nil {
+			return err
+		}
+		vss.recorder, err = recorder.New(vss.encoded, recorder.Config{
+			Dir:             cfg.RecordingDir,
+			SegmentDuration: cfg.RecordingSegment,
+			MaxFileSize:     cfg.RecordingMaxFileSize,
+			Keyring:         keyring,
+			Chain:           chain,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.ClipsDir != "" {
+		chain, err := openChain(cfg.ClipsDir, signingKey)
+		if err != nil {
+			return err
+		}
+		vss.clips, err = recorder.NewClipRecorder(vss.encoded, recorder.ClipConfig{
+			Dir:      cfg.ClipsDir,
+			PreRoll:  cfg.ClipPreRoll,
+			PostRoll: cfg.ClipPostRoll,
+			Keyring:  keyring,
+			Chain:    chain,
+		})
+		if err != nil {
+			return err
+		}
+		vss.clipOnMotion = cfg.ClipOnMotion
+	}
+	if dirs := recordingDirs(cfg); len(dirs) > 0 {
+		vss.retention = recorder.NewRetention(dirs, recorder.RetentionPolicy{
+			MaxAge:       cfg.RetentionMaxAge,
+			MaxBytes:     cfg.RetentionMaxBytes,
+			MinFreeBytes: cfg.RetentionMinFreeBytes,
+		})
+		vss.retentionInterval = cfg.RetentionInterval
+	}
+	vss.catalogs = recordingCatalogs(cfg, keyring)
+	if err := vss.initTimelapse(cfg); err != nil {
+		return err
+	}
 
 	// Init webrtcCodec
 	codecParam := &webrtc.RTPCodecParameters{
@@ -66,19 +255,115 @@ func (vss *VideoStreamSender) Init(websocktUrl string, stunUrl string) error {
 		},
 	}
 
-	vss.sgl = &s
 	vss.webrtcConfig = &peerConConfig
-	vss.camCapturer = cc
 	vss.webrtcCodec = codecParam
+	vss.sessions = map[string]*viewerSession{}
+	vss.whepSessions = map[string]*viewerSession{}
+	vss.ptzMaxZoom = cfg.PTZMaxZoom
+	vss.ptzSmoothing = cfg.PTZSmoothing
+	vss.controlAdminToken = cfg.ControlAdminToken
+	switch cfg.PTZMode {
+	case PTZModeGlobal:
+		vss.globalPTZ = newPTZController(cfg.PTZMaxZoom, cfg.PTZSmoothing)
+	case PTZModeViewer:
+	default:
+		return fmt.Errorf("Unknown PTZ mode %q", cfg.PTZMode)
+	}
+	vss.initHTTPServer(cfg)
+	vss.handleAPI("/api/masks", vss.requireTokenFor(vss.handlePrivacyMasks, http.MethodPut, http.MethodPost, http.MethodDelete))
+	vss.handleAPI("/api/layout", vss.handleLayout)
+	vss.handleAPI("/api/clips", vss.requireTokenFor(vss.handleClips, http.MethodPost))
+	vss.handleAPI("/api/retention", vss.requireTokenFor(vss.handleRetention, http.MethodPost))
+	vss.handleAPI("/api/recordings", vss.handleRecordings)
+	vss.handleAPI("/api/recordings/export", vss.requireTokenFor(vss.handleRecordingExport))
+	vss.handleAPI("/api/recordings/lock", vss.requireTokenFor(vss.handleRecordingLock))
+	vss.handleAPI("/api/timelapses", vss.handleTimelapses)
+	vss.handleAPI("/api/timelapses/", vss.serveTimelapse)
+	vss.handleWHEP(cfg.WHEPToken)
+	vss.mjpeg = mjpegSettings{quality: cfg.MJPEGQuality, width: cfg.MJPEGWidth, maxFps: cfg.MJPEGMaxFps}
+	vss.handleMJPEG()
+	if cfg.HLSEnabled {
+		vss.hls = hls.NewMuxer(vss.encoded, hls.Config{
+			SegmentCount:    cfg.HLSSegmentCount,
+			SegmentDuration: cfg.KeyframeInterval,
+			PartDuration:    cfg.HLSPartDuration,
+		})
+		vss.handleImage("/hls/", vss.hls.ServeHTTP)
+	}
+
+	return nil
+}
+
+// initFrameSource opens the configured cameras, several cameras are combined by a compositor
+func (vss *VideoStreamSender) initFrameSource(cfg *config.Config) error {
+	masks, err := loadPrivacyMasks(cfg.PrivacyMasksFile)
+	if err != nil {
+		return err
+	}
+	transform, err := newTransformFilter(cfg)
+	if err != nil {
+		return err
+	}
+	deviceIDs := cfg.CameraDevices
+	if len(deviceIDs) == 0 {
+		deviceIDs = []string{""}
+	}
+
+	sources := []FrameSource{}
+	vss.privacyMasks = []*filters.PrivacyMask{}
+	for i, deviceID := range deviceIDs {
+		cc, err := CreateCameraCapturer(deviceID, cfg.CameraWidth, cfg.CameraHeight, cfg.CameraFps)
+		if err != nil {
+			return err
+		}
+		// The transform runs first, so the masks and the encoder see the upright picture
+		if transform != nil {
+			cc.Filters().Add(transform)
+		}
+		// Masks are per camera so they stay on the scene whatever the compositor layout
+		cameraMasks := []filters.Mask{}
+		if i < len(masks) {
+			cameraMasks = masks[i]
+		}
+		pm, err := filters.NewPrivacyMask(cameraMasks...)
+		if err != nil {
+			return err
+		}
+		cc.Filters().Add(pm)
+		vss.privacyMasks = append(vss.privacyMasks, pm)
+		sources = append(sources, cc)
+	}
+	vss.masksFile = cfg.PrivacyMasksFile
 
+	if len(sources) == 1 {
+		vss.source = sources[0]
+		return nil
+	}
+	kind, err := ParseLayoutKind(cfg.CompositorLayout)
+	if err != nil {
+		return err
+	}
+	outSize := size.Size{Width: cfg.CompositorWidth, Height: cfg.CompositorHeight}
+	layout := Layout{Kind: kind, Main: cfg.CompositorMain, InsetScale: cfg.CompositorInsetScale}
+	compositor, err := NewCompositor(sources, outSize, cfg.CompositorFps, layout)
+	if err != nil {
+		return err
+	}
+	vss.compositor = compositor
+	vss.source = compositor
 	return nil
 }
 
-func (vss *VideoStreamSender) GetRTCStreamer(rtpCodecCap *webrtc.RTPCodecCapability, camCapturer *CameraCapturer) (*rtcStreamer, error) {
+// Source returns the frame source feeding the streamers
+func (vss *VideoStreamSender) Source() FrameSource {
+	return vss.source
+}
+
+func (vss *VideoStreamSender) GetRTCStreamer(rtpCodecCap *webrtc.RTPCodecCapability, source FrameSource) (*rtcStreamer, error) {
 	encCodec := encoders.H264Codec
 	// Create a encoder
-	logger.Printf("encCodec: %+v\nwidth: %+v\nheight: %+v\nfps: %+v\n", encCodec, camCapturer.Size().Width, camCapturer.Size().Height, camCapturer.Fps())
-	encoder, err := vss.encService.NewEncoder(encCodec, camCapturer.Size(), camCapturer.Fps())
+	logger.Printf("encCodec: %+v\nwidth: %+v\nheight: %+v\nfps: %+v\n", encCodec, source.Size().Width, source.Size().Height, source.Fps())
+	encoder, err := vss.encService.NewEncoder(encCodec, source.Size(), source.Fps())
 
 	logger.Println("encoder start: ============")
 	logger.Println(encoder)
@@ -101,14 +386,49 @@ func (vss *VideoStreamSender) GetRTCStreamer(rtpCodecCap *webrtc.RTPCodecCapabil
 		panic(err)
 	}
 
-	streamer := newRTCStreamer([]*webrtc.TrackLocalStaticSample{track}, camCapturer, &encoder, size)
+	streamer := newRTCStreamer([]*webrtc.TrackLocalStaticSample{track}, source, &encoder, size)
+	streamer.newEncoder = func(fps int) (encoders.Encoder, error) {
+		return vss.encService.NewEncoder(encCodec, source.Size(), fps)
+	}
+	if source == vss.source && vss.encoded != nil {
+		streamer.shared = vss.encoded
+	}
 	return streamer, nil
 }
 
 func (vss *VideoStreamSender) Run() error {
-	defer vss.sgl.Close()
-	vss.camCapturer.Start()
+	vss.source.Start()
+	vss.startHTTPServer()
+	vss.startSignalingServer()
+	vss.startMotionDetector()
+	if vss.whip != nil {
+		go vss.runWHIP(nil)
+	}
+	vss.runManualSignaling()
+	if vss.rtpOut != nil {
+		logger.Printf("Sending RTP to %v\n", vss.rtpOut.Addr())
+		go vss.rtpOut.Run(vss.encoded.Subscribe())
+	}
+	vss.startRTSPServer()
+	if vss.recorder != nil {
+		vss.recorder.Start()
+	}
+	if vss.clips != nil {
+		vss.clips.Start()
+	}
+	if vss.retention != nil {
+		vss.retention.Start(vss.retentionInterval)
+	}
+	if vss.timelapse != nil {
+		vss.timelapse.Start()
+	}
 
+	if vss.sgl == nil {
+		// the stream goes through the built-in signaling server, WHEP, WHIP, manual signaling, RTP, RTSP, HLS
+		// or to the recordings and the timelapse
+		select {}
+	}
+	defer vss.sgl.Close()
 	vss.sgl.SendMsg(&signaling.WsMsg{
 		Sender: true,
 		WSType: signaling.CONNECTED,
@@ -127,130 +447,127 @@ func (vss *VideoStreamSender) Run() error {
 			}
 			break
 		case signaling.SDP:
-			go func() {
-				streamer, err := vss.GetRTCStreamer(&vss.webrtcCodec.RTPCodecCapability, vss.camCapturer)
-				if err != nil {
-					panic(err)
-				}
-				track := streamer.tracks[0]
-
-				offStr := message.SDP
-
-				offer := webrtc.SessionDescription{}
-				decodeOffer(offStr, &offer)
-
-				if err != nil {
-					panic(err)
-				}
-				mediaEngine := webrtc.MediaEngine{}
-				mediaEngine.RegisterCodec(*vss.webrtcCodec, webrtc.RTPCodecTypeVideo)
-				api := webrtc.NewAPI(webrtc.WithMediaEngine(&mediaEngine))
-				peerConnection, err := api.NewPeerConnection(*vss.webrtcConfig)
-				if err != nil {
-					panic(err)
-				}
-
-				direction := webrtc.RTPTransceiverDirectionRecvonly
-
-				if direction == webrtc.RTPTransceiverDirectionSendrecv {
-					_, err = peerConnection.AddTrack(track)
-					if err != nil {
-						panic(err)
-					}
-					logger.Println("Direction: RTPTransceiverDirectionSendrecv")
-				} else if direction == webrtc.RTPTransceiverDirectionRecvonly {
-					_, err = peerConnection.AddTransceiverFromTrack(track, webrtc.RtpTransceiverInit{
-						Direction: webrtc.RTPTransceiverDirectionSendonly,
-					})
-					if err != nil {
-						panic(err)
-					}
-					logger.Println("Direction: RTPTransceiverDirectionSendonly")
-				} else {
-					logger.Fatalln("Unsupported transceiver direction")
-				}
-
-				// Set the remote SessionDescription
-				if err = peerConnection.SetRemoteDescription(offer); err != nil {
-					panic(err)
-				}
+			go vss.answerOffer(vss.sgl, message)
+			break
+		case signaling.TRIGGER:
+			vss.triggerClip(message.Data)
+		}
+	}
+}
 
-				// Set the handler for ICE connection state
-				// This will notify you when the peer has connected/disconnected
-				peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-					if connectionState == webrtc.ICEConnectionStateConnected {
-						logger.Println("start streamer")
-						streamer.start()
-						vss.camCapturer.AgentAdded()
-					}
-					if connectionState == webrtc.ICEConnectionStateDisconnected {
-						vss.camCapturer.AgentRemoved()
-						streamer.Close()
-						peerConnection.Close()
-					}
-					logger.Printf("Connection State has changed %s \n", connectionState.String())
-				})
-
-				// Set the handler for Peer connection state
-				// This will notify you when the peer has connected/disconnected
-				peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-					logger.Printf("Peer Connection State has changed: %s\n", s.String())
-
-					if s == webrtc.PeerConnectionStateFailed {
-						// Wait until PeerConnection has had no network activity for 30 seconds or another failure. It may be reconnected using an ICE Restart.
-						// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
-						// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
-						logger.Println("Peer Connection has gone to failed exiting", track.ID())
-					}
-					if s == webrtc.PeerConnectionStateClosed {
-						logger.Println("Peer Connection has been closed", track.ID())
-					}
-				})
+// Close completes the outputs writing files, so they stay playable
+func (vss *VideoStreamSender) Close() {
+	if vss.recorder != nil {
+		vss.recorder.Close()
+	}
+	if vss.clips != nil {
+		vss.clips.Close()
+	}
+	if vss.retention != nil {
+		vss.retention.Close()
+	}
+	if vss.timelapse != nil {
+		vss.timelapse.Close()
+	}
+}
 
-				// Create answer
-				answer, err := peerConnection.CreateAnswer(nil)
-				if err != nil {
-					panic(err)
-				}
+// startSignalingServer serves the built-in signaling server and viewer page in the background
+func (vss *VideoStreamSender) startSignalingServer() {
+	if vss.sigServer == nil {
+		return
+	}
+	go func() {
+		logger.Printf("Signaling server listening on %v\n", vss.sigAddr)
+		if err := vss.sigServer.ListenAndServe(vss.sigAddr); err != nil {
+			logger.Printf("Signaling server stopped: %v\n", err)
+		}
+	}()
+}
 
-				// send the answer in base64
-				vss.sgl.SendMsg(&signaling.WsMsg{
-					Sender: true,
-					WSType: signaling.SDP,
-					SDP:    encodeOffer(answer),
-					ID:     message.ID,
-				})
+// startRTSPServer serves the encoded stream over RTSP in the background
+func (vss *VideoStreamSender) startRTSPServer() {
+	if vss.rtspServer == nil {
+		return
+	}
+	go func() {
+		logger.Printf("RTSP server listening on %v\n", vss.rtspAddr)
+		if err := vss.rtspServer.ListenAndServe(vss.rtspAddr); err != nil {
+			logger.Printf("RTSP server stopped: %v\n", err)
+		}
+	}()
+}
 
-				// Create channel that is blocked until ICE Gathering is complete
-				gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+// answerOffer creates a viewer session for an offer received over a signaling websocket
+func (vss *VideoStreamSender) answerOffer(reply signaling.MsgSender, message *signaling.WsMsg) {
+	offer := webrtc.SessionDescription{}
+	if err := decodeOffer(message.SDP, &offer); err != nil {
+		sendSignalingError(reply, message.ID, fmt.Sprintf("Invalid offer: %v", err))
+		return
+	}
+	// the data of the offer may ask for recorded footage, as playback=<RFC 3339>&kind=&rate=
+	values, err := url.ParseQuery(message.Data)
+	if err != nil {
+		sendSignalingError(reply, message.ID, fmt.Sprintf("Invalid offer data: %v", err))
+		return
+	}
+	playback, err := parsePlaybackRequest(values)
+	if err != nil {
+		sendSignalingError(reply, message.ID, err.Error())
+		return
+	}
+	id := message.ID
+	if id == "" {
+		id = uuid.New().String()
+	}
+	_, answer, err := vss.newViewerSession(id, offer, playback)
+	if err != nil {
+		logger.Printf("Failed to answer viewer %v: %v\n", id, err)
+		sendSignalingError(reply, message.ID, err.Error())
+		return
+	}
 
-				// Sets the LocalDescription, and starts our UDP listeners
-				if err = peerConnection.SetLocalDescription(answer); err != nil {
-					panic(err)
-				}
+	// send the answer in base64
+	reply.SendMsg(&signaling.WsMsg{
+		Sender: true,
+		WSType: signaling.SDP,
+		SDP:    encodeOffer(answer),
+		ID:     message.ID,
+	})
+}
 
-				// Block until ICE Gathering is complete, disabling trickle ICE
-				// we do this because we only can exchange one signaling message
-				// in a production application you should exchange ICE Candidates via OnICECandidate
-				<-gatherComplete
-			}()
-			break
+// broadcastSignaling sends a message to the external signaling server and to the viewers of the built-in one
+func (vss *VideoStreamSender) broadcastSignaling(msg *signaling.WsMsg) {
+	if vss.sgl != nil {
+		if err := vss.sgl.SendMsg(msg); err != nil {
+			logger.Printf("Failed to send %v message: %v\n", msg.WSType, err)
 		}
 	}
+	if vss.sigServer != nil {
+		vss.sigServer.Broadcast(msg)
+	}
+}
+
+func sendSignalingError(reply signaling.MsgSender, id string, msg string) {
+	err := reply.SendMsg(&signaling.WsMsg{
+		Sender: true,
+		WSType: signaling.ERROR,
+		Data:   msg,
+		ID:     id,
+	})
+	if err != nil {
+		logger.Printf("Failed to send error to %v: %v\n", id, err)
+	}
 }
 
 // Decode decodes the input from base64
 // It can optionally unzip the input after decoding
-func decodeOffer(in string, obj interface{}) {
+func decodeOffer(in string, obj interface{}) error {
 	b, err := base64.StdEncoding.DecodeString(in)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = json.Unmarshal(b, obj)
-	if err != nil {
-		panic(err)
-	}
+	return json.Unmarshal(b, obj)
 }
 
 // Encode encodes the input in base64
@@ -0,0 +1,154 @@
+package vidoestreamsender
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+// whepPath is the WHEP endpoint, the sessions are resources below it
+const whepPath = "/whep"
+
+// maxSDPSize bounds the offers and SDP fragments read from the requests
+const maxSDPSize = 64 * 1024
+
+// handleWHEP registers the WebRTC-HTTP Egress Protocol endpoint on the HTTP server.
+// Players POST their offer to /whep and manage the session at the returned Location.
+func (vss *VideoStreamSender) handleWHEP(token string) {
+	handler := withCORS(requireBearerToken(token, http.HandlerFunc(vss.serveWHEP)))
+	vss.httpMux.Handle(whepPath, handler)
+	vss.httpMux.Handle(whepPath+"/", handler)
+}
+
+// serveWHEP handles the WHEP requests
+//
+//	POST   /whep       create a session from the SDP offer in the body, 201 with the answer
+//	PATCH  /whep/<id>  add the trickle ICE candidates of the SDP fragment in the body
+//	DELETE /whep/<id>  stop the session
+func (vss *VideoStreamSender) serveWHEP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, whepPath), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST, OPTIONS")
+			httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		vss.createWHEPSession(w, r)
+		return
+	}
+
+	session := vss.whepSession(id)
+	if session == nil {
+		httpError(w, http.StatusNotFound, "Unknown session")
+		return
+	}
+	switch r.Method {
+	case http.MethodPatch:
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), sdpFragContentType) {
+			httpError(w, http.StatusUnsupportedMediaType, "Expected "+sdpFragContentType)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		frag := parseSDPFrag(string(body))
+		if remote := session.pc.RemoteDescription(); frag.ufrag != "" && remote != nil && !strings.Contains(remote.SDP, "a=ice-ufrag:"+frag.ufrag) {
+			// new credentials ask for an ICE restart
+			httpError(w, http.StatusUnprocessableEntity, "ICE restart not supported")
+			return
+		}
+		for _, candidate := range frag.candidates {
+			if err := session.pc.AddICECandidate(candidate); err != nil {
+				httpError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		vss.removeWHEPSession(session)
+		session.close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.Header().Set("Allow", "PATCH, DELETE, OPTIONS")
+		httpError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (vss *VideoStreamSender) createWHEPSession(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		httpError(w, http.StatusUnsupportedMediaType, "Expected application/sdp")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	playback, err := parsePlaybackRequest(r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	id := uuid.New().String()
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+	session, answer, err := vss.newViewerSession(id, offer, playback)
+	if err != nil {
+		logger.Printf("Failed to answer WHEP viewer %v: %v\n", id, err)
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	vss.addWHEPSession(session)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", whepPath+"/"+id)
+	w.Header().Set("Accept-Patch", sdpFragContentType)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer.SDP)
+}
+
+// addWHEPSession registers a session created over WHEP, only those are resources below the endpoint so a WHEP
+// client can't reach the sessions of the other viewers
+func (vss *VideoStreamSender) addWHEPSession(session *viewerSession) {
+	vss.sessionsMu.Lock()
+	vss.whepSessions[session.id] = session
+	vss.sessionsMu.Unlock()
+	go func() {
+		<-session.done
+		vss.removeWHEPSession(session)
+	}()
+}
+
+func (vss *VideoStreamSender) removeWHEPSession(session *viewerSession) {
+	vss.sessionsMu.Lock()
+	defer vss.sessionsMu.Unlock()
+	if vss.whepSessions[session.id] == session {
+		delete(vss.whepSessions, session.id)
+	}
+}
+
+// whepSession returns the WHEP session with the given id, nil if there is none
+func (vss *VideoStreamSender) whepSession(id string) *viewerSession {
+	vss.sessionsMu.Lock()
+	defer vss.sessionsMu.Unlock()
+	return vss.whepSessions[id]
+}
+
+// withCORS lets browser players on other origins use an endpoint, preflight requests skip the token check
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Accept-Patch")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Accept-Post", "application/sdp")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,132 @@
+package vidoestreamsender
+
+import (
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/suite"
+)
+
+type WHEPSuit struct {
+	suite.Suite
+	source *solidSource
+	vss    *VideoStreamSender
+	server *httptest.Server
+	player *webrtc.PeerConnection
+}
+
+func TestWHEPSuite(t *testing.T) {
+	suite.Run(t, new(WHEPSuit))
+}
+
+func (s *WHEPSuit) SetupTest() {
+	s.source = newSolidSource(color.RGBA{G: 255, A: 255}, size.Size{Width: 320, Height: 240})
+	s.vss = newTestSender(s.source)
+	s.vss.handleWHEP("secret")
+	s.server = httptest.NewServer(s.vss.httpMux)
+
+	var err error
+	s.player, err = webrtc.NewPeerConnection(webrtc.Configuration{})
+	s.Require().NoError(err)
+	_, err = s.player.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	})
+	s.Require().NoError(err)
+}
+
+func (s *WHEPSuit) TearDownTest() {
+	s.player.Close()
+	s.server.Close()
+	s.source.Stop()
+}
+
+func (s *WHEPSuit) request(method string, path string, contentType string, body string) *http.Response {
+	req, err := http.NewRequest(method, s.server.URL+path, strings.NewReader(body))
+	s.Require().NoError(err)
+	req.Header.Set("Authorization", "Bearer secret")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	return resp
+}
+
+func (s *WHEPSuit) Test_Session() {
+	offer, err := s.player.CreateOffer(nil)
+	s.Require().NoError(err)
+	s.Require().NoError(s.player.SetLocalDescription(offer))
+
+	resp := s.request(http.MethodPost, "/whep", "application/sdp", offer.SDP)
+	answer, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	s.Require().Equal(http.StatusCreated, resp.StatusCode, string(answer))
+	s.Equal("application/sdp", resp.Header.Get("Content-Type"))
+	location := resp.Header.Get("Location")
+	s.True(strings.HasPrefix(location, "/whep/"))
+	s.NoError(s.player.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}))
+
+	id := strings.TrimPrefix(location, "/whep/")
+	s.NotNil(s.vss.session(id))
+
+	frag := "a=ice-ufrag:other\r\na=ice-pwd:otherpassword\r\nm=video 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\n"
+	resp = s.request(http.MethodPatch, location, sdpFragContentType, frag)
+	resp.Body.Close()
+	s.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = s.request(http.MethodPatch, location, sdpFragContentType,
+		"m=video 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\na=candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host\r\n")
+	resp.Body.Close()
+	s.Equal(http.StatusNoContent, resp.StatusCode)
+
+	resp = s.request(http.MethodDelete, location, "", "")
+	resp.Body.Close()
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.Nil(s.vss.session(id))
+
+	resp = s.request(http.MethodDelete, location, "", "")
+	resp.Body.Close()
+	s.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *WHEPSuit) Test_OtherViewersUnreachable() {
+	// a viewer of the signaling websocket, with an id the WHEP client may know
+	offer, err := s.player.CreateOffer(nil)
+	s.Require().NoError(err)
+	s.Require().NoError(s.player.SetLocalDescription(offer))
+	session, _, err := s.vss.newViewerSession("viewer", offer, nil)
+	s.Require().NoError(err)
+	defer session.close()
+
+	resp := s.request(http.MethodDelete, "/whep/viewer", "", "")
+	resp.Body.Close()
+	s.Equal(http.StatusNotFound, resp.StatusCode)
+	resp = s.request(http.MethodPatch, "/whep/viewer", sdpFragContentType, "m=video 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\n")
+	resp.Body.Close()
+	s.Equal(http.StatusNotFound, resp.StatusCode)
+	s.Equal(session, s.vss.session("viewer"))
+}
+
+func (s *WHEPSuit) Test_AuthAndPreflight() {
+	resp, err := http.Post(s.server.URL+"/whep", "application/sdp", strings.NewReader("v=0"))
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodOptions, s.server.URL+"/whep", nil)
+	resp, err = http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusNoContent, resp.StatusCode)
+	s.Equal("*", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp = s.request(http.MethodPost, "/whep", "text/plain", "v=0")
+	resp.Body.Close()
+	s.Equal(http.StatusUnsupportedMediaType, resp.StatusCode)
+}
@@ -0,0 +1,203 @@
+package vidoestreamsender
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+// whipCodec is the codec offered to WHIP endpoints, constrained baseline like the encoder output
+var whipCodec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	},
+	PayloadType: 102,
+}
+
+// whipClient publishes the stream to a WebRTC-HTTP Ingestion Protocol endpoint, e.g. of an SFU
+type whipClient struct {
+	url    string
+	token  string
+	retry  time.Duration
+	client *http.Client
+}
+
+func newWHIPClient(endpoint string, token string, retry time.Duration) *whipClient {
+	return &whipClient{
+		url:    endpoint,
+		token:  token,
+		retry:  retry,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// runWHIP publishes to the WHIP endpoint until stop is closed, publishing again after every failure
+func (vss *VideoStreamSender) runWHIP(stop <-chan struct{}) {
+	for {
+		err := vss.publishWHIP(stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		logger.Printf("WHIP publish ended: %v, retrying in %v\n", err, vss.whip.retry)
+		select {
+		case <-stop:
+			return
+		case <-time.After(vss.whip.retry):
+		}
+	}
+}
+
+// publishWHIP offers the stream to the WHIP endpoint and returns once the session ends.
+// The local candidates are sent with PATCH requests as they are gathered.
+func (vss *VideoStreamSender) publishWHIP(stop <-chan struct{}) error {
+	session, err := vss.newPeerSession("whip-"+uuid.New().String(), whipCodec)
+	if err != nil {
+		return err
+	}
+	defer session.close()
+	vss.addSession(session)
+
+	// never block the ICE agent, the candidates wait here until the resource exists
+	candidates := make(chan webrtc.ICECandidateInit, 64)
+	session.pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		select {
+		case candidates <- c.ToJSON():
+		default:
+			logger.Printf("Dropping WHIP candidate %v\n", c)
+		}
+	})
+
+	offer, err := session.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err := session.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	resource, etag, answer, err := vss.whip.post(offer.SDP)
+	if err != nil {
+		return err
+	}
+	defer vss.whip.delete(resource)
+	err = session.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer})
+	if err != nil {
+		return err
+	}
+	go vss.whip.trickle(resource, etag, session, candidates)
+
+	select {
+	case <-session.done:
+		return fmt.Errorf("Session closed")
+	case <-stop:
+		return nil
+	}
+}
+
+func (w *whipClient) newRequest(method string, target string, contentType string, body string) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	return req, nil
+}
+
+// post sends the offer and returns the session resource URL, its ETag and the answer
+func (w *whipClient) post(offer string) (string, string, string, error) {
+	req, err := w.newRequest(http.MethodPost, w.url, "application/sdp", offer)
+	if err != nil {
+		return "", "", "", err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSDPSize))
+	if err != nil {
+		return "", "", "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", "", "", fmt.Errorf("WHIP endpoint answered %v: %s", resp.Status, body)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return "", "", "", fmt.Errorf("WHIP answer without a valid Location: %v", err)
+	}
+	return location.String(), resp.Header.Get("ETag"), string(body), nil
+}
+
+// trickle sends the local candidates to the session resource until the session ends,
+// the candidates gathered meanwhile go together in the next request
+func (w *whipClient) trickle(resource string, etag string, session *viewerSession, candidates <-chan webrtc.ICECandidateInit) {
+	for {
+		batch := []webrtc.ICECandidateInit{}
+		select {
+		case <-session.done:
+			return
+		case c := <-candidates:
+			batch = append(batch, c)
+		}
+	drain:
+		for {
+			select {
+			case c := <-candidates:
+				batch = append(batch, c)
+			default:
+				break drain
+			}
+		}
+		frag := buildSDPFrag(session.pc.LocalDescription().SDP, batch)
+		req, err := w.newRequest(http.MethodPatch, resource, sdpFragContentType, frag)
+		if err != nil {
+			return
+		}
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+		resp, err := w.client.Do(req)
+		if err != nil {
+			logger.Printf("Failed to send WHIP candidates: %v\n", err)
+			continue
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented:
+			// the endpoint doesn't do trickle ICE, it only has the candidates of the answer to try
+			return
+		case resp.StatusCode >= 300:
+			logger.Printf("WHIP endpoint refused the candidates: %v\n", resp.Status)
+		}
+	}
+}
+
+// delete removes the session resource, the endpoint then releases the session
+func (w *whipClient) delete(resource string) {
+	req, err := w.newRequest(http.MethodDelete, resource, "", "")
+	if err != nil {
+		return
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		logger.Printf("Failed to delete WHIP session: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,153 @@
+package vidoestreamsender
+
+import (
+	"fmt"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/size"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/suite"
+)
+
+// whipStandIn is a minimal WHIP endpoint receiving the published stream
+type whipStandIn struct {
+	mu       sync.Mutex
+	failures int
+	posts    int
+	patches  int
+	deletes  int
+	pcs      []*webrtc.PeerConnection
+	received chan struct{}
+	once     sync.Once
+}
+
+func (w *whipStandIn) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/whip":
+		w.posts++
+		if w.failures > 0 {
+			w.failures--
+			http.Error(rw, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		offer, _ := io.ReadAll(r.Body)
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			if _, _, err := track.ReadRTP(); err == nil {
+				w.once.Do(func() { close(w.received) })
+			}
+		})
+		if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		answer, _ := pc.CreateAnswer(nil)
+		gathered := webrtc.GatheringCompletePromise(pc)
+		pc.SetLocalDescription(answer)
+		<-gathered
+		w.pcs = append(w.pcs, pc)
+		rw.Header().Set("Location", fmt.Sprintf("/whip/session/%d", len(w.pcs)-1))
+		rw.Header().Set("ETag", `"1"`)
+		rw.WriteHeader(http.StatusCreated)
+		io.WriteString(rw, pc.LocalDescription().SDP)
+	case r.Method == http.MethodPatch:
+		w.patches++
+		body, _ := io.ReadAll(r.Body)
+		pc := w.pcs[len(w.pcs)-1]
+		for _, c := range parseSDPFrag(string(body)).candidates {
+			pc.AddICECandidate(c)
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		w.deletes++
+		rw.WriteHeader(http.StatusOK)
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+func (w *whipStandIn) counts() (posts int, patches int, deletes int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.posts, w.patches, w.deletes
+}
+
+type WHIPSuit struct {
+	suite.Suite
+	source  *solidSource
+	vss     *VideoStreamSender
+	standIn *whipStandIn
+	server  *httptest.Server
+}
+
+func TestWHIPSuite(t *testing.T) {
+	suite.Run(t, new(WHIPSuit))
+}
+
+func (s *WHIPSuit) SetupTest() {
+	s.source = newSolidSource(color.RGBA{B: 255, A: 255}, size.Size{Width: 320, Height: 240})
+	s.vss = newTestSender(s.source)
+	s.standIn = &whipStandIn{received: make(chan struct{})}
+	s.server = httptest.NewServer(s.standIn)
+	s.vss.whip = newWHIPClient(s.server.URL+"/whip", "token", 10*time.Millisecond)
+}
+
+func (s *WHIPSuit) TearDownTest() {
+	s.server.Close()
+	s.source.Stop()
+	for _, pc := range s.standIn.pcs {
+		pc.Close()
+	}
+}
+
+func (s *WHIPSuit) Test_PublishAfterFailures() {
+	s.standIn.failures = 2
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.vss.runWHIP(stop)
+		close(done)
+	}()
+
+	select {
+	case <-s.standIn.received:
+	case <-time.After(15 * time.Second):
+		s.FailNow("no media received")
+	}
+	posts, patches, _ := s.standIn.counts()
+	s.Equal(3, posts)
+	// the offer went out before gathering, the candidates followed in PATCH requests
+	s.Positive(patches)
+
+	close(stop)
+	<-done
+	_, _, deletes := s.standIn.counts()
+	s.Equal(1, deletes)
+}
+
+func (s *WHIPSuit) Test_SDPFragRoundTrip() {
+	mid := "0"
+	local := "v=0\r\na=ice-ufrag:abcd\r\na=ice-pwd:secretsecretsecret\r\nm=video 9 UDP/TLS/RTP/SAVPF 102\r\na=mid:0\r\n"
+	frag := buildSDPFrag(local, []webrtc.ICECandidateInit{
+		{Candidate: "candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host"},
+		{Candidate: "candidate:2 1 udp 1694498815 198.51.100.1 50001 typ srflx raddr 0.0.0.0 rport 50001", SDPMid: &mid},
+	})
+	parsed := parseSDPFrag(frag)
+	s.Equal("abcd", parsed.ufrag)
+	s.Equal("secretsecretsecret", parsed.pwd)
+	s.Require().Len(parsed.candidates, 2)
+	s.Equal("0", *parsed.candidates[0].SDPMid)
+	s.Equal("candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host", parsed.candidates[0].Candidate)
+}
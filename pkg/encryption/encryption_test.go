@@ -0,0 +1,195 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type EncryptionSuit struct {
+	suite.Suite
+	keyring *Keyring
+	data    []byte
+}
+
+func TestEncryptionSuite(t *testing.T) {
+	suite.Run(t, new(EncryptionSuit))
+}
+
+func (s *EncryptionSuit) SetupTest() {
+	s.keyring = s.newKeyring("2024a")
+	// a few chunks and a short last one
+	s.data = make([]byte, 3*ChunkSize+1234)
+	_, err := rand.Read(s.data)
+	s.Require().NoError(err)
+}
+
+func (s *EncryptionSuit) newKeyring(ids ...string) *Keyring {
+	keyring := NewKeyring()
+	for _, id := range ids {
+		key, err := GenerateKey()
+		s.Require().NoError(err)
+		s.Require().NoError(keyring.Add(id, key))
+	}
+	return keyring
+}
+
+func (s *EncryptionSuit) encrypt(keyring *Keyring, data []byte, close bool) []byte {
+	out := &bytes.Buffer{}
+	w, err := NewWriter(out, keyring)
+	s.Require().NoError(err)
+	// uneven writes
+	for len(data) > 0 {
+		n := min(len(data), 10000)
+		_, err := w.Write(data[:n])
+		s.Require().NoError(err)
+		data = data[n:]
+	}
+	if close {
+		s.Require().NoError(w.Close())
+	}
+	return out.Bytes()
+}
+
+func (s *EncryptionSuit) Test_RoundTrip() {
+	sealed := s.encrypt(s.keyring, s.data, true)
+	s.True(IsEncrypted(bytes.NewReader(sealed)))
+	s.False(IsEncrypted(bytes.NewReader(s.data[:100])))
+	s.Equal(HeaderSize+len(s.data)+4*16, len(sealed))
+
+	r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), s.keyring)
+	s.Require().NoError(err)
+	s.True(r.Complete())
+	s.Equal("2024a", r.KeyID())
+	s.Equal(int64(len(s.data)), r.Size())
+	plain, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	s.Require().NoError(err)
+	s.Equal(s.data, plain)
+
+	// across chunks
+	p := make([]byte, 100)
+	_, err = r.ReadAt(p, ChunkSize-50)
+	s.Require().NoError(err)
+	s.Equal(s.data[ChunkSize-50:ChunkSize+50], p)
+	n, err := r.ReadAt(p, int64(len(s.data)-10))
+	s.Equal(10, n)
+	s.ErrorIs(err, io.EOF)
+
+	empty := s.encrypt(s.keyring, nil, true)
+	r, err = NewReader(bytes.NewReader(empty), int64(len(empty)), s.keyring)
+	s.Require().NoError(err)
+	s.True(r.Complete())
+	s.Zero(r.Size())
+}
+
+func (s *EncryptionSuit) Test_Truncated() {
+	// a file being written has its full chunks
+	sealed := s.encrypt(s.keyring, s.data, false)
+	r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), s.keyring)
+	s.Require().NoError(err)
+	s.False(r.Complete())
+	s.Equal(int64(3*ChunkSize), r.Size())
+
+	// a torn last chunk is dropped, the end of a complete file is missed
+	sealed = s.encrypt(s.keyring, s.data, true)
+	cut := sealed[:len(sealed)-100]
+	r, err = NewReader(bytes.NewReader(cut), int64(len(cut)), s.keyring)
+	s.Require().NoError(err)
+	s.False(r.Complete())
+	s.Equal(int64(3*ChunkSize), r.Size())
+	// without its last chunk
+	cut = sealed[:HeaderSize+3*(ChunkSize+16)]
+	r, err = NewReader(bytes.NewReader(cut), int64(len(cut)), s.keyring)
+	s.Require().NoError(err)
+	s.False(r.Complete())
+}
+
+func (s *EncryptionSuit) Test_Tampered() {
+	sealed := s.encrypt(s.keyring, s.data, true)
+	tampered := bytes.Clone(sealed)
+	tampered[HeaderSize+ChunkSize/2] ^= 1
+	r, err := NewReader(bytes.NewReader(tampered), int64(len(tampered)), s.keyring)
+	s.Require().NoError(err)
+	_, err = r.ReadAt(make([]byte, 10), 0)
+	s.ErrorIs(err, ErrCorrupted)
+
+	// chunks can't be swapped
+	swapped := bytes.Clone(sealed)
+	first, second := swapped[HeaderSize:HeaderSize+ChunkSize+16], swapped[HeaderSize+ChunkSize+16:HeaderSize+2*(ChunkSize+16)]
+	tmp := bytes.Clone(first)
+	copy(first, second)
+	copy(second, tmp)
+	r, err = NewReader(bytes.NewReader(swapped), int64(len(swapped)), s.keyring)
+	s.Require().NoError(err)
+	_, err = r.ReadAt(make([]byte, 10), 0)
+	s.ErrorIs(err, ErrCorrupted)
+
+	// the wrapped key authenticates the header
+	header := bytes.Clone(sealed)
+	header[prefixOffset] ^= 1
+	_, err = NewReader(bytes.NewReader(header), int64(len(header)), s.keyring)
+	s.ErrorIs(err, ErrCorrupted)
+
+	_, err = NewReader(bytes.NewReader(sealed), int64(len(sealed)), s.newKeyring("other"))
+	s.ErrorContains(err, "unknown key")
+	_, err = NewReader(bytes.NewReader(s.data), int64(len(s.data)), s.keyring)
+	s.ErrorIs(err, ErrNotEncrypted)
+}
+
+func (s *EncryptionSuit) Test_Rotation() {
+	old := s.encrypt(s.keyring, s.data, true)
+	path := filepath.Join(s.T().TempDir(), "old.mp4")
+	s.Require().NoError(os.WriteFile(path, old, 0o644))
+
+	// a new key encrypts the new files, the old files stay readable
+	key, err := GenerateKey()
+	s.Require().NoError(err)
+	s.Require().NoError(s.keyring.Add("2024b", key))
+	s.Equal("2024b", s.keyring.Current())
+	r, err := NewReader(bytes.NewReader(old), int64(len(old)), s.keyring)
+	s.Require().NoError(err)
+	s.Equal("2024a", r.KeyID())
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	s.Require().NoError(err)
+	defer f.Close()
+	id, err := Rewrap(f, s.keyring)
+	s.Require().NoError(err)
+	s.Equal("2024a", id)
+	id, err = Rewrap(f, s.keyring)
+	s.Require().NoError(err)
+	s.Equal("2024b", id)
+
+	// the old key can be retired
+	retired := NewKeyring()
+	s.Require().NoError(retired.Add("2024b", key))
+	info, err := f.Stat()
+	s.Require().NoError(err)
+	r, err = NewReader(f, info.Size(), retired)
+	s.Require().NoError(err)
+	plain, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	s.Require().NoError(err)
+	s.Equal(s.data, plain)
+}
+
+func (s *EncryptionSuit) Test_ParseKeyring() {
+	keyring, err := ParseKeyring([]byte("# rotated yearly\n" +
+		FormatKey("2023", make([]byte, KeySize)) + "\n\n" +
+		FormatKey("2024", bytes.Repeat([]byte{1}, KeySize)) + "\n"))
+	s.Require().NoError(err)
+	s.Equal("2024", keyring.Current())
+	_, err = keyring.key("2023")
+	s.NoError(err)
+
+	_, err = ParseKeyring([]byte(FormatKey("short", make([]byte, 16))))
+	s.Error(err)
+	_, err = ParseKeyring([]byte(FormatKey("a", make([]byte, KeySize)) + "\n" + FormatKey("a", make([]byte, KeySize))))
+	s.ErrorContains(err, "duplicate")
+	_, err = ParseKeyring([]byte("# nothing\n"))
+	s.Error(err)
+}
@@ -0,0 +1,115 @@
+// Package encryption encrypts files at rest in a chunked AES-GCM streaming format. Every file has its own random
+// data key, wrapped by a master key of a keyring. Rotating the master key only adds a key to the keyring: the
+// older files keep their wrapped key until they are rewrapped, and stay readable as long as their key is kept.
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeySize is the size of the master and data keys, AES-256
+const KeySize = 32
+
+// maxKeyIDSize bounds the key ids, stored in the file headers
+const maxKeyIDSize = 16
+
+// Keyring holds the master keys by id, the last one added encrypts the new files
+type Keyring struct {
+	keys    map[string][]byte
+	current string
+}
+
+// NewKeyring returns an empty keyring
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[string][]byte{}}
+}
+
+// Add adds a master key, which becomes the current one
+func (k *Keyring) Add(id string, key []byte) error {
+	if id == "" || len(id) > maxKeyIDSize || strings.ContainsAny(id, " \t\x00") {
+		return fmt.Errorf("encryption: invalid key id %q, 1 to %d characters without spaces", id, maxKeyIDSize)
+	}
+	if len(key) != KeySize {
+		return fmt.Errorf("encryption: key %q has %d bytes, expected %d", id, len(key), KeySize)
+	}
+	if _, found := k.keys[id]; found {
+		return fmt.Errorf("encryption: duplicate key id %q", id)
+	}
+	k.keys[id] = key
+	k.current = id
+	return nil
+}
+
+// Current returns the id of the key encrypting the new files
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// key returns a master key by id
+func (k *Keyring) key(id string) ([]byte, error) {
+	key, found := k.keys[id]
+	if !found {
+		return nil, fmt.Errorf("encryption: unknown key %q", id)
+	}
+	return key, nil
+}
+
+// ParseKeyring reads a key file: one "<id> <base64 key>" line per key, oldest first, so the last line is the
+// current key. Empty lines and lines starting with # are ignored.
+func ParseKeyring(data []byte) (*Keyring, error) {
+	k := NewKeyring()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("encryption: line %d: expected \"<id> <base64 key>\"", line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("encryption: line %d: %v", line, err)
+		}
+		if err := k.Add(fields[0], key); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if k.current == "" {
+		return nil, fmt.Errorf("encryption: no key")
+	}
+	return k, nil
+}
+
+// LoadKeyring reads a key file
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(data)
+}
+
+// GenerateKey returns a random key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// FormatKey returns the line of a key file holding a key
+func FormatKey(id string, key []byte) string {
+	return id + " " + base64.StdEncoding.EncodeToString(key)
+}
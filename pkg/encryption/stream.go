@@ -0,0 +1,361 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The files start with a fixed size header, so a rewrap replaces it in place:
+//
+//	magic        6 bytes "CPSENC"
+//	version      1 byte
+//	chunk size   1 byte, log2 of the plaintext size of the chunks
+//	nonce prefix 7 bytes, random
+//	key id       16 bytes, the id of the master key, zero padded
+//	wrap nonce   12 bytes
+//	wrapped key  48 bytes, the data key sealed by the master key, the header before it as additional data
+//
+// then the chunks, sealed by the data key with the nonce prefix, the big endian chunk index and 1 for the last
+// chunk or else 0. A file missing its last chunk is truncated, chunks can't be reordered or dropped unnoticed.
+const (
+	magic      = "CPSENC"
+	version    = 1
+	HeaderSize = 91
+
+	// ChunkSize is the plaintext size of the chunks written, the last one is shorter
+	ChunkSize     = 64 << 10
+	chunkSizeLog2 = 16
+
+	prefixOffset = 8
+	keyIDOffset  = 15
+	wrapOffset   = 31
+	keyOffset    = 43
+)
+
+var (
+	// ErrNotEncrypted is returned for a file without the header of the format
+	ErrNotEncrypted = errors.New("encryption: not an encrypted file")
+	// ErrCorrupted is returned when a chunk or the wrapped key doesn't authenticate
+	ErrCorrupted = errors.New("encryption: corrupted or tampered data")
+)
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk
+func chunkNonce(prefix []byte, index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:], uint32(index))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// IsEncrypted tells whether r starts with the header of the format
+func IsEncrypted(r io.ReaderAt) bool {
+	header := make([]byte, len(magic))
+	_, err := r.ReadAt(header, 0)
+	return err == nil && string(header) == magic
+}
+
+// wrap seals the data key of a header with the current key of the keyring
+func wrap(header []byte, dataKey []byte, keyring *Keyring) error {
+	id := keyring.Current()
+	master, err := keyring.key(id)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(master)
+	if err != nil {
+		return err
+	}
+	copy(header[keyIDOffset:wrapOffset], make([]byte, maxKeyIDSize))
+	copy(header[keyIDOffset:wrapOffset], id)
+	if _, err := rand.Read(header[wrapOffset:keyOffset]); err != nil {
+		return err
+	}
+	aead.Seal(header[keyOffset:keyOffset], header[wrapOffset:keyOffset], dataKey, header[:keyOffset])
+	return nil
+}
+
+// unwrap returns the data key of a header and the id of the master key wrapping it
+func unwrap(header []byte, keyring *Keyring) ([]byte, string, error) {
+	if string(header[:len(magic)]) != magic {
+		return nil, "", ErrNotEncrypted
+	}
+	if header[len(magic)] != version {
+		return nil, "", fmt.Errorf("encryption: unsupported version %d", header[len(magic)])
+	}
+	id := string(bytes.TrimRight(header[keyIDOffset:wrapOffset], "\x00"))
+	master, err := keyring.key(id)
+	if err != nil {
+		return nil, id, err
+	}
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, id, err
+	}
+	dataKey, err := aead.Open(nil, header[wrapOffset:keyOffset], header[keyOffset:HeaderSize], header[:keyOffset])
+	if err != nil {
+		return nil, id, ErrCorrupted
+	}
+	return dataKey, id, nil
+}
+
+// Writer encrypts a stream under a new data key. Up to a chunk of plaintext is buffered until the chunk fills or
+// the writer closes.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	buf    []byte
+	index  int64
+	closed bool
+}
+
+// NewWriter writes the header of a new file to w, with a data key wrapped by the current key of the keyring
+func NewWriter(w io.Writer, keyring *Keyring) (*Writer, error) {
+	header := make([]byte, HeaderSize)
+	copy(header, magic)
+	header[len(magic)] = version
+	header[len(magic)+1] = chunkSizeLog2
+	if _, err := rand.Read(header[prefixOffset:keyIDOffset]); err != nil {
+		return nil, err
+	}
+	dataKey, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := wrap(header, dataKey, keyring); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:      w,
+		aead:   aead,
+		prefix: header[prefixOffset:keyIDOffset],
+		buf:    make([]byte, 0, ChunkSize),
+	}, nil
+}
+
+// Write encrypts p, the full chunks are written once more data follows them
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("encryption: write after close")
+	}
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == ChunkSize {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+		k := min(ChunkSize-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:k]...)
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+func (w *Writer) seal(final bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.index, final), w.buf, nil)
+	w.buf = w.buf[:0]
+	w.index++
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// Close writes the last chunk, the underlying writer stays open
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+// Reader decrypts a file at random offsets. A file still being written, or cut short, reads up to its last
+// complete chunk.
+type Reader struct {
+	r         io.ReaderAt
+	aead      cipher.AEAD
+	prefix    []byte
+	keyID     string
+	chunkSize int64
+	chunks    int64
+	size      int64
+	complete  bool
+
+	mu     sync.Mutex
+	cached int64
+	plain  []byte
+}
+
+// NewReader returns the reader of an encrypted file of size bytes, its key must be in the keyring
+func NewReader(r io.ReaderAt, size int64, keyring *Keyring) (*Reader, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	dataKey, id, err := unwrap(header, keyring)
+	if err != nil {
+		return nil, err
+	}
+	log2 := header[len(magic)+1]
+	if log2 < 10 || log2 > 24 {
+		return nil, fmt.Errorf("encryption: invalid chunk size 2^%d", log2)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	reader := &Reader{
+		r:         r,
+		aead:      aead,
+		prefix:    header[prefixOffset:keyIDOffset],
+		keyID:     id,
+		chunkSize: 1 << log2,
+		cached:    -1,
+	}
+	sealedSize := reader.chunkSize + int64(aead.Overhead())
+	body := size - HeaderSize
+	reader.chunks = body / sealedSize
+	lastSize := reader.chunkSize
+	if rest := body % sealedSize; rest >= int64(aead.Overhead()) {
+		reader.chunks++
+		lastSize = rest - int64(aead.Overhead())
+	}
+	// the last chunk tells whether the file is complete, one torn by an interrupted write is dropped
+	for torn := false; reader.chunks > 0; torn = true {
+		last := reader.chunks - 1
+		if _, err := reader.open(last, lastSize, true); err == nil {
+			reader.complete = true
+		} else if _, err := reader.open(last, lastSize, false); err != nil {
+			if torn {
+				return nil, fmt.Errorf("chunk %d: %w", last, ErrCorrupted)
+			}
+			reader.chunks, lastSize = last, reader.chunkSize
+			continue
+		}
+		reader.size = last*reader.chunkSize + lastSize
+		break
+	}
+	return reader, nil
+}
+
+// open decrypts a chunk of size plaintext bytes
+func (r *Reader) open(index int64, size int64, final bool) ([]byte, error) {
+	sealed := make([]byte, size+int64(r.aead.Overhead()))
+	if _, err := r.r.ReadAt(sealed, HeaderSize+index*(r.chunkSize+int64(r.aead.Overhead()))); err != nil {
+		return nil, err
+	}
+	plain, err := r.aead.Open(sealed[:0], chunkNonce(r.prefix, index, final), sealed, nil)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	return plain, nil
+}
+
+// chunk returns the plaintext of a chunk, the last one read is cached
+func (r *Reader) chunk(index int64) ([]byte, error) {
+	if index == r.cached {
+		return r.plain, nil
+	}
+	size := r.chunkSize
+	last := index == r.chunks-1
+	if last {
+		size = r.size - index*r.chunkSize
+	}
+	plain, err := r.open(index, size, last && r.complete)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d: %w", index, err)
+	}
+	r.cached, r.plain = index, plain
+	return plain, nil
+}
+
+// ReadAt reads the plaintext at off
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off < 0 {
+		return 0, errors.New("encryption: negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		plain, err := r.chunk(off / r.chunkSize)
+		if err != nil {
+			return n, err
+		}
+		k := copy(p[n:], plain[off%r.chunkSize:])
+		n += k
+		off += int64(k)
+	}
+	return n, nil
+}
+
+// Size returns the plaintext size
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Complete tells whether the file has its last chunk, a file still being written doesn't
+func (r *Reader) Complete() bool {
+	return r.complete
+}
+
+// KeyID returns the id of the master key wrapping the data key
+func (r *Reader) KeyID() string {
+	return r.keyID
+}
+
+// Rewrap wraps the data key of a file with the current key of the keyring, in place, so the key that wrapped
+// it before can be retired. It returns the id of that key, the file is left as it is when it's already current.
+func Rewrap(f interface {
+	io.ReaderAt
+	io.WriterAt
+}, keyring *Keyring) (string, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", ErrNotEncrypted
+		}
+		return "", err
+	}
+	dataKey, id, err := unwrap(header, keyring)
+	if err != nil || id == keyring.Current() {
+		return id, err
+	}
+	if err := wrap(header, dataKey, keyring); err != nil {
+		return id, err
+	}
+	_, err = f.WriteAt(header[keyIDOffset:], keyIDOffset)
+	return id, err
+}
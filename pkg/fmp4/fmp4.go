@@ -0,0 +1,204 @@
+// Package fmp4 writes fragmented MP4 (CMAF) H.264 video: an init segment describing the track,
+// then self-contained moof+mdat fragments
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+)
+
+// Timescale is the time unit of the track, the RTP clock of video
+const Timescale = 90000
+
+// trackID is the id of the only track
+const trackID = 1
+
+// Sample flags of the trun box
+const (
+	keyframeFlags    = 0x02000000 // sample_depends_on=2, a sync sample
+	nonKeyframeFlags = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample
+)
+
+// Track describes the H.264 video track
+type Track struct {
+	SPS    []byte
+	PPS    []byte
+	Width  int
+	Height int
+}
+
+// NewTrack describes the track of a keyframe, from its parameter sets
+func NewTrack(keyframe []byte) (*Track, error) {
+	sps, pps := h264.ParameterSets(keyframe)
+	if sps == nil || pps == nil {
+		return nil, fmt.Errorf("fmp4: keyframe without parameter sets")
+	}
+	info, err := h264.ParseSPS(sps)
+	if err != nil {
+		return nil, err
+	}
+	return &Track{SPS: sps, PPS: pps, Width: info.Width, Height: info.Height}, nil
+}
+
+// Sample is an access unit of a fragment
+type Sample struct {
+	// Data holds the NAL units with 4 bytes length prefixes
+	Data []byte
+	// Duration is in Timescale units
+	Duration uint32
+	Keyframe bool
+}
+
+// NewSample converts an Annex-B access unit. The parameter sets and access unit delimiters are left out,
+// the init segment holds the parameter sets.
+func NewSample(au []byte, duration uint32, keyframe bool) Sample {
+	nalus := [][]byte{}
+	for _, nalu := range h264.SplitAnnexB(au) {
+		switch h264.NALUType(nalu) {
+		case h264.NALUTypeSPS, h264.NALUTypePPS, h264.NALUTypeAUD:
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+	return Sample{Data: h264.AVCC(nalus), Duration: duration, Keyframe: keyframe}
+}
+
+func box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	out := make([]byte, 0, size)
+	out = binary.BigEndian.AppendUint32(out, uint32(size))
+	out = append(out, typ...)
+	for _, p := range payloads {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func fullBox(typ string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	return box(typ, append([][]byte{header}, payloads...)...)
+}
+
+// fields concatenates big endian fields, each value is written with the size of its type
+func fields(values ...interface{}) []byte {
+	out := []byte{}
+	for _, v := range values {
+		switch v := v.(type) {
+		case uint8:
+			out = append(out, v)
+		case uint16:
+			out = binary.BigEndian.AppendUint16(out, v)
+		case uint32:
+			out = binary.BigEndian.AppendUint32(out, v)
+		case uint64:
+			out = binary.BigEndian.AppendUint64(out, v)
+		case int32:
+			out = binary.BigEndian.AppendUint32(out, uint32(v))
+		case []byte:
+			out = append(out, v...)
+		case string:
+			out = append(out, v...)
+		default:
+			panic(fmt.Sprintf("fmp4: unsupported field %T", v))
+		}
+	}
+	return out
+}
+
+// matrix is the identity transformation of mvhd and tkhd
+var matrix = fields(
+	uint32(0x00010000), uint32(0), uint32(0),
+	uint32(0), uint32(0x00010000), uint32(0),
+	uint32(0), uint32(0), uint32(0x40000000),
+)
+
+// InitSegment returns the ftyp and moov boxes of the track
+func InitSegment(t *Track) []byte {
+	ftyp := box("ftyp", fields("iso5", uint32(512), "iso5", "iso6", "mp41", "cmfc"))
+	mvhd := fullBox("mvhd", 0, 0, fields(
+		uint32(0), uint32(0), // creation and modification times
+		uint32(1000), uint32(0), // timescale, duration
+		uint32(0x00010000), uint16(0x0100), uint16(0), uint64(0), // rate, volume, reserved
+		matrix, make([]byte, 24), // pre_defined
+		uint32(trackID+1), // next_track_ID
+	))
+	tkhd := fullBox("tkhd", 0, 3, fields( // enabled, in movie
+		uint32(0), uint32(0), uint32(trackID), uint32(0), uint32(0), // times, track, reserved, duration
+		uint64(0), uint16(0), uint16(0), uint16(0), uint16(0), // reserved, layer, group, volume, reserved
+		matrix, uint32(t.Width<<16), uint32(t.Height<<16),
+	))
+	mdhd := fullBox("mdhd", 0, 0, fields(
+		uint32(0), uint32(0), uint32(Timescale), uint32(0),
+		uint16(0x55c4), uint16(0), // "und" language
+	))
+	hdlr := fullBox("hdlr", 0, 0, fields(uint32(0), "vide", make([]byte, 12), "VideoHandler", uint8(0)))
+	vmhd := fullBox("vmhd", 0, 1, fields(uint16(0), uint16(0), uint16(0), uint16(0)))
+	dinf := box("dinf", fullBox("dref", 0, 0, fields(uint32(1)), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, fields(uint32(1)), avc1(t)),
+		fullBox("stts", 0, 0, fields(uint32(0))),
+		fullBox("stsc", 0, 0, fields(uint32(0))),
+		fullBox("stsz", 0, 0, fields(uint32(0), uint32(0))),
+		fullBox("stco", 0, 0, fields(uint32(0))),
+	)
+	trak := box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", vmhd, dinf, stbl)))
+	mvex := box("mvex", fullBox("trex", 0, 0, fields(uint32(trackID), uint32(1), uint32(0), uint32(0), uint32(0))))
+	return append(ftyp, box("moov", mvhd, trak, mvex)...)
+}
+
+func avc1(t *Track) []byte {
+	avcC := box("avcC", fields(
+		uint8(1), t.SPS[1], t.SPS[2], t.SPS[3],
+		uint8(0xff), // 4 bytes NAL unit lengths
+		uint8(0xe1), uint16(len(t.SPS)), t.SPS,
+		uint8(1), uint16(len(t.PPS)), t.PPS,
+	))
+	return box("avc1", fields(
+		make([]byte, 6), uint16(1), // reserved, data_reference_index
+		make([]byte, 16), // pre_defined and reserved
+		uint16(t.Width), uint16(t.Height),
+		uint32(0x00480000), uint32(0x00480000), uint32(0), // 72 dpi, reserved
+		uint16(1), make([]byte, 32), // frame_count, compressorname
+		uint16(0x0018), uint16(0xffff), // depth, pre_defined
+	), avcC)
+}
+
+// Fragment returns the moof and mdat boxes of samples decoded from baseTime, in Timescale units
+func Fragment(sequence uint32, baseTime uint64, samples []Sample) []byte {
+	entries := []byte{}
+	dataSize := 0
+	for _, s := range samples {
+		flags := uint32(nonKeyframeFlags)
+		if s.Keyframe {
+			flags = keyframeFlags
+		}
+		entries = append(entries, fields(s.Duration, uint32(len(s.Data)), flags)...)
+		dataSize += len(s.Data)
+	}
+	build := func(dataOffset int32) []byte {
+		trun := fullBox("trun", 0, 0x000701, fields(uint32(len(samples)), dataOffset), entries) // data offset, durations, sizes, flags
+		traf := box("traf",
+			fullBox("tfhd", 0, 0x020000, fields(uint32(trackID))), // default-base-is-moof
+			fullBox("tfdt", 1, 0, fields(baseTime)),
+			trun,
+		)
+		return box("moof", fullBox("mfhd", 0, 0, fields(sequence)), traf)
+	}
+	// the data offset counts from the start of moof to the first sample in mdat
+	moof := build(0)
+	moof = build(int32(len(moof) + 8))
+
+	out := make([]byte, 0, len(moof)+8+dataSize)
+	out = append(out, moof...)
+	out = binary.BigEndian.AppendUint32(out, uint32(8+dataSize))
+	out = append(out, "mdat"...)
+	for _, s := range samples {
+		out = append(out, s.Data...)
+	}
+	return out
+}
@@ -0,0 +1,130 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/acentior/camera-pipeline-sender/pkg/h264"
+	"github.com/stretchr/testify/suite"
+)
+
+// parameter sets of x264 at 320x240
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0xd, 0xa6, 0x81, 0x41, 0xfa, 0x10, 0x0, 0x0, 0x3, 0x0, 0x10, 0x0, 0x0, 0x3, 0x3, 0xc8, 0xf1, 0x42, 0xaa}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+type FMP4Suit struct {
+	suite.Suite
+}
+
+func TestFMP4Suite(t *testing.T) {
+	suite.Run(t, new(FMP4Suit))
+}
+
+// children returns the boxes of data by type, the sizes must add up
+func (s *FMP4Suit) children(data []byte) map[string][]byte {
+	boxes := map[string][]byte{}
+	for len(data) > 0 {
+		s.Require().GreaterOrEqual(len(data), 8)
+		size := int(binary.BigEndian.Uint32(data))
+		s.Require().LessOrEqual(size, len(data))
+		boxes[string(data[4:8])] = data[8:size]
+		data = data[size:]
+	}
+	return boxes
+}
+
+func (s *FMP4Suit) Test_InitSegment() {
+	track, err := NewTrack(h264.AnnexB([][]byte{testSPS, testPPS, {0x65, 0x88}}))
+	s.Require().NoError(err)
+	s.Equal(320, track.Width)
+	s.Equal(240, track.Height)
+
+	top := s.children(InitSegment(track))
+	s.Equal("iso5", string(top["ftyp"][:4]))
+	moov := s.children(top["moov"])
+	s.Contains(moov, "mvhd")
+	s.Contains(moov, "mvex")
+	trak := s.children(moov["trak"])
+	mdia := s.children(trak["mdia"])
+	s.Equal(uint32(Timescale), binary.BigEndian.Uint32(mdia["mdhd"][12:]))
+	stbl := s.children(s.children(mdia["minf"])["stbl"])
+	// the stsd entry count then avc1, whose avcC follows the 78 bytes of visual sample entry
+	avc1 := s.children(stbl["stsd"][8:])["avc1"]
+	s.Equal(uint16(320), binary.BigEndian.Uint16(avc1[24:]))
+	avcC := s.children(avc1[78:])["avcC"]
+	s.Equal(testSPS, avcC[8:8+len(testSPS)])
+	s.Equal(testPPS, avcC[11+len(testSPS):])
+
+	_, err = NewTrack(h264.AnnexB([][]byte{{0x41, 0x9a}}))
+	s.Error(err)
+}
+
+func (s *FMP4Suit) Test_Fragment() {
+	samples := []Sample{
+		NewSample(h264.AnnexB([][]byte{testSPS, testPPS, {0x65, 0x88, 0x84}}), 3000, true),
+		NewSample(h264.AnnexB([][]byte{{0x41, 0x9a, 0x02}}), 3000, false),
+	}
+	// the parameter sets stay in the init segment
+	s.Equal([][]byte{{0x65, 0x88, 0x84}}, h264.SplitAVCC(samples[0].Data))
+
+	fragment := Fragment(7, 90000, samples)
+	top := s.children(fragment)
+	moof := s.children(top["moof"])
+	s.Equal(uint32(7), binary.BigEndian.Uint32(moof["mfhd"][4:]))
+	traf := s.children(moof["traf"])
+	s.Equal(uint64(90000), binary.BigEndian.Uint64(traf["tfdt"][4:]))
+
+	trun := traf["trun"]
+	s.Equal(uint32(2), binary.BigEndian.Uint32(trun[4:]))
+	// the data offset points at the first sample, from the start of moof
+	offset := int(binary.BigEndian.Uint32(trun[8:]))
+	s.Equal(samples[0].Data, fragment[offset:offset+len(samples[0].Data)])
+	s.Equal(uint32(keyframeFlags), binary.BigEndian.Uint32(trun[20:]))
+	s.Equal(uint32(nonKeyframeFlags), binary.BigEndian.Uint32(trun[32:]))
+	s.Equal(append(samples[0].Data, samples[1].Data...), top["mdat"])
+}
+
+func (s *FMP4Suit) Test_Parse() {
+	track, err := NewTrack(h264.AnnexB([][]byte{testSPS, testPPS, {0x65, 0x88}}))
+	s.Require().NoError(err)
+	file := InitSegment(track)
+	file = append(file, Fragment(1, 0, []Sample{
+		NewSample(h264.AnnexB([][]byte{{0x65, 0x88, 0x84}}), 3000, true),
+		NewSample(h264.AnnexB([][]byte{{0x41, 0x9a, 0x01}}), 3003, false),
+	})...)
+	file = append(file, Fragment(2, 6003, []Sample{NewSample(h264.AnnexB([][]byte{{0x65, 0x88, 0x85}}), 3000, true)})...)
+
+	parsed, err := Parse(bytes.NewReader(file), int64(len(file)))
+	s.Require().NoError(err)
+	s.Equal(track, parsed.Track)
+	s.Equal(uint32(Timescale), parsed.Timescale)
+	s.Require().Len(parsed.Fragments, 2)
+	s.Equal(uint64(6003), parsed.Fragments[1].BaseTime)
+	s.Equal(uint64(9003), parsed.Duration())
+	samples := parsed.Fragments[0].Samples
+	s.Require().Len(samples, 2)
+	s.True(samples[0].Keyframe)
+	s.False(samples[1].Keyframe)
+	s.Equal(uint32(3003), samples[1].Duration)
+	data, err := ReadSample(bytes.NewReader(file), samples[1])
+	s.Require().NoError(err)
+	s.Equal([][]byte{{0x41, 0x9a, 0x01}}, h264.SplitAVCC(data))
+
+	// a fragment is read again from the position of its moof
+	fragment, err := ReadFragment(bytes.NewReader(file), int64(len(file)), parsed.Fragments[1].Offset)
+	s.Require().NoError(err)
+	s.Equal(parsed.Fragments[1], *fragment)
+	_, err = ReadFragment(bytes.NewReader(file), int64(len(file)), 0)
+	s.Error(err)
+
+	// an interrupted recording keeps its complete fragments
+	parsed, err = Parse(bytes.NewReader(file), int64(len(file)-2))
+	s.Require().NoError(err)
+	s.Len(parsed.Fragments, 1)
+
+	_, err = Parse(bytes.NewReader(file[:20]), 20)
+	s.Error(err)
+}
@@ -0,0 +1,364 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// File describes a fragmented MP4 file of a single H.264 track
+type File struct {
+	Track     *Track
+	Timescale uint32
+	Fragments []FragmentInfo
+}
+
+// FragmentInfo locates a moof+mdat fragment and its samples
+type FragmentInfo struct {
+	// Offset is the position of the moof box in the file
+	Offset int64
+	// BaseTime is the decode time of the first sample, in Timescale units
+	BaseTime uint64
+	Samples  []SampleInfo
+}
+
+// SampleInfo locates a sample in the file
+type SampleInfo struct {
+	Offset   int64
+	Size     uint32
+	Duration uint32
+	Keyframe bool
+}
+
+// Duration returns the sum of the sample durations of the fragment
+func (f *FragmentInfo) Duration() uint64 {
+	d := uint64(0)
+	for _, s := range f.Samples {
+		d += uint64(s.Duration)
+	}
+	return d
+}
+
+// Duration returns the decode time of the end of the last fragment, in Timescale units
+func (f *File) Duration() uint64 {
+	if len(f.Fragments) == 0 {
+		return 0
+	}
+	last := f.Fragments[len(f.Fragments)-1]
+	return last.BaseTime + last.Duration()
+}
+
+// ReadSample returns the data of a sample, the NAL units with 4 bytes length prefixes
+func ReadSample(r io.ReaderAt, s SampleInfo) ([]byte, error) {
+	data := make([]byte, s.Size)
+	_, err := r.ReadAt(data, s.Offset)
+	return data, err
+}
+
+var errInvalid = errors.New("fmp4: invalid file")
+
+// Parse reads the track and the fragment index of a file of size bytes. A truncated last fragment, as left
+// by an interrupted recording, is ignored.
+func Parse(r io.ReaderAt, size int64) (*File, error) {
+	f := &File{}
+	for offset := int64(0); offset+8 <= size; {
+		typ, boxSize, headerSize, err := boxAt(r, offset, size)
+		if err != nil {
+			return nil, err
+		}
+		if boxSize == 0 {
+			// truncated
+			break
+		}
+		switch typ {
+		case "moov", "moof":
+			payload := make([]byte, boxSize-headerSize)
+			if _, err := r.ReadAt(payload, offset+headerSize); err != nil {
+				return nil, err
+			}
+			if typ == "moov" {
+				err = f.parseMoov(payload)
+			} else {
+				err = f.parseMoof(payload, offset)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		offset += boxSize
+	}
+	if f.Track == nil {
+		return nil, fmt.Errorf("fmp4: no H.264 track")
+	}
+	// the samples of a truncated mdat are dropped with their fragment
+	for len(f.Fragments) > 0 {
+		last := f.Fragments[len(f.Fragments)-1].Samples
+		if len(last) == 0 || last[len(last)-1].Offset+int64(last[len(last)-1].Size) <= size {
+			break
+		}
+		f.Fragments = f.Fragments[:len(f.Fragments)-1]
+	}
+	return f, nil
+}
+
+// ReadFragment indexes the samples of the fragment whose moof box is at offset, in a file of size bytes
+func ReadFragment(r io.ReaderAt, size int64, offset int64) (*FragmentInfo, error) {
+	typ, boxSize, headerSize, err := boxAt(r, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	if typ != "moof" || boxSize == 0 {
+		return nil, errInvalid
+	}
+	payload := make([]byte, boxSize-headerSize)
+	if _, err := r.ReadAt(payload, offset+headerSize); err != nil {
+		return nil, err
+	}
+	f := &File{}
+	if err := f.parseMoof(payload, offset); err != nil {
+		return nil, err
+	}
+	return &f.Fragments[0], nil
+}
+
+// boxAt reads the header of the box at offset, the size is 0 when the box runs past the end of the file
+func boxAt(r io.ReaderAt, offset int64, size int64) (typ string, boxSize int64, headerSize int64, err error) {
+	header := make([]byte, 16)
+	if _, err := r.ReadAt(header[:8], offset); err != nil {
+		return "", 0, 0, err
+	}
+	boxSize = int64(binary.BigEndian.Uint32(header))
+	typ = string(header[4:8])
+	headerSize = 8
+	if boxSize == 1 {
+		if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+			return typ, 0, 0, nil
+		}
+		boxSize, headerSize = int64(binary.BigEndian.Uint64(header[8:])), 16
+	} else if boxSize == 0 {
+		boxSize = size - offset
+	}
+	if boxSize < headerSize || offset+boxSize > size {
+		return typ, 0, 0, nil
+	}
+	return typ, boxSize, headerSize, nil
+}
+
+// children returns the child boxes of a payload by type, the first of each type
+func children(payload []byte) (map[string][]byte, error) {
+	boxes := map[string][]byte{}
+	for len(payload) > 0 {
+		if len(payload) < 8 {
+			return nil, errInvalid
+		}
+		size := int(binary.BigEndian.Uint32(payload))
+		if size < 8 || size > len(payload) {
+			return nil, errInvalid
+		}
+		typ := string(payload[4:8])
+		if _, found := boxes[typ]; !found {
+			boxes[typ] = payload[8:size]
+		}
+		payload = payload[size:]
+	}
+	return boxes, nil
+}
+
+// path returns the box at the path of types under payload
+func path(payload []byte, types ...string) ([]byte, error) {
+	for _, typ := range types {
+		boxes, err := children(payload)
+		if err != nil {
+			return nil, err
+		}
+		var found bool
+		if payload, found = boxes[typ]; !found {
+			return nil, fmt.Errorf("fmp4: no %v box", typ)
+		}
+	}
+	return payload, nil
+}
+
+func (f *File) parseMoov(moov []byte) error {
+	mdia, err := path(moov, "trak", "mdia")
+	if err != nil {
+		return err
+	}
+	mdhd, err := path(mdia, "mdhd")
+	if err != nil {
+		return err
+	}
+	if len(mdhd) < 24 {
+		return errInvalid
+	}
+	if mdhd[0] == 1 {
+		if len(mdhd) < 32 {
+			return errInvalid
+		}
+		f.Timescale = binary.BigEndian.Uint32(mdhd[20:])
+	} else {
+		f.Timescale = binary.BigEndian.Uint32(mdhd[12:])
+	}
+	stsd, err := path(mdia, "minf", "stbl", "stsd")
+	if err != nil {
+		return err
+	}
+	// version, flags and entry count before the sample entries
+	if len(stsd) < 8 {
+		return errInvalid
+	}
+	avc1, err := path(stsd[8:], "avc1")
+	if err != nil {
+		return err
+	}
+	if len(avc1) < 78 {
+		return errInvalid
+	}
+	avcC, err := path(avc1[78:], "avcC")
+	if err != nil {
+		return err
+	}
+	track := &Track{Width: int(binary.BigEndian.Uint16(avc1[24:])), Height: int(binary.BigEndian.Uint16(avc1[26:]))}
+	// configuration version, profile, compatibility, level, length size, then the parameter sets
+	if len(avcC) < 6 {
+		return errInvalid
+	}
+	rest := avcC[5:]
+	readSets := func(countMask byte) ([]byte, error) {
+		if len(rest) < 1 {
+			return nil, errInvalid
+		}
+		count := int(rest[0] & countMask)
+		rest = rest[1:]
+		var first []byte
+		for i := 0; i < count; i++ {
+			if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+				return nil, errInvalid
+			}
+			n := int(binary.BigEndian.Uint16(rest))
+			if first == nil {
+				first = rest[2 : 2+n]
+			}
+			rest = rest[2+n:]
+		}
+		return first, nil
+	}
+	// the SPS count has 3 reserved bits, the PPS count is a full byte
+	if track.SPS, err = readSets(0x1f); err != nil {
+		return err
+	}
+	if track.PPS, err = readSets(0xff); err != nil {
+		return err
+	}
+	f.Track = track
+	return nil
+}
+
+// parseMoof indexes the samples of a fragment starting at offset
+func (f *File) parseMoof(moof []byte, offset int64) error {
+	traf, err := path(moof, "traf")
+	if err != nil {
+		return err
+	}
+	boxes, err := children(traf)
+	if err != nil {
+		return err
+	}
+	tfhd, trun := boxes["tfhd"], boxes["trun"]
+	if len(tfhd) < 8 || len(trun) < 8 {
+		return errInvalid
+	}
+
+	// defaults of the track fragment header
+	flags := binary.BigEndian.Uint32(tfhd) & 0xffffff
+	rest := tfhd[8:]
+	field := func() uint32 {
+		if len(rest) < 4 {
+			err = errInvalid
+			return 0
+		}
+		v := binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
+		return v
+	}
+	base := offset
+	if flags&0x01 != 0 {
+		if len(rest) < 8 {
+			return errInvalid
+		}
+		base = int64(binary.BigEndian.Uint64(rest))
+		rest = rest[8:]
+	}
+	if flags&0x02 != 0 {
+		field() // sample_description_index
+	}
+	var defaultDuration, defaultSize, defaultFlags uint32
+	if flags&0x08 != 0 {
+		defaultDuration = field()
+	}
+	if flags&0x10 != 0 {
+		defaultSize = field()
+	}
+	if flags&0x20 != 0 {
+		defaultFlags = field()
+	}
+
+	fragment := FragmentInfo{Offset: offset}
+	if tfdt := boxes["tfdt"]; len(tfdt) >= 8 {
+		if tfdt[0] == 1 && len(tfdt) >= 12 {
+			fragment.BaseTime = binary.BigEndian.Uint64(tfdt[4:])
+		} else {
+			fragment.BaseTime = uint64(binary.BigEndian.Uint32(tfdt[4:]))
+		}
+	}
+
+	flags = binary.BigEndian.Uint32(trun) & 0xffffff
+	count := binary.BigEndian.Uint32(trun[4:])
+	rest = trun[8:]
+	dataOffset := base
+	if flags&0x01 != 0 {
+		dataOffset = base + int64(int32(field()))
+	}
+	firstFlags, hasFirstFlags := uint32(0), flags&0x04 != 0
+	if hasFirstFlags {
+		firstFlags = field()
+	}
+	fieldsPerSample := uint64(0)
+	for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&bit != 0 {
+			fieldsPerSample++
+		}
+	}
+	if uint64(count)*fieldsPerSample*4 > uint64(len(rest)) || count > 1<<20 {
+		return errInvalid
+	}
+	for i := uint32(0); i < count; i++ {
+		s := SampleInfo{Offset: dataOffset, Duration: defaultDuration, Size: defaultSize}
+		sampleFlags := defaultFlags
+		if flags&0x100 != 0 {
+			s.Duration = field()
+		}
+		if flags&0x200 != 0 {
+			s.Size = field()
+		}
+		if flags&0x400 != 0 {
+			sampleFlags = field()
+		}
+		if flags&0x800 != 0 {
+			field() // composition time offset
+		}
+		if i == 0 && hasFirstFlags {
+			sampleFlags = firstFlags
+		}
+		if err != nil {
+			return err
+		}
+		// sample_is_non_sync_sample
+		s.Keyframe = sampleFlags&0x10000 == 0
+		fragment.Samples = append(fragment.Samples, s)
+		dataOffset += int64(s.Size)
+	}
+	f.Fragments = append(f.Fragments, fragment)
+	return err
+}
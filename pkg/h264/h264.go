@@ -0,0 +1,111 @@
+// Package h264 reads the NAL units of H.264 Annex-B access units
+package h264
+
+import "bytes"
+
+// NAL unit types
+const (
+	NALUTypeSlice = 1
+	NALUTypeIDR   = 5
+	NALUTypeSEI   = 6
+	NALUTypeSPS   = 7
+	NALUTypePPS   = 8
+	NALUTypeAUD   = 9
+)
+
+// NALUType returns the type of a NAL unit without start code
+func NALUType(nalu []byte) byte {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return nalu[0] & 0x1f
+}
+
+// SplitAnnexB returns the NAL units of an Annex-B stream, without their start codes
+func SplitAnnexB(data []byte) [][]byte {
+	nalus := [][]byte{}
+	start := -1
+	for i := 0; i+2 < len(data); {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			i++
+			continue
+		}
+		if start >= 0 {
+			nalus = append(nalus, trimZeros(data[start:i]))
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+// trimZeros drops the trailing zeros, the first byte of a 4 bytes start code
+func trimZeros(nalu []byte) []byte {
+	return bytes.TrimRight(nalu, "\x00")
+}
+
+// IsKeyframe tells if an access unit holds an IDR picture, decoding can start there
+func IsKeyframe(au []byte) bool {
+	for _, nalu := range SplitAnnexB(au) {
+		if NALUType(nalu) == NALUTypeIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// ParameterSets returns the first SPS and PPS of an access unit, nil when missing
+func ParameterSets(au []byte) (sps []byte, pps []byte) {
+	for _, nalu := range SplitAnnexB(au) {
+		switch NALUType(nalu) {
+		case NALUTypeSPS:
+			if sps == nil {
+				sps = nalu
+			}
+		case NALUTypePPS:
+			if pps == nil {
+				pps = nalu
+			}
+		}
+	}
+	return sps, pps
+}
+
+// AnnexB joins NAL units into an Annex-B stream
+func AnnexB(nalus [][]byte) []byte {
+	out := []byte{}
+	for _, nalu := range nalus {
+		out = append(out, 0, 0, 0, 1)
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// AVCC writes NAL units with 4 bytes length prefixes, the layout of MP4 samples
+func AVCC(nalus [][]byte) []byte {
+	out := []byte{}
+	for _, nalu := range nalus {
+		n := len(nalu)
+		out = append(out, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// SplitAVCC returns the NAL units of length prefixed data, it stops at the first truncated unit
+func SplitAVCC(data []byte) [][]byte {
+	nalus := [][]byte{}
+	for len(data) >= 4 {
+		n := int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		data = data[4:]
+		if n > len(data) {
+			break
+		}
+		nalus = append(nalus, data[:n])
+		data = data[n:]
+	}
+	return nalus
+}
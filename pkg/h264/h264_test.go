@@ -0,0 +1,68 @@
+package h264
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type H264Suit struct {
+	suite.Suite
+}
+
+func TestH264Suite(t *testing.T) {
+	suite.Run(t, new(H264Suit))
+}
+
+var (
+	testSPS   = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda}
+	testPPS   = []byte{0x68, 0xce, 0x3c, 0x80}
+	testIDR   = []byte{0x65, 0x88, 0x84, 0x00, 0x21}
+	testSlice = []byte{0x41, 0x9a, 0x02}
+)
+
+func (s *H264Suit) Test_SplitAnnexB() {
+	// 4 bytes start codes before the parameter sets, 3 bytes before the slice
+	au := append([]byte{0, 0, 0, 1}, testSPS...)
+	au = append(au, 0, 0, 0, 1)
+	au = append(au, testPPS...)
+	au = append(au, 0, 0, 1)
+	au = append(au, testIDR...)
+
+	nalus := SplitAnnexB(au)
+	s.Require().Len(nalus, 3)
+	s.Equal(testSPS, nalus[0])
+	s.Equal(testPPS, nalus[1])
+	s.Equal(testIDR, nalus[2])
+	s.True(IsKeyframe(au))
+	s.False(IsKeyframe(AnnexB([][]byte{testSlice})))
+
+	sps, pps := ParameterSets(au)
+	s.Equal(testSPS, sps)
+	s.Equal(testPPS, pps)
+}
+
+func (s *H264Suit) Test_AVCC() {
+	nalus := [][]byte{testSPS, testPPS, testIDR}
+	s.Equal(nalus, SplitAVCC(AVCC(nalus)))
+	s.Equal(nalus, SplitAnnexB(AnnexB(nalus)))
+	// a truncated unit is left out
+	truncated := AVCC(nalus)
+	s.Len(SplitAVCC(truncated[:len(truncated)-1]), 2)
+}
+
+func (s *H264Suit) Test_ParseSPS() {
+	// x264 baseline 1920x1080, 1088 lines cropped to 1080, with emulation prevention bytes
+	nalu := []byte{0x67, 0x42, 0xc0, 0x28, 0xa6, 0x80, 0x78, 0x2, 0x27, 0xe5, 0x84, 0x0, 0x0, 0x3, 0x0, 0x4, 0x0, 0x0, 0x3, 0x0, 0xf2, 0x3c, 0x60, 0xca, 0x80}
+	sps, err := ParseSPS(nalu)
+	s.Require().NoError(err)
+	s.Equal(byte(66), sps.ProfileIdc)
+	s.Equal(byte(40), sps.LevelIdc)
+	s.Equal(1920, sps.Width)
+	s.Equal(1080, sps.Height)
+
+	_, err = ParseSPS(nalu[:6])
+	s.Error(err)
+	_, err = ParseSPS(testPPS)
+	s.Error(err)
+}
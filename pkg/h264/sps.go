@@ -0,0 +1,209 @@
+package h264
+
+import (
+	"errors"
+)
+
+// SPS holds the fields of a sequence parameter set the containers need
+type SPS struct {
+	ProfileIdc     byte
+	ConstraintSets byte
+	LevelIdc       byte
+	Width          int
+	Height         int
+}
+
+var errTruncated = errors.New("h264: truncated SPS")
+
+// bitReader reads the RBSP of a NAL unit, MSB first
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bit() (uint, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errTruncated
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint(b), nil
+}
+
+func (r *bitReader) bits(n int) (uint, error) {
+	v := uint(0)
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("h264: invalid Exp-Golomb code")
+		}
+	}
+	v, err := r.bits(zeros)
+	return (1<<zeros - 1) + v, err
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if v%2 == 1 {
+		return int(v+1) / 2, err
+	}
+	return -int(v / 2), err
+}
+
+// rbsp removes the emulation prevention bytes of a NAL unit payload
+func rbsp(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// ParseSPS reads the profile, the level and the picture size of a SPS NAL unit
+func ParseSPS(nalu []byte) (*SPS, error) {
+	if NALUType(nalu) != NALUTypeSPS || len(nalu) < 4 {
+		return nil, errors.New("h264: not a SPS")
+	}
+	sps := &SPS{ProfileIdc: nalu[1], ConstraintSets: nalu[2], LevelIdc: nalu[3]}
+	r := &bitReader{data: rbsp(nalu[4:])}
+	// every field is read in order, the first error sticks
+	var err error
+	ue := func() uint {
+		if err != nil {
+			return 0
+		}
+		var v uint
+		v, err = r.ue()
+		return v
+	}
+	se := func() int {
+		if err != nil {
+			return 0
+		}
+		var v int
+		v, err = r.se()
+		return v
+	}
+	flag := func() bool {
+		if err != nil {
+			return false
+		}
+		var v uint
+		v, err = r.bit()
+		return v == 1
+	}
+
+	ue() // seq_parameter_set_id
+	chromaFormat := uint(1)
+	separateColourPlane := false
+	switch sps.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = ue()
+		if chromaFormat == 3 {
+			separateColourPlane = flag()
+		}
+		ue()   // bit_depth_luma_minus8
+		ue()   // bit_depth_chroma_minus8
+		flag() // qpprime_y_zero_transform_bypass_flag
+		if flag() {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if !flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	ue() // log2_max_frame_num_minus4
+	switch ue() {
+	case 0:
+		ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		flag() // delta_pic_order_always_zero_flag
+		se()   // offset_for_non_ref_pic
+		se()   // offset_for_top_to_bottom_field
+		for n := ue(); n > 0 && err == nil; n-- {
+			se()
+		}
+	}
+	ue()   // max_num_ref_frames
+	flag() // gaps_in_frame_num_value_allowed_flag
+	widthMbs := ue() + 1
+	heightMapUnits := ue() + 1
+	frameMbsOnly := flag()
+	if !frameMbsOnly {
+		flag() // mb_adaptive_frame_field_flag
+	}
+	flag() // direct_8x8_inference_flag
+	var cropLeft, cropRight, cropTop, cropBottom uint
+	if flag() {
+		cropLeft, cropRight, cropTop, cropBottom = ue(), ue(), ue(), ue()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fieldFactor := uint(2)
+	if frameMbsOnly {
+		fieldFactor = 1
+	}
+	cropUnitX, cropUnitY := uint(1), fieldFactor
+	if chromaFormat != 0 && !separateColourPlane {
+		if chromaFormat == 1 || chromaFormat == 2 {
+			cropUnitX = 2
+		}
+		if chromaFormat == 1 {
+			cropUnitY = 2 * fieldFactor
+		}
+	}
+	sps.Width = int(widthMbs*16 - cropUnitX*(cropLeft+cropRight))
+	sps.Height = int(fieldFactor*heightMapUnits*16 - cropUnitY*(cropTop+cropBottom))
+	return sps, nil
+}